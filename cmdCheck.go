@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// the exit codes of qemu-img check
+const (
+	checkOK          = 0
+	checkFailed      = 1
+	checkCorruptions = 2
+	checkLeaks       = 3
+)
+
+func cmdCheck(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("check")
+	format := fs.String("f", "", "format of the image")
+	output := outputFlag(fs)
+	repair := fs.String("r", "", "repair leaks or all")
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return checkFailed, err
+	}
+	if err := checkOutput(*output); err != nil {
+		return checkFailed, err
+	}
+	if *repair != "" && *repair != "leaks" && *repair != "all" {
+		return checkFailed, fmt.Errorf("-r must be leaks or all, not %s", *repair)
+	}
+
+	image, err := openImage(positional[0], *format, *repair != "")
+	if err != nil {
+		return checkFailed, err
+	}
+	defer image.Close()
+
+	result, err := image.Check()
+	if err != nil {
+		return checkFailed, err
+	}
+
+	// rebuilding the refcounts repairs the leaks as well as the refcounts
+	// which are too small
+	repaired := *repair == "all" && result.Corruptions != 0 ||
+		*repair != "" && result.Leaks != 0
+	if repaired {
+		if *output == "human" {
+			printProblems(stdout, result)
+			fmt.Fprintf(stdout, "\nThe following inconsistencies were found and repaired:\n\n")
+			fmt.Fprintf(stdout, "    %d leaked clusters\n    %d corruptions\n\n", result.Leaks, result.Corruptions)
+			fmt.Fprintf(stdout, "Double checking the fixed image now...\n")
+		}
+		if err := image.RebuildRefCounts(); err != nil {
+			return checkFailed, err
+		}
+		if result, err = image.Check(); err != nil {
+			return checkFailed, err
+		}
+	}
+	result.Filename = positional[0]
+
+	code := checkOK
+	switch {
+	case result.CheckErrors != 0:
+		code = checkFailed
+	case result.Corruptions != 0:
+		code = checkCorruptions
+	case result.Leaks != 0:
+		code = checkLeaks
+	}
+
+	if *output == "json" {
+		return code, printJSON(stdout, result)
+	}
+
+	printProblems(stdout, result)
+	if result.Corruptions == 0 && result.Leaks == 0 && result.CheckErrors == 0 {
+		fmt.Fprintf(stdout, "No errors were found on the image.\n")
+	}
+	if result.Corruptions != 0 {
+		fmt.Fprintf(stdout, "\n%d errors were found on the image.\n"+
+			"Data may be corrupted, or further writes to the image may corrupt it.\n", result.Corruptions)
+	}
+	if result.Leaks != 0 {
+		fmt.Fprintf(stdout, "\n%d leaked clusters were found on the image.\n"+
+			"This means waste of disk space, but no harm to data.\n", result.Leaks)
+	}
+	if result.CheckErrors != 0 {
+		fmt.Fprintf(stdout, "\n%d internal errors have occurred during the check.\n", result.CheckErrors)
+	}
+
+	if result.TotalClusters != 0 && result.AllocatedClusters != 0 {
+		total := float64(result.TotalClusters)
+		allocated := float64(result.AllocatedClusters)
+		fmt.Fprintf(stdout, "%d/%d = %0.2f%% allocated, %0.2f%% fragmented, %0.2f%% compressed clusters\n",
+			result.AllocatedClusters, result.TotalClusters,
+			allocated*100/total,
+			float64(result.FragmentedClusters)*100/allocated,
+			float64(result.CompressedClusters)*100/allocated)
+	}
+	if result.ImageEndOffset != 0 {
+		fmt.Fprintf(stdout, "Image end offset: %d\n", result.ImageEndOffset)
+	}
+	return code, nil
+}
+
+func printProblems(w io.Writer, result *gqcow2.CheckResult) {
+	for _, problem := range result.Problems {
+		fmt.Fprintln(w, problem)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// the exit codes of qemu-img compare
+const (
+	compareIdentical = 0
+	compareDifferent = 1
+	compareFailed    = 2
+)
+
+func cmdCompare(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("compare")
+	format1 := fs.String("f", "", "format of the first image")
+	format2 := fs.String("F", "", "format of the second image")
+	strict := fs.Bool("s", false, "strict mode, the allocation and the size must match")
+	showProgress := fs.Bool("p", false, "show the progress")
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return compareFailed, err
+	}
+
+	a, err := openDisk(positional[0], *format1, false)
+	if err != nil {
+		return compareFailed, err
+	}
+	defer a.Close()
+	b, err := openDisk(positional[1], *format2, false)
+	if err != nil {
+		return compareFailed, err
+	}
+	defer b.Close()
+
+	opts := gqcow2.CompareOptions{Strict: *strict}
+	if *showProgress {
+		opts.Progress = progressPrinter(stdout)
+		defer fmt.Fprintln(stdout)
+	}
+	if !*strict && a.VirtualSize() != b.VirtualSize() {
+		fmt.Fprintf(stdout, "Warning: Image size mismatch!\n")
+	}
+
+	result, err := gqcow2.Compare(a, b, opts)
+	if err != nil {
+		return compareFailed, err
+	}
+	switch {
+	case result.Identical:
+		fmt.Fprintf(stdout, "Images are identical.\n")
+		return compareIdentical, nil
+	case result.SizeMismatch:
+		fmt.Fprintf(stdout, "Strict mode: Image size mismatch!\n")
+	case result.AllocationMismatch:
+		fmt.Fprintf(stdout, "Strict mode: Offset %d block status mismatch!\n", result.Offset)
+	default:
+		fmt.Fprintf(stdout, "Content mismatch at offset %d!\n", result.Offset)
+	}
+	return compareDifferent, nil
+}
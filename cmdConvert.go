@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/remote"
+	"go-qcow2/pkg/vhd"
+	"go-qcow2/pkg/vmdk"
+)
+
+const (
+	copyChunkSize = 4 << 20
+	// zero blocks of this size are not written, like qemu-img -S
+	sparseBlockSize = 4096
+)
+
+// copyGuest copies the guest content of src in [start, start+length)
+// to the beginning of the new target dst. The target reads as zeros,
+// so unallocated and zero regions and zero blocks are not written.
+func copyGuest(src gqcow2.BackingDisk, dst gqcow2.DiskHandler, start uint64, length uint64, progress gqcow2.ProgressFunc) error {
+	regions, err := gqcow2.Map(src)
+	if err != nil {
+		return err
+	}
+
+	end := start + length
+	buf := make([]byte, copyChunkSize)
+	for _, r := range regions {
+		regionStart, regionEnd := max(r.Start, start), min(r.Start+r.Length, end)
+		if regionStart >= regionEnd {
+			continue
+		}
+
+		for offset := regionStart; r.Data && offset < regionEnd; {
+			chunk := buf[:min(regionEnd-offset, uint64(len(buf)))]
+			if _, err := src.ReadAt(chunk, int64(offset)); err != nil && err != io.EOF {
+				return err
+			}
+			if err := writeSparse(dst, chunk, offset-start); err != nil {
+				return err
+			}
+			offset += uint64(len(chunk))
+		}
+
+		if progress != nil {
+			progress(regionEnd-start, length)
+		}
+	}
+	return nil
+}
+
+// writeSparse writes the runs of non zero blocks of buf at offset
+func writeSparse(dst io.WriterAt, buf []byte, offset uint64) error {
+	for index := 0; index < len(buf); {
+		if isZero(buf[index:min(index+sparseBlockSize, len(buf))]) {
+			index += sparseBlockSize
+			continue
+		}
+
+		runEnd := index + sparseBlockSize
+		for runEnd < len(buf) && !isZero(buf[runEnd:min(runEnd+sparseBlockSize, len(buf))]) {
+			runEnd += sparseBlockSize
+		}
+		runEnd = min(runEnd, len(buf))
+		if _, err := dst.WriteAt(buf[index:runEnd], int64(offset)+int64(index)); err != nil {
+			return err
+		}
+		index = runEnd
+	}
+	return nil
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// progressPrinter prints the progress like qemu-img -p
+func progressPrinter(w io.Writer) gqcow2.ProgressFunc {
+	return func(done uint64, total uint64) {
+		percent := 100.0
+		if total != 0 {
+			percent = float64(done) * 100 / float64(total)
+		}
+		fmt.Fprintf(w, "    (%3.2f/100%%)\r", percent)
+	}
+}
+
+// convert copies the guest content into a new target of the format
+func convert(src gqcow2.BackingDisk, start uint64, path string, format string,
+	opts createOptions, progress gqcow2.ProgressFunc) error {
+	if opts.BackingFile != "" {
+		return errors.New("the target cannot have a backing file")
+	}
+
+	dst, c, err := createTarget(path, format, opts)
+	if err != nil {
+		return err
+	}
+	err = copyGuest(src, dst, start, opts.Size, progress)
+	return errors.Join(err, c.Close())
+}
+
+// isStreamFormat tells if the format is only written in a single pass
+func isStreamFormat(format string) bool {
+	return format == "vmdk" || format == "vpc"
+}
+
+// isStreamTarget tells if the target is written in a single pass,
+// either to the standard output or as an s3 object
+func isStreamTarget(path string) bool {
+	return path == "-" || strings.HasPrefix(path, "s3://")
+}
+
+// convertStream writes the guest content into the stream target, the
+// target of a stream format may be a file as well
+func convertStream(src gqcow2.BackingDisk, path string, format string, opts createOptions, stdout io.Writer) error {
+	if opts.BackingFile != "" {
+		return errors.New("the target cannot have a backing file")
+	}
+
+	w := stdout
+	var upload *remote.S3Writer
+	var file *os.File
+	switch {
+	case path == "-":
+	case strings.HasPrefix(path, "s3://"):
+		bucket, key, err := parseS3URL(path)
+		if err != nil {
+			return err
+		}
+		if upload, err = remote.NewS3Writer(s3Config(), bucket, key); err != nil {
+			return err
+		}
+		w = upload
+	default:
+		var err error
+		if file, err = os.Create(path); err != nil {
+			return err
+		}
+		w = file
+	}
+
+	var err error
+	switch format {
+	case "qcow2":
+		_, err = gqcow2.ConvertStream(src, w, opts.CreateOptions)
+	case "raw":
+		_, err = io.Copy(w, io.NewSectionReader(src, 0, int64(opts.Size)))
+	case "vmdk":
+		name := ""
+		if path != "-" {
+			name = filepath.Base(path)
+		}
+		_, err = vmdk.WriteStreamOptimized(src, w, name)
+	case "vpc":
+		// dynamic by default like qemu-img, Azure takes fixed disks
+		dynamic := opts.subformat == "dynamic" || (opts.subformat == "" && !opts.azure)
+		if dynamic && opts.azure {
+			err = errors.New("azure only takes fixed disks")
+			break
+		}
+		_, err = vhd.Write(src, w, vhd.Options{Dynamic: dynamic, Azure: opts.azure})
+	default:
+		err = fmt.Errorf("unsupported format %s", format)
+	}
+
+	if upload != nil {
+		if err != nil {
+			return errors.Join(err, upload.Abort())
+		}
+		return upload.Close()
+	}
+	if file != nil {
+		return errors.Join(err, file.Close())
+	}
+	return err
+}
+
+func cmdConvert(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("convert")
+	format := fs.String("f", "", "format of the source image")
+	outputFormat := fs.String("O", "raw", "format of the target image")
+	options := fs.String("o", "", "comma separated options of the target")
+	showProgress := fs.Bool("p", false, "show the progress")
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return 1, err
+	}
+
+	opts, err := parseCreateOptions(*options)
+	if err != nil {
+		return 1, err
+	}
+
+	src, err := openDisk(positional[0], *format, false)
+	if err != nil {
+		return 1, err
+	}
+	defer src.Close()
+	opts.Size = src.VirtualSize()
+
+	if isStreamTarget(positional[1]) || isStreamFormat(*outputFormat) {
+		return 0, convertStream(src, positional[1], *outputFormat, opts, stdout)
+	}
+
+	var progress gqcow2.ProgressFunc
+	if *showProgress {
+		progress = progressPrinter(stdout)
+		progress(0, opts.Size)
+		defer fmt.Fprintln(stdout)
+	}
+	return 0, convert(src, 0, positional[1], *outputFormat, opts, progress)
+}
+
+// cmdDd copies a part of the guest content into a new image like qemu-img dd
+func cmdDd(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("dd")
+	format := fs.String("f", "", "format of the input")
+	outputFormat := fs.String("O", "raw", "format of the output")
+	fs.Bool("U", false, "ignored, images are never locked")
+	operands, err := parseFlags(fs, args, -1)
+	if err != nil {
+		return 1, err
+	}
+
+	var input, output string
+	blockSize, count, skip := uint64(512), int64(-1), uint64(0)
+	for _, operand := range operands {
+		key, value, ok := strings.Cut(operand, "=")
+		if !ok {
+			return 1, fmt.Errorf("invalid operand %s", operand)
+		}
+		var n uint64
+		if key != "if" && key != "of" {
+			if n, err = parseSize(value); err != nil {
+				return 1, err
+			}
+		}
+		switch key {
+		case "if":
+			input = value
+		case "of":
+			output = value
+		case "bs":
+			if n == 0 {
+				return 1, errors.New("bs must be positive")
+			}
+			blockSize = n
+		case "count":
+			count = int64(n)
+		case "skip":
+			skip = n
+		default:
+			return 1, fmt.Errorf("invalid operand %s", operand)
+		}
+	}
+	if input == "" || output == "" {
+		return 1, errors.New("if and of must be given")
+	}
+
+	src, err := openDisk(input, *format, false)
+	if err != nil {
+		return 1, err
+	}
+	defer src.Close()
+
+	start := min(skip*blockSize, src.VirtualSize())
+	opts := createOptions{}
+	opts.Size = src.VirtualSize() - start
+	if count >= 0 {
+		opts.Size = min(opts.Size, uint64(count)*blockSize)
+	}
+	return 0, convert(src, start, output, *outputFormat, opts, nil)
+}
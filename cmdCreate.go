@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/nbd"
+)
+
+// createOptions are the -o options of qemu-img create and convert
+type createOptions struct {
+	gqcow2.CreateOptions
+	lazyRefCounts bool
+
+	// the vpc subformat, fixed or dynamic
+	subformat string
+	// a fixed vpc whose size is rounded up to a MiB for Azure
+	azure bool
+}
+
+// parseCreateOptions parses the comma separated key=value list of -o
+func parseCreateOptions(list string) (createOptions, error) {
+	var opts createOptions
+	if list == "" {
+		return opts, nil
+	}
+
+	for _, option := range strings.Split(list, ",") {
+		key, value, _ := strings.Cut(option, "=")
+		var err error
+		switch key {
+		case "size":
+			opts.Size, err = parseSize(value)
+		case "cluster_size":
+			var size uint64
+			if size, err = parseSize(value); err == nil && bits.OnesCount64(size) != 1 {
+				err = fmt.Errorf("cluster size %s is not a power of two", value)
+			}
+			opts.ClusterBits = uint32(bits.TrailingZeros64(size))
+		case "refcount_bits":
+			var width uint64
+			if width, err = strconv.ParseUint(value, 10, 64); err == nil && bits.OnesCount64(width) != 1 {
+				err = fmt.Errorf("refcount width %s is not a power of two", value)
+			}
+			opts.RefCountOrder = uint32(bits.TrailingZeros64(width))
+		case "compat":
+			switch value {
+			case "0.10", "v2":
+				opts.Version = 2
+			case "1.1", "v3":
+				opts.Version = 3
+			default:
+				err = fmt.Errorf("invalid compat level %s", value)
+			}
+		case "preallocation":
+			opts.Preallocation, err = gqcow2.ParsePreallocMode(value)
+		case "lazy_refcounts":
+			opts.lazyRefCounts, err = parseBool(value)
+		case "backing_file":
+			opts.BackingFile = value
+		case "backing_fmt":
+			opts.BackingFormat = value
+		case "subformat":
+			if value != "fixed" && value != "dynamic" {
+				err = fmt.Errorf("invalid subformat %s", value)
+			}
+			opts.subformat = value
+		case "azure":
+			opts.azure, err = parseBool(value)
+		default:
+			err = fmt.Errorf("invalid parameter '%s'", key)
+		}
+		if err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch value {
+	case "on", "true", "yes":
+		return true, nil
+	case "off", "false", "no":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %s", value)
+}
+
+// createTarget creates a new raw or qcow2 file, it is written through
+// the returned handler
+func createTarget(path string, format string, opts createOptions) (gqcow2.DiskHandler, io.Closer, error) {
+	if nbd.IsURL(path) {
+		return createNBDTarget(path, format, opts)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch format {
+	case "raw":
+		if err := createRaw(f, opts.Size, opts.Preallocation); err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return f, f, nil
+	case "qcow2":
+		image, err := gqcow2.Create(f, path, opts.CreateOptions)
+		if err == nil && opts.lazyRefCounts {
+			lazy := true
+			err = image.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy})
+		}
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return image, image, nil
+	}
+
+	f.Close()
+	return nil, nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// createNBDTarget zeroes the existing export to take the raw guest
+// content, it must be large enough
+func createNBDTarget(url string, format string, opts createOptions) (gqcow2.DiskHandler, io.Closer, error) {
+	if format != "raw" {
+		return nil, nil, fmt.Errorf("an nbd export can only be written as raw, not %s", format)
+	}
+	c, err := nbd.DialURL(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.VirtualSize() < opts.Size {
+		c.Close()
+		return nil, nil, fmt.Errorf("the export of %d bytes is smaller than %d bytes", c.VirtualSize(), opts.Size)
+	}
+	if err := c.WriteZeroes(0, c.VirtualSize(), true); err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, closeFunc(func() error {
+		return errors.Join(c.Flush(), c.Close())
+	}), nil
+}
+
+// closeFunc is an io.Closer calling the function
+type closeFunc func() error
+
+func (f closeFunc) Close() error {
+	return f()
+}
+
+func createRaw(f *os.File, size uint64, prealloc gqcow2.PreallocMode) error {
+	switch prealloc {
+	case "", gqcow2.PreallocOff:
+		return f.Truncate(int64(size))
+	case gqcow2.PreallocFalloc:
+		return gqcow2.Fallocate(f, 0, int64(size))
+	case gqcow2.PreallocFull:
+		zeros := make([]byte, min(size, 4<<20))
+		for offset := uint64(0); offset < size; offset += uint64(len(zeros)) {
+			if _, err := f.WriteAt(zeros[:min(size-offset, uint64(len(zeros)))], int64(offset)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("preallocation %s is not supported for raw", prealloc)
+}
+
+func cmdCreate(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("create")
+	format := fs.String("f", "raw", "format of the new image")
+	options := fs.String("o", "", "comma separated options")
+	backingFile := fs.String("b", "", "backing file")
+	backingFormat := fs.String("F", "", "format of the backing file")
+	unsafe := fs.Bool("u", false, "don't open the backing file, size must be given")
+	quiet := fs.Bool("q", false, "quiet")
+	positional, err := parseFlags(fs, args, -1)
+	if err != nil {
+		return 1, err
+	}
+	if len(positional) < 1 || len(positional) > 2 {
+		return 1, fmt.Errorf("expecting filename and size")
+	}
+
+	opts, err := parseCreateOptions(*options)
+	if err != nil {
+		return 1, err
+	}
+	if *backingFile != "" {
+		opts.BackingFile = *backingFile
+	}
+	if *backingFormat != "" {
+		opts.BackingFormat = *backingFormat
+	}
+	if opts.BackingFile != "" && *format != "qcow2" {
+		return 1, fmt.Errorf("format %s doesn't support backing files", *format)
+	}
+
+	path := positional[0]
+	if len(positional) == 2 {
+		if opts.Size, err = parseSize(positional[1]); err != nil {
+			return 1, err
+		}
+	} else if opts.BackingFile == "" || *unsafe {
+		return 1, fmt.Errorf("size must be given")
+	}
+
+	// the size defaults to the size of the backing file
+	if opts.BackingFile != "" && !*unsafe {
+		name := opts.BackingFile
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(filepath.Dir(path), name)
+		}
+		backing, err := openDisk(name, opts.BackingFormat, false)
+		if err != nil {
+			return 1, err
+		}
+		if len(positional) == 1 {
+			opts.Size = backing.VirtualSize()
+		}
+		backing.Close()
+	}
+
+	if !*quiet {
+		fmt.Fprintf(stdout, "Formatting '%s', fmt=%s %s\n", path, *format, describeOptions(*format, opts))
+	}
+	_, c, err := createTarget(path, *format, opts)
+	if err != nil {
+		return 1, err
+	}
+	return 0, c.Close()
+}
+
+// describeOptions lists the options of the new image like qemu-img
+func describeOptions(format string, opts createOptions) string {
+	size := fmt.Sprintf("size=%d", opts.Size)
+	if format != "qcow2" {
+		return size
+	}
+	clusterBits, refCountOrder := opts.ClusterBits, opts.RefCountOrder
+	if clusterBits == 0 {
+		clusterBits = gqcow2.DefaultClusterBits
+	}
+	if refCountOrder == 0 {
+		refCountOrder = gqcow2.DefaultRefCountOrder
+	}
+
+	s := fmt.Sprintf("cluster_size=%d", 1<<clusterBits)
+	if opts.Preallocation != "" {
+		s += " preallocation=" + string(opts.Preallocation)
+	}
+	s += " compression_type=zlib " + size
+	if opts.BackingFile != "" {
+		s += " backing_file=" + opts.BackingFile
+	}
+	if opts.BackingFormat != "" {
+		s += " backing_fmt=" + opts.BackingFormat
+	}
+	lazy := "off"
+	if opts.lazyRefCounts {
+		lazy = "on"
+	}
+	return s + fmt.Sprintf(" lazy_refcounts=%s refcount_bits=%d", lazy, 1<<refCountOrder)
+}
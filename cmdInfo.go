@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/vhd"
+	"go-qcow2/pkg/vhdx"
+	"go-qcow2/pkg/vmdk"
+)
+
+func cmdInfo(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("info")
+	format := fs.String("f", "", "format of the image")
+	output := outputFlag(fs)
+	backingChain := fs.Bool("backing-chain", false, "describe every image of the backing chain")
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return 1, err
+	}
+	if err := checkOutput(*output); err != nil {
+		return 1, err
+	}
+
+	path := positional[0]
+	d, err := openDisk(path, *format, false)
+	if err != nil {
+		return 1, err
+	}
+	defer d.Close()
+
+	var infos []*gqcow2.ImageInfo
+	switch disk := d.(type) {
+	case *gqcow2.Image:
+		if *backingChain {
+			infos, err = gqcow2.BackingChainInfo(disk)
+		} else {
+			var info *gqcow2.ImageInfo
+			info, err = disk.Info()
+			infos = append(infos, info)
+		}
+		if err != nil {
+			return 1, err
+		}
+	case *gqcow2.RawDisk:
+		infos = append(infos, disk.Info(path))
+	case *vmdk.Disk:
+		infos = append(infos, disk.Info(path))
+	case *vhd.Disk:
+		infos = append(infos, disk.Info(path))
+	case *vhdx.Disk:
+		infos = append(infos, disk.Info(path))
+	}
+
+	if *output == "json" {
+		if *backingChain {
+			return 0, printJSON(stdout, infos)
+		}
+		return 0, printJSON(stdout, infos[0])
+	}
+
+	for index, info := range infos {
+		if index > 0 {
+			fmt.Fprintln(stdout)
+		}
+		printInfo(stdout, info)
+	}
+	return 0, nil
+}
+
+// printInfo prints the info in the human format of qemu-img info
+func printInfo(w io.Writer, info *gqcow2.ImageInfo) {
+	fmt.Fprintf(w, "image: %s\n", info.Filename)
+	fmt.Fprintf(w, "file format: %s\n", info.Format)
+	fmt.Fprintf(w, "virtual size: %s (%d bytes)\n", sizeToStr(info.VirtualSize), info.VirtualSize)
+	fmt.Fprintf(w, "disk size: %s\n", sizeToStr(info.ActualSize))
+	if info.Encrypted {
+		fmt.Fprintf(w, "encrypted: yes\n")
+	}
+	if info.ClusterSize != 0 {
+		fmt.Fprintf(w, "cluster_size: %d\n", info.ClusterSize)
+	}
+	if info.DirtyFlag {
+		fmt.Fprintf(w, "cleanly shut down: no\n")
+	}
+	if info.BackingFilename != "" {
+		fmt.Fprintf(w, "backing file: %s", info.BackingFilename)
+		if info.FullBackingFilename != info.BackingFilename {
+			fmt.Fprintf(w, " (actual path: %s)", info.FullBackingFilename)
+		}
+		fmt.Fprintln(w)
+	}
+	if info.BackingFormat != "" {
+		fmt.Fprintf(w, "backing file format: %s\n", info.BackingFormat)
+	}
+	if len(info.Snapshots) != 0 {
+		fmt.Fprintf(w, "Snapshot list:\n")
+		printSnapshots(w, info.Snapshots)
+	}
+	if info.FormatSpecific != nil {
+		fmt.Fprintf(w, "Format specific information:\n")
+		printFields(w, reflect.ValueOf(info.FormatSpecific.Data).Elem(), 1)
+	}
+}
+
+// printFields prints the fields of a struct by their json names, nested
+// values are indented like qemu-img prints its format specific information
+func printFields(w io.Writer, v reflect.Value, level int) {
+	indent := strings.Repeat("    ", level)
+	for index := range v.NumField() {
+		field := v.Field(index)
+		name, options, _ := strings.Cut(v.Type().Field(index).Tag.Get("json"), ",")
+		if options == "omitempty" && field.IsZero() {
+			continue
+		}
+		printValue(w, indent+strings.ReplaceAll(name, "-", " "), field, level)
+	}
+}
+
+func printValue(w io.Writer, key string, v reflect.Value, level int) {
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		fmt.Fprintf(w, "%s:\n", key)
+		printFields(w, v, level+1)
+	case reflect.Slice:
+		fmt.Fprintf(w, "%s:\n", key)
+		indent := strings.Repeat("    ", level+1)
+		for index := range v.Len() {
+			printValue(w, fmt.Sprintf("%s[%d]", indent, index), v.Index(index), level+1)
+		}
+	default:
+		fmt.Fprintf(w, "%s: %v\n", key, v.Interface())
+	}
+}
+
+// printSnapshots prints the snapshot table like qemu-img
+func printSnapshots(w io.Writer, snapshots []gqcow2.SnapshotInfo) {
+	fmt.Fprintf(w, "%-10s%-17s%8s%20s%13s%11s\n", "ID", "TAG", "VM SIZE", "DATE", "VM CLOCK", "ICOUNT")
+	for _, s := range snapshots {
+		seconds := s.VMClockSec
+		clock := fmt.Sprintf("%04d:%02d:%02d.%03d", seconds/3600, seconds/60%60, seconds%60, s.VMClockNsec/1e6)
+
+		icount := ""
+		if s.ICount != nil {
+			icount = fmt.Sprint(*s.ICount)
+		}
+		fmt.Fprintf(w, "%-9s %-16s %8s%20s%13s%11s\n",
+			s.ID, s.Name, sizeToStr(s.VMStateSize),
+			time.Unix(s.DateSec, s.DateNsec).Format("2006-01-02 15:04:05"),
+			clock, icount)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// chainNames returns the file names of the backing chain by depth
+func chainNames(d gqcow2.BackingDisk, path string) []string {
+	names := []string{path}
+	for {
+		image, ok := d.(*gqcow2.Image)
+		if !ok || image.Backing == nil {
+			return names
+		}
+
+		if backing, ok := image.Backing.(*gqcow2.Image); ok {
+			names = append(names, backing.Name)
+		} else if filepath.IsAbs(image.BackingFile) {
+			names = append(names, image.BackingFile)
+		} else {
+			names = append(names, filepath.Join(filepath.Dir(image.Name), image.BackingFile))
+		}
+		d = image.Backing
+	}
+}
+
+// hex formats like the %#x of C, 0 has no prefix
+func hex(v uint64) string {
+	if v == 0 {
+		return "0"
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+func cmdMap(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("map")
+	format := fs.String("f", "", "format of the image")
+	output := outputFlag(fs)
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return 1, err
+	}
+	if err := checkOutput(*output); err != nil {
+		return 1, err
+	}
+
+	path := positional[0]
+	d, err := openDisk(path, *format, false)
+	if err != nil {
+		return 1, err
+	}
+	defer d.Close()
+
+	regions, err := gqcow2.Map(d)
+	if err != nil {
+		return 1, err
+	}
+
+	if *output == "json" {
+		fmt.Fprint(stdout, "[")
+		for index, r := range regions {
+			if index > 0 {
+				fmt.Fprint(stdout, ",\n")
+			}
+			fmt.Fprintf(stdout, `{ "start": %d, "length": %d, "depth": %d, "present": %t, "zero": %t, "data": %t, "compressed": %t`,
+				r.Start, r.Length, r.Depth, r.Present, r.Zero, r.Data, r.Compressed)
+			if r.Data && !r.Compressed {
+				fmt.Fprintf(stdout, `, "offset": %d`, r.Offset)
+			}
+			fmt.Fprint(stdout, "}")
+		}
+		fmt.Fprint(stdout, "]\n")
+		return 0, nil
+	}
+
+	names := chainNames(d, path)
+	fmt.Fprintf(stdout, "%-16s%-16s%-16s%s\n", "Offset", "Length", "Mapped to", "File")
+	for _, r := range regions {
+		if !r.Data || r.Compressed {
+			continue
+		}
+		fmt.Fprintf(stdout, "%-16s%-16s%-16s%s\n", hex(r.Start), hex(r.Length), hex(r.Offset), names[r.Depth])
+	}
+	return 0, nil
+}
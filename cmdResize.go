@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+func cmdResize(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("resize")
+	format := fs.String("f", "", "format of the image")
+	shrink := fs.Bool("shrink", false, "allow the image to shrink")
+	preallocation := fs.String("preallocation", "", "preallocation of the new area")
+	quiet := fs.Bool("q", false, "quiet")
+	positional, err := parseFlags(fs, args, 2)
+	if err != nil {
+		return 1, err
+	}
+	prealloc, err := gqcow2.ParsePreallocMode(*preallocation)
+	if err != nil {
+		return 1, err
+	}
+
+	d, err := openDisk(positional[0], *format, true)
+	if err != nil {
+		return 1, err
+	}
+
+	// the size is absolute, or relative with a sign
+	sizeArg := positional[1]
+	sign := ""
+	if strings.HasPrefix(sizeArg, "+") || strings.HasPrefix(sizeArg, "-") {
+		sign, sizeArg = sizeArg[:1], sizeArg[1:]
+	}
+	size, err := parseSize(sizeArg)
+	if err != nil {
+		d.Close()
+		return 1, err
+	}
+	switch sign {
+	case "+":
+		size = d.VirtualSize() + size
+	case "-":
+		if size > d.VirtualSize() {
+			d.Close()
+			return 1, errors.New("the image cannot be shrunk below 0")
+		}
+		size = d.VirtualSize() - size
+	}
+
+	switch disk := d.(type) {
+	case *gqcow2.Image:
+		err = disk.Resize(size, gqcow2.ResizeOptions{Shrink: *shrink, Preallocation: prealloc})
+	case *gqcow2.RawDisk:
+		if size < disk.Size && !*shrink {
+			err = gqcow2.ErrShrinkNotAllowed
+		} else if prealloc != gqcow2.PreallocOff {
+			err = fmt.Errorf("preallocation %s is not supported for raw", prealloc)
+		} else if t, ok := disk.Handler.(gqcow2.Truncater); ok {
+			err = t.Truncate(int64(size))
+		} else {
+			// e.g. an nbd export has a fixed size
+			err = errors.New("raw resize is not supported for this target")
+		}
+	}
+	if err = errors.Join(err, d.Close()); err != nil {
+		return 1, err
+	}
+
+	if !*quiet {
+		fmt.Fprintf(stdout, "Image resized.\n")
+	}
+	return 0, nil
+}
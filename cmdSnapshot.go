@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+func cmdSnapshot(args []string, stdout io.Writer) (int, error) {
+	fs := newFlagSet("snapshot")
+	format := fs.String("f", "", "format of the image")
+	list := fs.Bool("l", false, "list the snapshots")
+	create := fs.String("c", "", "create a snapshot")
+	apply := fs.String("a", "", "apply a snapshot")
+	remove := fs.String("d", "", "delete a snapshot")
+	fs.Bool("U", false, "ignored, images are never locked")
+	positional, err := parseFlags(fs, args, 1)
+	if err != nil {
+		return 1, err
+	}
+	// like qemu-img, a single action is taken per call
+	actions := 0
+	for _, given := range []bool{*list, *create != "", *apply != "", *remove != ""} {
+		if given {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return 1, errors.New("exactly one of -l, -c, -a or -d must be given")
+	}
+
+	image, err := openImage(positional[0], *format, !*list)
+	if err != nil {
+		return 1, err
+	}
+
+	switch {
+	case *create != "":
+		err = image.CreateSnapshot(*create)
+	case *apply != "":
+		err = image.ApplySnapshot(*apply)
+	case *remove != "":
+		err = image.DeleteSnapshot(*remove)
+	default:
+		err = listSnapshots(image, stdout)
+	}
+	if err = errors.Join(err, image.Close()); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+func listSnapshots(image *gqcow2.Image, stdout io.Writer) error {
+	info, err := image.Info()
+	if err != nil {
+		return err
+	}
+	if len(info.Snapshots) != 0 {
+		fmt.Fprintf(stdout, "Snapshot list:\n")
+		printSnapshots(stdout, info.Snapshots)
+	}
+	return nil
+}
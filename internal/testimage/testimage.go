@@ -0,0 +1,64 @@
+// Package testimage creates the qcow2 images the tests of the disk
+// formats and the servers start from.
+package testimage
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Create creates a qcow2 image of the size in a temporary directory of
+// the test, with random data in the extents. It returns the image,
+// closed when the test ends, and its guest content.
+func Create(t testing.TB, size uint64, extents ...gqcow2.Extent) (*gqcow2.Image, []byte) {
+	return CreateFile(t, filepath.Join(t.TempDir(), "disk.qcow2"), size, extents...)
+}
+
+// CreateFile is Create at the given path
+func CreateFile(t testing.TB, path string, size uint64, extents ...gqcow2.Extent) (*gqcow2.Image, []byte) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	image, err := gqcow2.Create(f, path, gqcow2.CreateOptions{Size: size})
+	require.NoError(t, err)
+	t.Cleanup(func() { image.Close() })
+
+	content := make([]byte, size)
+	r := rand.New(rand.NewSource(1))
+	for _, e := range extents {
+		r.Read(content[e.Start:e.End()])
+		_, err = image.WriteAt(content[e.Start:e.End()], int64(e.Start))
+		require.NoError(t, err)
+	}
+	return image, content
+}
+
+// Overlay creates a qcow2 overlay at path of the qcow2 backing file,
+// which is named relative to the overlay. The overlay is closed when
+// the test ends.
+func Overlay(t testing.TB, path string, size uint64, backing string) *gqcow2.Image {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	overlay, err := gqcow2.Create(f, path, gqcow2.CreateOptions{Size: size, BackingFile: backing, BackingFormat: "qcow2"})
+	require.NoError(t, err)
+	t.Cleanup(func() { overlay.Close() })
+	require.NoError(t, overlay.OpenBacking(gqcow2.OpenLocalBacking))
+	return overlay
+}
+
+// Read reads the whole guest content of the image
+func Read(t testing.TB, image *gqcow2.Image) []byte {
+	content := make([]byte, image.VirtualSize())
+	_, err := image.ReadAt(content, 0)
+	require.NoError(t, err)
+	return content
+}
+
+// Sparse are extents with a hole between them, the first MiB and a
+// single 64KiB cluster at 3MiB
+var Sparse = []gqcow2.Extent{{Start: 0, Length: 1 << 20}, {Start: 3 << 20, Length: 64 << 10}}
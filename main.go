@@ -1,4 +1,397 @@
+// go-qcow2 is a single binary replacement for the common qemu-img
+// subcommands, the flags and the output formats follow qemu-img.
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/nbd"
+	"go-qcow2/pkg/remote"
+	"go-qcow2/pkg/vhd"
+	"go-qcow2/pkg/vhdx"
+	"go-qcow2/pkg/vmdk"
+)
+
+const usage = `usage: go-qcow2 <command> [options]
+
+commands:
+  info [-f fmt] [--output=human|json] filename
+  map [-f fmt] [--output=human|json] filename
+  convert [-f fmt] [-O output_fmt] [-o options] [-p] filename output_filename
+  check [-f fmt] [--output=human|json] [-r leaks|all] filename
+  create [-f fmt] [-o options] [-b backing_file [-F backing_fmt]] [-u] filename [size]
+  snapshot [-l | -c snapshot | -a snapshot | -d snapshot] filename
+  resize [-f fmt] [--shrink] [--preallocation=mode] filename [+|-]size
+  compare [-f fmt] [-F fmt] [-s] [-p] filename1 filename2
+  dd [-f fmt] [-O output_fmt] [bs=block_size] [count=blocks] [skip=blocks] if=input of=output
+`
+
+type command func(args []string, stdout io.Writer) (int, error)
+
+var commands = map[string]command{
+	"info":     cmdInfo,
+	"map":      cmdMap,
+	"convert":  cmdConvert,
+	"check":    cmdCheck,
+	"create":   cmdCreate,
+	"snapshot": cmdSnapshot,
+	"resize":   cmdResize,
+	"compare":  cmdCompare,
+	"dd":       cmdDd,
+}
+
 func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run runs the command line and returns the exit code
+func run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		return 1
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "go-qcow2: unknown command %s\n%s", args[0], usage)
+		return 1
+	}
+
+	code, err := cmd(args[1:], stdout)
+	if err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(stderr, "go-qcow2: %s: %v\n", args[0], err)
+		}
+		if code == 0 {
+			code = 1
+		}
+	}
+	return code
+}
+
+// newFlagSet returns the flag set of a subcommand, the errors are
+// returned instead of printed
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+// parseFlags parses the flags of a subcommand and returns the positional
+// arguments, the flags may follow them like for qemu-img
+func parseFlags(fs *flag.FlagSet, args []string, positional int) ([]string, error) {
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		// everything after -- is positional, e.g. a negative size
+		if consumed := len(args) - len(fs.Args()); consumed > 0 && args[consumed-1] == "--" {
+			rest = append(rest, fs.Args()...)
+			break
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+
+	if positional >= 0 && len(rest) != positional {
+		return nil, fmt.Errorf("expecting %d arguments, got %d", positional, len(rest))
+	}
+	return rest, nil
+}
+
+// outputFlag adds the --output flag of qemu-img
+func outputFlag(fs *flag.FlagSet) *string {
+	return fs.String("output", "human", "human or json")
+}
+
+func checkOutput(output string) error {
+	if output != "human" && output != "json" {
+		return fmt.Errorf("--output must be human or json, not %s", output)
+	}
+	return nil
+}
+
+// printJSON prints the value indented like qemu-img does
+func printJSON(w io.Writer, v any) error {
+	out, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", out)
+	return err
+}
+
+// disk is an opened qcow2 image with its backing chain, a vmdk, vhd or
+// vhdx disk or a raw file
+type disk interface {
+	gqcow2.BackingDisk
+	io.Closer
+}
+
+// probeFormat tells qcow2, vmdk, vhdx and vpc from raw by the magic, a
+// fixed vpc only has its footer at the end
+func probeFormat(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(f, magic); err == nil {
+		switch {
+		case string(magic[:4]) == gqcow2.QCOW2MagicNumber:
+			return "qcow2", nil
+		case string(magic[:4]) == vmdk.MagicNumber:
+			return "vmdk", nil
+		case string(magic) == vhdx.Signature:
+			return "vhdx", nil
+		case string(magic) == vhd.Cookie:
+			return "vpc", nil
+		}
+	}
+	if info, err := f.Stat(); err == nil && info.Size() >= 512 {
+		if _, err := f.ReadAt(magic, info.Size()-512); err == nil && string(magic) == vhd.Cookie {
+			return "vpc", nil
+		}
+	}
+	return "raw", nil
+}
+
+// openDisk opens the file as qcow2, vmdk, vpc, vhdx or raw, the format
+// is probed if empty
+func openDisk(path string, format string, writable bool) (disk, error) {
+	if isURL(path) {
+		return openHTTPDisk(path, format, writable)
+	}
+	if nbd.IsURL(path) {
+		return openNBDDisk(path, format, writable)
+	}
+	if format == "" {
+		var err error
+		if format, err = probeFormat(path); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		return gqcow2.OpenImage(path, writable)
+	case "raw":
+		flag := os.O_RDONLY
+		if writable {
+			flag = os.O_RDWR
+		}
+		f, err := os.OpenFile(path, flag, 0)
+		if err != nil {
+			return nil, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return gqcow2.NewRawDisk(f, uint64(info.Size())), nil
+	case "vmdk", "vpc", "vhdx":
+		if writable {
+			return nil, fmt.Errorf("%s can only be opened read only", path)
+		}
+		switch format {
+		case "vmdk":
+			return vmdk.OpenFile(path)
+		case "vpc":
+			return vhd.OpenFile(path)
+		}
+		return vhdx.OpenFile(path)
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") ||
+		strings.HasPrefix(path, "s3://")
+}
+
+// s3Config reads the object storage from the environment like the aws cli
+func s3Config() remote.S3Config {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	return remote.S3Config{
+		Endpoint:     endpoint,
+		Region:       region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+}
+
+// parseS3URL splits s3://bucket/key
+func parseS3URL(url string) (string, string, error) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(url, "s3://"), "/")
+	if bucket == "" || key == "" {
+		return "", "", fmt.Errorf("invalid s3 url %s", url)
+	}
+	return bucket, key, nil
+}
+
+// openHTTPDisk opens a disk served over http or stored in s3, the
+// backing chain of an image is opened from the same server
+func openHTTPDisk(url string, format string, writable bool) (disk, error) {
+	if writable {
+		return nil, fmt.Errorf("%s can only be opened read only", url)
+	}
+
+	var f *remote.HTTPFile
+	var err error
+	open := remote.OpenHTTPBacking
+	if strings.HasPrefix(url, "s3://") {
+		config := s3Config()
+		bucket, key, err := parseS3URL(url)
+		if err != nil {
+			return nil, err
+		}
+		if f, err = remote.OpenS3File(config, bucket, key); err != nil {
+			return nil, err
+		}
+		open = remote.OpenS3Backing(config, bucket)
+	} else if f, err = remote.OpenHTTPFile(url); err != nil {
+		return nil, err
+	}
+
+	if format == "" {
+		format = "raw"
+		magic := make([]byte, 4)
+		if _, err := f.ReadAt(magic, 0); err == nil && string(magic) == gqcow2.QCOW2MagicNumber {
+			format = "qcow2"
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		image, err := gqcow2.NewFileImage(f, f.URL)
+		if err != nil {
+			return nil, err
+		}
+		if err := image.OpenBacking(open); err != nil {
+			return nil, err
+		}
+		return image, nil
+	case "raw":
+		return gqcow2.NewRawDisk(f, uint64(f.Size())), nil
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// openNBDDisk opens an export of an NBD server, the holes of a raw
+// export are found by block status. The backing file of an image on
+// the export cannot be opened.
+func openNBDDisk(url string, format string, writable bool) (disk, error) {
+	c, err := nbd.DialURL(url)
+	if err != nil {
+		return nil, err
+	}
+	if writable && c.ReadOnly() {
+		c.Close()
+		return nil, fmt.Errorf("%s is read only", url)
+	}
+
+	if format == "" {
+		format = "raw"
+		magic := make([]byte, 4)
+		if _, err := c.ReadAt(magic, 0); err == nil && string(magic) == gqcow2.QCOW2MagicNumber {
+			format = "qcow2"
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		image, err := gqcow2.NewFileImage(c, url)
+		if err == nil {
+			image.RWMode = writable
+			err = image.OpenBacking(func(from *gqcow2.Image, name string) (gqcow2.FileHandler, error) {
+				return nil, fmt.Errorf("backing file %s of an nbd export is not supported", name)
+			})
+		}
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		return image, nil
+	case "raw":
+		return gqcow2.NewRawDisk(c, c.VirtualSize()), nil
+	}
+	c.Close()
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// openImage opens a qcow2 image, other formats are refused
+func openImage(path string, format string, writable bool) (*gqcow2.Image, error) {
+	d, err := openDisk(path, format, writable)
+	if err != nil {
+		return nil, err
+	}
+	image, ok := d.(*gqcow2.Image)
+	if !ok {
+		d.Close()
+		return nil, fmt.Errorf("%s is not a qcow2 image", path)
+	}
+	return image, nil
+}
+
+var sizeSuffixes = "KMGTPE"
+
+// parseSize parses a size like qemu-img, a number of bytes with an
+// optional suffix of k, M, G, T, P or E in powers of 1024
+func parseSize(s string) (uint64, error) {
+	number, shift := s, 0
+	if len(s) > 0 {
+		last := strings.ToUpper(s[len(s)-1:])
+		if last == "B" {
+			number = s[:len(s)-1]
+		} else if index := strings.Index(sizeSuffixes, last); index >= 0 {
+			number, shift = s[:len(s)-1], 10*(index+1)
+		}
+	}
+
+	if shift == 0 {
+		return strconv.ParseUint(number, 10, 64)
+	}
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+	value *= float64(uint64(1) << shift)
+	if value >= math.MaxUint64 {
+		return 0, fmt.Errorf("size %s is too large", s)
+	}
+	return uint64(value), nil
+}
+
+// sizeToStr formats a size like qemu does, e.g. 1.5 GiB
+func sizeToStr(size uint64) string {
+	suffixes := []string{"", "Ki", "Mi", "Gi", "Ti", "Pi", "Ei"}
+	_, exp := math.Frexp(float64(size) / (1000.0 / 1024.0))
+	index := max(exp-1, 0) / 10
+	value := float64(size) / float64(uint64(1)<<(index*10))
+	return strconv.FormatFloat(value, 'g', 3, 64) + " " + suffixes[index] + "B"
 }
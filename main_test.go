@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/nbd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCommand runs the command line and returns the exit code and stdout
+func runCommand(t *testing.T, args ...string) (int, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	t.Log(stderr.String())
+	return code, stdout.String()
+}
+
+func Test_ParseSize(t *testing.T) {
+	for s, want := range map[string]uint64{
+		"512": 512, "1k": 1024, "1K": 1024, "64M": 64 << 20, "1.5G": 3 << 29, "2T": 2 << 40, "4096B": 4096,
+	} {
+		size, err := parseSize(s)
+		require.NoError(t, err, s)
+		assert.Equal(t, want, size, s)
+	}
+	for _, s := range []string{"", "1.5", "-1G", "1X"} {
+		_, err := parseSize(s)
+		assert.Error(t, err, s)
+	}
+
+	assert.Equal(t, "0 B", sizeToStr(0))
+	assert.Equal(t, "192 KiB", sizeToStr(196608))
+	assert.Equal(t, "1.5 GiB", sizeToStr(3<<29))
+	assert.Equal(t, "1 GiB", sizeToStr(1<<30))
+}
+
+func Test_CLI(t *testing.T) {
+	dir := t.TempDir()
+	rawPath := filepath.Join(dir, "disk.raw")
+	content := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(content[:1<<20])
+	require.NoError(t, os.WriteFile(rawPath, content, 0o644))
+
+	t.Run("create and info",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "new.qcow2")
+			code, out := runCommand(t, "create", "-f", "qcow2", "-o", "cluster_size=4k,lazy_refcounts=on", path, "1G")
+			require.Equal(t, 0, code)
+			assert.Contains(t, out, "cluster_size=4096")
+
+			code, out = runCommand(t, "info", path, "--output=json")
+			require.Equal(t, 0, code)
+			var info map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &info))
+			assert.Equal(t, float64(1<<30), info["virtual-size"])
+			assert.Equal(t, float64(4096), info["cluster-size"])
+			assert.Equal(t, "qcow2", info["format"])
+
+			code, out = runCommand(t, "info", path)
+			require.Equal(t, 0, code)
+			assert.Contains(t, out, "virtual size: 1 GiB (1073741824 bytes)\n")
+			assert.Contains(t, out, "Format specific information:\n    compat: 1.1\n    compression type: zlib\n    lazy refcounts: true\n")
+
+			overlay := filepath.Join(dir, "overlay.qcow2")
+			code, _ = runCommand(t, "create", "-f", "qcow2", "-b", "new.qcow2", "-F", "qcow2", overlay)
+			require.Equal(t, 0, code)
+			code, out = runCommand(t, "info", "--backing-chain", "--output=json", overlay)
+			require.Equal(t, 0, code)
+			var chain []map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &chain))
+			require.Len(t, chain, 2)
+			assert.Equal(t, "new.qcow2", chain[0]["backing-filename"])
+			assert.Equal(t, path, chain[1]["filename"])
+			assert.Equal(t, float64(1<<30), chain[0]["virtual-size"])
+		})
+
+	t.Run("convert, compare and check",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "converted.qcow2")
+			code, _ := runCommand(t, "convert", "-O", "qcow2", rawPath, path)
+			require.Equal(t, 0, code)
+
+			code, out := runCommand(t, "compare", rawPath, path)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, "Images are identical.\n", out)
+			// only the first MiB is allocated in the image
+			code, out = runCommand(t, "compare", "-s", rawPath, path)
+			assert.Equal(t, 1, code)
+			assert.Equal(t, "Strict mode: Offset 1048576 block status mismatch!\n", out)
+
+			code, out = runCommand(t, "check", path)
+			assert.Equal(t, 0, code)
+			assert.True(t, strings.HasPrefix(out, "No errors were found on the image.\n16/64 = 25.00% allocated"), out)
+
+			code, out = runCommand(t, "map", "--output=json", path)
+			require.Equal(t, 0, code)
+			var regions []map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &regions))
+			require.Len(t, regions, 2)
+			assert.Equal(t, float64(1<<20), regions[0]["length"])
+
+			back := filepath.Join(dir, "back.raw")
+			code, _ = runCommand(t, "convert", "-f", "qcow2", path, back)
+			require.Equal(t, 0, code)
+			converted, err := os.ReadFile(back)
+			require.NoError(t, err)
+			assert.Equal(t, content, converted)
+
+			content[100] ^= 1
+			require.NoError(t, os.WriteFile(back, content, 0o644))
+			content[100] ^= 1
+			code, out = runCommand(t, "compare", path, back)
+			assert.Equal(t, 1, code)
+			assert.Equal(t, "Content mismatch at offset 100!\n", out)
+		})
+
+	t.Run("convert to the standard output",
+		func(t *testing.T) {
+			code, out := runCommand(t, "convert", "-O", "qcow2", rawPath, "-")
+			require.Equal(t, 0, code)
+			path := filepath.Join(dir, "streamed.qcow2")
+			require.NoError(t, os.WriteFile(path, []byte(out), 0o644))
+
+			code, out = runCommand(t, "compare", rawPath, path)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, "Images are identical.\n", out)
+
+			code, out = runCommand(t, "convert", "-O", "raw", path, "-")
+			require.Equal(t, 0, code)
+			assert.Equal(t, content, []byte(out))
+		})
+
+	t.Run("dd and resize",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "part.qcow2")
+			code, _ := runCommand(t, "dd", "-O", "qcow2", "bs=64k", "skip=3", "count=5", "if="+rawPath, "of="+path)
+			require.Equal(t, 0, code)
+
+			code, out := runCommand(t, "resize", path, "+1M")
+			require.Equal(t, 0, code)
+			assert.Equal(t, "Image resized.\n", out)
+			code, _ = runCommand(t, "resize", path, "--", "-64k")
+			assert.NotEqual(t, 0, code)
+			code, _ = runCommand(t, "resize", "--shrink", path, "--", "-64k")
+			require.Equal(t, 0, code)
+
+			raw := filepath.Join(dir, "part.raw")
+			code, _ = runCommand(t, "convert", path, raw)
+			require.Equal(t, 0, code)
+			part, err := os.ReadFile(raw)
+			require.NoError(t, err)
+			want := append(bytes.Clone(content[3*65536:8*65536]), make([]byte, 1<<20-65536)...)
+			assert.Equal(t, want, part)
+		})
+
+	t.Run("snapshots",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "snapshots.qcow2")
+			code, _ := runCommand(t, "convert", "-O", "qcow2", rawPath, path)
+			require.Equal(t, 0, code)
+
+			code, _ = runCommand(t, "snapshot", "-c", "before", path)
+			require.Equal(t, 0, code)
+			code, _ = runCommand(t, "resize", path, "+1M")
+			require.Equal(t, 0, code)
+			code, out := runCommand(t, "snapshot", "-l", path)
+			require.Equal(t, 0, code)
+			assert.True(t, strings.HasPrefix(out, "Snapshot list:\n"), out)
+			assert.Contains(t, out, "before")
+
+			code, _ = runCommand(t, "snapshot", "-a", "before", path)
+			require.Equal(t, 0, code)
+			code, out = runCommand(t, "compare", rawPath, path)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, "Images are identical.\n", out)
+
+			// the actions cannot be mixed
+			code, _ = runCommand(t, "snapshot", "-c", "after", "-d", "before", path)
+			assert.Equal(t, 1, code)
+			code, _ = runCommand(t, "snapshot", "-l", "-a", "before", path)
+			assert.Equal(t, 1, code)
+
+			code, _ = runCommand(t, "snapshot", "-d", "before", path)
+			require.Equal(t, 0, code)
+			code, out = runCommand(t, "snapshot", "-l", path)
+			require.Equal(t, 0, code)
+			assert.Empty(t, out)
+			code, _ = runCommand(t, "snapshot", "-d", "before", path)
+			assert.Equal(t, 1, code)
+			code, out = runCommand(t, "check", path)
+			assert.Equal(t, 0, code, out)
+		})
+
+	t.Run("info and convert over http",
+		func(t *testing.T) {
+			server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+			defer server.Close()
+
+			code, out := runCommand(t, "info", "--output=json", server.URL+"/converted.qcow2")
+			require.Equal(t, 0, code)
+			var info map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &info))
+			assert.Equal(t, float64(len(content)), info["virtual-size"])
+			assert.Equal(t, "qcow2", info["format"])
+
+			raw := filepath.Join(dir, "downloaded.raw")
+			code, _ = runCommand(t, "convert", server.URL+"/converted.qcow2", raw)
+			require.Equal(t, 0, code)
+			downloaded, err := os.ReadFile(raw)
+			require.NoError(t, err)
+			assert.Equal(t, content, downloaded)
+
+			code, _ = runCommand(t, "resize", server.URL+"/converted.qcow2", "+1M")
+			assert.Equal(t, 1, code)
+		})
+
+	t.Run("convert from and into nbd exports",
+		func(t *testing.T) {
+			image, err := gqcow2.OpenImage(filepath.Join(dir, "converted.qcow2"), false)
+			require.NoError(t, err)
+			defer image.Close()
+			f, err := os.OpenFile(filepath.Join(dir, "target.raw"), os.O_RDWR|os.O_CREATE, 0o644)
+			require.NoError(t, err)
+			defer f.Close()
+			require.NoError(t, f.Truncate(int64(len(content))+4096))
+			_, err = f.WriteAt(bytes.Repeat([]byte{0xff}, len(content)), 0)
+			require.NoError(t, err)
+
+			socket := filepath.Join(dir, "nbd.sock")
+			l, err := net.Listen("unix", socket)
+			require.NoError(t, err)
+			server := nbd.NewServer(&nbd.Export{Name: "disk", Disk: image},
+				&nbd.Export{Name: "target", Disk: gqcow2.NewRawDisk(f, uint64(len(content))+4096)})
+			go server.Serve(l)
+			defer server.Close()
+
+			raw := filepath.Join(dir, "exported.raw")
+			code, _ := runCommand(t, "convert", "nbd+unix:///disk?socket="+socket, raw)
+			require.Equal(t, 0, code)
+			exported, err := os.ReadFile(raw)
+			require.NoError(t, err)
+			assert.Equal(t, content, exported)
+
+			code, _ = runCommand(t, "convert", rawPath, "nbd+unix:///target?socket="+socket)
+			require.Equal(t, 0, code)
+			target, err := os.ReadFile(f.Name())
+			require.NoError(t, err)
+			assert.Equal(t, append(content, make([]byte, 4096)...), target)
+
+			code, _ = runCommand(t, "convert", "-O", "qcow2", rawPath, "nbd+unix:///target?socket="+socket)
+			assert.Equal(t, 1, code)
+
+			// the size of an export is fixed
+			code, _ = runCommand(t, "resize", "nbd+unix:///target?socket="+socket, "+1M")
+			assert.Equal(t, 1, code)
+		})
+
+	t.Run("convert into and from vmdk",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "appliance.vmdk")
+			code, _ := runCommand(t, "convert", "-O", "vmdk", filepath.Join(dir, "converted.qcow2"), path)
+			require.Equal(t, 0, code)
+
+			code, out := runCommand(t, "info", "--output=json", path)
+			require.Equal(t, 0, code)
+			var info map[string]any
+			require.NoError(t, json.Unmarshal([]byte(out), &info))
+			assert.Equal(t, float64(len(content)), info["virtual-size"])
+			assert.Equal(t, "vmdk", info["format"])
+
+			back := filepath.Join(dir, "appliance.qcow2")
+			code, _ = runCommand(t, "convert", "-O", "qcow2", path, back)
+			require.Equal(t, 0, code)
+			code, out = runCommand(t, "compare", rawPath, back)
+			assert.Equal(t, 0, code)
+			assert.Equal(t, "Images are identical.\n", out)
+
+			code, _ = runCommand(t, "resize", path, "+1M")
+			assert.Equal(t, 1, code)
+		})
+
+	t.Run("convert into and from vpc",
+		func(t *testing.T) {
+			for _, options := range []string{"subformat=dynamic", "azure=on"} {
+				path := filepath.Join(dir, "azure.vhd")
+				code, _ := runCommand(t, "convert", "-O", "vpc", "-o", options, filepath.Join(dir, "converted.qcow2"), path)
+				require.Equal(t, 0, code)
+
+				code, out := runCommand(t, "info", "--output=json", path)
+				require.Equal(t, 0, code)
+				var info map[string]any
+				require.NoError(t, json.Unmarshal([]byte(out), &info))
+				assert.Equal(t, float64(len(content)), info["virtual-size"])
+				assert.Equal(t, "vpc", info["format"])
+
+				raw := filepath.Join(dir, "azure.raw")
+				code, _ = runCommand(t, "convert", path, raw)
+				require.Equal(t, 0, code)
+				converted, err := os.ReadFile(raw)
+				require.NoError(t, err)
+				assert.Equal(t, content, converted)
+			}
+
+			code, _ := runCommand(t, "convert", "-O", "vpc", "-o", "subformat=dynamic,azure=on", rawPath, filepath.Join(dir, "azure.vhd"))
+			assert.Equal(t, 1, code)
+		})
+
+	t.Run("errors",
+		func(t *testing.T) {
+			code, _ := runCommand(t, "nothing")
+			assert.Equal(t, 1, code)
+			code, _ = runCommand(t, "info", filepath.Join(dir, "missing.qcow2"))
+			assert.Equal(t, 1, code)
+			code, _ = runCommand(t, "compare", rawPath, filepath.Join(dir, "missing.qcow2"))
+			assert.Equal(t, 2, code)
+			code, _ = runCommand(t, "snapshot", "-c", "snap", rawPath)
+			assert.Equal(t, 1, code)
+		})
+}
@@ -0,0 +1,173 @@
+// Package diskhttp serves the guest disk of an image over http, e.g. for
+// a web console. The disk is a resource supporting byte ranges, so
+// browsers and tools fetch single partitions, and JSON endpoints describe
+// the image:
+//
+//	GET /disk       the guest disk, with Range requests
+//	GET /info       the image like qemu-img info --output=json
+//	GET /map        the regions of the guest like qemu-img map --output=json
+//	GET /snapshots  the internal snapshots
+//	GET /check      the refcount check like qemu-img check --output=json
+//
+// The handler can be mounted under a prefix with http.StripPrefix.
+package diskhttp
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// Handler serves one disk, which is only read. The requests are
+// serialized since images are not safe for concurrent use.
+type Handler struct {
+	// Disk is served, the endpoints of images are only available
+	// when it is a *gqcow2.Image
+	Disk gqcow2.BackingDisk
+	// Name is the file name of the disk in downloads and in the info
+	Name string
+	// ModTime is the Last-Modified of the disk, unset by default
+	ModTime time.Time
+
+	mu  sync.Mutex
+	mux *http.ServeMux
+}
+
+func NewHandler(disk gqcow2.BackingDisk, name string) *Handler {
+	h := &Handler{Disk: disk, Name: name, mux: http.NewServeMux()}
+	h.mux.HandleFunc("GET /disk", h.serveDisk)
+	h.mux.HandleFunc("GET /info", h.serveInfo)
+	h.mux.HandleFunc("GET /map", h.serveMap)
+	h.mux.HandleFunc("GET /snapshots", h.serveSnapshots)
+	h.mux.HandleFunc("GET /check", h.serveCheck)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// ReadAt reads the disk under the lock of the handler
+func (h *Handler) ReadAt(p []byte, off int64) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.Disk.ReadAt(p, off)
+}
+
+// serveDisk serves the guest content, http.ServeContent answers the
+// single and multiple ranges, HEAD and the conditional requests
+func (h *Handler) serveDisk(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": h.Name}))
+	content := io.NewSectionReader(h, 0, int64(h.Disk.VirtualSize()))
+	http.ServeContent(w, r, h.Name, h.ModTime, content)
+}
+
+func (h *Handler) info() (*gqcow2.ImageInfo, error) {
+	switch disk := h.Disk.(type) {
+	case *gqcow2.Image:
+		info, err := disk.Info()
+		if err != nil {
+			return nil, err
+		}
+		// the paths on the server are not exposed, absolute names
+		// recorded in the image are cut to their base name
+		info.Filename = h.Name
+		info.FullBackingFilename = ""
+		info.BackingFilename = baseName(info.BackingFilename)
+		if info.FormatSpecific != nil && info.FormatSpecific.Data != nil {
+			info.FormatSpecific.Data.DataFile = baseName(info.FormatSpecific.Data.DataFile)
+		}
+		return info, nil
+	case *gqcow2.RawDisk:
+		return disk.Info(h.Name), nil
+	}
+	return &gqcow2.ImageInfo{VirtualSize: h.Disk.VirtualSize(), Filename: h.Name, Format: "raw"}, nil
+}
+
+// baseName is the base name of an absolute path, relative names are kept
+func baseName(name string) string {
+	if filepath.IsAbs(name) {
+		return filepath.Base(name)
+	}
+	return name
+}
+
+func (h *Handler) serveInfo(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	info, err := h.info()
+	h.mu.Unlock()
+	writeJSON(w, info, err)
+}
+
+func (h *Handler) serveMap(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	regions, err := gqcow2.Map(h.Disk)
+	h.mu.Unlock()
+	if regions == nil {
+		regions = []gqcow2.VirtualDiskRegion{}
+	}
+	writeJSON(w, regions, err)
+}
+
+func (h *Handler) serveSnapshots(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	info, err := h.info()
+	h.mu.Unlock()
+	snapshots := []gqcow2.SnapshotInfo{}
+	if err == nil && info.Snapshots != nil {
+		snapshots = info.Snapshots
+	}
+	writeJSON(w, snapshots, err)
+}
+
+// checkResult adds the verdict and the problems found to the
+// output of qemu-img check
+type checkResult struct {
+	*gqcow2.CheckResult
+	Consistent bool     `json:"consistent"`
+	Problems   []string `json:"problems"`
+}
+
+func (h *Handler) serveCheck(w http.ResponseWriter, r *http.Request) {
+	image, ok := h.Disk.(*gqcow2.Image)
+	if !ok {
+		http.Error(w, "only qcow2 images can be checked", http.StatusNotFound)
+		return
+	}
+
+	h.mu.Lock()
+	result, err := image.Check()
+	h.mu.Unlock()
+	if err != nil {
+		writeJSON(w, nil, err)
+		return
+	}
+	result.Filename = h.Name
+	problems := result.Problems
+	if problems == nil {
+		problems = []string{}
+	}
+	writeJSON(w, checkResult{CheckResult: result, Consistent: result.Consistent(), Problems: problems}, nil)
+}
+
+// writeJSON writes the value, or the error as an internal error
+func writeJSON(w http.ResponseWriter, v any, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
@@ -0,0 +1,174 @@
+package diskhttp_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/diskhttp"
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string, header ...string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	for index := 0; index < len(header); index += 2 {
+		req.Header.Set(header[index], header[index+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, body
+}
+
+func Test_Handler(t *testing.T) {
+	image, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+	server := httptest.NewServer(http.StripPrefix("/images/disk", diskhttp.NewHandler(image, "disk.qcow2")))
+	defer server.Close()
+	url := server.URL + "/images/disk"
+
+	t.Run("Serve the whole disk and ranges of it",
+		func(t *testing.T) {
+			resp, body := get(t, url+"/disk")
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, "application/octet-stream", resp.Header.Get("Content-Type"))
+			assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			require.NoError(t, err)
+			assert.Equal(t, "disk.qcow2", params["filename"])
+			assert.Equal(t, content, body)
+
+			resp, body = get(t, url+"/disk", "Range", "bytes=1048000-1049999")
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, "bytes 1048000-1049999/4194304", resp.Header.Get("Content-Range"))
+			assert.Equal(t, content[1048000:1050000], body)
+
+			resp, body = get(t, url+"/disk", "Range", "bytes=-512")
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, content[4<<20-512:], body)
+
+			resp, body = get(t, url+"/disk", "Range", "bytes=0-99,4000-4099")
+			require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			_, params, err = mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			require.NoError(t, err)
+			parts := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+			for _, want := range [][2]int{{0, 100}, {4000, 4100}} {
+				part, err := parts.NextPart()
+				require.NoError(t, err)
+				data, err := io.ReadAll(part)
+				require.NoError(t, err)
+				assert.Equal(t, content[want[0]:want[1]], data)
+			}
+
+			resp, _ = get(t, url+"/disk", "Range", "bytes=5000000-")
+			assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+			resp, err = http.Head(url + "/disk")
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, int64(4<<20), resp.ContentLength)
+		})
+
+	t.Run("Describe the image",
+		func(t *testing.T) {
+			resp, body := get(t, url+"/info")
+			assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var info gqcow2.ImageInfo
+			require.NoError(t, json.Unmarshal(body, &info))
+			assert.Equal(t, uint64(4<<20), info.VirtualSize)
+			assert.Equal(t, "qcow2", info.Format)
+			assert.Equal(t, "disk.qcow2", info.Filename)
+
+			_, body = get(t, url+"/map")
+			var regions []gqcow2.VirtualDiskRegion
+			require.NoError(t, json.Unmarshal(body, &regions))
+			require.Len(t, regions, 2)
+			assert.Equal(t, uint64(1<<20), regions[0].Length)
+			assert.True(t, regions[0].Data)
+			assert.False(t, regions[1].Data)
+
+			_, body = get(t, url+"/snapshots")
+			assert.JSONEq(t, "[]", string(body))
+
+			_, body = get(t, url+"/check")
+			var check map[string]any
+			require.NoError(t, json.Unmarshal(body, &check))
+			assert.Equal(t, true, check["consistent"])
+			assert.Equal(t, "disk.qcow2", check["filename"])
+			assert.Equal(t, float64(0), check["corruptions"])
+			assert.Equal(t, []any{}, check["problems"])
+		})
+
+	t.Run("Unknown paths and methods",
+		func(t *testing.T) {
+			resp, _ := get(t, url+"/missing")
+			assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+			resp, err := http.Post(url+"/disk", "application/octet-stream", bytes.NewReader([]byte{1}))
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+		})
+}
+
+func Test_HandlerRawDisk(t *testing.T) {
+	content := make([]byte, 100000)
+	rand.New(rand.NewSource(2)).Read(content)
+	raw := gqcow2.NewRawDisk(bytes.NewReader(content), uint64(len(content)))
+	server := httptest.NewServer(diskhttp.NewHandler(raw, "disk.raw"))
+	defer server.Close()
+
+	resp, body := get(t, server.URL+"/disk", "Range", "bytes=99990-")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[99990:], body)
+
+	_, body = get(t, server.URL+"/info")
+	var info gqcow2.ImageInfo
+	require.NoError(t, json.Unmarshal(body, &info))
+	assert.Equal(t, "raw", info.Format)
+	assert.Equal(t, "disk.raw", info.Filename)
+
+	resp, _ = get(t, server.URL+"/check")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func Test_HandlerHidesServerPaths(t *testing.T) {
+	base, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+	path := filepath.Join(t.TempDir(), "overlay.qcow2")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	overlay, err := gqcow2.Create(f, path, gqcow2.CreateOptions{
+		Size: 4 << 20, BackingFile: base.Name, BackingFormat: "qcow2",
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { overlay.Close() })
+	overlay.Backing = base
+
+	server := httptest.NewServer(diskhttp.NewHandler(overlay, "vm.qcow2"))
+	defer server.Close()
+
+	_, body := get(t, server.URL+"/info")
+	var info gqcow2.ImageInfo
+	require.NoError(t, json.Unmarshal(body, &info))
+	assert.Equal(t, "vm.qcow2", info.Filename)
+	assert.Equal(t, "disk.qcow2", info.BackingFilename)
+	assert.Empty(t, info.FullBackingFilename)
+	assert.NotContains(t, string(body), filepath.Dir(base.Name))
+
+	_, body = get(t, server.URL+"/disk")
+	assert.Equal(t, content, body)
+}
@@ -0,0 +1,434 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Bitmaps extension data:
+//
+//Byte  0 -  3:  nb_bitmaps
+//               The number of bitmaps contained in the image.
+//
+//      4 -  7:  Reserved, must be zero.
+//
+//      8 - 15:  bitmap_directory_size
+//               Size of the bitmap directory in bytes.
+//
+//     16 - 23:  bitmap_directory_offset
+//               Offset into the image file at which the bitmap directory
+//               starts. Must be aligned to a cluster boundary.
+//
+// Bitmap directory entry:
+//
+//Byte  0 -  7:  bitmap_table_offset
+//      8 - 11:  bitmap_table_size, number of entries in the bitmap table
+//     12 - 15:  flags
+//               Bit 0: in_use, the bitmap was not saved correctly
+//               Bit 1: auto, the bitmap tracks the guest writes
+//               Bit 2: extra_data_compatible
+//         16:   type, 1 for dirty tracking bitmap
+//         17:   granularity_bits
+//     18 - 19:  name_size
+//     20 - 23:  extra_data_size
+//     variable: extra data, name, padding to the multiple of 8
+//
+// Each bitmap table entry points to a cluster of bitmap data, the bits
+// are ordered from the least significant bit of the first byte.
+//
+// Bitmap table entry:
+//
+//Bit       0:  if bits 9 - 55 are zero, 1 means all bits of the
+//              cluster are set, 0 means all bits are unset
+//     1 -  8:  Reserved
+//     9 - 55:  offset of the bitmap data cluster
+//    56 - 63:  Reserved
+
+const (
+	BitmapInUse               uint32 = 1 << 0
+	BitmapAuto                uint32 = 1 << 1
+	BitmapExtraDataCompatible uint32 = 1 << 2
+
+	BitmapTypeDirtyTracking uint8 = 1
+)
+
+var ErrBitmapNotFound = errors.New("bitmap not found")
+
+type Bitmap struct {
+	Name            string
+	Flags           uint32
+	Type            uint8
+	GranularityBits uint8
+	ExtraData       []byte
+
+	TableOffset uint64
+	TableSize   uint32
+
+	// one bit per granularity, nil until LoadBitmapData
+	Data []byte
+}
+
+// Granularity is in bytes of the virtual disk covered by one bit
+func (b *Bitmap) Granularity() uint64 {
+	return 1 << b.GranularityBits
+}
+
+func (b *Bitmap) InUse() bool {
+	return b.Flags&BitmapInUse != 0
+}
+
+// dataLength is the number of bytes of the bitmap data for the disk size
+func (b *Bitmap) dataLength(size uint64) uint64 {
+	return divRoundUp(divRoundUp(size, b.Granularity()), 8)
+}
+
+// NewBitmap returns an empty dirty tracking bitmap for the virtual disk size
+func NewBitmap(name string, granularityBits uint8, size uint64) *Bitmap {
+	b := &Bitmap{
+		Name:            name,
+		Type:            BitmapTypeDirtyTracking,
+		GranularityBits: granularityBits,
+	}
+	b.Data = make([]byte, b.dataLength(size))
+	return b
+}
+
+// SetDirty marks every granule overlaps the extent
+func (b *Bitmap) SetDirty(e Extent) {
+	if e.Length == 0 {
+		return
+	}
+	first := e.Start / b.Granularity()
+	last := (e.End() - 1) / b.Granularity()
+	for bit := first; bit <= last && bit/8 < uint64(len(b.Data)); bit++ {
+		b.Data[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Extents merges the dirty granules into extents of the virtual disk
+func (b *Bitmap) Extents(size uint64) []Extent {
+	extents := make([]Extent, 0)
+	granularity := b.Granularity()
+	granules := divRoundUp(size, granularity)
+
+	for bit := uint64(0); bit < granules; bit++ {
+		if b.Data[bit/8]&(1<<(bit%8)) == 0 {
+			continue
+		}
+		start := bit * granularity
+		end := min(start+granularity, size)
+		if len(extents) > 0 && extents[len(extents)-1].End() == start {
+			extents[len(extents)-1].Length = end - extents[len(extents)-1].Start
+		} else {
+			extents = append(extents, Extent{Start: start, Length: end - start})
+		}
+	}
+
+	return extents
+}
+
+// LoadBitmaps reads the bitmap directory, nil if there is no bitmap
+func (i *Image) LoadBitmaps() ([]*Bitmap, error) {
+	ext := i.Extension(ExtensionBitmaps)
+	if ext == nil {
+		return nil, nil
+	}
+	if len(ext.Data) < 24 {
+		return nil, errors.New("corrupted bitmaps extension")
+	}
+
+	count := binary.BigEndian.Uint32(ext.Data[0:4])
+	dirSize := binary.BigEndian.Uint64(ext.Data[8:16])
+	dirOffset := binary.BigEndian.Uint64(ext.Data[16:24])
+
+	dir, err := readAt(i.Handler, int64(dirOffset), int64(dirSize))
+	if err != nil {
+		return nil, errors.Join(errors.New("reading bitmap directory failed"), err)
+	}
+
+	bitmaps := make([]*Bitmap, 0, count)
+	offset := uint64(0)
+	for range count {
+		if offset+24 > dirSize {
+			return nil, errors.New("corrupted bitmap directory")
+		}
+		entry := dir[offset:]
+		nameSize := uint64(binary.BigEndian.Uint16(entry[18:20]))
+		extraSize := uint64(binary.BigEndian.Uint32(entry[20:24]))
+		if offset+24+extraSize+nameSize > dirSize {
+			return nil, errors.New("corrupted bitmap directory")
+		}
+
+		b := &Bitmap{
+			TableOffset:     binary.BigEndian.Uint64(entry[0:8]),
+			TableSize:       binary.BigEndian.Uint32(entry[8:12]),
+			Flags:           binary.BigEndian.Uint32(entry[12:16]),
+			Type:            entry[16],
+			GranularityBits: entry[17],
+			ExtraData:       append([]byte(nil), entry[24:24+extraSize]...),
+			Name:            string(entry[24+extraSize : 24+extraSize+nameSize]),
+		}
+		bitmaps = append(bitmaps, b)
+
+		offset += alignUp(24+extraSize+nameSize, 8)
+	}
+
+	return bitmaps, nil
+}
+
+// FindBitmap looks up the bitmap by name
+func (i *Image) FindBitmap(name string) (*Bitmap, error) {
+	bitmaps, err := i.LoadBitmaps()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bitmaps {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrBitmapNotFound, name)
+}
+
+// LoadBitmapData reads the bits of the bitmap into b.Data
+func (i *Image) LoadBitmapData(b *Bitmap) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	length := b.dataLength(i.Header.Size)
+	if divRoundUp(length, clusterSize) > uint64(b.TableSize) {
+		return fmt.Errorf("bitmap table of %s is too small", b.Name)
+	}
+
+	rawTable, err := readAt(i.Handler, int64(b.TableOffset), int64(b.TableSize)*8)
+	if err != nil {
+		return errors.Join(fmt.Errorf("reading bitmap table of %s failed", b.Name), err)
+	}
+
+	b.Data = make([]byte, length)
+	for index := uint64(0); index*clusterSize < length; index++ {
+		entry := binary.BigEndian.Uint64(rawTable[index*8 : index*8+8])
+		chunk := b.Data[index*clusterSize : min((index+1)*clusterSize, length)]
+
+		dataOffset := entry & offsetMask
+		if dataOffset == 0 {
+			if entry&1 == 1 {
+				for n := range chunk {
+					chunk[n] = 0xff
+				}
+			}
+			continue
+		}
+
+		raw, err := readAt(i.Handler, int64(dataOffset), int64(len(chunk)))
+		if err != nil {
+			return errors.Join(fmt.Errorf("reading bitmap data of %s failed", b.Name), err)
+		}
+		copy(chunk, raw)
+	}
+
+	return nil
+}
+
+// DirtyExtents loads the named bitmap and returns the dirty parts of the
+// virtual disk, bitmaps that are not consistent are refused.
+func (i *Image) DirtyExtents(name string) ([]Extent, error) {
+	b, err := i.FindBitmap(name)
+	if err != nil {
+		return nil, err
+	}
+	if b.Type != BitmapTypeDirtyTracking {
+		return nil, fmt.Errorf("bitmap %s has unknown type %d", name, b.Type)
+	}
+	if b.InUse() || i.Header.AutoclearFeatures&AutoclearBitmaps == 0 {
+		return nil, fmt.Errorf("bitmap %s is inconsistent", name)
+	}
+	if err := i.LoadBitmapData(b); err != nil {
+		return nil, err
+	}
+
+	return b.Extents(i.Header.Size), nil
+}
+
+// StoreBitmap writes the bitmap into the image, a bitmap with
+// the same name is replaced.
+func (i *Image) StoreBitmap(b *Bitmap) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if i.Header.Version < 3 {
+		return errors.New("bitmaps require a v3 image")
+	}
+
+	bitmaps, err := i.LoadBitmaps()
+	if err != nil {
+		return err
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	length := b.dataLength(i.Header.Size)
+	if uint64(len(b.Data)) < length {
+		return fmt.Errorf("bitmap data of %s is too short", b.Name)
+	}
+
+	tableSize := divRoundUp(length, clusterSize)
+	rawTable := make([]byte, alignUp(max(tableSize*8, 1), clusterSize))
+	for index := range tableSize {
+		chunk := b.Data[index*clusterSize : min((index+1)*clusterSize, length)]
+		if isAllZero(chunk) {
+			continue
+		}
+
+		dataOffset, err := i.allocateClusters(1)
+		if err != nil {
+			return err
+		}
+		if _, err := i.writer().WriteAt(chunk, int64(dataOffset)); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(rawTable[index*8:index*8+8], dataOffset)
+	}
+
+	tableOffset, err := i.allocateClusters(uint64(len(rawTable)) / clusterSize)
+	if err != nil {
+		return err
+	}
+	if _, err := i.writer().WriteAt(rawTable, int64(tableOffset)); err != nil {
+		return err
+	}
+
+	stored := *b
+	stored.Type = BitmapTypeDirtyTracking
+	stored.TableOffset = tableOffset
+	stored.TableSize = uint32(tableSize)
+
+	kept := make([]*Bitmap, 0, len(bitmaps)+1)
+	for _, old := range bitmaps {
+		if old.Name == b.Name {
+			if err := i.freeBitmap(old); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, old)
+	}
+	i.markStaleBitmaps(kept)
+	kept = append(kept, &stored)
+
+	return i.writeBitmapDirectory(kept)
+}
+
+// RemoveBitmap deletes the named bitmap and frees its clusters
+func (i *Image) RemoveBitmap(name string) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+
+	bitmaps, err := i.LoadBitmaps()
+	if err != nil {
+		return err
+	}
+
+	kept := make([]*Bitmap, 0, len(bitmaps))
+	for _, b := range bitmaps {
+		if b.Name == name {
+			if err := i.freeBitmap(b); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if len(kept) == len(bitmaps) {
+		return fmt.Errorf("%w: %s", ErrBitmapNotFound, name)
+	}
+	i.markStaleBitmaps(kept)
+
+	return i.writeBitmapDirectory(kept)
+}
+
+// freeBitmap releases the bitmap table and the data clusters
+func (i *Image) freeBitmap(b *Bitmap) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	rawTable, err := readAt(i.Handler, int64(b.TableOffset), int64(b.TableSize)*8)
+	if err != nil {
+		return err
+	}
+	for index := range uint64(b.TableSize) {
+		dataOffset := binary.BigEndian.Uint64(rawTable[index*8:index*8+8]) & offsetMask
+		if dataOffset == 0 {
+			continue
+		}
+		if err := i.updateRefCount(dataOffset, clusterSize, -1); err != nil {
+			return err
+		}
+	}
+	return i.updateRefCount(b.TableOffset, max(uint64(b.TableSize)*8, 1), -1)
+}
+
+// markStaleBitmaps flags the bitmaps in use if the autoclear bit was
+// cleared, they missed the guest writes since and must stay
+// inconsistent once writeBitmapDirectory sets the bit again
+func (i *Image) markStaleBitmaps(bitmaps []*Bitmap) {
+	if i.Header.AutoclearFeatures&AutoclearBitmaps != 0 {
+		return
+	}
+	for _, b := range bitmaps {
+		b.Flags |= BitmapInUse
+	}
+}
+
+// writeBitmapDirectory writes a new directory for the bitmaps, and
+// replaces the bitmaps extension
+func (i *Image) writeBitmapDirectory(bitmaps []*Bitmap) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	oldExt := i.Extension(ExtensionBitmaps)
+	var oldOffset, oldSize uint64
+	if oldExt != nil {
+		oldSize = binary.BigEndian.Uint64(oldExt.Data[8:16])
+		oldOffset = binary.BigEndian.Uint64(oldExt.Data[16:24])
+	}
+
+	if len(bitmaps) == 0 {
+		i.SetExtension(ExtensionBitmaps, nil)
+		i.Header.AutoclearFeatures &^= AutoclearBitmaps
+	} else {
+		dir := make([]byte, 0)
+		for _, b := range bitmaps {
+			entry := make([]byte, alignUp(24+uint64(len(b.ExtraData))+uint64(len(b.Name)), 8))
+			binary.BigEndian.PutUint64(entry[0:8], b.TableOffset)
+			binary.BigEndian.PutUint32(entry[8:12], b.TableSize)
+			binary.BigEndian.PutUint32(entry[12:16], b.Flags)
+			entry[16] = b.Type
+			entry[17] = b.GranularityBits
+			binary.BigEndian.PutUint16(entry[18:20], uint16(len(b.Name)))
+			binary.BigEndian.PutUint32(entry[20:24], uint32(len(b.ExtraData)))
+			copy(entry[24:], b.ExtraData)
+			copy(entry[24+len(b.ExtraData):], b.Name)
+			dir = append(dir, entry...)
+		}
+
+		dirOffset, err := i.allocateClusters(divRoundUp(uint64(len(dir)), clusterSize))
+		if err != nil {
+			return err
+		}
+		if _, err := i.writer().WriteAt(dir, int64(dirOffset)); err != nil {
+			return err
+		}
+
+		extData := make([]byte, 24)
+		binary.BigEndian.PutUint32(extData[0:4], uint32(len(bitmaps)))
+		binary.BigEndian.PutUint64(extData[8:16], uint64(len(dir)))
+		binary.BigEndian.PutUint64(extData[16:24], dirOffset)
+		i.SetExtension(ExtensionBitmaps, extData)
+		i.Header.AutoclearFeatures |= AutoclearBitmaps
+	}
+
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+
+	if oldSize != 0 {
+		return i.updateRefCount(oldOffset, oldSize, -1)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gqcow2
+
+// maxCachedTables bounds the memory used by each cache,
+// with 64KiB clusters this is 64MiB.
+const maxCachedTables = 1024
+
+// tableCache keeps the cluster sized metadata tables (l2 tables,
+// refcount blocks) in memory. Updates are written through to the
+// image file, unless the cache or the image is in write back mode,
+// then the modified tables are written when they are evicted or flushed.
+type tableCache struct {
+	tables map[uint64][]byte
+	dirty  map[uint64]bool
+
+	// set for the refcount blocks while lazy refcounts are in use
+	writeBack bool
+}
+
+func newTableCache() *tableCache {
+	return &tableCache{
+		tables: make(map[uint64][]byte),
+		dirty:  make(map[uint64]bool),
+	}
+}
+
+func (c *tableCache) get(offset uint64) ([]byte, bool) {
+	table, ok := c.tables[offset]
+	return table, ok
+}
+
+// victim picks an entry to evict, clean entries first
+func (c *tableCache) victim() uint64 {
+	var victim uint64
+	for key := range c.tables {
+		victim = key
+		if !c.dirty[key] {
+			break
+		}
+	}
+	return victim
+}
+
+func (c *tableCache) drop(offset uint64) {
+	delete(c.tables, offset)
+	delete(c.dirty, offset)
+}
+
+// deferred tells if updates of the cache are kept in memory
+func (i *Image) deferred(c *tableCache) bool {
+	return c.writeBack || i.WriteBack
+}
+
+// cachePut adds the table to the cache, the modified tables
+// are flushed in order before one of them is evicted
+func (i *Image) cachePut(c *tableCache, offset uint64, table []byte) error {
+	if _, ok := c.tables[offset]; !ok && len(c.tables) >= maxCachedTables {
+		victim := c.victim()
+		if c.dirty[victim] {
+			if err := i.flushMetadata(); err != nil {
+				return err
+			}
+		}
+		c.drop(victim)
+	}
+	c.tables[offset] = table
+	return nil
+}
+
+// flushCache writes every modified table of the cache back into the image
+func (i *Image) flushCache(c *tableCache) error {
+	for offset := range c.dirty {
+		if err := i.writeCachedTable(c, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCachedTable writes one modified table back into the image
+func (i *Image) writeCachedTable(c *tableCache, offset uint64) error {
+	if !c.dirty[offset] {
+		return nil
+	}
+	if _, err := i.writer().WriteAt(c.tables[offset], int64(offset)); err != nil {
+		return err
+	}
+	delete(c.dirty, offset)
+	return nil
+}
+
+// loadTable reads a cluster sized table through the cache
+func (i *Image) loadTable(c *tableCache, offset uint64) ([]byte, error) {
+	if table, ok := c.get(offset); ok {
+		return table, nil
+	}
+
+	table, err := readAt(i.Handler, int64(offset), int64(i.Header.ClusterSize()))
+	if err != nil {
+		return nil, err
+	}
+	if err := i.cachePut(c, offset, table); err != nil {
+		return nil, err
+	}
+
+	return table, nil
+}
+
+// storeTableEntry updates one entry of a cached table and
+// writes the entry back into the image.
+func (i *Image) storeTableEntry(c *tableCache, offset uint64, entryOffset int, entry []byte) error {
+	table, err := i.loadTable(c, offset)
+	if err != nil {
+		return err
+	}
+	copy(table[entryOffset:], entry)
+
+	if i.deferred(c) {
+		c.dirty[offset] = true
+		return nil
+	}
+	_, err = i.writer().WriteAt(entry, int64(offset)+int64(entryOffset))
+	return err
+}
+
+// storeTable replaces a whole table
+func (i *Image) storeTable(c *tableCache, offset uint64, table []byte) error {
+	if err := i.cachePut(c, offset, table); err != nil {
+		return err
+	}
+
+	if i.deferred(c) {
+		c.dirty[offset] = true
+		return nil
+	}
+	_, err := i.writer().WriteAt(table, int64(offset))
+	return err
+}
@@ -89,28 +89,7 @@ func (i *Image) extractL2EntryData(vdOffset uint64, guestCluster *GuestCluster)
 	}
 	guestCluster.L2Info = l2entry
 
-	if l2entry.Standard != nil {
-		if l2entry.Flag {
-			if l2entry.Standard.AllZero {
-				return nil
-			} else {
-				rc, err := i.Handler.ReadAt(guestCluster.Raw, int64(guestCluster.Length))
-				if err != nil {
-					return err
-				}
-				if rc < int(guestCluster.Length) {
-					return io.ErrUnexpectedEOF
-				}
-				return nil
-			}
-		}
-
-		// unused
-		return nil
-	}
-
-	// if compressed
-	return decompressGuestCluster(i, guestCluster)
+	return i.readGuest(l2entry, guestCluster.Start, guestCluster.Raw)
 }
 
 type ClusterMap struct {
@@ -0,0 +1,251 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// faultFile is an in memory FileHandler and DiskHandler which records
+// every write, so the file can be rebuilt as it was at any point, or
+// as a power loss leaves it with some of the unflushed writes lost.
+type faultFile struct {
+	base []byte
+	buf  []byte
+	ops  []fileOp
+}
+
+// fileOp is a write, a truncate, or a sync if data is nil and truncate is false
+type fileOp struct {
+	offset   int64
+	data     []byte
+	truncate bool
+}
+
+func (o fileOp) isSync() bool {
+	return o.data == nil && !o.truncate
+}
+
+func newFaultFile(content []byte) *faultFile {
+	return &faultFile{base: bytes.Clone(content), buf: bytes.Clone(content)}
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.buf)) {
+		clear(p)
+		return len(p), nil
+	}
+	n := copy(p, f.buf[off:])
+	clear(p[n:])
+	return len(p), nil
+}
+
+func (f *faultFile) WriteAt(p []byte, off int64) (int, error) {
+	f.ops = append(f.ops, fileOp{offset: off, data: bytes.Clone(p)})
+	f.buf = applyOp(f.buf, f.ops[len(f.ops)-1])
+	return len(p), nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	f.ops = append(f.ops, fileOp{offset: size, truncate: true})
+	f.buf = applyOp(f.buf, f.ops[len(f.ops)-1])
+	return nil
+}
+
+func (f *faultFile) Sync() error {
+	f.ops = append(f.ops, fileOp{})
+	return nil
+}
+
+func (f *faultFile) Size() int64 {
+	return int64(len(f.buf))
+}
+
+func applyOp(buf []byte, op fileOp) []byte {
+	if op.truncate {
+		if op.offset < int64(len(buf)) {
+			return buf[:op.offset]
+		}
+		return append(buf, make([]byte, op.offset-int64(len(buf)))...)
+	}
+	if end := op.offset + int64(len(op.data)); end > int64(len(buf)) {
+		buf = append(buf, make([]byte, end-int64(len(buf)))...)
+	}
+	copy(buf[op.offset:], op.data)
+	return buf
+}
+
+// lastSync returns the index of the last sync of the first n ops, -1 if there is none
+func (f *faultFile) lastSync(n int) int {
+	for index := n - 1; index >= 0; index-- {
+		if f.ops[index].isSync() {
+			return index
+		}
+	}
+	return -1
+}
+
+// replay rebuilds the file after the first n ops, an unflushed op
+// (issued after the last sync) is only applied if keep says so
+func (f *faultFile) replay(n int, keep func(index int) bool) *faultFile {
+	buf := bytes.Clone(f.base)
+	lastSync := f.lastSync(n)
+	for index, op := range f.ops[:n] {
+		if op.isSync() || (index > lastSync && !keep(index)) {
+			continue
+		}
+		buf = applyOp(buf, op)
+	}
+	return newFaultFile(buf)
+}
+
+type crashConfig struct {
+	name      string
+	writeBack bool
+	lazy      bool
+	// drop unflushed writes, only safe if the writes are ordered by syncs
+	dropUnflushed bool
+}
+
+// crashWorkload runs random guest writes on a new image, it returns the
+// recorded file, the number of file ops when each guest op has finished,
+// which guest ops are flushes and the guest content after each guest op
+func crashWorkload(t *testing.T, cfg crashConfig, seed int64) (*faultFile, []int, []bool, [][]byte) {
+	const size = 1 << 20
+	disk := &bytesDisk{}
+	_, err := gqcow2.Create(disk, "crash.qcow2", gqcow2.CreateOptions{Size: size, ClusterBits: 12})
+	require.NoError(t, err)
+
+	f := newFaultFile(disk.buf)
+	image, err := gqcow2.NewFileImage(f, "crash.qcow2")
+	require.NoError(t, err)
+	if cfg.lazy {
+		lazy := true
+		require.NoError(t, image.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy}))
+	}
+	image.WriteBack = cfg.writeBack
+	f.base, f.ops = bytes.Clone(f.buf), nil
+
+	r := rand.New(rand.NewSource(seed))
+	boundaries := []int{0}
+	flushes := []bool{true}
+	snapshots := [][]byte{make([]byte, size)}
+	for range 40 {
+		off := uint64(r.Intn(size - 20000))
+		length := uint64(r.Intn(20000)) + 1
+		op := r.Intn(6)
+		switch op {
+		case 0:
+			require.NoError(t, image.WriteZeroes(off, length, r.Intn(2) == 0))
+		case 1:
+			require.NoError(t, image.Discard(off, length))
+		case 2:
+			require.NoError(t, image.Flush())
+		default:
+			data := make([]byte, length)
+			r.Read(data)
+			_, err := image.WriteAt(data, int64(off))
+			require.NoError(t, err)
+		}
+
+		boundaries = append(boundaries, len(f.ops))
+		flushes = append(flushes, op == 2)
+		snapshots = append(snapshots, readGuest(t, image))
+	}
+	require.NoError(t, image.Close())
+	boundaries = append(boundaries, len(f.ops))
+	flushes = append(flushes, true)
+	snapshots = append(snapshots, snapshots[len(snapshots)-1])
+
+	return f, boundaries, flushes, snapshots
+}
+
+// verifyCrash opens the crashed image, checks it and makes sure every
+// byte holds a value the guest has seen between the last durable guest
+// op and the op the crash happened in
+func verifyCrash(t *testing.T, crashed *faultFile, durable int, current int, snapshots [][]byte) {
+	image, err := gqcow2.NewFileImage(crashed, "crash.qcow2")
+	require.NoError(t, err)
+	if image.Dirty() {
+		require.NoError(t, image.RebuildRefCounts())
+	}
+
+	result, err := image.Check()
+	require.NoError(t, err)
+	require.True(t, result.Consistent(), "%v", result.Problems)
+
+	got := readGuest(t, image)
+	for b := range got {
+		found := false
+		for m := durable; m <= current && !found; m++ {
+			found = got[b] == snapshots[m][b]
+		}
+		if !found {
+			require.Failf(t, "wrong data", "byte %d is %d, guest ops %d to %d", b, got[b], durable, current)
+		}
+	}
+}
+
+// guestOps returns the guest op the file op n belongs to, the last
+// guest op finished before file op n and the last flush finished before
+func guestOps(boundaries []int, flushes []bool, n int) (int, int, int) {
+	finished, flushed := 0, 0
+	for m, boundary := range boundaries {
+		if boundary <= n {
+			finished = m
+			if flushes[m] {
+				flushed = m
+			}
+		}
+	}
+	return min(finished+1, len(boundaries)-1), finished, flushed
+}
+
+func Test_CrashConsistency(t *testing.T) {
+	configs := []crashConfig{
+		{name: "write through"},
+		{name: "write back", writeBack: true},
+		{name: "write back with power loss", writeBack: true, dropUnflushed: true},
+		{name: "lazy refcounts", lazy: true},
+		{name: "lazy refcounts with power loss", lazy: true, writeBack: true, dropUnflushed: true},
+	}
+
+	for _, cfg := range configs {
+		for seed := range int64(3) {
+			t.Run(fmt.Sprintf("%s seed %d", cfg.name, seed), func(t *testing.T) {
+				f, boundaries, flushes, snapshots := crashWorkload(t, cfg, seed)
+				r := rand.New(rand.NewSource(seed))
+
+				for n := 0; n <= len(f.ops); n++ {
+					current, finished, flushed := guestOps(boundaries, flushes, n)
+					if !cfg.dropUnflushed {
+						// without write back every finished guest op reached the disk
+						durable := flushed
+						if !cfg.writeBack {
+							durable = finished
+						}
+						verifyCrash(t, f.replay(n, func(int) bool { return true }), durable, current, snapshots)
+						continue
+					}
+
+					// only the guest ops before the last flush are durable
+					crashed := f.replay(n, func(int) bool { return r.Intn(2) == 0 })
+					verifyCrash(t, crashed, flushed, current, snapshots)
+				}
+
+				// nothing is lost after the image is closed
+				final := f.replay(len(f.ops), func(int) bool { return true })
+				image, err := gqcow2.NewFileImage(final, "crash.qcow2")
+				require.NoError(t, err)
+				assert.False(t, image.Dirty())
+				assert.Equal(t, snapshots[len(snapshots)-1], readGuest(t, image))
+			})
+		}
+	}
+}
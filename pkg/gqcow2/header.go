@@ -134,8 +134,9 @@ type Header struct {
 	// cluster size is 1 << cluster bites
 	ClusterBits uint32
 	// virtual disk size in bytes
-	Size        uint64
-	CryptMethod bool // 0 for no encryption, 1 for AES, 2 for LUKS
+	Size uint64
+	// 0 for no encryption, 1 for AES, 2 for LUKS
+	CryptMethod uint32
 
 	L1Size        uint32
 	L1TableOffset uint64
@@ -147,12 +148,44 @@ type Header struct {
 	SnapshotOffset uint64
 
 	// these fields only meaningful for v3
-	// ... other ignored fields...
+	IncompatibleFeatures uint64
+	CompatibleFeatures   uint64
+	AutoclearFeatures    uint64
+
 	RefCountOrder uint32
 	// 4bytes, 100 - 103
 	Length uint32
+	// byte 104, only present if Length > 104
+	// 0 for zlib, 1 for zstd
+	CompressionType uint8
 }
 
+// bits of the incompatible_features field
+const (
+	IncompatibleDirty        uint64 = 1 << 0
+	IncompatibleCorrupt      uint64 = 1 << 1
+	IncompatibleExternalData uint64 = 1 << 2
+	IncompatibleCompression  uint64 = 1 << 3
+	IncompatibleExtendedL2   uint64 = 1 << 4
+)
+
+// bits of the compatible_features field
+const (
+	CompatibleLazyRefCounts uint64 = 1 << 0
+)
+
+// values of the crypt_method field
+const (
+	CryptNone uint32 = 0
+	CryptAES  uint32 = 1
+	CryptLUKS uint32 = 2
+)
+
+// bits of the autoclear_features field
+const (
+	AutoclearBitmaps uint64 = 1 << 0
+)
+
 // ClusetrSize is in bytes
 func (h *Header) ClusterSize() int {
 	return 1 << h.ClusterBits
@@ -198,13 +231,16 @@ func ParseHeader(r FileHandler) (*Header, error) {
 		BackingFileSize:       binary.BigEndian.Uint32(hdr[16:20]),
 		ClusterBits:           binary.BigEndian.Uint32(hdr[20:24]),
 		Size:                  binary.BigEndian.Uint64(hdr[24:32]),
-		CryptMethod:           binary.BigEndian.Uint32(hdr[32:36]) == 1,
+		CryptMethod:           binary.BigEndian.Uint32(hdr[32:36]),
 		L1Size:                binary.BigEndian.Uint32(hdr[36:40]),
 		L1TableOffset:         binary.BigEndian.Uint64(hdr[40:48]),
 		RefCountTableOffset:   binary.BigEndian.Uint64(hdr[48:56]),
 		RefcountTableClusters: binary.BigEndian.Uint32(hdr[56:60]),
 		NumSnapshots:          binary.BigEndian.Uint32(hdr[60:64]),
 		SnapshotOffset:        binary.BigEndian.Uint64(hdr[64:72]),
+		IncompatibleFeatures:  binary.BigEndian.Uint64(hdr[72:80]),
+		CompatibleFeatures:    binary.BigEndian.Uint64(hdr[80:88]),
+		AutoclearFeatures:     binary.BigEndian.Uint64(hdr[88:96]),
 		RefCountOrder:         binary.BigEndian.Uint32(hdr[96:100]),
 		Length:                binary.BigEndian.Uint32(hdr[100:104]),
 	}
@@ -212,6 +248,21 @@ func ParseHeader(r FileHandler) (*Header, error) {
 	if h.Version != 2 && h.Version != 3 {
 		return nil, errors.New("invalid version")
 	}
+	// bytes after 72 belong to the header extensions in v2
+	if h.Version == 2 {
+		h.IncompatibleFeatures = 0
+		h.CompatibleFeatures = 0
+		h.AutoclearFeatures = 0
+		h.RefCountOrder = 4
+		h.Length = 72
+	}
+	if h.Length > 104 {
+		ct, err := readAt(r, 104, 1)
+		if err != nil {
+			return nil, err
+		}
+		h.CompressionType = ct[0]
+	}
 	// 1 << 9 == 512, which is the smallest cluster size
 	if h.ClusterBits < 9 {
 		return nil, errors.New("invalid cluster size")
@@ -220,6 +271,45 @@ func ParseHeader(r FileHandler) (*Header, error) {
 	return h, nil
 }
 
+// Bytes serializes the header into its on-disk format, the
+// length is 72 for v2 and header_length for v3.
+func (h *Header) Bytes() []byte {
+	length := h.Length
+	if h.Version == 2 || length < 104 {
+		length = 104
+	}
+	buf := make([]byte, length)
+
+	copy(buf[0:4], QCOW2MagicNumber)
+	binary.BigEndian.PutUint32(buf[4:8], h.Version)
+	binary.BigEndian.PutUint64(buf[8:16], h.BackingFileOffset)
+	binary.BigEndian.PutUint32(buf[16:20], h.BackingFileSize)
+	binary.BigEndian.PutUint32(buf[20:24], h.ClusterBits)
+	binary.BigEndian.PutUint64(buf[24:32], h.Size)
+	binary.BigEndian.PutUint32(buf[32:36], h.CryptMethod)
+	binary.BigEndian.PutUint32(buf[36:40], h.L1Size)
+	binary.BigEndian.PutUint64(buf[40:48], h.L1TableOffset)
+	binary.BigEndian.PutUint64(buf[48:56], h.RefCountTableOffset)
+	binary.BigEndian.PutUint32(buf[56:60], h.RefcountTableClusters)
+	binary.BigEndian.PutUint32(buf[60:64], h.NumSnapshots)
+	binary.BigEndian.PutUint64(buf[64:72], h.SnapshotOffset)
+
+	if h.Version == 2 {
+		return buf[:72]
+	}
+
+	binary.BigEndian.PutUint64(buf[72:80], h.IncompatibleFeatures)
+	binary.BigEndian.PutUint64(buf[80:88], h.CompatibleFeatures)
+	binary.BigEndian.PutUint64(buf[88:96], h.AutoclearFeatures)
+	binary.BigEndian.PutUint32(buf[96:100], h.RefCountOrder)
+	binary.BigEndian.PutUint32(buf[100:104], length)
+	if length > 104 {
+		buf[104] = h.CompressionType
+	}
+
+	return buf
+}
+
 func (i *Image) LoadHeader() error {
 	var err error
 	if i.Header, err = ParseHeader(i.Handler); err != nil {
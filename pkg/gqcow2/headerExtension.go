@@ -0,0 +1,184 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Directly after the image header, optional sections called header extensions
+// can be stored. Each extension has a structure like the following:
+//
+//Byte  0 -  3:   Header extension type:
+//                    0x00000000 - End of the header extension area
+//                    0xe2792aca - Backing file format name string
+//                    0x6803f857 - Feature name table
+//                    0x23852875 - Bitmaps extension
+//                    0x0537be77 - Full disk encryption header pointer
+//                    0x44415441 - External data file name string
+//                    other      - Unknown header extension, can be safely
+//                                 ignored
+//
+//      4 -  7:   Length of the header extension data
+//
+//      8 -  n:   Header extension data
+//
+//      n -  m:   Padding to round up the header extension size to the next
+//                multiple of 8.
+
+const (
+	ExtensionEnd              uint32 = 0x00000000
+	ExtensionBackingFormat    uint32 = 0xe2792aca
+	ExtensionFeatureNameTable uint32 = 0x6803f857
+	ExtensionBitmaps          uint32 = 0x23852875
+	ExtensionEncryption       uint32 = 0x0537be77
+	ExtensionExternalDataFile uint32 = 0x44415441
+)
+
+type HeaderExtension struct {
+	Type uint32
+	Data []byte
+}
+
+// LoadHeaderExtensions reads the extensions between the header and
+// the end of the first cluster, and the backing file name if any.
+func (i *Image) LoadHeaderExtensions() error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	offset := uint64(i.Header.Length)
+
+	i.Extensions = make([]HeaderExtension, 0)
+	for offset+8 <= clusterSize {
+		raw, err := readAt(i.Handler, int64(offset), 8)
+		if err != nil {
+			return err
+		}
+		extType := binary.BigEndian.Uint32(raw[0:4])
+		extLength := uint64(binary.BigEndian.Uint32(raw[4:8]))
+		if extType == ExtensionEnd {
+			break
+		}
+		if offset+8+extLength > clusterSize {
+			return fmt.Errorf("corrupted header extension 0x%08x, length %d", extType, extLength)
+		}
+
+		data, err := readAt(i.Handler, int64(offset+8), int64(extLength))
+		if err != nil {
+			return err
+		}
+
+		if extType == ExtensionBackingFormat {
+			i.BackingFormat = string(data)
+		} else {
+			i.Extensions = append(i.Extensions, HeaderExtension{Type: extType, Data: data})
+		}
+
+		offset = offset + 8 + alignUp(extLength, 8)
+	}
+
+	if i.Header.BackingFileOffset != 0 {
+		if i.Header.BackingFileSize > 1023 {
+			return errors.New("backing file name is longer than 1023 bytes")
+		}
+		name, err := readAt(i.Handler, int64(i.Header.BackingFileOffset), int64(i.Header.BackingFileSize))
+		if err != nil {
+			return err
+		}
+		i.BackingFile = string(name)
+	}
+
+	return nil
+}
+
+// Extension returns the first header extension of the given type
+func (i *Image) Extension(extType uint32) *HeaderExtension {
+	for index := range i.Extensions {
+		if i.Extensions[index].Type == extType {
+			return &i.Extensions[index]
+		}
+	}
+	return nil
+}
+
+// SetExtension replaces the extension of the same type, or adds it.
+// nil data removes the extension.
+func (i *Image) SetExtension(extType uint32, data []byte) {
+	for index := range i.Extensions {
+		if i.Extensions[index].Type == extType {
+			if data == nil {
+				i.Extensions = append(i.Extensions[:index], i.Extensions[index+1:]...)
+			} else {
+				i.Extensions[index].Data = data
+			}
+			return
+		}
+	}
+	if data != nil {
+		i.Extensions = append(i.Extensions, HeaderExtension{Type: extType, Data: data})
+	}
+}
+
+// WriteHeader writes the header, its extensions and the backing
+// file name into the first cluster of the image.
+func (i *Image) WriteHeader() error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	// everything the header refers to goes first
+	if i.WriteBack {
+		if err := i.flushMetadata(); err != nil {
+			return err
+		}
+	}
+
+	buf, err := i.headerCluster()
+	if err != nil {
+		return err
+	}
+	_, err = i.writer().WriteAt(buf, 0)
+	return err
+}
+
+// headerCluster serializes the header, its extensions and the
+// backing file name into the first cluster
+func (i *Image) headerCluster() ([]byte, error) {
+	clusterSize := i.Header.ClusterSize()
+	exts := make([]HeaderExtension, 0, len(i.Extensions)+1)
+	if i.BackingFormat != "" {
+		exts = append(exts, HeaderExtension{Type: ExtensionBackingFormat, Data: []byte(i.BackingFormat)})
+	}
+	exts = append(exts, i.Extensions...)
+
+	// header length is fixed by version, compute where the extensions start
+	offset := uint64(len(i.Header.Bytes()))
+	extBuf := make([]byte, 0)
+	for _, ext := range exts {
+		entry := make([]byte, 8+alignUp(uint64(len(ext.Data)), 8))
+		binary.BigEndian.PutUint32(entry[0:4], ext.Type)
+		binary.BigEndian.PutUint32(entry[4:8], uint32(len(ext.Data)))
+		copy(entry[8:], ext.Data)
+		extBuf = append(extBuf, entry...)
+	}
+	// end of the header extension area
+	extBuf = append(extBuf, make([]byte, 8)...)
+
+	if len(i.BackingFile) > 1023 {
+		return nil, errors.New("backing file name is longer than 1023 bytes")
+	}
+	if i.BackingFile != "" {
+		i.Header.BackingFileOffset = offset + uint64(len(extBuf))
+		i.Header.BackingFileSize = uint32(len(i.BackingFile))
+	} else {
+		i.Header.BackingFileOffset = 0
+		i.Header.BackingFileSize = 0
+	}
+
+	buf := make([]byte, clusterSize)
+	hdr := i.Header.Bytes()
+	if len(hdr)+len(extBuf)+len(i.BackingFile) > clusterSize {
+		return nil, errors.New("header and its extensions exceed the first cluster")
+	}
+	copy(buf, hdr)
+	copy(buf[len(hdr):], extBuf)
+	copy(buf[len(hdr)+len(extBuf):], i.BackingFile)
+	return buf, nil
+}
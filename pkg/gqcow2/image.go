@@ -1,10 +1,13 @@
 package gqcow2
 
 import (
+	"errors"
 	"fmt"
 	"io"
 )
 
+var ErrReadOnly = errors.New("image is opened read only")
+
 // FileHandler handles the read/write operation against
 // the image resource. No matter its local/remote
 // fs file, http served file, or other file system.
@@ -37,11 +40,40 @@ type Image struct {
 	Header        *Header
 	RefCountTable []RefCountTableEntry
 	L1Table       []L1Entry
+
+	// header extensions except the backing format
+	Extensions    []HeaderExtension
+	BackingFile   string
+	BackingFormat string
+
+	// guest view of the backing file, nil if not opened
+	Backing BackingDisk
+
+	// punch holes into the image file for freed clusters
+	PunchHoles bool
+
+	// keep modified l2 tables and refcount blocks in memory until
+	// Flush or Close, instead of writing every update through
+	WriteBack bool
+
+	// cached l2 tables and refcount blocks, keyed by image offset
+	l2Cache       *tableCache
+	refCountCache *tableCache
+	// clusters below this index are known to be in use
+	freeClusterIndex     uint64
+	growingRefCountTable bool
+	// the image was dirty when it was opened
+	staleRefCounts bool
 }
 
 func NewFileImage(f FileHandler, name string) (*Image, error) {
 	var err error
-	image := &Image{Name: name, Handler: f}
+	image := &Image{
+		Name:          name,
+		Handler:       f,
+		l2Cache:       newTableCache(),
+		refCountCache: newTableCache(),
+	}
 
 	if _, ok := f.(io.WriterAt); ok {
 		image.RWMode = true
@@ -54,6 +86,11 @@ func NewFileImage(f FileHandler, name string) (*Image, error) {
 		return nil, err
 	}
 
+	if err = image.LoadHeaderExtensions(); err != nil {
+		return nil, err
+	}
+	image.staleRefCounts = image.Dirty()
+
 	if err = image.LoadRefcountTable(); err != nil {
 		return nil, err
 	}
@@ -65,6 +102,15 @@ func NewFileImage(f FileHandler, name string) (*Image, error) {
 	return image, nil
 }
 
+// VirtualSize is the size of the guest disk in bytes
+func (i *Image) VirtualSize() uint64 {
+	return i.Header.Size
+}
+
+func (i *Image) writer() io.WriterAt {
+	return i.Handler.(io.WriterAt)
+}
+
 func (i *Image) String() string {
 	return fmt.Sprintf(`image:%s
     format:qcow2
@@ -0,0 +1,155 @@
+package gqcow2
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AmendOptions changes the options of an existing image, nil
+// or zero fields keep the current setting.
+type AmendOptions struct {
+	// 2 or 3
+	Version uint32
+	// refcount bits = 1 << RefCountOrder, v3 only
+	RefCountOrder *uint32
+	// v3 only
+	LazyRefCounts *bool
+	// an empty string clears the backing format
+	BackingFormat *string
+}
+
+// Amend changes the image options in place like qemu-img amend.
+//
+// Changing the refcount order rebuilds the refcount structures at the
+// end of the image. Downgrading to v2 is refused if v3 only features
+// are in use, zero clusters are turned into unallocated or zero
+// filled clusters.
+func (i *Image) Amend(opts AmendOptions) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if i.staleRefCounts || i.Header.IncompatibleFeatures&IncompatibleCorrupt != 0 {
+		return errors.New("the image must be repaired before it is amended")
+	}
+	if opts.Version != 0 && opts.Version != 2 && opts.Version != 3 {
+		return fmt.Errorf("invalid version %d", opts.Version)
+	}
+
+	version := i.Header.Version
+	if opts.Version != 0 {
+		version = opts.Version
+	}
+	if version == 2 {
+		if opts.RefCountOrder != nil && *opts.RefCountOrder != 4 {
+			return errors.New("v2 images only support 16 refcount bits")
+		}
+		if opts.LazyRefCounts != nil && *opts.LazyRefCounts {
+			return errors.New("lazy refcounts require v3")
+		}
+	}
+	if opts.RefCountOrder != nil && *opts.RefCountOrder > 6 {
+		return errors.New("refcount order must not exceed 6")
+	}
+	if opts.BackingFormat != nil && *opts.BackingFormat != "" && i.BackingFile == "" {
+		return errors.New("the image has no backing file")
+	}
+
+	// amend works on consistent refcounts
+	if err := i.MarkClean(); err != nil {
+		return err
+	}
+
+	if version == 3 && i.Header.Version == 2 {
+		i.upgrade()
+	}
+
+	if opts.RefCountOrder != nil && *opts.RefCountOrder != i.Header.RefCountOrder {
+		counts, err := i.clusterRefCounts()
+		if err != nil {
+			return err
+		}
+		if err := i.rewriteRefCounts(counts, *opts.RefCountOrder); err != nil {
+			return err
+		}
+	}
+
+	if opts.LazyRefCounts != nil {
+		if *opts.LazyRefCounts {
+			i.Header.CompatibleFeatures |= CompatibleLazyRefCounts
+		} else {
+			i.Header.CompatibleFeatures &^= CompatibleLazyRefCounts
+		}
+	}
+
+	if opts.BackingFormat != nil {
+		i.BackingFormat = *opts.BackingFormat
+	}
+
+	if version == 2 && i.Header.Version == 3 {
+		if err := i.downgrade(); err != nil {
+			return err
+		}
+	}
+
+	return i.WriteHeader()
+}
+
+// upgrade turns the in-memory v2 header into a v3 one
+func (i *Image) upgrade() {
+	i.Header.Version = 3
+	i.Header.Length = 104
+	i.Header.RefCountOrder = 4
+	i.Header.IncompatibleFeatures = 0
+	i.Header.CompatibleFeatures = 0
+	i.Header.AutoclearFeatures = 0
+}
+
+// downgrade turns the image into v2, refused if v3 only features are in use
+func (i *Image) downgrade() error {
+	switch {
+	case i.Header.IncompatibleFeatures != 0:
+		return fmt.Errorf("incompatible features 0x%x require v3", i.Header.IncompatibleFeatures)
+	case i.Header.RefCountOrder != 4:
+		return errors.New("v2 images only support 16 refcount bits")
+	case i.Extension(ExtensionBitmaps) != nil:
+		return errors.New("bitmaps require v3")
+	case i.Extension(ExtensionExternalDataFile) != nil:
+		return errors.New("external data files require v3")
+	case i.Header.NumSnapshots != 0:
+		return errors.New("images with snapshots cannot be downgraded")
+	}
+
+	// v2 has no zero flag, from now on the zero clusters are written
+	// as v2 does, either unallocated or filled with zeros
+	i.Header.Version = 2
+	i.Header.Length = 72
+	i.Header.CompatibleFeatures = 0
+	i.Header.AutoclearFeatures = 0
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	entriesPerTable := uint64(i.Header.L2EntryPerTable())
+	for l1Index, l1Entry := range i.L1Table {
+		if l1Entry.L2TableOffset == 0 {
+			continue
+		}
+		table, err := i.ExtractL2Table(l1Entry.L2TableOffset)
+		if err != nil {
+			return err
+		}
+
+		for l2Index, entry := range table {
+			vdOffset := (uint64(l1Index)*entriesPerTable + uint64(l2Index)) * clusterSize
+			if vdOffset >= i.Header.Size {
+				break
+			}
+			if entry.Standard == nil || !entry.Standard.AllZero {
+				continue
+			}
+			if err := i.zeroCluster(vdOffset, false, true); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageAmend(t *testing.T) {
+	t.Run("Upgrade v2 to v3 and turn on lazy refcounts",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "v2.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20, Version: 2},
+				[]gqcow2.Extent{{Start: 0, Length: 300000}})
+
+			lazy := true
+			require.NoError(t, image.Amend(gqcow2.AmendOptions{Version: 3, LazyRefCounts: &lazy}))
+
+			reopened, err := gqcow2.OpenImage(path, true)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(3), reopened.Header.Version)
+			assert.Equal(t, uint32(104), reopened.Header.Length)
+			assert.Equal(t, uint32(4), reopened.Header.RefCountOrder)
+			assert.Equal(t, gqcow2.CompatibleLazyRefCounts, reopened.Header.CompatibleFeatures)
+			assert.Equal(t, content, readGuest(t, reopened))
+		})
+
+	t.Run("Change the refcount width",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "refcount.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 4 << 20, ClusterBits: 12},
+				[]gqcow2.Extent{{Start: 0, Length: 4 << 20}})
+
+			for _, order := range []uint32{0, 6, 3} {
+				require.NoError(t, image.Amend(gqcow2.AmendOptions{RefCountOrder: &order}))
+
+				reopened, err := gqcow2.OpenImage(path, true)
+				require.NoError(t, err)
+				assert.Equal(t, order, reopened.Header.RefCountOrder)
+				assert.Equal(t, content, readGuest(t, reopened))
+
+				// the new refcounts still account every cluster
+				for _, offset := range []uint64{0, reopened.Header.L1TableOffset, reopened.Header.RefCountTableOffset} {
+					refcount, err := reopened.ReadRefCount(offset)
+					require.NoError(t, err)
+					assert.Equal(t, 1, refcount)
+				}
+
+				_, err = reopened.WriteAt(bytes.Repeat([]byte{5}, 10000), 1<<20)
+				require.NoError(t, err)
+				copy(content[1<<20:], bytes.Repeat([]byte{5}, 10000))
+				assert.Equal(t, content, readGuest(t, reopened))
+				image = reopened
+			}
+		})
+
+	t.Run("Downgrade v3 to v2 expands zero clusters",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			base := bytes.Repeat([]byte{1}, 1<<20)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644))
+
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 1<<20, "base.raw", "raw")
+			_, err := overlay.WriteAt(bytes.Repeat([]byte{2}, 65536), 65536)
+			require.NoError(t, err)
+			require.NoError(t, overlay.WriteZeroes(0, 3*65536, true))
+			want := readGuest(t, overlay)
+
+			format := ""
+			require.NoError(t, overlay.Amend(gqcow2.AmendOptions{Version: 2, BackingFormat: &format}))
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "overlay.qcow2"), false)
+			require.NoError(t, err)
+			assert.Equal(t, uint32(2), reopened.Header.Version)
+			assert.Empty(t, reopened.BackingFormat)
+			assert.Equal(t, want, readGuest(t, reopened))
+			for _, offset := range []uint64{0, 65536, 2 * 65536} {
+				entry, err := reopened.FindL2Entry(offset)
+				require.NoError(t, err)
+				assert.False(t, entry.Standard.AllZero)
+				assert.True(t, entry.Allocated())
+			}
+		})
+
+	t.Run("Downgrade is refused for v3 only features",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "v3.qcow2")
+			image, _ := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20, RefCountOrder: 5}, nil)
+
+			assert.Error(t, image.Amend(gqcow2.AmendOptions{Version: 2}))
+
+			order := uint32(4)
+			require.NoError(t, image.Amend(gqcow2.AmendOptions{Version: 2, RefCountOrder: &order}))
+			assert.Equal(t, uint32(2), image.Header.Version)
+		})
+}
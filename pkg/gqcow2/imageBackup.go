@@ -0,0 +1,128 @@
+package gqcow2
+
+import (
+	"io"
+)
+
+// copyChunkSize bounds the buffer used when copying guest data
+const copyChunkSize = 4 << 20
+
+// ExportDirty copies the guest data covered by the dirty bits of the
+// named bitmap into target at the same offsets, everything else of
+// target is left untouched. With a sparse raw file as target this is
+// a raw delta, the returned extents tell which parts it holds.
+func ExportDirty(image *Image, bitmapName string, target DiskHandler) ([]Extent, error) {
+	extents, err := image.DirtyExtents(bitmapName)
+	if err != nil {
+		return nil, err
+	}
+
+	cm, err := image.DumpToClusterMap()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, region := range intersectRegions(cm.Regions, extents) {
+		// zero clusters, or unallocated ones without anything beneath
+		if region.Zero && (region.Present || image.Backing == nil) {
+			if err := writeZeros(target, region.Start, region.Length); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if err := copyRange(image, target, region.Start, region.Length); err != nil {
+			return nil, err
+		}
+	}
+
+	return extents, nil
+}
+
+// ExportDirtyToOverlay creates a qcow2 overlay on top of the previous
+// backup in f, which holds only the dirty clusters of the named bitmap.
+func ExportDirtyToOverlay(image *Image, bitmapName string, f DiskHandler, name string,
+	previous string, previousFormat string) (*Image, []Extent, error) {
+	overlay, err := Create(f, name, CreateOptions{
+		Size:          image.Header.Size,
+		ClusterBits:   image.Header.ClusterBits,
+		BackingFile:   previous,
+		BackingFormat: previousFormat,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	extents, err := ExportDirty(image, bitmapName, overlay)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return overlay, extents, nil
+}
+
+// intersectRegions cuts the regions down to the parts covered by the
+// extents, both must be sorted by start.
+func intersectRegions(regions []VirtualDiskRegion, extents []Extent) []VirtualDiskRegion {
+	result := make([]VirtualDiskRegion, 0)
+
+	ri, ei := 0, 0
+	for ri < len(regions) && ei < len(extents) {
+		region := regions[ri]
+		extent := extents[ei]
+		regionEnd := region.Start + region.Length
+
+		start := max(region.Start, extent.Start)
+		end := min(regionEnd, extent.End())
+		if start < end {
+			part := region
+			part.Start = start
+			part.Length = end - start
+			if part.Offset != 0 {
+				part.Offset = region.Offset + (start - region.Start)
+			}
+			result = append(result, part)
+		}
+
+		if regionEnd <= extent.End() {
+			ri++
+		} else {
+			ei++
+		}
+	}
+
+	return result
+}
+
+// copyRange copies length bytes at start from src to dst
+func copyRange(src io.ReaderAt, dst io.WriterAt, start uint64, length uint64) error {
+	buf := make([]byte, min(length, copyChunkSize))
+	for done := uint64(0); done < length; {
+		chunk := buf[:min(length-done, uint64(len(buf)))]
+		if _, err := src.ReadAt(chunk, int64(start+done)); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := dst.WriteAt(chunk, int64(start+done)); err != nil {
+			return err
+		}
+		done += uint64(len(chunk))
+	}
+	return nil
+}
+
+// writeZeros fills length bytes at start of dst with zeros
+func writeZeros(dst io.WriterAt, start uint64, length uint64) error {
+	if zw, ok := dst.(ZeroWriter); ok {
+		return zw.WriteZeroes(start, length, false)
+	}
+
+	buf := make([]byte, min(length, copyChunkSize))
+	for done := uint64(0); done < length; {
+		chunk := buf[:min(length-done, uint64(len(buf)))]
+		if _, err := dst.WriteAt(chunk, int64(start+done)); err != nil {
+			return err
+		}
+		done += uint64(len(chunk))
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createTestImage creates a qcow2 file filled with random data in the
+// given extents, and returns the expected guest content.
+func createTestImage(t *testing.T, path string, opts gqcow2.CreateOptions, extents []gqcow2.Extent) (*gqcow2.Image, []byte) {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	image, err := gqcow2.Create(f, path, opts)
+	require.NoError(t, err)
+
+	content := make([]byte, opts.Size)
+	r := rand.New(rand.NewSource(int64(len(extents))))
+	for _, e := range extents {
+		r.Read(content[e.Start:e.End()])
+		_, err := image.WriteAt(content[e.Start:e.End()], int64(e.Start))
+		require.NoError(t, err)
+	}
+
+	return image, content
+}
+
+func readGuest(t *testing.T, image *gqcow2.Image) []byte {
+	content := make([]byte, image.VirtualSize())
+	_, err := image.ReadAt(content, 0)
+	require.NoError(t, err)
+	return content
+}
+
+func Test_ExportDirty(t *testing.T) {
+	dir := t.TempDir()
+	size := uint64(4 << 20)
+	image, _ := createTestImage(t, filepath.Join(dir, "disk.qcow2"),
+		gqcow2.CreateOptions{Size: size},
+		[]gqcow2.Extent{{Start: 0, Length: 1 << 20}, {Start: 3 << 20, Length: 4096}})
+
+	// the full backup taken last night
+	full := readGuest(t, image)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "full.raw"), full, 0o644))
+
+	// guest writes since then
+	changed := bytes.Repeat([]byte{0xab}, 100000)
+	_, err := image.WriteAt(changed, 70000)
+	require.NoError(t, err)
+	_, err = image.WriteAt(make([]byte, 4096), 3<<20)
+	require.NoError(t, err)
+
+	bitmap := gqcow2.NewBitmap("nightly", 16, size)
+	bitmap.SetDirty(gqcow2.Extent{Start: 70000, Length: 100000})
+	bitmap.SetDirty(gqcow2.Extent{Start: 3 << 20, Length: 4096})
+	require.NoError(t, image.StoreBitmap(bitmap))
+	current := readGuest(t, image)
+
+	t.Run("Export dirty clusters as a raw delta",
+		func(t *testing.T) {
+			delta, err := os.Create(filepath.Join(dir, "delta.raw"))
+			require.NoError(t, err)
+			defer delta.Close()
+
+			extents, err := gqcow2.ExportDirty(image, "nightly", delta)
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.Extent{
+				{Start: 65536, Length: 131072},
+				{Start: 3 << 20, Length: 65536},
+			}, extents)
+
+			// applying the delta onto the full backup gives the current disk
+			restored := append([]byte(nil), full...)
+			for _, e := range extents {
+				_, err := delta.ReadAt(restored[e.Start:e.End()], int64(e.Start))
+				require.NoError(t, err)
+			}
+			assert.Equal(t, current, restored)
+		})
+
+	t.Run("Export dirty clusters as an overlay of the full backup",
+		func(t *testing.T) {
+			path := filepath.Join(dir, "incremental.qcow2")
+			f, err := os.Create(path)
+			require.NoError(t, err)
+			defer f.Close()
+
+			_, _, err = gqcow2.ExportDirtyToOverlay(image, "nightly", f, path, "full.raw", "raw")
+			require.NoError(t, err)
+
+			overlay, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			assert.Equal(t, "full.raw", overlay.BackingFile)
+			assert.Equal(t, current, readGuest(t, overlay))
+
+			// only the dirty clusters are allocated in the overlay
+			regions := overlay.Dump()
+			allocated := uint64(0)
+			for _, region := range regions {
+				if region.Present {
+					allocated += region.Length
+				}
+			}
+			assert.Equal(t, uint64(3*65536), allocated)
+		})
+
+	t.Run("Refuse bitmap in use",
+		func(t *testing.T) {
+			bitmap.Name = "busy"
+			bitmap.Flags = gqcow2.BitmapInUse
+			require.NoError(t, image.StoreBitmap(bitmap))
+
+			_, err := gqcow2.ExportDirty(image, "busy", &bytesDisk{})
+			assert.Error(t, err)
+		})
+
+	t.Run("Refuse bitmap stored before a guest write",
+		func(t *testing.T) {
+			_, err := image.WriteAt([]byte{0xcd}, 2<<20)
+			require.NoError(t, err)
+			fresh := gqcow2.NewBitmap("fresh", 16, size)
+			fresh.SetDirty(gqcow2.Extent{Start: 2 << 20, Length: 1})
+			require.NoError(t, image.StoreBitmap(fresh))
+
+			_, err = gqcow2.ExportDirty(image, "nightly", &bytesDisk{})
+			assert.Error(t, err)
+			extents, err := gqcow2.ExportDirty(image, "fresh", &bytesDisk{})
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.Extent{{Start: 2 << 20, Length: 65536}}, extents)
+		})
+}
+
+// bytesDisk is an in memory DiskHandler
+type bytesDisk struct {
+	buf []byte
+}
+
+func (d *bytesDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(d.buf)) {
+		clear(p)
+		return len(p), nil
+	}
+	n := copy(p, d.buf[off:])
+	clear(p[n:])
+	return len(p), nil
+}
+
+func (d *bytesDisk) WriteAt(p []byte, off int64) (int, error) {
+	if end := int(off) + len(p); end > len(d.buf) {
+		d.buf = append(d.buf, make([]byte, end-len(d.buf))...)
+	}
+	return copy(d.buf[off:], p), nil
+}
@@ -0,0 +1,129 @@
+package gqcow2
+
+import (
+	"fmt"
+)
+
+// CheckResult follows the json output of qemu-img check
+type CheckResult struct {
+	Filename string `json:"filename"`
+	Format   string `json:"format"`
+
+	// referenced clusters whose refcount is too small, or whose
+	// copied flag doesn't match the refcount
+	Corruptions int `json:"corruptions"`
+	// clusters whose refcount is larger than their references
+	Leaks       int `json:"leaks"`
+	CheckErrors int `json:"check-errors"`
+
+	ImageEndOffset     uint64 `json:"image-end-offset"`
+	TotalClusters      uint64 `json:"total-clusters"`
+	AllocatedClusters  uint64 `json:"allocated-clusters"`
+	FragmentedClusters uint64 `json:"fragmented-clusters"`
+	CompressedClusters uint64 `json:"compressed-clusters"`
+
+	// one line for each problem found
+	Problems []string `json:"-"`
+}
+
+// Consistent tells if nothing but leaked clusters has been found
+func (r *CheckResult) Consistent() bool {
+	return r.Corruptions == 0 && r.CheckErrors == 0
+}
+
+func (r *CheckResult) corruption(format string, args ...any) {
+	r.Corruptions++
+	r.Problems = append(r.Problems, "ERROR "+fmt.Sprintf(format, args...))
+}
+
+// Check compares the refcounts with the references of the image
+// metadata like qemu-img check, nothing is repaired.
+func (i *Image) Check() (*CheckResult, error) {
+	clusterSize := uint64(i.Header.ClusterSize())
+	result := &CheckResult{
+		Filename:      i.Name,
+		Format:        "qcow2",
+		TotalClusters: divRoundUp(i.Header.Size, clusterSize),
+	}
+
+	counts, err := i.computeRefCounts()
+	if err != nil {
+		return nil, err
+	}
+
+	refcounts := make([]uint64, len(counts))
+	for clusterIndex := range counts {
+		if refcounts[clusterIndex], err = i.getRefCount(uint64(clusterIndex)); err != nil {
+			return nil, err
+		}
+		want := counts[clusterIndex]
+		if refcounts[clusterIndex] < want {
+			result.corruption("cluster %d refcount=%d reference=%d", clusterIndex, refcounts[clusterIndex], want)
+		} else if refcounts[clusterIndex] > want {
+			result.Leaks++
+			result.Problems = append(result.Problems, fmt.Sprintf("Leaked cluster %d refcount=%d reference=%d",
+				clusterIndex, refcounts[clusterIndex], want))
+		}
+		if want != 0 {
+			result.ImageEndOffset = (uint64(clusterIndex) + 1) * clusterSize
+		}
+	}
+	// clusters beyond the last reference must be free
+	if last, err := i.lastUsedCluster(); err == nil {
+		for clusterIndex := uint64(len(counts)); clusterIndex <= last; clusterIndex++ {
+			refcount, err := i.getRefCount(clusterIndex)
+			if err != nil {
+				return nil, err
+			}
+			if refcount != 0 {
+				result.Leaks++
+				result.Problems = append(result.Problems, fmt.Sprintf("Leaked cluster %d refcount=%d reference=0",
+					clusterIndex, refcount))
+			}
+		}
+	}
+
+	// the copied flag must be set exactly if the refcount is 1
+	copiedFlag := func(what string, offset uint64, flag bool) {
+		clusterIndex := offset / clusterSize
+		if offset%clusterSize != 0 {
+			result.corruption("%s offset %d is not cluster aligned", what, offset)
+			return
+		}
+		if clusterIndex < uint64(len(refcounts)) && flag != (refcounts[clusterIndex] == 1) {
+			result.corruption("OFLAG_COPIED %s: offset=%d refcount=%d", what, offset, refcounts[clusterIndex])
+		}
+	}
+
+	lastHostOffset := uint64(0)
+	for _, l1Entry := range i.L1Table {
+		if l1Entry.L2TableOffset == 0 {
+			continue
+		}
+		copiedFlag("L2 table", l1Entry.L2TableOffset, l1Entry.RefCountBit)
+
+		table, err := i.ExtractL2Table(l1Entry.L2TableOffset)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range table {
+			if entry.Compressed != nil {
+				result.AllocatedClusters++
+				result.CompressedClusters++
+				continue
+			}
+			if entry.Standard.DataOffset == 0 {
+				continue
+			}
+			copiedFlag("data cluster", entry.Standard.DataOffset, entry.Flag)
+
+			result.AllocatedClusters++
+			if lastHostOffset != 0 && entry.Standard.DataOffset != lastHostOffset+clusterSize {
+				result.FragmentedClusters++
+			}
+			lastHostOffset = entry.Standard.DataOffset
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package gqcow2_test
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "check.qcow2")
+	image, _ := createTestImage(t, path,
+		gqcow2.CreateOptions{Size: 1 << 20},
+		[]gqcow2.Extent{{Start: 0, Length: 3 * 65536}, {Start: 10 * 65536, Length: 65536}})
+
+	result, err := image.Check()
+	require.NoError(t, err)
+	assert.True(t, result.Consistent())
+	assert.Zero(t, result.Leaks)
+	assert.Equal(t, uint64(16), result.TotalClusters)
+	assert.Equal(t, uint64(4), result.AllocatedClusters)
+
+	// drop the refcount of a data cluster and leak a free one
+	entry, err := image.FindL2Entry(0)
+	require.NoError(t, err)
+	dataCluster := entry.Standard.DataOffset / 65536
+	blockOffset := image.RefCountTable[0].RefCountBlockOffset
+	result, err = image.Check()
+	require.NoError(t, err)
+	leaked := result.ImageEndOffset/65536 + 3
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	refcount := make([]byte, 2)
+	_, err = f.WriteAt(refcount, int64(blockOffset+dataCluster*2))
+	require.NoError(t, err)
+	binary.BigEndian.PutUint16(refcount, 1)
+	_, err = f.WriteAt(refcount, int64(blockOffset+leaked*2))
+	require.NoError(t, err)
+
+	reopened, err := gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	result, err = reopened.Check()
+	require.NoError(t, err)
+	assert.False(t, result.Consistent())
+	// the refcount is too small, and the copied flag doesn't match it
+	assert.Equal(t, 2, result.Corruptions)
+	assert.Equal(t, 1, result.Leaks)
+}
+
+// putSnapshotImage writes the image qemu-img leaves after creating a
+// 1MiB image, writing its first two clusters and taking the snapshot
+// "first": the header, the refcount table and block, the l1 table, the
+// l2 table and the two data clusters, then the l1 table of the snapshot
+// and the snapshot table. The l2 table and the data clusters are shared,
+// their refcount is 2 and their copied flags are cleared.
+func putSnapshotImage(t *testing.T, path string) []byte {
+	const clusterSize = 65536
+	file := make([]byte, 9*clusterSize)
+	be := binary.BigEndian
+
+	copy(file, "QFI\xfb")
+	be.PutUint32(file[4:], 3)
+	be.PutUint32(file[20:], 16)
+	be.PutUint64(file[24:], 1<<20)
+	be.PutUint32(file[36:], 1)
+	be.PutUint64(file[40:], 3*clusterSize)
+	be.PutUint64(file[48:], 1*clusterSize)
+	be.PutUint32(file[56:], 1)
+	be.PutUint32(file[60:], 1)
+	be.PutUint64(file[64:], 8*clusterSize)
+	be.PutUint32(file[96:], 4)
+	be.PutUint32(file[100:], 104)
+
+	be.PutUint64(file[1*clusterSize:], 2*clusterSize)
+	for cluster, refcount := range []uint16{1, 1, 1, 1, 2, 2, 2, 1, 1} {
+		be.PutUint16(file[2*clusterSize+cluster*2:], refcount)
+	}
+	for _, l1Offset := range []int{3 * clusterSize, 7 * clusterSize} {
+		be.PutUint64(file[l1Offset:], 4*clusterSize)
+	}
+	be.PutUint64(file[4*clusterSize:], 5*clusterSize)
+	be.PutUint64(file[4*clusterSize+8:], 6*clusterSize)
+
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(content[:2*clusterSize])
+	copy(file[5*clusterSize:], content[:2*clusterSize])
+
+	copy(file[8*clusterSize:], snapshotEntry(7*clusterSize, 1, "1", "first", time.Unix(1700000000, 0), 1<<20))
+	require.NoError(t, os.WriteFile(path, file, 0o644))
+	return content
+}
+
+func Test_CheckSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.qcow2")
+	putSnapshotImage(t, path)
+
+	image, err := gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	defer image.Close()
+	result, err := image.Check()
+	require.NoError(t, err)
+	assert.True(t, result.Consistent(), result.Problems)
+	assert.Zero(t, result.Leaks)
+	assert.Equal(t, uint64(2), result.AllocatedClusters)
+	assert.Equal(t, uint64(9*65536), result.ImageEndOffset)
+
+	t.Run("Find the clusters the snapshot lost",
+		func(t *testing.T) {
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer f.Close()
+			// the refcount of the second data cluster only counts the active l1
+			_, err = f.WriteAt([]byte{0, 1}, 2*65536+6*2)
+			require.NoError(t, err)
+
+			reopened, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			defer reopened.Close()
+			result, err := reopened.Check()
+			require.NoError(t, err)
+			// the refcount is too small, and the copied flag doesn't match it
+			assert.Equal(t, 2, result.Corruptions)
+		})
+}
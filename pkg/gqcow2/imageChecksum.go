@@ -0,0 +1,143 @@
+package gqcow2
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"io"
+	"runtime"
+	"sync"
+)
+
+const (
+	DefaultChecksumAlgorithm = "sha256"
+	DefaultChecksumBlockSize = 64 * 1024
+
+	// the blocks read before their digests are combined
+	checksumWindow = 256
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+type ChecksumOptions struct {
+	// md5, sha1, sha256 or sha512, sha256 by default
+	Algorithm string
+	// the guest content is hashed in blocks of this size, the checksum
+	// depends on it. 64 KiB by default
+	BlockSize uint64
+	// the number of goroutines hashing the blocks, the number of CPUs
+	// by default. The checksum doesn't depend on it
+	Workers int
+}
+
+// Checksum hashes the guest content of the disk independent of the image
+// layout, a raw file and an image of the same content have the same
+// checksum. Every block of the disk is hashed, then the block digests
+// are hashed in order. The blocks in unallocated and zero regions are
+// not read, they all have the digest of a zero block.
+func Checksum(disk BackingDisk, opts ChecksumOptions) ([]byte, error) {
+	if opts.Algorithm == "" {
+		opts.Algorithm = DefaultChecksumAlgorithm
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultChecksumBlockSize
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	newHash, ok := checksumAlgorithms[opts.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown checksum algorithm %q", opts.Algorithm)
+	}
+
+	regions, err := chainRegions(disk, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	size := disk.VirtualSize()
+	blockSize := opts.BlockSize
+	zeroDigest := hashBlock(newHash, make([]byte, blockSize))
+
+	jobs := make(chan func())
+	var wg sync.WaitGroup
+	for range opts.Workers {
+		go func() {
+			for job := range jobs {
+				job()
+				wg.Done()
+			}
+		}()
+	}
+	defer close(jobs)
+
+	result := newHash()
+	blocks := divRoundUp(size, blockSize)
+	buffers := make([][]byte, checksumWindow)
+	digests := make([][]byte, checksumWindow)
+	regionIndex := 0
+	for first := uint64(0); first < blocks; first += checksumWindow {
+		count := min(checksumWindow, blocks-first)
+		for index := range count {
+			start := (first + index) * blockSize
+			length := min(blockSize, size-start)
+
+			for regions[regionIndex].Start+regions[regionIndex].Length <= start {
+				regionIndex++
+			}
+			if length == blockSize && zeroRange(regions[regionIndex:], start, start+length) {
+				digests[index] = zeroDigest
+				continue
+			}
+
+			if buffers[index] == nil {
+				buffers[index] = make([]byte, blockSize)
+			}
+			buf := buffers[index][:length]
+			if _, err := disk.ReadAt(buf, int64(start)); err != nil && err != io.EOF {
+				wg.Wait()
+				return nil, err
+			}
+
+			wg.Add(1)
+			jobs <- func() {
+				digests[index] = hashBlock(newHash, buf)
+			}
+		}
+		wg.Wait()
+
+		for _, digest := range digests[:count] {
+			result.Write(digest)
+		}
+	}
+
+	return result.Sum(nil), nil
+}
+
+func hashBlock(newHash func() hash.Hash, buf []byte) []byte {
+	h := newHash()
+	h.Write(buf)
+	return h.Sum(nil)
+}
+
+// zeroRange tells if the regions from the first one read as zeros
+// between start and end
+func zeroRange(regions []VirtualDiskRegion, start uint64, end uint64) bool {
+	for _, region := range regions {
+		if region.Start >= end {
+			return true
+		}
+		if region.Start+region.Length > start && region.Data {
+			return false
+		}
+	}
+	return true
+}
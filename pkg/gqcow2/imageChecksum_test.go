@@ -0,0 +1,95 @@
+package gqcow2_test
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readCounter counts the bytes read from the file
+type readCounter struct {
+	*os.File
+	read int
+}
+
+func (r *readCounter) ReadAt(p []byte, off int64) (int, error) {
+	r.read += len(p)
+	return r.File.ReadAt(p, off)
+}
+
+func Test_Checksum(t *testing.T) {
+	t.Run("The checksum doesn't depend on the layout",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			size := uint64(1<<20 + 1000)
+			image, content := createTestImage(t, filepath.Join(dir, "disk.qcow2"),
+				gqcow2.CreateOptions{Size: size},
+				[]gqcow2.Extent{{Start: 0, Length: 100000}, {Start: 500000, Length: 65536}, {Start: 1 << 20, Length: 1000}})
+			require.NoError(t, image.WriteZeroes(3*65536, 65536, true))
+
+			// the block digests hashed in order
+			want := sha256.New()
+			for start := uint64(0); start < size; start += gqcow2.DefaultChecksumBlockSize {
+				digest := sha256.Sum256(content[start:min(start+gqcow2.DefaultChecksumBlockSize, size)])
+				want.Write(digest[:])
+			}
+
+			sum, err := gqcow2.Checksum(image, gqcow2.ChecksumOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, want.Sum(nil), sum)
+
+			sum, err = gqcow2.Checksum(image, gqcow2.ChecksumOptions{Workers: 1})
+			require.NoError(t, err)
+			assert.Equal(t, want.Sum(nil), sum)
+
+			f, err := os.Create(filepath.Join(dir, "disk.raw"))
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.Write(content)
+			require.NoError(t, err)
+			sum, err = gqcow2.Checksum(gqcow2.NewRawDisk(f, size), gqcow2.ChecksumOptions{Workers: 3})
+			require.NoError(t, err)
+			assert.Equal(t, want.Sum(nil), sum)
+
+			_, err = image.WriteAt([]byte{content[700000] + 1}, 700000)
+			require.NoError(t, err)
+			sum, err = gqcow2.Checksum(image, gqcow2.ChecksumOptions{})
+			require.NoError(t, err)
+			assert.NotEqual(t, want.Sum(nil), sum)
+		})
+
+	t.Run("Zero regions are not read",
+		func(t *testing.T) {
+			size := uint64(16 << 30)
+			path := filepath.Join(t.TempDir(), "empty.qcow2")
+			f, err := os.Create(path)
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = gqcow2.Create(f, path, gqcow2.CreateOptions{Size: size})
+			require.NoError(t, err)
+			counter := &readCounter{File: f}
+			image, err := gqcow2.NewFileImage(counter, path)
+			require.NoError(t, err)
+			counter.read = 0
+
+			zero := sha256.Sum256(make([]byte, 1<<20))
+			want := sha256.New()
+			for range size >> 20 {
+				want.Write(zero[:])
+			}
+
+			sum, err := gqcow2.Checksum(image, gqcow2.ChecksumOptions{BlockSize: 1 << 20})
+			require.NoError(t, err)
+			assert.Equal(t, want.Sum(nil), sum)
+			assert.Zero(t, counter.read)
+
+			_, err = gqcow2.Checksum(image, gqcow2.ChecksumOptions{Algorithm: "crc32"})
+			assert.Error(t, err)
+		})
+}
@@ -0,0 +1,117 @@
+package gqcow2
+
+import (
+	"errors"
+	"io"
+)
+
+// ProgressFunc reports how many bytes of the total have been processed
+type ProgressFunc func(done uint64, total uint64)
+
+type CommitOptions struct {
+	// keep the overlay as it is, like qemu-img commit -d. By
+	// default the overlay is emptied after the commit.
+	KeepOverlay bool
+
+	Progress ProgressFunc
+}
+
+// Commit copies every allocated cluster of the overlay into its backing
+// file like qemu-img commit. The backing file must be opened writable
+// (e.g. by OpenLocalBackingRW), it grows if it is smaller than the overlay.
+func Commit(overlay *Image, opts CommitOptions) error {
+	if overlay.Backing == nil {
+		return errors.New("the image has no backing file opened")
+	}
+	base, ok := overlay.Backing.(io.WriterAt)
+	if !ok {
+		return errors.New("the backing file is not writable")
+	}
+	if !overlay.RWMode && !opts.KeepOverlay {
+		return ErrReadOnly
+	}
+
+	if overlay.Header.Size > overlay.Backing.VirtualSize() {
+		if err := resizeBacking(overlay.Backing, overlay.Header.Size); err != nil {
+			return err
+		}
+	}
+
+	cm, err := overlay.DumpToClusterMap()
+	if err != nil {
+		return err
+	}
+
+	total := uint64(0)
+	for _, region := range cm.Regions {
+		if region.Present {
+			total += region.Length
+		}
+	}
+
+	done := uint64(0)
+	for _, region := range cm.Regions {
+		if !region.Present {
+			continue
+		}
+
+		for offset := uint64(0); offset < region.Length; offset += copyChunkSize {
+			length := min(copyChunkSize, region.Length-offset)
+			if region.Zero {
+				err = writeZeros(base, region.Start+offset, length)
+			} else {
+				err = copyRange(overlay, base, region.Start+offset, length)
+			}
+			if err != nil {
+				return err
+			}
+
+			done += length
+			if opts.Progress != nil {
+				opts.Progress(done, total)
+			}
+		}
+	}
+
+	if opts.KeepOverlay {
+		return nil
+	}
+	return overlay.MakeEmpty()
+}
+
+// resizeBacking grows the backing disk to size
+func resizeBacking(backing BackingDisk, size uint64) error {
+	switch b := backing.(type) {
+	case *Image:
+		return b.Resize(size, ResizeOptions{})
+	case *RawDisk:
+		return b.Resize(size)
+	}
+	return errors.New("the backing file cannot be resized")
+}
+
+// MakeEmpty drops every cluster of the image, the guest then reads
+// the backing file (or zeros) everywhere.
+func (i *Image) MakeEmpty() error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if err := i.beforeWrite(); err != nil {
+		return err
+	}
+
+	for l1Index, l1Entry := range i.L1Table {
+		if l1Entry.L2TableOffset == 0 {
+			continue
+		}
+		i.L1Table[l1Index] = L1Entry{Index: l1Index}
+		if err := i.writeL1Entry(l1Index); err != nil {
+			return err
+		}
+		if err := i.freeL2Table(l1Entry.L2TableOffset); err != nil {
+			return err
+		}
+	}
+
+	return i.truncateToLastCluster()
+}
@@ -0,0 +1,91 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createOverlay creates an overlay of the backing file in the same
+// directory, with its backing chain opened writable
+func createOverlay(t *testing.T, path string, size uint64, backing string, format string) *gqcow2.Image {
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	overlay, err := gqcow2.Create(f, path, gqcow2.CreateOptions{
+		Size:          size,
+		BackingFile:   backing,
+		BackingFormat: format,
+	})
+	require.NoError(t, err)
+	require.NoError(t, overlay.OpenBacking(gqcow2.OpenLocalBackingRW))
+
+	return overlay
+}
+
+func Test_Commit(t *testing.T) {
+	t.Run("Commit into a qcow2 backing file",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			createTestImage(t, filepath.Join(dir, "base.qcow2"),
+				gqcow2.CreateOptions{Size: 2 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 2 << 20}})
+
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 2<<20, "base.qcow2", "qcow2")
+			_, err := overlay.WriteAt(bytes.Repeat([]byte{1}, 300000), 100000)
+			require.NoError(t, err)
+			require.NoError(t, overlay.WriteZeroes(1<<20, 65536, true))
+			want := readGuest(t, overlay)
+
+			var lastDone, lastTotal uint64
+			err = gqcow2.Commit(overlay, gqcow2.CommitOptions{
+				Progress: func(done uint64, total uint64) {
+					assert.GreaterOrEqual(t, done, lastDone)
+					lastDone, lastTotal = done, total
+				},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, lastTotal, lastDone)
+			assert.Equal(t, uint64(7*65536), lastTotal)
+
+			// the overlay is empty and still shows the same content
+			for _, region := range overlay.Dump() {
+				assert.False(t, region.Present)
+			}
+			assert.Equal(t, want, readGuest(t, overlay))
+
+			base, err := gqcow2.OpenImage(filepath.Join(dir, "base.qcow2"), false)
+			require.NoError(t, err)
+			assert.Equal(t, want, readGuest(t, base))
+		})
+
+	t.Run("Commit into a smaller raw backing file",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			raw := bytes.Repeat([]byte{7}, 1<<20)
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "base.raw"), raw, 0o644))
+
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 2<<20, "base.raw", "raw")
+			_, err := overlay.WriteAt(bytes.Repeat([]byte{9}, 4096), 2<<20-4096)
+			require.NoError(t, err)
+			want := readGuest(t, overlay)
+
+			require.NoError(t, gqcow2.Commit(overlay, gqcow2.CommitOptions{KeepOverlay: true}))
+
+			got, err := os.ReadFile(filepath.Join(dir, "base.raw"))
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+
+			// the overlay is kept as it is
+			entry, err := overlay.FindL2Entry(2<<20 - 4096)
+			require.NoError(t, err)
+			assert.True(t, entry.Allocated())
+		})
+}
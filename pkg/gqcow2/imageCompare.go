@@ -0,0 +1,155 @@
+package gqcow2
+
+import (
+	"bytes"
+	"io"
+)
+
+type CompareOptions struct {
+	// like qemu-img compare -s, the allocation state and the size
+	// must match as well
+	Strict bool
+
+	Progress ProgressFunc
+}
+
+type CompareResult struct {
+	Identical bool
+	// the first guest offset which differs
+	Offset uint64
+
+	// only in strict mode, the offset is allocated in one disk but not
+	// the other, or the sizes differ and the offset is the smaller size
+	AllocationMismatch bool
+	SizeMismatch       bool
+}
+
+// Compare compares the guest content of two disks like qemu-img compare,
+// a disk is an Image with its backing chain or e.g. a RawDisk. Unallocated
+// and zero regions are equal, the parts beyond the end of the smaller disk
+// must read as zeros unless in strict mode.
+func Compare(a BackingDisk, b BackingDisk, opts CompareOptions) (*CompareResult, error) {
+	regionsA, err := chainRegions(a, 0)
+	if err != nil {
+		return nil, err
+	}
+	regionsB, err := chainRegions(b, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sizeA, sizeB := a.VirtualSize(), b.VirtualSize()
+	common := min(sizeA, sizeB)
+	if opts.Strict && sizeA != sizeB {
+		return &CompareResult{Offset: common, SizeMismatch: true}, nil
+	}
+
+	total := max(sizeA, sizeB)
+	bufA := make([]byte, copyChunkSize)
+	bufB := make([]byte, copyChunkSize)
+	indexA, indexB := 0, 0
+	for offset := uint64(0); offset < common; {
+		for regionsA[indexA].Start+regionsA[indexA].Length <= offset {
+			indexA++
+		}
+		for regionsB[indexB].Start+regionsB[indexB].Length <= offset {
+			indexB++
+		}
+		ra, rb := regionsA[indexA], regionsB[indexB]
+		end := min(ra.Start+ra.Length, rb.Start+rb.Length, common)
+
+		if opts.Strict && ra.Present != rb.Present {
+			return &CompareResult{Offset: offset, AllocationMismatch: true}, nil
+		}
+
+		var diff int64
+		switch {
+		case !ra.Data && !rb.Data:
+			diff = -1
+		case !ra.Data:
+			diff, err = firstNonZero(b, bufB, offset, end-offset)
+		case !rb.Data:
+			diff, err = firstNonZero(a, bufA, offset, end-offset)
+		default:
+			diff, err = firstDifference(a, b, bufA, bufB, offset, end-offset)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if diff >= 0 {
+			return &CompareResult{Offset: uint64(diff)}, nil
+		}
+
+		offset = end
+		if opts.Progress != nil {
+			opts.Progress(offset, total)
+		}
+	}
+
+	// the rest of the larger disk must read as zeros
+	larger, regions := a, regionsA
+	if sizeB > sizeA {
+		larger, regions = b, regionsB
+	}
+	for _, region := range regions {
+		end := region.Start + region.Length
+		if end <= common || !region.Data {
+			continue
+		}
+		start := max(region.Start, common)
+		diff, err := firstNonZero(larger, bufA, start, end-start)
+		if err != nil {
+			return nil, err
+		}
+		if diff >= 0 {
+			return &CompareResult{Offset: uint64(diff)}, nil
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(total, total)
+	}
+
+	return &CompareResult{Identical: true}, nil
+}
+
+// firstNonZero returns the offset of the first non zero byte in the
+// range of the disk, -1 if there is none
+func firstNonZero(disk BackingDisk, buf []byte, start uint64, length uint64) (int64, error) {
+	for done := uint64(0); done < length; {
+		chunk := buf[:min(length-done, uint64(len(buf)))]
+		if _, err := disk.ReadAt(chunk, int64(start+done)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		for index, b := range chunk {
+			if b != 0 {
+				return int64(start + done + uint64(index)), nil
+			}
+		}
+		done += uint64(len(chunk))
+	}
+	return -1, nil
+}
+
+// firstDifference returns the offset of the first byte which differs in
+// the range of the disks, -1 if there is none
+func firstDifference(a BackingDisk, b BackingDisk, bufA []byte, bufB []byte, start uint64, length uint64) (int64, error) {
+	for done := uint64(0); done < length; {
+		chunkLength := min(length-done, uint64(len(bufA)))
+		chunkA, chunkB := bufA[:chunkLength], bufB[:chunkLength]
+		if _, err := a.ReadAt(chunkA, int64(start+done)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if _, err := b.ReadAt(chunkB, int64(start+done)); err != nil && err != io.EOF {
+			return 0, err
+		}
+		if !bytes.Equal(chunkA, chunkB) {
+			for index := range chunkA {
+				if chunkA[index] != chunkB[index] {
+					return int64(start + done + uint64(index)), nil
+				}
+			}
+		}
+		done += chunkLength
+	}
+	return -1, nil
+}
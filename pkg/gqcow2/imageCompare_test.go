@@ -0,0 +1,123 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Compare(t *testing.T) {
+	t.Run("Compare an image with a raw file",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			image, content := createTestImage(t, filepath.Join(dir, "disk.qcow2"),
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 100000}, {Start: 500000, Length: 65536}})
+
+			f, err := os.Create(filepath.Join(dir, "disk.raw"))
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.Write(content)
+			require.NoError(t, err)
+			raw := gqcow2.NewRawDisk(f, uint64(len(content)))
+
+			result, err := gqcow2.Compare(image, raw, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.True(t, result.Identical)
+
+			// a raw file is allocated everywhere
+			result, err = gqcow2.Compare(image, raw, gqcow2.CompareOptions{Strict: true})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 131072, AllocationMismatch: true}, result)
+
+			// unallocated in the image
+			_, err = f.WriteAt([]byte{1}, 700000)
+			require.NoError(t, err)
+			result, err = gqcow2.Compare(image, raw, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 700000}, result)
+
+			_, err = f.WriteAt([]byte{content[123456] + 1}, 123456)
+			require.NoError(t, err)
+			result, err = gqcow2.Compare(image, raw, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 123456}, result)
+		})
+
+	t.Run("Zero clusters equal unallocated ones unless strict",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			a, _ := createTestImage(t, filepath.Join(dir, "a.qcow2"), gqcow2.CreateOptions{Size: 1 << 20}, nil)
+			b, _ := createTestImage(t, filepath.Join(dir, "b.qcow2"), gqcow2.CreateOptions{Size: 1 << 20}, nil)
+			require.NoError(t, a.WriteZeroes(3*65536, 65536, true))
+			_, err := b.WriteAt(make([]byte, 65536), 5*65536)
+			require.NoError(t, err)
+
+			result, err := gqcow2.Compare(a, b, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.True(t, result.Identical)
+
+			result, err = gqcow2.Compare(a, b, gqcow2.CompareOptions{Strict: true})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 3 * 65536, AllocationMismatch: true}, result)
+		})
+
+	t.Run("The rest of the larger disk must be zeros",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			small, _ := createTestImage(t, filepath.Join(dir, "small.qcow2"),
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 65536}})
+			large, _ := createTestImage(t, filepath.Join(dir, "large.qcow2"),
+				gqcow2.CreateOptions{Size: 2 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 65536}})
+
+			result, err := gqcow2.Compare(small, large, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.True(t, result.Identical)
+
+			result, err = gqcow2.Compare(small, large, gqcow2.CompareOptions{Strict: true})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 1 << 20, SizeMismatch: true}, result)
+
+			_, err = large.WriteAt(make([]byte, 1000), 1<<20)
+			require.NoError(t, err)
+			_, err = large.WriteAt([]byte{7}, 1500000)
+			require.NoError(t, err)
+			result, err = gqcow2.Compare(large, small, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 1500000}, result)
+		})
+
+	t.Run("Compare reads through the backing chain",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			_, content := createTestImage(t, filepath.Join(dir, "base.qcow2"),
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 20}})
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 1<<20, "base.qcow2", "qcow2")
+			_, err := overlay.WriteAt(bytes.Repeat([]byte{9}, 1000), 200000)
+			require.NoError(t, err)
+			copy(content[200000:], bytes.Repeat([]byte{9}, 1000))
+
+			flat, _ := createTestImage(t, filepath.Join(dir, "flat.qcow2"), gqcow2.CreateOptions{Size: 1 << 20}, nil)
+			_, err = flat.WriteAt(content, 0)
+			require.NoError(t, err)
+
+			result, err := gqcow2.Compare(overlay, flat, gqcow2.CompareOptions{Strict: true})
+			require.NoError(t, err)
+			assert.True(t, result.Identical)
+
+			_, err = flat.WriteAt([]byte{content[900000] + 1}, 900000)
+			require.NoError(t, err)
+			result, err = gqcow2.Compare(overlay, flat, gqcow2.CompareOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.CompareResult{Offset: 900000}, result)
+		})
+}
@@ -21,6 +21,13 @@ func Convert(image *Image, virtualDisk *VirtualDisk) error {
 		}
 
 		if !region.Present || !region.Data || region.Zero {
+			// e.g. an NBD target writes zeros without sending them
+			if zw, ok := virtualDisk.Handler.(ZeroWriter); ok {
+				if err := zw.WriteZeroes(region.Start, region.Length, true); err != nil {
+					return err
+				}
+				continue
+			}
 			allZeroBuf := make([]byte, region.Length)
 			if _, err := virtualDisk.Handler.WriteAt(allZeroBuf, int64(region.Start)); err != nil {
 				return err
@@ -54,8 +61,10 @@ func Convert(image *Image, virtualDisk *VirtualDisk) error {
 
 func decompressGuestCluster(image *Image, compressed *GuestCluster) error {
 	ErrDecompressFail := errors.New("decompress guest cluster failed")
-	comVDStart := compressed.Start
-	comVDLength := compressed.Length
+	if image.Header.CompressionType != 0 {
+		return errors.Join(ErrDecompressFail,
+			fmt.Errorf("unsupported compression type %d", image.Header.CompressionType))
+	}
 
 	totalSectors := compressed.L2Info.Compressed.AdditionalSectorCount + 1
 
@@ -65,30 +74,23 @@ func decompressGuestCluster(image *Image, compressed *GuestCluster) error {
 	if err != nil {
 		if err != io.EOF {
 			return errors.Join(ErrDecompressFail, err)
-		} else {
-			fmt.Printf("%s\n", compressed)
-			fmt.Printf("ts: %d\nstart:%d\nlength:%d\nimage_start:%d\nread_count: %d\n",
-				totalSectors, comVDStart, comVDLength, compressed.L2Info.Compressed.DataOffset,
-				rc)
-			// NOTE: not sure if decompressed should be padding with 0 if cannot occupy the whole cluster
-			compressedBuf = compressedBuf[0:rc]
 		}
+		// the last compressed cluster may end before its last sector
+		compressedBuf = compressedBuf[0:rc]
 	}
 
 	// read and decompress
 	decompressor := flate.NewReader(bytes.NewReader(compressedBuf))
 	defer decompressor.Close()
 
-	// we only need a cluster size of data, or the remaining length
-	// whichever the smallest.
-	//	decompressedBuf := make([]byte, comVDLength)
+	// we only need a cluster size of data, decompression stops when
+	// it has produced a cluster of data.
 	decompressedBuf := make([]byte, image.Header.ClusterSize())
-	n, err := decompressor.Read(decompressedBuf)
-	if err != nil {
+	_, err = io.ReadFull(decompressor, decompressedBuf)
+	if err != nil && err != io.ErrUnexpectedEOF {
 		return errors.Join(ErrDecompressFail, err)
 	}
-	_ = n
-	compressed.Raw = decompressedBuf //[:n]
+	compressed.Raw = decompressedBuf
 
 	return nil
 }
@@ -140,6 +142,9 @@ func decompressGuestCluster(image *Image, compressed *GuestCluster) error {
 //	return nil
 //}
 
+// convertBufferSize bounds the buffer of copies without sendfile
+const convertBufferSize = 4 << 20
+
 func convertStandardRegion(image *Image, virtualDisk *VirtualDisk, region VirtualDiskRegion) error {
 	imageStart := int64(region.Offset)
 	copyLength := int64(region.Length)
@@ -187,5 +192,16 @@ func convertStandardRegion(image *Image, virtualDisk *VirtualDisk, region Virtua
 	}
 
 	// use userspace buf
-	panic("unexpected")
+	buf := make([]byte, min(copyLength, convertBufferSize))
+	for offset := int64(0); offset < copyLength; offset += int64(len(buf)) {
+		buf = buf[:min(int64(len(buf)), copyLength-offset)]
+		rc, err := image.Handler.ReadAt(buf, imageStart+offset)
+		if err != nil && !(err == io.EOF && rc == len(buf)) {
+			return errors.Join(fmt.Errorf("read image at %d failed", imageStart+offset), err)
+		}
+		if _, err := virtualDisk.Handler.WriteAt(buf, vdStart+offset); err != nil {
+			return errors.Join(fmt.Errorf("write disk at %d failed", vdStart+offset), err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,230 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// streamLayout places the tables and data of an image written in
+// a single forward pass, every cluster is in use
+type streamLayout struct {
+	clusterSize uint64
+
+	refCountTableOffset   uint64
+	refCountTableClusters uint64
+	refCountBlocksOffset  uint64
+	refCountBlocks        uint64
+	l1Offset              uint64
+	l1Clusters            uint64
+	l2Offset              uint64
+	dataOffset            uint64
+	clusters              uint64
+
+	// runs of guest clusters holding data, in guest order
+	runs []Extent
+	// the l1 indexes which get an l2 table, in order
+	l2Indexes []uint64
+}
+
+// ConvertStream writes the guest content of source as a new qcow2 image
+// into w in a single forward pass, w needs no seeking, e.g. a pipe, a gzip
+// writer or an upload. The metadata is computed up front from the region
+// map of the source, the image consists of the header, the refcount table
+// and blocks, the l1 table, the l2 tables and then the data clusters in
+// guest order. Only the clusters holding data in the source are allocated.
+// The size defaults to the one of the source, it returns the number of
+// bytes written.
+func ConvertStream(source BackingDisk, w io.Writer, opts CreateOptions) (uint64, error) {
+	if opts.Size == 0 {
+		opts.Size = source.VirtualSize()
+	}
+	if err := opts.setDefaults(); err != nil {
+		return 0, err
+	}
+	if opts.Size < source.VirtualSize() {
+		return 0, errors.New("the image is smaller than the source")
+	}
+	if opts.BackingFile != "" {
+		return 0, errors.New("a streamed image cannot have a backing file")
+	}
+	if opts.Preallocation != "" && opts.Preallocation != PreallocOff {
+		return 0, errors.New("a streamed image cannot be preallocated")
+	}
+
+	regions, err := Map(source)
+	if err != nil {
+		return 0, err
+	}
+	layout := newStreamLayout(regions, opts)
+
+	image := &Image{Header: newHeader(opts)}
+	h := image.Header
+	h.RefCountTableOffset = layout.refCountTableOffset
+	h.RefcountTableClusters = uint32(layout.refCountTableClusters)
+	h.L1Size = l1SizeFor(opts.Size, opts.ClusterBits)
+	h.L1TableOffset = layout.l1Offset
+	hdr, err := image.headerCluster()
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: w}
+	if _, err := cw.Write(hdr); err != nil {
+		return cw.n, err
+	}
+	if err := layout.writeRefCounts(cw, h.RefCountBit()); err != nil {
+		return cw.n, err
+	}
+	if err := layout.writeTables(cw, opts.ClusterBits); err != nil {
+		return cw.n, err
+	}
+	if err := layout.writeData(cw, source); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+func newStreamLayout(regions []VirtualDiskRegion, opts CreateOptions) *streamLayout {
+	l := &streamLayout{clusterSize: uint64(1) << opts.ClusterBits}
+
+	dataClusters := uint64(0)
+	for _, region := range regions {
+		if !region.Data || region.Zero {
+			continue
+		}
+		first := region.Start / l.clusterSize
+		end := divRoundUp(region.Start+region.Length, l.clusterSize)
+		if last := len(l.runs) - 1; last >= 0 && l.runs[last].End() >= first {
+			dataClusters += end - max(l.runs[last].End(), first)
+			l.runs[last].Length = max(l.runs[last].End(), end) - l.runs[last].Start
+			continue
+		}
+		l.runs = append(l.runs, Extent{Start: first, Length: end - first})
+		dataClusters += end - first
+	}
+
+	entriesPerTable := l.clusterSize / 8
+	for _, run := range l.runs {
+		for index := run.Start / entriesPerTable; index <= (run.End()-1)/entriesPerTable; index++ {
+			if n := len(l.l2Indexes); n == 0 || l.l2Indexes[n-1] < index {
+				l.l2Indexes = append(l.l2Indexes, index)
+			}
+		}
+	}
+
+	l1Size := l1SizeFor(opts.Size, opts.ClusterBits)
+	l.l1Clusters = max(divRoundUp(uint64(l1Size)*8, l.clusterSize), 1)
+	l2Clusters := uint64(len(l.l2Indexes))
+	l.refCountBlocks, l.refCountTableClusters = refCountMetadataClusters(
+		1+l.l1Clusters+l2Clusters+dataClusters, l.clusterSize, newHeader(opts).RefCountOrder)
+
+	l.refCountTableOffset = l.clusterSize
+	l.refCountBlocksOffset = l.refCountTableOffset + l.refCountTableClusters*l.clusterSize
+	l.l1Offset = l.refCountBlocksOffset + l.refCountBlocks*l.clusterSize
+	l.l2Offset = l.l1Offset + l.l1Clusters*l.clusterSize
+	l.dataOffset = l.l2Offset + l2Clusters*l.clusterSize
+	l.clusters = l.dataOffset/l.clusterSize + dataClusters
+	return l
+}
+
+// writeRefCounts writes the refcount table and the blocks, the
+// refcount of every cluster of the image is one
+func (l *streamLayout) writeRefCounts(w io.Writer, refCountBits int) error {
+	table := make([]byte, l.refCountTableClusters*l.clusterSize)
+	for index := range l.refCountBlocks {
+		binary.BigEndian.PutUint64(table[index*8:], l.refCountBlocksOffset+index*l.clusterSize)
+	}
+	if _, err := w.Write(table); err != nil {
+		return err
+	}
+
+	refCountsPerBlock := l.clusterSize * 8 / uint64(refCountBits)
+	block := make([]byte, l.clusterSize)
+	for index := range l.refCountBlocks {
+		clear(block)
+		first := index * refCountsPerBlock
+		for cluster := first; cluster < min(first+refCountsPerBlock, l.clusters); cluster++ {
+			if _, _, err := putRefCount(block, cluster-first, refCountBits, 1); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTables writes the l1 table and the l2 tables, the data clusters
+// follow the l2 tables in guest order
+func (l *streamLayout) writeTables(w io.Writer, clusterBits uint32) error {
+	l1 := make([]byte, l.l1Clusters*l.clusterSize)
+	for index, l1Index := range l.l2Indexes {
+		entry := L1Entry{L2TableOffset: l.l2Offset + uint64(index)*l.clusterSize, RefCountBit: true}
+		binary.BigEndian.PutUint64(l1[l1Index*8:], entry.Raw())
+	}
+	if _, err := w.Write(l1); err != nil {
+		return err
+	}
+
+	entriesPerTable := l.clusterSize / 8
+	table := make([]byte, l.clusterSize)
+	run, hostOffset := 0, l.dataOffset
+	for _, l1Index := range l.l2Indexes {
+		clear(table)
+		first, end := l1Index*entriesPerTable, (l1Index+1)*entriesPerTable
+		for ; run < len(l.runs) && l.runs[run].Start < end; run++ {
+			start := max(l.runs[run].Start, first)
+			stop := min(l.runs[run].End(), end)
+			for cluster := start; cluster < stop; cluster++ {
+				entry := L2Entry{Flag: true, Standard: &StandardDescriptor{DataOffset: hostOffset}}
+				binary.BigEndian.PutUint64(table[(cluster-first)*8:], entry.Raw(clusterBits))
+				hostOffset += l.clusterSize
+			}
+			if l.runs[run].End() > end {
+				// the run continues in the next table
+				break
+			}
+		}
+		if _, err := w.Write(table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeData copies the data clusters, the last cluster is filled
+// up with zeros beyond the end of the source
+func (l *streamLayout) writeData(w io.Writer, source BackingDisk) error {
+	buf := make([]byte, max(l.clusterSize, convertBufferSize/l.clusterSize*l.clusterSize))
+	for _, run := range l.runs {
+		start, end := run.Start*l.clusterSize, run.End()*l.clusterSize
+		for offset := start; offset < end; {
+			chunk := buf[:min(uint64(len(buf)), end-offset)]
+			rc, err := source.ReadAt(chunk, int64(offset))
+			if err != nil && err != io.EOF {
+				return errors.Join(fmt.Errorf("read source at %d failed", offset), err)
+			}
+			clear(chunk[rc:])
+			if _, err := w.Write(chunk); err != nil {
+				return err
+			}
+			offset += uint64(len(chunk))
+		}
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
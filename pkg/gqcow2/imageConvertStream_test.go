@@ -0,0 +1,134 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkStreamed opens the streamed image and checks it is consistent,
+// has no leaks and reads like content
+func checkStreamed(t *testing.T, path string, content []byte) *gqcow2.CheckResult {
+	image, err := gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	defer image.Close()
+
+	result, err := image.Check()
+	require.NoError(t, err)
+	assert.True(t, result.Consistent(), result.Problems)
+	assert.Zero(t, result.Leaks, result.Problems)
+	assert.Equal(t, content, readGuest(t, image))
+	return result
+}
+
+func Test_ConvertStream(t *testing.T) {
+	t.Run("Stream a backing chain into one image",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			_, content := createTestImage(t, filepath.Join(dir, "base.qcow2"),
+				gqcow2.CreateOptions{Size: 8 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 20}, {Start: 5 << 20, Length: 100000}})
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 10<<20, "base.qcow2", "qcow2")
+			defer overlay.Close()
+			changed := bytes.Repeat([]byte{0xcd}, 70000)
+			_, err := overlay.WriteAt(changed, 9<<20)
+			require.NoError(t, err)
+			content = append(content, make([]byte, 2<<20)...)
+			copy(content[9<<20:], changed)
+
+			var out bytes.Buffer
+			n, err := gqcow2.ConvertStream(overlay, &out, gqcow2.CreateOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, uint64(out.Len()), n)
+
+			path := filepath.Join(dir, "streamed.qcow2")
+			require.NoError(t, os.WriteFile(path, out.Bytes(), 0o644))
+			result := checkStreamed(t, path, content)
+			// 16 + 2 + 2 data clusters
+			assert.Equal(t, uint64(20), result.AllocatedClusters)
+			assert.Equal(t, uint64(0), result.FragmentedClusters)
+		})
+
+	t.Run("Stream a raw disk through gzip",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			content := make([]byte, 3<<20+12345)
+			rand.New(rand.NewSource(1)).Read(content)
+			raw := gqcow2.NewRawDisk(bytes.NewReader(content), uint64(len(content)))
+
+			r, w := io.Pipe()
+			go func() {
+				gz := gzip.NewWriter(w)
+				_, err := gqcow2.ConvertStream(raw, gz, gqcow2.CreateOptions{Version: 2})
+				w.CloseWithError(errors.Join(err, gz.Close()))
+			}()
+
+			gz, err := gzip.NewReader(r)
+			require.NoError(t, err)
+			path := filepath.Join(dir, "streamed.qcow2")
+			f, err := os.Create(path)
+			require.NoError(t, err)
+			_, err = io.Copy(f, gz)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			image, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			defer image.Close()
+			assert.Equal(t, uint32(2), image.Header.Version)
+			assert.Equal(t, content, readGuest(t, image))
+		})
+
+	t.Run("Many l2 tables and refcount blocks",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			_, content := createTestImage(t, filepath.Join(dir, "source.qcow2"),
+				gqcow2.CreateOptions{Size: 6 << 20},
+				[]gqcow2.Extent{{Start: 4096, Length: 3 << 20}, {Start: 4<<20 + 300, Length: 40000}})
+			source, err := gqcow2.OpenImage(filepath.Join(dir, "source.qcow2"), false)
+			require.NoError(t, err)
+			defer source.Close()
+
+			path := filepath.Join(dir, "streamed.qcow2")
+			f, err := os.Create(path)
+			require.NoError(t, err)
+			// 2 bits refcounts, a refcount block covers 1MiB of the file
+			_, err = gqcow2.ConvertStream(source, f, gqcow2.CreateOptions{Size: 7 << 20, ClusterBits: 9, RefCountOrder: 1})
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			checkStreamed(t, path, append(content, make([]byte, 1<<20)...))
+			image, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			defer image.Close()
+			assert.Equal(t, uint32(1), image.Header.RefCountOrder)
+			blocks := 0
+			for _, entry := range image.RefCountTable {
+				if entry.RefCountBlockOffset != 0 {
+					blocks++
+				}
+			}
+			assert.Greater(t, blocks, 3)
+		})
+
+	t.Run("Invalid options",
+		func(t *testing.T) {
+			raw := gqcow2.NewRawDisk(bytes.NewReader(make([]byte, 4096)), 4096)
+			_, err := gqcow2.ConvertStream(raw, io.Discard, gqcow2.CreateOptions{Size: 512})
+			assert.Error(t, err)
+			_, err = gqcow2.ConvertStream(raw, io.Discard, gqcow2.CreateOptions{BackingFile: "base.qcow2"})
+			assert.Error(t, err)
+			_, err = gqcow2.ConvertStream(raw, io.Discard, gqcow2.CreateOptions{Preallocation: gqcow2.PreallocFull})
+			assert.Error(t, err)
+		})
+}
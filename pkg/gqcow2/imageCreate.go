@@ -0,0 +1,154 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	DefaultClusterBits   = 16
+	DefaultRefCountOrder = 4
+)
+
+type CreateOptions struct {
+	// virtual disk size in bytes
+	Size uint64
+	// 2 or 3, default to 3
+	Version uint32
+	// default to 16, 64KiB clusters
+	ClusterBits uint32
+	// default to 4, 16 bits refcounts
+	RefCountOrder uint32
+
+	BackingFile   string
+	BackingFormat string
+
+	Preallocation PreallocMode
+}
+
+func (opts *CreateOptions) setDefaults() error {
+	if opts.Version == 0 {
+		opts.Version = 3
+	}
+	if opts.ClusterBits == 0 {
+		opts.ClusterBits = DefaultClusterBits
+	}
+	if opts.RefCountOrder == 0 && opts.Version == 3 {
+		opts.RefCountOrder = DefaultRefCountOrder
+	}
+
+	if opts.Version != 2 && opts.Version != 3 {
+		return errors.New("invalid version")
+	}
+	if opts.ClusterBits < 9 || opts.ClusterBits > 21 {
+		return errors.New("invalid cluster size")
+	}
+	if opts.Version == 2 && opts.RefCountOrder != 0 && opts.RefCountOrder != 4 {
+		return errors.New("refcount width can only be 16 bits for v2")
+	}
+	if opts.RefCountOrder > 6 {
+		return errors.New("invalid refcount width")
+	}
+	if _, err := ParsePreallocMode(string(opts.Preallocation)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// l1SizeFor returns the number of l1 entries needed for the virtual size
+func l1SizeFor(size uint64, clusterBits uint32) uint32 {
+	clusterSize := uint64(1) << clusterBits
+	// each l2 table maps clusterSize / 8 clusters
+	return uint32(divRoundUp(size, clusterSize*clusterSize/8))
+}
+
+// newHeader is the header of a new image without any tables
+func newHeader(opts CreateOptions) *Header {
+	h := &Header{
+		Version:       opts.Version,
+		ClusterBits:   opts.ClusterBits,
+		Size:          opts.Size,
+		RefCountOrder: opts.RefCountOrder,
+		Length:        104,
+	}
+	if opts.Version == 2 {
+		h.RefCountOrder = 4
+		h.Length = 72
+	}
+	return h
+}
+
+// Create formats f as an empty qcow2 image. The layout is the same
+// as what qemu-img creates: header, refcount table, the first
+// refcount block, then the l1 table.
+func Create(f DiskHandler, name string, opts CreateOptions) (*Image, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	h := newHeader(opts)
+	h.RefCountTableOffset = 1 << opts.ClusterBits
+	h.RefcountTableClusters = 1
+
+	image := &Image{
+		RWMode:        true,
+		Name:          name,
+		Handler:       f,
+		Header:        h,
+		Extensions:    make([]HeaderExtension, 0),
+		BackingFile:   opts.BackingFile,
+		BackingFormat: opts.BackingFormat,
+		l2Cache:       newTableCache(),
+		refCountCache: newTableCache(),
+	}
+
+	clusterSize := uint64(h.ClusterSize())
+	// the refcount table points to the block in cluster 2, which
+	// accounts for the header, the table and itself
+	rawTable := make([]byte, clusterSize)
+	binary.BigEndian.PutUint64(rawTable[0:8], 2*clusterSize)
+	if _, err := f.WriteAt(rawTable, int64(clusterSize)); err != nil {
+		return nil, err
+	}
+	rawBlock := make([]byte, clusterSize)
+	for index := range uint64(3) {
+		if _, _, err := putRefCount(rawBlock, index, h.RefCountBit(), 1); err != nil {
+			return nil, err
+		}
+	}
+	if err := image.storeTable(image.refCountCache, 2*clusterSize, rawBlock); err != nil {
+		return nil, err
+	}
+	if err := image.WriteHeader(); err != nil {
+		return nil, err
+	}
+	if err := image.LoadRefcountTable(); err != nil {
+		return nil, err
+	}
+
+	l1Size := l1SizeFor(opts.Size, opts.ClusterBits)
+	l1Clusters := max(divRoundUp(uint64(l1Size)*8, clusterSize), 1)
+	l1Offset, err := image.allocateClusters(l1Clusters)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(make([]byte, l1Clusters*clusterSize), int64(l1Offset)); err != nil {
+		return nil, err
+	}
+
+	h.L1Size = l1Size
+	h.L1TableOffset = l1Offset
+	if err := image.WriteHeader(); err != nil {
+		return nil, err
+	}
+
+	image, err = NewFileImage(f, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := image.Preallocate(0, opts.Size, opts.Preallocation); err != nil {
+		return nil, err
+	}
+
+	return image, nil
+}
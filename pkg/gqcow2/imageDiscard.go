@@ -0,0 +1,177 @@
+package gqcow2
+
+// ZeroWriter is implemented by disks which can zero a range
+// without writing the zeros, like Image.
+type ZeroWriter interface {
+	WriteZeroes(off uint64, length uint64, mayUnmap bool) error
+}
+
+// Discard tells the image the guest doesn't need the range any more,
+// like the TRIM command. Only whole clusters are discarded, they become
+// unallocated, or read as zeros if there is a backing file. Host
+// clusters no longer used are freed.
+func (i *Image) Discard(off uint64, length uint64) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if off > i.Header.Size || length > i.Header.Size-off {
+		return ErrOutOfRange
+	}
+	if err := i.beforeWrite(); err != nil {
+		return err
+	}
+
+	start, end := i.wholeClusters(off, length)
+	for vdOffset := start; vdOffset < end; vdOffset += uint64(i.Header.ClusterSize()) {
+		if err := i.zeroCluster(vdOffset, true, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteZeroes makes the range read as zeros. Whole clusters are marked
+// by the zero flag on v3 images. If mayUnmap is true their host clusters
+// are freed, otherwise allocated clusters stay allocated.
+func (i *Image) WriteZeroes(off uint64, length uint64, mayUnmap bool) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if off > i.Header.Size || length > i.Header.Size-off {
+		return ErrOutOfRange
+	}
+	if length == 0 {
+		return nil
+	}
+	if err := i.beforeWrite(); err != nil {
+		return err
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	start, end := i.wholeClusters(off, length)
+	if start >= end {
+		// the range may still cross a cluster boundary
+		head := min(length, alignUp(off+1, clusterSize)-off)
+		if err := i.zeroPartial(off, head); err != nil {
+			return err
+		}
+		return i.zeroPartial(off+head, length-head)
+	}
+
+	if err := i.zeroPartial(off, start-off); err != nil {
+		return err
+	}
+	for vdOffset := start; vdOffset < end; vdOffset += clusterSize {
+		if err := i.zeroCluster(vdOffset, false, mayUnmap); err != nil {
+			return err
+		}
+	}
+	if off+length > end {
+		return i.zeroPartial(end, off+length-end)
+	}
+	return nil
+}
+
+// wholeClusters returns the clusters fully covered by the range, the
+// last cluster of the disk is whole if the range reaches the disk end.
+func (i *Image) wholeClusters(off uint64, length uint64) (uint64, uint64) {
+	clusterSize := uint64(i.Header.ClusterSize())
+	start := alignUp(off, clusterSize)
+	end := (off + length) / clusterSize * clusterSize
+	if off+length == i.Header.Size {
+		end = alignUp(i.Header.Size, clusterSize)
+	}
+	return start, max(start, end)
+}
+
+// zeroPartial zeros a range inside one cluster by writing zeros
+func (i *Image) zeroPartial(off uint64, length uint64) error {
+	if length == 0 {
+		return nil
+	}
+	entry, err := i.FindL2Entry(off)
+	if err != nil {
+		return err
+	}
+	// already reads as zeros
+	if entry.Standard != nil && (entry.Standard.AllZero ||
+		(entry.Standard.DataOffset == 0 && i.BackingFile == "")) {
+		return nil
+	}
+	_, err = i.WriteAt(make([]byte, length), int64(off))
+	return err
+}
+
+// zeroCluster discards or zeros the whole cluster at vdOffset
+func (i *Image) zeroCluster(vdOffset uint64, discard bool, mayUnmap bool) error {
+	entry, err := i.FindL2Entry(vdOffset)
+	if err != nil {
+		return err
+	}
+
+	newEntry, writeData := i.zeroEntryFor(entry, discard, mayUnmap)
+	if writeData {
+		// no zero flag, write the zeros as data
+		clusterSize := uint64(i.Header.ClusterSize())
+		_, err := i.WriteAt(make([]byte, min(clusterSize, i.Header.Size-vdOffset)), int64(vdOffset))
+		return err
+	}
+	if newEntry == nil || entry.Raw(i.Header.ClusterBits) == newEntry.Raw(i.Header.ClusterBits) {
+		return nil
+	}
+	// nothing to record for an unallocated l2 table
+	l1Index, _ := i.l2Position(vdOffset)
+	if newEntry.Raw(i.Header.ClusterBits) == 0 &&
+		(l1Index >= uint64(len(i.L1Table)) || i.L1Table[l1Index].L2TableOffset == 0) {
+		return nil
+	}
+
+	l2TableStart, l2Index, err := i.l2TableForWrite(vdOffset)
+	if err != nil {
+		return err
+	}
+	// the table may have been copied, which changes the entry
+	if entry, err = i.FindL2Entry(vdOffset); err != nil {
+		return err
+	}
+	newEntry, _ = i.zeroEntryFor(entry, discard, mayUnmap)
+	if err := i.writeL2Entry(l2TableStart, l2Index, *newEntry); err != nil {
+		return err
+	}
+
+	if newEntry.Standard.DataOffset != 0 {
+		return nil
+	}
+	return i.releaseL2Entry(entry)
+}
+
+// zeroEntryFor decides the new l2 entry of a discarded or zeroed
+// cluster, nil to keep the entry. writeData is true if the cluster
+// can only be zeroed by writing zeros.
+func (i *Image) zeroEntryFor(entry L2Entry, discard bool, mayUnmap bool) (*L2Entry, bool) {
+	hasZeroFlag := i.Header.Version >= 3
+	hasBacking := i.BackingFile != ""
+	unallocated := &L2Entry{Standard: &StandardDescriptor{}}
+	zero := &L2Entry{Standard: &StandardDescriptor{AllZero: true}}
+
+	switch {
+	case discard && !hasBacking:
+		return unallocated, false
+	case discard && !hasZeroFlag:
+		// the backing file would show through
+		return nil, false
+	case discard:
+		return zero, false
+	case !hasZeroFlag && !hasBacking && mayUnmap:
+		return unallocated, false
+	case !hasZeroFlag:
+		return nil, true
+	case !mayUnmap && entry.Standard != nil && entry.Flag && entry.Standard.DataOffset != 0:
+		// keep the cluster preallocated
+		return &L2Entry{Flag: true, Standard: &StandardDescriptor{
+			DataOffset: entry.Standard.DataOffset,
+			AllZero:    true,
+		}}, false
+	}
+	return zero, false
+}
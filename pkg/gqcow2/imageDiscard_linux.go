@@ -0,0 +1,18 @@
+package gqcow2
+
+import (
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+const fallocPunchHole = 0x01 | 0x02
+
+// punchHole gives the host cluster back to the file system
+func (i *Image) punchHole(clusterIndex uint64) error {
+	if !i.PunchHoles || !i.FastMode {
+		return nil
+	}
+	clusterSize := int64(i.Header.ClusterSize())
+	fd := int(i.Handler.(FastHandler).Fd())
+	return syscall.Fallocate(fd, fallocPunchHole, int64(clusterIndex)*clusterSize, clusterSize)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package gqcow2
+
+// punchHole zeros the freed host cluster, holes can only be punched on
+// linux
+func (i *Image) punchHole(clusterIndex uint64) error {
+	if !i.PunchHoles || !i.RWMode {
+		return nil
+	}
+	clusterSize := uint64(i.Header.ClusterSize())
+	return writeZeros(i.writer(), clusterIndex*clusterSize, clusterSize)
+}
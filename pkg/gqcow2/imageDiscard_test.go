@@ -0,0 +1,124 @@
+package gqcow2_test
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func allocatedBytes(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func Test_ImageDiscard(t *testing.T) {
+	t.Run("Discard deallocates whole clusters and punches holes",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "discard.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 4 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 4 << 20}})
+			image.PunchHoles = true
+			before := allocatedBytes(t, path)
+
+			// the partial clusters at both ends are kept
+			require.NoError(t, image.Discard(65536-100, 2<<20))
+			copy(content[65536:65536+2<<20-65536], make([]byte, 2<<20-65536))
+
+			assert.Equal(t, content, readGuest(t, image))
+			if runtime.GOOS == "linux" {
+				// the other systems zero the clusters instead
+				assert.LessOrEqual(t, allocatedBytes(t, path), before-int64(2<<20-65536))
+			}
+
+			regions := image.Dump()
+			assert.Equal(t, uint64(65536), regions[1].Start)
+			assert.False(t, regions[1].Present)
+		})
+
+	t.Run("Discard on an overlay hides the backing data",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			_, _ = createTestImage(t, filepath.Join(dir, "base.qcow2"),
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 20}})
+
+			path := filepath.Join(dir, "overlay.qcow2")
+			f, err := os.Create(path)
+			require.NoError(t, err)
+			defer f.Close()
+			overlay, err := gqcow2.Create(f, path, gqcow2.CreateOptions{
+				Size: 1 << 20, BackingFile: "base.qcow2", BackingFormat: "qcow2"})
+			require.NoError(t, err)
+			require.NoError(t, overlay.OpenBacking(gqcow2.OpenLocalBacking))
+
+			require.NoError(t, overlay.Discard(0, 1<<20))
+			assert.True(t, isZero(readGuest(t, overlay)))
+		})
+
+	t.Run("Write zeroes keeps the clusters allocated unless unmap is allowed",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "zero.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 20}})
+
+			require.NoError(t, image.WriteZeroes(1000, 200000, false))
+			require.NoError(t, image.WriteZeroes(512<<10, 128<<10, true))
+			copy(content[1000:201000], make([]byte, 200000))
+			copy(content[512<<10:640<<10], make([]byte, 128<<10))
+			assert.Equal(t, content, readGuest(t, image))
+
+			regions := image.Dump()
+			for _, region := range regions {
+				if region.Zero {
+					assert.True(t, region.Present)
+				}
+			}
+			// the zeroed clusters still own their host clusters
+			entry, err := image.FindL2Entry(65536)
+			require.NoError(t, err)
+			assert.True(t, entry.Standard.AllZero)
+			assert.NotZero(t, entry.Standard.DataOffset)
+
+			entry, err = image.FindL2Entry(512 << 10)
+			require.NoError(t, err)
+			assert.True(t, entry.Standard.AllZero)
+			assert.Zero(t, entry.Standard.DataOffset)
+		})
+	t.Run("Write zeroes across a cluster boundary without whole clusters",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "boundary.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 65536, Length: 65536}})
+
+			// the first cluster already reads as zeros, the second doesn't
+			require.NoError(t, image.WriteZeroes(60000, 40000, true))
+			copy(content[60000:100000], make([]byte, 40000))
+			assert.Equal(t, content, readGuest(t, image))
+		})
+
+	t.Run("Refuse ranges beyond the end",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "range.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 20}})
+
+			// the end of the range wraps around
+			assert.ErrorIs(t, image.Discard(65536, math.MaxUint64-1000), gqcow2.ErrOutOfRange)
+			assert.ErrorIs(t, image.WriteZeroes(65536, math.MaxUint64-1000, true), gqcow2.ErrOutOfRange)
+			assert.ErrorIs(t, image.WriteZeroes(2<<20, 0, true), gqcow2.ErrOutOfRange)
+			assert.Equal(t, content, readGuest(t, image))
+		})
+}
@@ -374,9 +374,131 @@ func (image *Image) Dump() []VirtualDiskRegion {
 //	return regions
 //}
 
+// SameAs tells whether vdr can be merged into another, which is
+// the region right before it. Standard data regions must also be
+// contiguous in the image file.
 func (vdr VirtualDiskRegion) SameAs(another VirtualDiskRegion) bool {
+	if vdr.Offset != 0 && vdr.Offset != another.Offset+another.Length {
+		return false
+	}
 	return vdr.Present == another.Present &&
 		vdr.Zero == another.Zero &&
 		vdr.Data == another.Data &&
 		vdr.Compressed == another.Compressed
 }
+
+// RegionMapper is implemented by disks and raw handlers that know their
+// allocation, e.g. an NBD export with block status. The regions cover
+// the disk in order, the offset of a data region is its guest offset.
+type RegionMapper interface {
+	MapRegions() ([]VirtualDiskRegion, error)
+}
+
+// Map returns the regions of the disk through its backing chain like
+// qemu-img map, the depth of a region is the level of the chain holding
+// it. A disk which isn't an image is a single data region, unless it or
+// the handler of a raw disk is a RegionMapper.
+func Map(disk BackingDisk) ([]VirtualDiskRegion, error) {
+	return chainRegions(disk, 0)
+}
+
+// chainRegions returns the regions of the disk with the unallocated
+// regions of an image filled by its backing chain, the depth of a region
+// is the level of the chain it comes from. A disk which isn't an image
+// is a single data region, the parts beyond the end of a backing disk are
+// unallocated zeros.
+func chainRegions(disk BackingDisk, depth int) ([]VirtualDiskRegion, error) {
+	image, ok := disk.(*Image)
+	if !ok {
+		if disk.VirtualSize() == 0 {
+			return nil, nil
+		}
+		if mapper, ok := rawMapper(disk); ok {
+			return mappedRegions(mapper, disk.VirtualSize(), depth)
+		}
+		// the host offset of a raw disk is the guest offset
+		return []VirtualDiskRegion{{Length: disk.VirtualSize(), Depth: depth, Present: true, Data: true}}, nil
+	}
+
+	cm, err := image.DumpToClusterMap()
+	if err != nil {
+		return nil, err
+	}
+	if image.Backing == nil {
+		for index := range cm.Regions {
+			cm.Regions[index].Depth = depth
+		}
+		return cm.Regions, nil
+	}
+
+	backing, err := chainRegions(image.Backing, depth+1)
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make([]VirtualDiskRegion, 0, len(cm.Regions))
+	for _, region := range cm.Regions {
+		region.Depth = depth
+		if region.Present {
+			regions = append(regions, region)
+			continue
+		}
+
+		start, end := region.Start, region.Start+region.Length
+		for _, b := range backing {
+			bEnd := b.Start + b.Length
+			if bEnd <= start || b.Start >= end {
+				continue
+			}
+			clipped := b
+			clipped.Start = max(b.Start, start)
+			clipped.Length = min(bEnd, end) - clipped.Start
+			if clipped.Data && !clipped.Compressed {
+				clipped.Offset += clipped.Start - b.Start
+			}
+			regions = append(regions, clipped)
+		}
+		if backingEnd := image.Backing.VirtualSize(); backingEnd < end {
+			tail := max(backingEnd, start)
+			regions = append(regions, VirtualDiskRegion{
+				Start: tail, Length: end - tail, Depth: depth, Zero: true,
+			})
+		}
+	}
+	return regions, nil
+}
+
+// rawMapper returns the RegionMapper of the disk or of its raw handler
+func rawMapper(disk BackingDisk) (RegionMapper, bool) {
+	if raw, ok := disk.(*RawDisk); ok {
+		mapper, ok := raw.Handler.(RegionMapper)
+		return mapper, ok
+	}
+	mapper, ok := disk.(RegionMapper)
+	return mapper, ok
+}
+
+// mappedRegions clips the regions of the mapper to the size of the disk,
+// the disk beyond the end of the mapped regions reads as zeros
+func mappedRegions(mapper RegionMapper, size uint64, depth int) ([]VirtualDiskRegion, error) {
+	mapped, err := mapper.MapRegions()
+	if err != nil {
+		return nil, err
+	}
+
+	regions := make([]VirtualDiskRegion, 0, len(mapped)+1)
+	end := uint64(0)
+	for _, region := range mapped {
+		if region.Start >= size {
+			break
+		}
+		region.Length = min(region.Length, size-region.Start)
+		region.Depth = depth
+		regions = append(regions, region)
+		end = region.Start + region.Length
+	}
+	if end < size {
+		regions = append(regions, VirtualDiskRegion{Start: end, Length: size - end, Depth: depth, Zero: true})
+	}
+	return regions, nil
+}
@@ -0,0 +1,99 @@
+package gqcow2
+
+import (
+	"errors"
+	"io"
+)
+
+// Syncer is implemented by handlers that can make the
+// written data durable, e.g. os.File
+type Syncer interface {
+	Sync() error
+}
+
+// sync issues fsync on the handler if it supports it
+func (i *Image) sync() error {
+	if s, ok := i.Handler.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// flushMetadata writes the modified tables back in the order that keeps
+// the image consistent at every point: the guest data goes first, then
+// the refcounts, and last the l2 tables referencing the clusters.
+func (i *Image) flushMetadata() error {
+	if len(i.refCountCache.dirty) == 0 && len(i.l2Cache.dirty) == 0 {
+		return nil
+	}
+
+	if err := i.sync(); err != nil {
+		return err
+	}
+	if len(i.refCountCache.dirty) != 0 {
+		if err := i.flushCache(i.refCountCache); err != nil {
+			return err
+		}
+		if err := i.sync(); err != nil {
+			return err
+		}
+	}
+	if len(i.l2Cache.dirty) != 0 {
+		if err := i.flushCache(i.l2Cache); err != nil {
+			return err
+		}
+		if err := i.sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush writes the cached metadata back into the image and makes
+// everything written so far durable.
+func (i *Image) Flush() error {
+	if !i.RWMode {
+		return nil
+	}
+	if err := i.flushMetadata(); err != nil {
+		return err
+	}
+	return i.sync()
+}
+
+// Close flushes the image, clears the dirty bit of lazy refcounts and
+// closes the handler as well as the opened backing chain.
+func (i *Image) Close() error {
+	var err error
+	if i.RWMode {
+		err = i.Flush()
+		// an image opened dirty is left for the next writable open to repair
+		if err == nil && !i.staleRefCounts {
+			err = i.MarkClean()
+		}
+	}
+
+	err = errors.Join(err, closeDisk(i.Backing))
+	return errors.Join(err, CloseHandler(i.Handler))
+}
+
+// closeDisk closes the backing disk if it can be closed, nil is ignored
+func closeDisk(d BackingDisk) error {
+	if c, ok := d.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// Close closes the handler of the raw disk
+func (r *RawDisk) Close() error {
+	return CloseHandler(r.Handler)
+}
+
+// CloseHandler closes the handler of a disk if it can be closed
+func CloseHandler(h FileHandler) error {
+	if c, ok := h.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncCounter counts the fsync calls on the file
+type syncCounter struct {
+	*os.File
+	syncs int
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return s.File.Sync()
+}
+
+func Test_ImageFlush(t *testing.T) {
+	t.Run("Write back keeps the metadata in memory until Flush",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "writeback.qcow2")
+			_, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 65536}})
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			counter := &syncCounter{File: f}
+			image, err := gqcow2.NewFileImage(counter, path)
+			require.NoError(t, err)
+			image.WriteBack = true
+
+			_, err = image.WriteAt(bytes.Repeat([]byte{8}, 1000), 300000)
+			require.NoError(t, err)
+			copy(content[300000:], bytes.Repeat([]byte{8}, 1000))
+			assert.Equal(t, content, readGuest(t, image))
+
+			// the l2 entry is not written yet, the cluster still reads as zeros
+			onDisk := openOnDisk(t, path)
+			entry, err := onDisk.FindL2Entry(300000)
+			require.NoError(t, err)
+			assert.False(t, entry.Allocated())
+
+			require.NoError(t, image.Flush())
+			assert.NotZero(t, counter.syncs)
+			assert.Equal(t, content, readGuest(t, openOnDisk(t, path)))
+
+			require.NoError(t, image.Close())
+			_, err = f.ReadAt(make([]byte, 1), 0)
+			assert.ErrorIs(t, err, os.ErrClosed)
+		})
+
+	t.Run("Close clears the dirty bit",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "lazy.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20}, nil)
+			lazy := true
+			require.NoError(t, image.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy}))
+			image.WriteBack = true
+
+			_, err := image.WriteAt(bytes.Repeat([]byte{2}, 200000), 100000)
+			require.NoError(t, err)
+			copy(content[100000:], bytes.Repeat([]byte{2}, 200000))
+			assert.True(t, openOnDisk(t, path).Dirty())
+
+			require.NoError(t, image.Close())
+			onDisk := openOnDisk(t, path)
+			assert.False(t, onDisk.Dirty())
+			assert.Equal(t, content, readGuest(t, onDisk))
+
+			entry, err := onDisk.FindL2Entry(100000)
+			require.NoError(t, err)
+			refcount, err := onDisk.ReadRefCount(entry.Standard.DataOffset)
+			require.NoError(t, err)
+			assert.Equal(t, 1, refcount)
+		})
+}
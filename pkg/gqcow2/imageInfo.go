@@ -0,0 +1,297 @@
+package gqcow2
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ImageInfo follows the json output of qemu-img info
+type ImageInfo struct {
+	VirtualSize         uint64          `json:"virtual-size"`
+	Filename            string          `json:"filename"`
+	ClusterSize         int             `json:"cluster-size,omitempty"`
+	Format              string          `json:"format"`
+	ActualSize          uint64          `json:"actual-size,omitempty"`
+	Encrypted           bool            `json:"encrypted,omitempty"`
+	Snapshots           []SnapshotInfo  `json:"snapshots,omitempty"`
+	FormatSpecific      *FormatSpecific `json:"format-specific,omitempty"`
+	FullBackingFilename string          `json:"full-backing-filename,omitempty"`
+	BackingFilename     string          `json:"backing-filename,omitempty"`
+	BackingFormat       string          `json:"backing-filename-format,omitempty"`
+	DirtyFlag           bool            `json:"dirty-flag"`
+}
+
+type SnapshotInfo struct {
+	ICount      *int64 `json:"icount,omitempty"`
+	VMStateSize uint64 `json:"vm-state-size"`
+	Name        string `json:"name"`
+	DateSec     int64  `json:"date-sec"`
+	DateNsec    int64  `json:"date-nsec"`
+	VMClockSec  int64  `json:"vm-clock-sec"`
+	VMClockNsec int64  `json:"vm-clock-nsec"`
+	ID          string `json:"id"`
+}
+
+type FormatSpecific struct {
+	Type string     `json:"type"`
+	Data *Qcow2Info `json:"data"`
+}
+
+// Qcow2Info is the qcow2 specific part of ImageInfo, the fields which
+// are pointers are only known by v3 images
+type Qcow2Info struct {
+	Compat          string       `json:"compat"`
+	DataFile        string       `json:"data-file,omitempty"`
+	CompressionType string       `json:"compression-type"`
+	LazyRefCounts   *bool        `json:"lazy-refcounts,omitempty"`
+	Bitmaps         []BitmapInfo `json:"bitmaps,omitempty"`
+	RefCountBits    int          `json:"refcount-bits"`
+	Encrypt         *EncryptInfo `json:"encrypt,omitempty"`
+	Corrupt         *bool        `json:"corrupt,omitempty"`
+	ExtendedL2      *bool        `json:"extended-l2,omitempty"`
+}
+
+type BitmapInfo struct {
+	Flags       []string `json:"flags"`
+	Name        string   `json:"name"`
+	Granularity uint64   `json:"granularity"`
+}
+
+// EncryptInfo tells the encryption format, the other fields are the
+// details of a luks header
+type EncryptInfo struct {
+	Format         string     `json:"format"`
+	IvgenAlg       string     `json:"ivgen-alg,omitempty"`
+	IvgenHashAlg   string     `json:"ivgen-hash-alg,omitempty"`
+	HashAlg        string     `json:"hash-alg,omitempty"`
+	CipherAlg      string     `json:"cipher-alg,omitempty"`
+	UUID           string     `json:"uuid,omitempty"`
+	CipherMode     string     `json:"cipher-mode,omitempty"`
+	Slots          []LUKSSlot `json:"slots,omitempty"`
+	PayloadOffset  uint64     `json:"payload-offset,omitempty"`
+	MasterKeyIters uint32     `json:"master-key-iters,omitempty"`
+}
+
+type LUKSSlot struct {
+	Active    bool   `json:"active"`
+	Iters     uint32 `json:"iters,omitempty"`
+	Stripes   uint32 `json:"stripes,omitempty"`
+	KeyOffset uint64 `json:"key-offset"`
+}
+
+// Info describes the image like qemu-img info
+func (i *Image) Info() (*ImageInfo, error) {
+	info := &ImageInfo{
+		VirtualSize: i.Header.Size,
+		Filename:    i.Name,
+		ClusterSize: i.Header.ClusterSize(),
+		Format:      "qcow2",
+		ActualSize:  actualSize(i.Handler),
+		Encrypted:   i.Header.CryptMethod != CryptNone,
+		DirtyFlag:   i.Dirty(),
+	}
+
+	if i.BackingFile != "" {
+		info.BackingFilename = i.BackingFile
+		info.FullBackingFilename = i.backingPath()
+		info.BackingFormat = i.BackingFormat
+	}
+
+	snapshots, err := i.LoadSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		si := SnapshotInfo{
+			VMStateSize: s.VMStateSize,
+			Name:        s.Name,
+			DateSec:     s.Date.Unix(),
+			DateNsec:    int64(s.Date.Nanosecond()),
+			VMClockSec:  int64(s.VMClock.Seconds()),
+			VMClockNsec: s.VMClock.Nanoseconds() % 1e9,
+			ID:          s.ID,
+		}
+		if s.ICount >= 0 {
+			si.ICount = &s.ICount
+		}
+		info.Snapshots = append(info.Snapshots, si)
+	}
+
+	qcow2 := &Qcow2Info{
+		Compat:          "0.10",
+		CompressionType: "zlib",
+		RefCountBits:    i.Header.RefCountBit(),
+	}
+	if i.Header.CompressionType == 1 {
+		qcow2.CompressionType = "zstd"
+	}
+	if i.Header.Version == 3 {
+		lazy := i.LazyRefCounts()
+		corrupt := i.Header.IncompatibleFeatures&IncompatibleCorrupt != 0
+		extendedL2 := i.Header.IncompatibleFeatures&IncompatibleExtendedL2 != 0
+		qcow2.Compat = "1.1"
+		qcow2.LazyRefCounts = &lazy
+		qcow2.Corrupt = &corrupt
+		qcow2.ExtendedL2 = &extendedL2
+	}
+	if ext := i.Extension(ExtensionExternalDataFile); ext != nil {
+		qcow2.DataFile = string(ext.Data)
+	}
+
+	bitmaps, err := i.LoadBitmaps()
+	if err != nil {
+		return nil, err
+	}
+	for _, b := range bitmaps {
+		bi := BitmapInfo{Flags: []string{}, Name: b.Name, Granularity: b.Granularity()}
+		if b.InUse() {
+			bi.Flags = append(bi.Flags, "in-use")
+		}
+		if b.Flags&BitmapAuto != 0 {
+			bi.Flags = append(bi.Flags, "auto")
+		}
+		qcow2.Bitmaps = append(qcow2.Bitmaps, bi)
+	}
+
+	switch i.Header.CryptMethod {
+	case CryptNone:
+	case CryptAES:
+		qcow2.Encrypt = &EncryptInfo{Format: "aes"}
+	case CryptLUKS:
+		if qcow2.Encrypt, err = i.luksInfo(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown encryption method %d", i.Header.CryptMethod)
+	}
+
+	info.FormatSpecific = &FormatSpecific{Type: "qcow2", Data: qcow2}
+	return info, nil
+}
+
+// Info describes the raw disk like qemu-img info
+func (r *RawDisk) Info(name string) *ImageInfo {
+	return &ImageInfo{
+		VirtualSize: r.Size,
+		Filename:    name,
+		Format:      "raw",
+		ActualSize:  actualSize(r.Handler),
+	}
+}
+
+// BackingChainInfo describes the image and every image of its opened
+// backing chain like qemu-img info --backing-chain
+func BackingChainInfo(image *Image) ([]*ImageInfo, error) {
+	var infos []*ImageInfo
+	for image != nil {
+		info, err := image.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+
+		switch backing := image.Backing.(type) {
+		case *Image:
+			image = backing
+		case *RawDisk:
+			infos = append(infos, backing.Info(info.FullBackingFilename))
+			image = nil
+		default:
+			image = nil
+		}
+	}
+	return infos, nil
+}
+
+// backingPath is the backing file name resolved against the directory
+// of the image, like the opener of local backing files does
+func (i *Image) backingPath() string {
+	if filepath.IsAbs(i.BackingFile) {
+		return i.BackingFile
+	}
+	return filepath.Join(filepath.Dir(i.Name), i.BackingFile)
+}
+
+// actualSize is the space the file takes on the file system, or its
+// size if that is unknown
+func actualSize(f FileHandler) uint64 {
+	if h, ok := f.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := h.Stat(); err == nil {
+			if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+				return uint64(stat.Blocks) * 512
+			}
+		}
+	}
+	size, _ := HandlerSize(f)
+	return size
+}
+
+// the layout of a luks1 header
+const (
+	luksHeaderSize  = 592
+	luksSlotCount   = 8
+	luksSlotOffset  = 208
+	luksSlotSize    = 48
+	luksSlotActive  = 0x00ac71f3
+	luksSectorBytes = 512
+)
+
+// luksInfo parses the luks header the encryption extension points to
+func (i *Image) luksInfo() (*EncryptInfo, error) {
+	ext := i.Extension(ExtensionEncryption)
+	if ext == nil || len(ext.Data) < 16 {
+		return nil, errors.New("luks encryption without the encryption extension")
+	}
+	offset := binary.BigEndian.Uint64(ext.Data[0:8])
+
+	hdr, err := readAt(i.Handler, int64(offset), luksHeaderSize)
+	if err != nil {
+		return nil, errors.Join(errors.New("reading luks header failed"), err)
+	}
+	if !bytes.Equal(hdr[0:6], []byte("LUKS\xba\xbe")) {
+		return nil, errors.New("invalid luks header")
+	}
+
+	cString := func(b []byte) string {
+		return string(bytes.TrimRight(b, "\x00"))
+	}
+	cipherName := cString(hdr[8:40])
+	mode, ivgen, _ := strings.Cut(cString(hdr[40:72]), "-")
+	ivgen, ivgenHash, _ := strings.Cut(ivgen, ":")
+	keyBits := binary.BigEndian.Uint32(hdr[108:112]) * 8
+	if mode == "xts" {
+		// xts splits the key into two
+		keyBits /= 2
+	}
+
+	info := &EncryptInfo{
+		Format:         "luks",
+		IvgenAlg:       ivgen,
+		IvgenHashAlg:   ivgenHash,
+		HashAlg:        cString(hdr[72:104]),
+		CipherAlg:      fmt.Sprintf("%s-%d", cipherName, keyBits),
+		UUID:           cString(hdr[168:208]),
+		CipherMode:     mode,
+		PayloadOffset:  uint64(binary.BigEndian.Uint32(hdr[104:108])) * luksSectorBytes,
+		MasterKeyIters: binary.BigEndian.Uint32(hdr[164:168]),
+	}
+	for slot := range luksSlotCount {
+		s := hdr[luksSlotOffset+slot*luksSlotSize:]
+		ls := LUKSSlot{
+			Active:    binary.BigEndian.Uint32(s[0:4]) == luksSlotActive,
+			KeyOffset: uint64(binary.BigEndian.Uint32(s[40:44])) * luksSectorBytes,
+		}
+		if ls.Active {
+			ls.Iters = binary.BigEndian.Uint32(s[4:8])
+			ls.Stripes = binary.BigEndian.Uint32(s[44:48])
+		}
+		info.Slots = append(info.Slots, ls)
+	}
+	return info, nil
+}
@@ -0,0 +1,142 @@
+package gqcow2_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageInfo(t *testing.T) {
+	t.Run("Info of a v3 image with a raw backing file",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "base.raw"), make([]byte, 1<<20), 0o644))
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 2<<20, "base.raw", "raw")
+
+			lazy := true
+			require.NoError(t, overlay.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy}))
+			bitmap := gqcow2.NewBitmap("b0", 16, 2<<20)
+			bitmap.Flags = gqcow2.BitmapAuto
+			require.NoError(t, overlay.StoreBitmap(bitmap))
+
+			info, err := overlay.Info()
+			require.NoError(t, err)
+			assert.Equal(t, uint64(2<<20), info.VirtualSize)
+			assert.Equal(t, "qcow2", info.Format)
+			assert.Equal(t, 65536, info.ClusterSize)
+			assert.NotZero(t, info.ActualSize)
+			assert.Equal(t, "base.raw", info.BackingFilename)
+			assert.Equal(t, filepath.Join(dir, "base.raw"), info.FullBackingFilename)
+			assert.Equal(t, "raw", info.BackingFormat)
+			assert.False(t, info.DirtyFlag)
+
+			data := info.FormatSpecific.Data
+			assert.Equal(t, "1.1", data.Compat)
+			assert.Equal(t, "zlib", data.CompressionType)
+			assert.True(t, *data.LazyRefCounts)
+			assert.False(t, *data.Corrupt)
+			assert.Equal(t, 16, data.RefCountBits)
+			assert.Equal(t, []gqcow2.BitmapInfo{{Flags: []string{"auto"}, Name: "b0", Granularity: 65536}}, data.Bitmaps)
+			assert.Nil(t, data.Encrypt)
+
+			chain, err := gqcow2.BackingChainInfo(overlay)
+			require.NoError(t, err)
+			require.Len(t, chain, 2)
+			assert.Equal(t, &gqcow2.ImageInfo{
+				VirtualSize: 1 << 20,
+				Filename:    filepath.Join(dir, "base.raw"),
+				Format:      "raw",
+				ActualSize:  chain[1].ActualSize,
+			}, chain[1])
+		})
+
+	t.Run("The json of v2 leaves out the v3 fields",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "v2.qcow2")
+			image, _ := createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20, Version: 2}, nil)
+
+			info, err := image.Info()
+			require.NoError(t, err)
+			out, err := json.Marshal(info.FormatSpecific)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"type": "qcow2", "data": {"compat": "0.10", "compression-type": "zlib", "refcount-bits": 16}}`, string(out))
+		})
+
+	t.Run("Snapshots and the luks header",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "luks.qcow2")
+			image, _ := createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20}, nil)
+
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer f.Close()
+
+			date := time.Unix(1700000000, 0)
+			_, err = f.WriteAt(snapshotEntry(image.Header.L1TableOffset, image.Header.L1Size, "1", "snap", date, 1<<20), 1<<20)
+			require.NoError(t, err)
+
+			luks := make([]byte, 592)
+			copy(luks, "LUKS\xba\xbe")
+			binary.BigEndian.PutUint16(luks[6:8], 1)
+			copy(luks[8:], "aes")
+			copy(luks[40:], "xts-plain64")
+			copy(luks[72:], "sha256")
+			binary.BigEndian.PutUint32(luks[104:108], 4096)
+			binary.BigEndian.PutUint32(luks[108:112], 64)
+			binary.BigEndian.PutUint32(luks[164:168], 1000)
+			copy(luks[168:], "1b0d6a4a-3f5e-4c5a-9d3c-6c0b3a3e1f00")
+			for slot := range 8 {
+				s := luks[208+slot*48:]
+				binary.BigEndian.PutUint32(s[0:4], 0x0000dead)
+				binary.BigEndian.PutUint32(s[40:44], uint32(8+slot*504))
+			}
+			binary.BigEndian.PutUint32(luks[208:212], 0x00ac71f3)
+			binary.BigEndian.PutUint32(luks[212:216], 2000)
+			binary.BigEndian.PutUint32(luks[252:256], 4000)
+			_, err = f.WriteAt(luks, 2<<20)
+			require.NoError(t, err)
+
+			ext := make([]byte, 16)
+			binary.BigEndian.PutUint64(ext[0:8], 2<<20)
+			binary.BigEndian.PutUint64(ext[8:16], 2<<20)
+			image.SetExtension(gqcow2.ExtensionEncryption, ext)
+			image.Header.CryptMethod = gqcow2.CryptLUKS
+			image.Header.NumSnapshots = 1
+			image.Header.SnapshotOffset = 1 << 20
+			require.NoError(t, image.WriteHeader())
+
+			reopened, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			defer reopened.Close()
+			info, err := reopened.Info()
+			require.NoError(t, err)
+
+			require.Len(t, info.Snapshots, 1)
+			assert.Equal(t, "snap", info.Snapshots[0].Name)
+			assert.Equal(t, int64(1700000000), info.Snapshots[0].DateSec)
+			assert.Equal(t, int64(90), info.Snapshots[0].VMClockSec)
+			assert.Equal(t, int64(12345), *info.Snapshots[0].ICount)
+
+			assert.True(t, info.Encrypted)
+			encrypt := info.FormatSpecific.Data.Encrypt
+			require.NotNil(t, encrypt)
+			assert.Equal(t, "luks", encrypt.Format)
+			assert.Equal(t, "aes-256", encrypt.CipherAlg)
+			assert.Equal(t, "xts", encrypt.CipherMode)
+			assert.Equal(t, "plain64", encrypt.IvgenAlg)
+			assert.Equal(t, "sha256", encrypt.HashAlg)
+			assert.Equal(t, uint64(4096*512), encrypt.PayloadOffset)
+			assert.Equal(t, uint32(1000), encrypt.MasterKeyIters)
+			require.Len(t, encrypt.Slots, 8)
+			assert.Equal(t, gqcow2.LUKSSlot{Active: true, Iters: 2000, Stripes: 4000, KeyOffset: 4096}, encrypt.Slots[0])
+			assert.Equal(t, gqcow2.LUKSSlot{KeyOffset: 512 * 512}, encrypt.Slots[1])
+		})
+}
@@ -0,0 +1,201 @@
+package gqcow2
+
+import (
+	"errors"
+)
+
+type MeasureOptions struct {
+	// options of the target image, 0 means the default like CreateOptions
+	ClusterBits   uint32
+	RefCountOrder uint32
+	Preallocation PreallocMode
+
+	// the data is written compressed, compressed source clusters then
+	// count by their compressed size, other data is counted uncompressed
+	// as the upper bound
+	Compress bool
+}
+
+// MeasureResult follows the json output of qemu-img measure
+type MeasureResult struct {
+	// the file size needed by the data and the metadata
+	Required uint64 `json:"required"`
+	// the file size once every cluster is allocated
+	FullyAllocated uint64 `json:"fully-allocated"`
+}
+
+func (opts *MeasureOptions) setDefaults() error {
+	if opts.ClusterBits == 0 {
+		opts.ClusterBits = DefaultClusterBits
+	}
+	if opts.RefCountOrder == 0 {
+		opts.RefCountOrder = DefaultRefCountOrder
+	}
+	if opts.Preallocation == "" {
+		opts.Preallocation = PreallocOff
+	}
+	if opts.ClusterBits < 9 || opts.ClusterBits > 21 {
+		return errors.New("cluster bits must be between 9 and 21")
+	}
+	if opts.RefCountOrder > 6 {
+		return errors.New("refcount order must not exceed 6")
+	}
+	if opts.Compress && opts.Preallocation != PreallocOff {
+		return errors.New("compression cannot be used with preallocation")
+	}
+	return nil
+}
+
+// MeasureSize measures a new empty image of the virtual size like
+// qemu-img measure --size
+func MeasureSize(size uint64, opts MeasureOptions) (*MeasureResult, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+	return measure(size, 0, opts), nil
+}
+
+// Measure measures the image converted from source like qemu-img measure,
+// the data of the whole backing chain of the source is counted.
+func Measure(source *Image, opts MeasureOptions) (*MeasureResult, error) {
+	if err := opts.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	clusterSize := uint64(1) << opts.ClusterBits
+	cm, err := source.DumpToClusterMap()
+	if err != nil {
+		return nil, err
+	}
+
+	// the target clusters touched by data
+	dataClusters := uint64(0)
+	lastCluster := uint64(0)
+	touch := func(start uint64, length uint64) {
+		first := start / clusterSize
+		last := (start + length - 1) / clusterSize
+		if dataClusters > 0 && first <= lastCluster {
+			first = lastCluster + 1
+		}
+		if last >= first {
+			dataClusters += last - first + 1
+			lastCluster = last
+		}
+	}
+
+	compressedBytes := uint64(0)
+	if opts.Compress {
+		for _, gc := range cm.CompressedCluster {
+			_, length := source.compressedRange(gc.L2Info.Compressed)
+			compressedBytes += length
+		}
+	}
+
+	sourceClusterSize := uint64(source.Header.ClusterSize())
+	for _, region := range cm.Regions {
+		switch {
+		case region.Compressed && opts.Compress:
+		case region.Present && region.Data:
+			touch(region.Start, region.Length)
+		case !region.Present && source.Backing != nil:
+			for offset := region.Start; offset < region.Start+region.Length; offset += sourceClusterSize {
+				length := min(sourceClusterSize, region.Start+region.Length-offset)
+				data, err := chainHasData(source.Backing, offset)
+				if err != nil {
+					return nil, err
+				}
+				if data {
+					touch(offset, length)
+				}
+			}
+		}
+	}
+
+	return measure(source.Header.Size, dataClusters*clusterSize+alignUp(compressedBytes, clusterSize), opts), nil
+}
+
+// chainHasData tells if the backing chain has data at offset,
+// zero clusters and the parts beyond the end of a disk have no data
+func chainHasData(disk BackingDisk, offset uint64) (bool, error) {
+	for disk != nil {
+		if offset >= disk.VirtualSize() {
+			return false, nil
+		}
+		image, ok := disk.(*Image)
+		if !ok {
+			return true, nil
+		}
+
+		entry, err := image.FindL2Entry(offset)
+		if err != nil {
+			return false, err
+		}
+		if entry.Standard != nil && entry.Standard.AllZero {
+			return false, nil
+		}
+		if entry.Allocated() {
+			return true, nil
+		}
+		disk = image.Backing
+	}
+	return false, nil
+}
+
+// measure adds the metadata of a fully allocated image to the data
+func measure(size uint64, data uint64, opts MeasureOptions) *MeasureResult {
+	clusterSize := uint64(1) << opts.ClusterBits
+	virtualSize := alignUp(size, clusterSize)
+	fullyAllocated := fullyAllocatedSize(virtualSize, clusterSize, opts.RefCountOrder)
+
+	if opts.Preallocation == PreallocFull || opts.Preallocation == PreallocFalloc {
+		data = virtualSize
+	}
+
+	// the metadata is counted for the fully allocated image
+	return &MeasureResult{
+		Required:       fullyAllocated - virtualSize + data,
+		FullyAllocated: fullyAllocated,
+	}
+}
+
+// fullyAllocatedSize is the file size with every cluster of the
+// virtual size allocated, as qemu computes it
+func fullyAllocatedSize(virtualSize uint64, clusterSize uint64, refCountOrder uint32) uint64 {
+	entriesPerTable := clusterSize / 8
+
+	// the header
+	metaSize := clusterSize
+	// l2 tables
+	l2Entries := alignUp(virtualSize/clusterSize, entriesPerTable)
+	metaSize += l2Entries * 8
+	// l1 table
+	l1Entries := alignUp(l2Entries*8/clusterSize, entriesPerTable)
+	metaSize += l1Entries * 8
+	// refcount table and blocks
+	metaSize += refCountMetadataSize((metaSize+virtualSize)/clusterSize, clusterSize, refCountOrder)
+
+	return metaSize + virtualSize
+}
+
+// refCountMetadataSize is the size of the refcount table and blocks
+// covering the clusters as well as themselves
+func refCountMetadataSize(clusters uint64, clusterSize uint64, refCountOrder uint32) uint64 {
+	blocks, tableClusters := refCountMetadataClusters(clusters, clusterSize, refCountOrder)
+	return (blocks + tableClusters) * clusterSize
+}
+
+// refCountMetadataClusters is the number of refcount blocks and refcount
+// table clusters covering the clusters as well as themselves
+func refCountMetadataClusters(clusters uint64, clusterSize uint64, refCountOrder uint32) (uint64, uint64) {
+	refCountsPerBlock := clusterSize * 8 / (1 << refCountOrder)
+	blocks, tableClusters := uint64(0), uint64(0)
+	for {
+		total := clusters + blocks + tableClusters
+		newBlocks := divRoundUp(total, refCountsPerBlock)
+		newTableClusters := divRoundUp(newBlocks*RefCountTableEntrySizeByte, clusterSize)
+		if newBlocks == blocks && newTableClusters == tableClusters {
+			return blocks, tableClusters
+		}
+		blocks, tableClusters = newBlocks, newTableClusters
+	}
+}
@@ -0,0 +1,77 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Measure(t *testing.T) {
+	t.Run("Measure a virtual size like qemu-img measure --size",
+		func(t *testing.T) {
+			// the values printed by qemu-img measure -O qcow2
+			result, err := gqcow2.MeasureSize(0, gqcow2.MeasureOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.MeasureResult{Required: 196608, FullyAllocated: 196608}, result)
+
+			result, err = gqcow2.MeasureSize(1<<30, gqcow2.MeasureOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.MeasureResult{Required: 393216, FullyAllocated: 1074135040}, result)
+
+			result, err = gqcow2.MeasureSize(1<<30, gqcow2.MeasureOptions{Preallocation: gqcow2.PreallocFull})
+			require.NoError(t, err)
+			assert.Equal(t, result.FullyAllocated, result.Required)
+
+			_, err = gqcow2.MeasureSize(1<<30, gqcow2.MeasureOptions{Preallocation: gqcow2.PreallocFull, Compress: true})
+			assert.Error(t, err)
+		})
+
+	t.Run("Measure counts the target clusters holding data",
+		func(t *testing.T) {
+			image, _ := createTestImage(t, filepath.Join(t.TempDir(), "measure.qcow2"),
+				gqcow2.CreateOptions{Size: 4 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 3 * 65536}, {Start: 100000, Length: 1000}, {Start: 10 * 65536, Length: 65536}})
+			require.NoError(t, image.WriteZeroes(20*65536, 65536, true))
+
+			result, err := gqcow2.Measure(image, gqcow2.MeasureOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.MeasureResult{Required: 327680 + 4*65536, FullyAllocated: 327680 + 4<<20}, result)
+
+			// the image converted with the same options fits
+			converted, _ := createTestImage(t, filepath.Join(t.TempDir(), "converted.qcow2"),
+				gqcow2.CreateOptions{Size: 4 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 3 * 65536}, {Start: 10 * 65536, Length: 65536}})
+			check, err := converted.Check()
+			require.NoError(t, err)
+			assert.LessOrEqual(t, check.ImageEndOffset, result.Required)
+
+			result, err = gqcow2.Measure(image, gqcow2.MeasureOptions{ClusterBits: 12, RefCountOrder: 6})
+			require.NoError(t, err)
+			assert.Equal(t, &gqcow2.MeasureResult{Required: 32768 + 64*4096, FullyAllocated: 32768 + 4<<20}, result)
+		})
+
+	t.Run("Measure counts the data of the backing chain",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			createTestImage(t, filepath.Join(dir, "base.qcow2"),
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 2 * 65536}})
+
+			overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 1<<20, "base.qcow2", "qcow2")
+			require.NoError(t, overlay.WriteZeroes(0, 65536, true))
+			_, err := overlay.WriteAt(bytes.Repeat([]byte{1}, 1000), 5*65536)
+			require.NoError(t, err)
+
+			result, err := gqcow2.Measure(overlay, gqcow2.MeasureOptions{})
+			require.NoError(t, err)
+			empty, err := gqcow2.MeasureSize(1<<20, gqcow2.MeasureOptions{})
+			require.NoError(t, err)
+			// cluster 1 of the base and cluster 5 of the overlay
+			assert.Equal(t, empty.Required+2*65536, result.Required)
+		})
+}
@@ -0,0 +1,312 @@
+package gqcow2
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// qemu refuses chains deeper than this as well
+const maxBackingChainDepth = 64
+
+// BackingDisk is the guest view of a backing file, either
+// another qcow2 image or a raw disk.
+type BackingDisk interface {
+	io.ReaderAt
+	VirtualSize() uint64
+}
+
+// RawDisk exposes a raw file as a BackingDisk, reading
+// beyond the end of the file returns zeros.
+type RawDisk struct {
+	Handler FileHandler
+	Size    uint64
+}
+
+func NewRawDisk(f FileHandler, size uint64) *RawDisk {
+	return &RawDisk{Handler: f, Size: size}
+}
+
+func (r *RawDisk) VirtualSize() uint64 {
+	return r.Size
+}
+
+func (r *RawDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(r.Size) {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > int64(r.Size) {
+		p = p[:int64(r.Size)-off]
+		eof = io.EOF
+	}
+
+	rc, err := r.Handler.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		return rc, err
+	}
+	// the file may be shorter than the disk
+	clear(p[rc:])
+
+	return len(p), eof
+}
+
+// WriteAt writes into the raw file if it is writable
+func (r *RawDisk) WriteAt(p []byte, off int64) (int, error) {
+	w, ok := r.Handler.(io.WriterAt)
+	if !ok {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || uint64(off)+uint64(len(p)) > r.Size {
+		return 0, ErrOutOfRange
+	}
+	return w.WriteAt(p, off)
+}
+
+// Resize changes the size of the raw disk, the handler must support Truncate
+func (r *RawDisk) Resize(newSize uint64) error {
+	t, ok := r.Handler.(Truncater)
+	if !ok {
+		return errors.New("raw disk cannot be resized")
+	}
+	if err := t.Truncate(int64(newSize)); err != nil {
+		return err
+	}
+	r.Size = newSize
+	return nil
+}
+
+// ReadAt reads the guest visible content of the virtual disk,
+// unallocated clusters are read from the backing file if it is opened.
+func (i *Image) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	virtualSize := i.Header.Size
+	if uint64(off) >= virtualSize {
+		return 0, io.EOF
+	}
+	var eof error
+	if uint64(off)+uint64(len(p)) > virtualSize {
+		p = p[:virtualSize-uint64(off)]
+		eof = io.EOF
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	done := 0
+	for done < len(p) {
+		vdOffset := uint64(off) + uint64(done)
+		chunk := min(clusterSize-vdOffset%clusterSize, uint64(len(p)-done))
+
+		entry, err := i.FindL2Entry(vdOffset)
+		if err != nil {
+			return done, err
+		}
+		if err := i.readGuest(entry, vdOffset, p[done:done+int(chunk)]); err != nil {
+			return done, err
+		}
+		done += int(chunk)
+	}
+
+	return done, eof
+}
+
+// readGuest fills buf, which never crosses the cluster boundary,
+// with the guest data at vdOffset described by the l2 entry
+func (i *Image) readGuest(entry L2Entry, vdOffset uint64, buf []byte) error {
+	inCluster := vdOffset % uint64(i.Header.ClusterSize())
+
+	if entry.Compressed != nil {
+		gc := GuestCluster{GuestClusterMeta: GuestClusterMeta{L2Info: entry}}
+		if err := decompressGuestCluster(i, &gc); err != nil {
+			return err
+		}
+		copy(buf, gc.Raw[inCluster:])
+		return nil
+	}
+
+	if entry.Standard.AllZero {
+		clear(buf)
+		return nil
+	}
+
+	if entry.Standard.DataOffset != 0 {
+		rc, err := i.Handler.ReadAt(buf, int64(entry.Standard.DataOffset+inCluster))
+		if rc < len(buf) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		return nil
+	}
+
+	// unallocated
+	return i.readBacking(vdOffset, buf)
+}
+
+// readBacking reads the backing file, or zeros if there is no backing
+// file or the backing file is smaller than this image
+func (i *Image) readBacking(vdOffset uint64, buf []byte) error {
+	return readDisk(i.Backing, vdOffset, buf)
+}
+
+// readDisk reads the disk, a nil disk and the part beyond its end read as zeros
+func readDisk(disk BackingDisk, offset uint64, buf []byte) error {
+	if disk == nil || offset >= disk.VirtualSize() {
+		clear(buf)
+		return nil
+	}
+
+	rc, err := disk.ReadAt(buf, int64(offset))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	clear(buf[rc:])
+	return nil
+}
+
+// BackingOpener opens the backing file name found in the header of
+// image from. Relative names are resolved by the opener.
+type BackingOpener func(from *Image, name string) (FileHandler, error)
+
+// OpenLocalBacking opens the backing file from the local file system,
+// relative names are resolved against the directory of the overlay.
+func OpenLocalBacking(from *Image, name string) (FileHandler, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(from.Name), name)
+	}
+	return os.Open(name)
+}
+
+// OpenLocalBackingRW is like OpenLocalBacking, but opens
+// the backing file for writing, as commit requires.
+func OpenLocalBackingRW(from *Image, name string) (FileHandler, error) {
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(filepath.Dir(from.Name), name)
+	}
+	return os.OpenFile(name, os.O_RDWR, 0)
+}
+
+// OpenBacking opens the whole backing chain of the image
+func (i *Image) OpenBacking(open BackingOpener) error {
+	return i.openBacking(open, 0)
+}
+
+func (i *Image) openBacking(open BackingOpener, depth int) error {
+	if i.BackingFile == "" {
+		return nil
+	}
+
+	backing, err := i.openBackingDisk(open, i.BackingFile, i.BackingFormat, depth)
+	if err != nil {
+		return err
+	}
+	i.Backing = backing
+	return nil
+}
+
+// openBackingDisk opens the backing file name of the image, format is
+// probed if empty. A qcow2 backing file gets its own chain opened.
+func (i *Image) openBackingDisk(open BackingOpener, name string, format string, depth int) (BackingDisk, error) {
+	if depth >= maxBackingChainDepth {
+		return nil, fmt.Errorf("backing chain of %s is too deep", i.Name)
+	}
+
+	f, err := open(i, name)
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("opening backing file %s failed", name), err)
+	}
+
+	if named, ok := f.(interface{ Name() string }); ok {
+		name = named.Name()
+	}
+
+	if format == "" {
+		if format, err = probeFormat(f); err != nil {
+			return nil, err
+		}
+	}
+
+	switch format {
+	case "qcow2":
+		backing, err := NewFileImage(f, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := backing.openBacking(open, depth+1); err != nil {
+			return nil, err
+		}
+		return backing, nil
+	case "raw":
+		size, err := HandlerSize(f)
+		if err != nil {
+			return nil, err
+		}
+		return NewRawDisk(f, size), nil
+	}
+
+	return nil, fmt.Errorf("unsupported backing format %s", format)
+}
+
+// OpenImage opens a local qcow2 file together with its backing chain
+func OpenImage(path string, writable bool) (*Image, error) {
+	flag := os.O_RDONLY
+	if writable {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := NewFileImage(f, path)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// an os.File is always a WriterAt, even opened read only
+	image.RWMode = writable
+	if writable && image.staleRefCounts {
+		if err := image.RebuildRefCounts(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if err := image.OpenBacking(OpenLocalBacking); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return image, nil
+}
+
+// probeFormat tells qcow2 from raw by the magic
+func probeFormat(f FileHandler) (string, error) {
+	magic := make([]byte, 4)
+	rc, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if rc == 4 && string(magic) == QCOW2MagicNumber {
+		return "qcow2", nil
+	}
+	return "raw", nil
+}
+
+// HandlerSize finds out the size of the file behind the handler
+func HandlerSize(f FileHandler) (uint64, error) {
+	switch h := f.(type) {
+	case interface{ Stat() (os.FileInfo, error) }:
+		info, err := h.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return uint64(info.Size()), nil
+	case interface{ Size() int64 }:
+		return uint64(h.Size()), nil
+	}
+	return 0, errors.New("cannot find out the size of the file")
+}
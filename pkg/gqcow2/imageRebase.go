@@ -0,0 +1,123 @@
+package gqcow2
+
+import (
+	"bytes"
+	"errors"
+)
+
+type RebaseOptions struct {
+	// the new backing file, empty to remove the backing file
+	BackingFile   string
+	BackingFormat string
+
+	// only rewrite the backing file name, like qemu-img rebase -u
+	Unsafe bool
+
+	// opens the new backing file, required in safe mode. In unsafe
+	// mode the new backing file is opened if it is set.
+	Open BackingOpener
+
+	Progress ProgressFunc
+}
+
+// Rebase changes the backing file of the image like qemu-img rebase.
+//
+// In safe mode the old backing file must be opened, every cluster not
+// allocated in the image is compared between the old and the new
+// backing file, the different ones are copied into the image so the
+// guest visible content doesn't change.
+func Rebase(image *Image, opts RebaseOptions) error {
+	if !image.RWMode {
+		return ErrReadOnly
+	}
+
+	var newBacking BackingDisk
+	if opts.BackingFile != "" && opts.Open != nil {
+		var err error
+		newBacking, err = image.openBackingDisk(opts.Open, opts.BackingFile, opts.BackingFormat, 0)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := switchBacking(image, newBacking, opts); err != nil {
+		return errors.Join(err, closeDisk(newBacking))
+	}
+
+	// the old backing chain is no longer used
+	oldBacking := image.Backing
+	image.Backing = newBacking
+	return closeDisk(oldBacking)
+}
+
+// switchBacking copies the differences in safe mode and writes the new
+// backing file into the header
+func switchBacking(image *Image, newBacking BackingDisk, opts RebaseOptions) error {
+	if !opts.Unsafe {
+		if image.BackingFile != "" && image.Backing == nil {
+			return errors.New("the old backing file must be opened for a safe rebase")
+		}
+		if opts.BackingFile != "" && newBacking == nil {
+			return errors.New("the new backing file must be opened for a safe rebase")
+		}
+		if err := copyBackingDifference(image, newBacking, opts.Progress); err != nil {
+			return err
+		}
+	}
+
+	image.BackingFile = opts.BackingFile
+	image.BackingFormat = opts.BackingFormat
+	if opts.BackingFile == "" {
+		image.BackingFormat = ""
+	}
+	return image.WriteHeader()
+}
+
+// copyBackingDifference copies the old backing data into the image
+// wherever the image is unallocated and the new backing differs
+func copyBackingDifference(image *Image, newBacking BackingDisk, progress ProgressFunc) error {
+	cm, err := image.DumpToClusterMap()
+	if err != nil {
+		return err
+	}
+
+	total := uint64(0)
+	for _, region := range cm.Regions {
+		if !region.Present {
+			total += region.Length
+		}
+	}
+
+	clusterSize := uint64(image.Header.ClusterSize())
+	oldBuf := make([]byte, clusterSize)
+	newBuf := make([]byte, clusterSize)
+	done := uint64(0)
+	for _, region := range cm.Regions {
+		if region.Present {
+			continue
+		}
+
+		for offset := region.Start; offset < region.Start+region.Length; offset += clusterSize {
+			length := min(clusterSize, region.Start+region.Length-offset)
+			if err := image.readBacking(offset, oldBuf[:length]); err != nil {
+				return err
+			}
+			if err := readDisk(newBacking, offset, newBuf[:length]); err != nil {
+				return err
+			}
+
+			if !bytes.Equal(oldBuf[:length], newBuf[:length]) {
+				if _, err := image.WriteAt(oldBuf[:length], int64(offset)); err != nil {
+					return err
+				}
+			}
+
+			done += length
+			if progress != nil {
+				progress(done, total)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,134 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Rebase(t *testing.T) {
+	// base.raw and other.raw only differ in the second and the last cluster
+	setup := func(t *testing.T) (string, *gqcow2.Image) {
+		dir := t.TempDir()
+		base := bytes.Repeat([]byte{1}, 1<<20)
+		other := bytes.Clone(base)
+		copy(other[65536:], bytes.Repeat([]byte{2}, 65536))
+		copy(other[1<<20-100:], bytes.Repeat([]byte{3}, 100))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "other.raw"), other, 0o644))
+
+		overlay := createOverlay(t, filepath.Join(dir, "overlay.qcow2"), 1<<20, "base.raw", "raw")
+		_, err := overlay.WriteAt(bytes.Repeat([]byte{9}, 1000), 65536+500)
+		require.NoError(t, err)
+		return dir, overlay
+	}
+
+	t.Run("Safe rebase keeps the guest content",
+		func(t *testing.T) {
+			dir, overlay := setup(t)
+			want := readGuest(t, overlay)
+
+			var lastDone, lastTotal uint64
+			err := gqcow2.Rebase(overlay, gqcow2.RebaseOptions{
+				BackingFile:   "other.raw",
+				BackingFormat: "raw",
+				Open:          gqcow2.OpenLocalBacking,
+				Progress: func(done uint64, total uint64) {
+					lastDone, lastTotal = done, total
+				},
+			})
+			require.NoError(t, err)
+			assert.Equal(t, lastTotal, lastDone)
+			assert.Equal(t, uint64(15*65536), lastTotal)
+			assert.Equal(t, want, readGuest(t, overlay))
+
+			// only the last cluster had to be copied
+			present := 0
+			for _, region := range overlay.Dump() {
+				if region.Present {
+					present++
+				}
+			}
+			assert.Equal(t, 2, present)
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "overlay.qcow2"), false)
+			require.NoError(t, err)
+			assert.Equal(t, "other.raw", reopened.BackingFile)
+			assert.Equal(t, "raw", reopened.BackingFormat)
+			assert.Equal(t, want, readGuest(t, reopened))
+		})
+
+	t.Run("Safe rebase onto no backing file copies everything",
+		func(t *testing.T) {
+			dir, overlay := setup(t)
+			want := readGuest(t, overlay)
+
+			require.NoError(t, gqcow2.Rebase(overlay, gqcow2.RebaseOptions{}))
+			assert.Equal(t, want, readGuest(t, overlay))
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "overlay.qcow2"), false)
+			require.NoError(t, err)
+			assert.Empty(t, reopened.BackingFile)
+			assert.Nil(t, reopened.Backing)
+			assert.Equal(t, want, readGuest(t, reopened))
+		})
+
+	t.Run("Unsafe rebase only rewrites the backing file name",
+		func(t *testing.T) {
+			dir, overlay := setup(t)
+			want := readGuest(t, overlay)
+			copy(want[1<<20-100:], bytes.Repeat([]byte{3}, 100))
+
+			require.NoError(t, gqcow2.Rebase(overlay, gqcow2.RebaseOptions{
+				BackingFile:   "other.raw",
+				BackingFormat: "raw",
+				Unsafe:        true,
+			}))
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "overlay.qcow2"), false)
+			require.NoError(t, err)
+			assert.Equal(t, "other.raw", reopened.BackingFile)
+			assert.Equal(t, want, readGuest(t, reopened))
+		})
+
+	t.Run("Close the backing files no longer used",
+		func(t *testing.T) {
+			_, overlay := setup(t)
+			old := overlay.Backing.(*gqcow2.RawDisk).Handler.(*os.File)
+
+			var opened []*os.File
+			open := func(from *gqcow2.Image, name string) (gqcow2.FileHandler, error) {
+				f, err := gqcow2.OpenLocalBacking(from, name)
+				if err == nil {
+					opened = append(opened, f.(*os.File))
+				}
+				return f, err
+			}
+			require.NoError(t, gqcow2.Rebase(overlay, gqcow2.RebaseOptions{
+				BackingFile: "other.raw", BackingFormat: "raw", Open: open,
+			}))
+			_, err := old.Stat()
+			assert.ErrorIs(t, err, os.ErrClosed)
+
+			// a failed rebase closes the new backing file again, the old
+			// one must be open for a safe rebase
+			require.NoError(t, gqcow2.Rebase(overlay, gqcow2.RebaseOptions{
+				BackingFile: "other.raw", BackingFormat: "raw", Unsafe: true,
+			}))
+			require.Len(t, opened, 1)
+			_, err = opened[0].Stat()
+			assert.ErrorIs(t, err, os.ErrClosed)
+			assert.Error(t, gqcow2.Rebase(overlay, gqcow2.RebaseOptions{
+				BackingFile: "base.raw", BackingFormat: "raw", Open: open,
+			}))
+			require.Len(t, opened, 2)
+			_, err = opened[1].Stat()
+			assert.ErrorIs(t, err, os.ErrClosed)
+		})
+}
@@ -0,0 +1,298 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrShrinkNotAllowed = errors.New("shrinking the image may lose data, shrink must be requested explicitly")
+
+// Truncater is implemented by handlers whose size can be changed,
+// such as os.File.
+type Truncater interface {
+	Truncate(size int64) error
+}
+
+type ResizeOptions struct {
+	// allow the image to shrink, the data beyond the new end is lost
+	Shrink bool
+	// preallocation of the new area when growing
+	Preallocation PreallocMode
+}
+
+// Resize changes the virtual size of the image like qemu-img resize.
+//
+// Growing extends (and relocates if necessary) the l1 table, the new
+// area reads as zeros. Shrinking must be allowed by opts.Shrink, the
+// clusters beyond the new end are discarded and the image file is
+// truncated if the handler supports it.
+func (i *Image) Resize(newSize uint64, opts ResizeOptions) error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if newSize%512 != 0 {
+		return errors.New("the new size must be a multiple of 512")
+	}
+	bitmaps, err := i.LoadBitmaps()
+	if err != nil {
+		return err
+	}
+	if len(bitmaps) > 0 {
+		return errors.New("cannot resize an image with bitmaps")
+	}
+
+	oldSize := i.Header.Size
+	switch {
+	case newSize == oldSize:
+		return nil
+	case i.Header.NumSnapshots > 0 && i.Header.Version < 3:
+		// the snapshots of v2 don't record their own size
+		return errors.New("cannot resize a v2 image which has snapshots")
+	case newSize > oldSize:
+		if err := i.grow(newSize); err != nil {
+			return err
+		}
+		return i.Preallocate(oldSize, newSize, opts.Preallocation)
+	case !opts.Shrink:
+		return ErrShrinkNotAllowed
+	}
+
+	return i.shrink(newSize)
+}
+
+func (i *Image) grow(newSize uint64) error {
+	oldSize := i.Header.Size
+	clusterSize := uint64(i.Header.ClusterSize())
+
+	if err := i.resizeL1Table(l1SizeFor(newSize, i.Header.ClusterBits)); err != nil {
+		return err
+	}
+
+	i.Header.Size = newSize
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+
+	// the new area must read as zeros, stale data may exist in the tail
+	// of the old last cluster, or in a backing file larger than the image
+	zeroEnd := oldSize
+	if tail := min(alignUp(oldSize, clusterSize), newSize); tail > oldSize {
+		entry, err := i.FindL2Entry(oldSize)
+		if err != nil {
+			return err
+		}
+		if entry.Allocated() {
+			zeroEnd = tail
+		}
+	}
+	if i.Backing != nil {
+		zeroEnd = max(zeroEnd, min(i.Backing.VirtualSize(), newSize))
+	}
+	if zeroEnd > oldSize {
+		return writeZeros(i, oldSize, zeroEnd-oldSize)
+	}
+	return nil
+}
+
+func (i *Image) shrink(newSize uint64) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	l2Coverage := clusterSize * uint64(i.Header.L2EntryPerTable())
+
+	// discard every cluster beyond the new end, the cluster holding
+	// the new end is kept
+	firstCluster := divRoundUp(newSize, clusterSize)
+	for l1Index := firstCluster * clusterSize / l2Coverage; l1Index < uint64(len(i.L1Table)); l1Index++ {
+		l1Entry := i.L1Table[l1Index]
+		if l1Entry.L2TableOffset == 0 {
+			continue
+		}
+
+		tableStart := l1Index * l2Coverage
+		if tableStart >= firstCluster*clusterSize {
+			// the whole table is beyond the new end
+			if err := i.freeL2Table(l1Entry.L2TableOffset); err != nil {
+				return err
+			}
+			i.L1Table[l1Index] = L1Entry{Index: int(l1Index)}
+			if err := i.writeL1Entry(int(l1Index)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// a table shared with a snapshot is copied before its entries
+		// are cleared
+		l2TableStart, _, err := i.l2TableForWrite(tableStart)
+		if err != nil {
+			return err
+		}
+		firstIndex := (firstCluster*clusterSize - tableStart) / clusterSize
+		if err := i.discardL2Entries(l2TableStart, firstIndex, uint64(i.Header.L2EntryPerTable())); err != nil {
+			return err
+		}
+	}
+
+	// the data after the new end in the last cluster must not
+	// reappear if the image grows again
+	if tail := alignUp(newSize, clusterSize); tail > newSize && tail <= i.Header.Size {
+		entry, err := i.FindL2Entry(newSize)
+		if err != nil {
+			return err
+		}
+		if entry.Allocated() {
+			if err := writeZeros(i, newSize, tail-newSize); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := i.resizeL1Table(l1SizeFor(newSize, i.Header.ClusterBits)); err != nil {
+		return err
+	}
+
+	i.Header.Size = newSize
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+
+	return i.truncateToLastCluster()
+}
+
+// discardL2Entries releases the entries [from, to) of the l2 table
+// starting at l2TableStart, which must not be shared
+func (i *Image) discardL2Entries(l2TableStart uint64, from uint64, to uint64) error {
+	table, err := i.ExtractL2Table(l2TableStart)
+	if err != nil {
+		return err
+	}
+
+	for l2Index := from; l2Index < to; l2Index++ {
+		entry := table[l2Index]
+		if !entry.Allocated() && !entry.Standard.AllZero {
+			continue
+		}
+		if err := i.writeL2Entry(l2TableStart, l2Index, L2Entry{Standard: &StandardDescriptor{}}); err != nil {
+			return err
+		}
+		if err := i.releaseL2Entry(entry); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// freeL2Table releases every cluster referenced by the l2 table, then the table itself
+func (i *Image) freeL2Table(offset uint64) error {
+	table, err := i.ExtractL2Table(offset)
+	if err != nil {
+		return err
+	}
+	for _, entry := range table {
+		if err := i.releaseL2Entry(entry); err != nil {
+			return err
+		}
+	}
+
+	i.l2Cache.drop(offset)
+	return i.updateRefCount(offset, uint64(i.Header.ClusterSize()), -1)
+}
+
+// resizeL1Table changes the number of l1 entries, the table is
+// relocated if it outgrows its clusters. Entries beyond the new size
+// must have been released already.
+func (i *Image) resizeL1Table(newL1Size uint32) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	oldL1Size := i.Header.L1Size
+	if newL1Size == oldL1Size {
+		return nil
+	}
+
+	oldClusters := max(divRoundUp(uint64(oldL1Size)*8, clusterSize), 1)
+	newClusters := max(divRoundUp(uint64(newL1Size)*8, clusterSize), 1)
+
+	if newL1Size < oldL1Size {
+		i.L1Table = i.L1Table[:newL1Size]
+		i.Header.L1Size = newL1Size
+		if err := i.WriteHeader(); err != nil {
+			return err
+		}
+		if newClusters < oldClusters {
+			return i.updateRefCount(i.Header.L1TableOffset+newClusters*clusterSize,
+				(oldClusters-newClusters)*clusterSize, -1)
+		}
+		return nil
+	}
+
+	for index := oldL1Size; index < newL1Size; index++ {
+		i.L1Table = append(i.L1Table, L1Entry{Index: int(index)})
+	}
+
+	rawTable := make([]byte, newClusters*clusterSize)
+	for index, entry := range i.L1Table {
+		binary.BigEndian.PutUint64(rawTable[index*8:index*8+8], entry.Raw())
+	}
+
+	// still fits, zero the new entries in place
+	if newClusters <= oldClusters {
+		newEntries := rawTable[uint64(oldL1Size)*8 : uint64(newL1Size)*8]
+		if _, err := i.writer().WriteAt(newEntries, int64(i.Header.L1TableOffset)+int64(oldL1Size)*8); err != nil {
+			return err
+		}
+		i.Header.L1Size = newL1Size
+		return i.WriteHeader()
+	}
+
+	oldOffset := i.Header.L1TableOffset
+	newOffset, err := i.allocateClusters(newClusters)
+	if err != nil {
+		return err
+	}
+	if _, err := i.writer().WriteAt(rawTable, int64(newOffset)); err != nil {
+		return err
+	}
+
+	i.Header.L1TableOffset = newOffset
+	i.Header.L1Size = newL1Size
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+
+	return i.updateRefCount(oldOffset, oldClusters*clusterSize, -1)
+}
+
+// lastUsedCluster returns the index of the last host cluster whose refcount is not 0
+func (i *Image) lastUsedCluster() (uint64, error) {
+	entryCount := uint64(i.Header.RefCountBlockEntryCount())
+	for tableIndex := len(i.RefCountTable) - 1; tableIndex >= 0; tableIndex-- {
+		if i.RefCountTable[tableIndex].RefCountBlockOffset == 0 {
+			continue
+		}
+		first := uint64(tableIndex) * entryCount
+		for clusterIndex := first + entryCount; clusterIndex > first; clusterIndex-- {
+			refcount, err := i.getRefCount(clusterIndex - 1)
+			if err != nil {
+				return 0, err
+			}
+			if refcount != 0 {
+				return clusterIndex - 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("no cluster is in use")
+}
+
+// truncateToLastCluster cuts the free clusters off the end of the image file
+func (i *Image) truncateToLastCluster() error {
+	t, ok := i.Handler.(Truncater)
+	if !ok {
+		return nil
+	}
+
+	last, err := i.lastUsedCluster()
+	if err != nil {
+		return err
+	}
+	return t.Truncate(int64((last + 1) * uint64(i.Header.ClusterSize())))
+}
@@ -0,0 +1,120 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ImageResize(t *testing.T) {
+	t.Run("Grow relocates the l1 table",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "grow.qcow2")
+			// 512 bytes clusters, one l1 cluster maps 2MiB
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20, ClusterBits: 9},
+				[]gqcow2.Extent{{Start: 1000, Length: 300000}})
+			oldL1Offset := image.Header.L1TableOffset
+
+			require.NoError(t, image.Resize(8<<20, gqcow2.ResizeOptions{}))
+			assert.Equal(t, uint64(8<<20), image.VirtualSize())
+			assert.NotEqual(t, oldL1Offset, image.Header.L1TableOffset)
+
+			tail := bytes.Repeat([]byte{0x5a}, 4096)
+			_, err := image.WriteAt(tail, 8<<20-4096)
+			require.NoError(t, err)
+
+			reopened, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			got := readGuest(t, reopened)
+			assert.Equal(t, content, got[:1<<20])
+			assert.True(t, isZero(got[1<<20:8<<20-4096]))
+			assert.Equal(t, tail, got[8<<20-4096:])
+		})
+
+	t.Run("Shrink requires the shrink flag",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "shrink.qcow2")
+			image, _ := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 4 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 4 << 20}})
+
+			assert.ErrorIs(t, image.Resize(1<<20, gqcow2.ResizeOptions{}), gqcow2.ErrShrinkNotAllowed)
+			assert.Equal(t, uint64(4<<20), image.VirtualSize())
+		})
+
+	t.Run("Shrink discards clusters beyond the new end",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "shrink.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 4 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 4 << 20}})
+			before, err := os.Stat(path)
+			require.NoError(t, err)
+
+			newSize := uint64(1<<20 + 512)
+			require.NoError(t, image.Resize(newSize, gqcow2.ResizeOptions{Shrink: true}))
+
+			after, err := os.Stat(path)
+			require.NoError(t, err)
+			assert.Less(t, after.Size(), before.Size()-int64(2<<20))
+
+			// growing again must not bring the discarded data back
+			require.NoError(t, image.Resize(4<<20, gqcow2.ResizeOptions{}))
+			reopened, err := gqcow2.OpenImage(path, false)
+			require.NoError(t, err)
+			got := readGuest(t, reopened)
+			assert.Equal(t, content[:newSize], got[:newSize])
+			assert.True(t, isZero(got[newSize:]))
+		})
+
+	t.Run("Shrink keeps the clusters of a snapshot",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.qcow2")
+			content := putSnapshotImage(t, path)
+			before, err := os.ReadFile(path)
+			require.NoError(t, err)
+
+			image, err := gqcow2.OpenImage(path, true)
+			require.NoError(t, err)
+			defer image.Close()
+			require.NoError(t, image.Resize(65536, gqcow2.ResizeOptions{Shrink: true}))
+			assert.Equal(t, content[:65536], readGuest(t, image))
+
+			// the snapshot still has its l2 table and both data clusters
+			after, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, before[4*65536:7*65536], after[4*65536:7*65536])
+			result, err := image.Check()
+			require.NoError(t, err)
+			assert.True(t, result.Consistent(), result.Problems)
+			assert.Zero(t, result.Leaks, result.Problems)
+		})
+
+	t.Run("Refuse to resize a v2 image with snapshots",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.qcow2")
+			createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20, Version: 2}, nil)
+			f, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			_, err = f.WriteAt([]byte{0, 0, 0, 1}, 60)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			image, err := gqcow2.OpenImage(path, true)
+			require.NoError(t, err)
+			defer image.Close()
+			assert.ErrorContains(t, image.Resize(2<<20, gqcow2.ResizeOptions{}), "v2")
+			assert.ErrorContains(t, image.Resize(65536, gqcow2.ResizeOptions{Shrink: true}), "v2")
+		})
+}
+
+func isZero(buf []byte) bool {
+	return bytes.Count(buf, []byte{0}) == len(buf)
+}
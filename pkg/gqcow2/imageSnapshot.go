@@ -0,0 +1,374 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// the size of the extra data written for each snapshot: the vm state
+// size, the disk size and the instruction counter
+const snapshotExtraSize = 24
+
+// CreateSnapshot takes an internal snapshot of the guest disk like
+// qemu-img snapshot -c. The snapshot gets a copy of the l1 table, the
+// l2 tables and the clusters are shared and copied on the next write.
+func (i *Image) CreateSnapshot(name string) error {
+	if err := i.beforeSnapshot(); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("the snapshot name must not be empty")
+	}
+	snapshots, tableSize, err := i.loadSnapshotTable()
+	if err != nil {
+		return err
+	}
+	id := 1
+	for _, s := range snapshots {
+		if s.Name == name {
+			return fmt.Errorf("snapshot %s already exists", name)
+		}
+		if n, err := strconv.Atoi(s.ID); err == nil && n >= id {
+			id = n + 1
+		}
+	}
+
+	// every l2 table and cluster gains the reference of the snapshot,
+	// their copied flags are cleared
+	if err := i.updateL1RefCounts(i.L1Table, 1); err != nil {
+		return err
+	}
+	if err := i.writeL1Table(); err != nil {
+		return err
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	l1Offset, err := i.allocateClusters(max(divRoundUp(uint64(i.Header.L1Size)*8, clusterSize), 1))
+	if err != nil {
+		return err
+	}
+	if _, err := i.writer().WriteAt(i.rawL1Table(i.L1Table), int64(l1Offset)); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	snapshots = append(snapshots, SnapshotHeader{
+		L1TableOffset: l1Offset,
+		L1Size:        i.Header.L1Size,
+		ID:            strconv.Itoa(id),
+		Name:          name,
+		Date:          time.Unix(now.Unix(), int64(now.Nanosecond())),
+		DiskSize:      i.Header.Size,
+		ICount:        -1,
+	})
+	return i.writeSnapshotTable(snapshots, tableSize)
+}
+
+// ApplySnapshot reverts the guest disk to the snapshot like qemu-img
+// snapshot -a, the snapshot is kept. The snapshot is found by its id,
+// or else by its name.
+func (i *Image) ApplySnapshot(idOrName string) error {
+	if err := i.beforeSnapshot(); err != nil {
+		return err
+	}
+	snapshots, err := i.LoadSnapshots()
+	if err != nil {
+		return err
+	}
+	index := findSnapshot(snapshots, idOrName)
+	if index < 0 {
+		return fmt.Errorf("snapshot %s not found", idOrName)
+	}
+	s := snapshots[index]
+
+	// the bitmaps can't follow a change of the size, see Resize
+	if s.DiskSize != 0 && s.DiskSize != i.Header.Size {
+		bitmaps, err := i.LoadBitmaps()
+		if err != nil {
+			return err
+		}
+		if len(bitmaps) > 0 {
+			return errors.New("cannot apply a snapshot of another size to an image with bitmaps")
+		}
+	}
+	// the guest data changes like by a write
+	if err := i.beforeWrite(); err != nil {
+		return err
+	}
+
+	if s.L1Size > i.Header.L1Size {
+		if err := i.resizeL1Table(s.L1Size); err != nil {
+			return err
+		}
+	}
+	snapshotL1, err := i.readL1Table(s.L1TableOffset, s.L1Size)
+	if err != nil {
+		return err
+	}
+
+	// the snapshot references are taken before the current ones are
+	// dropped, so the shared clusters are never freed
+	if err := i.updateL1RefCounts(snapshotL1, 1); err != nil {
+		return err
+	}
+	current := i.L1Table
+	i.L1Table = make([]L1Entry, i.Header.L1Size)
+	for index := range i.L1Table {
+		i.L1Table[index] = L1Entry{Index: index}
+		if index < len(snapshotL1) {
+			i.L1Table[index].L2TableOffset = snapshotL1[index].L2TableOffset
+		}
+	}
+	if err := i.writeL1Table(); err != nil {
+		return err
+	}
+	if err := i.updateL1RefCounts(current, -1); err != nil {
+		return err
+	}
+	if err := i.updateL1RefCounts(i.L1Table, 0); err != nil {
+		return err
+	}
+	if err := i.writeL1Table(); err != nil {
+		return err
+	}
+
+	// v2 snapshots don't record their disk size
+	if s.DiskSize != 0 && s.DiskSize != i.Header.Size {
+		i.Header.Size = s.DiskSize
+		return i.WriteHeader()
+	}
+	return nil
+}
+
+// DeleteSnapshot removes the snapshot like qemu-img snapshot -d, the
+// clusters only it references are freed. The snapshot is found by its
+// id, or else by its name.
+func (i *Image) DeleteSnapshot(idOrName string) error {
+	if err := i.beforeSnapshot(); err != nil {
+		return err
+	}
+	snapshots, tableSize, err := i.loadSnapshotTable()
+	if err != nil {
+		return err
+	}
+	index := findSnapshot(snapshots, idOrName)
+	if index < 0 {
+		return fmt.Errorf("snapshot %s not found", idOrName)
+	}
+	s := snapshots[index]
+
+	// the snapshot is gone from the table before its clusters are freed
+	if err := i.writeSnapshotTable(append(snapshots[:index:index], snapshots[index+1:]...), tableSize); err != nil {
+		return err
+	}
+	snapshotL1, err := i.readL1Table(s.L1TableOffset, s.L1Size)
+	if err != nil {
+		return err
+	}
+	if err := i.updateL1RefCounts(snapshotL1, -1); err != nil {
+		return err
+	}
+	clusterSize := uint64(i.Header.ClusterSize())
+	if err := i.updateRefCount(s.L1TableOffset, max(divRoundUp(uint64(s.L1Size)*8, clusterSize), 1)*clusterSize, -1); err != nil {
+		return err
+	}
+
+	// the clusters the active l1 table no longer shares get their
+	// copied flags back
+	if err := i.updateL1RefCounts(i.L1Table, 0); err != nil {
+		return err
+	}
+	return i.writeL1Table()
+}
+
+// beforeSnapshot checks the image can take, apply or delete snapshots
+func (i *Image) beforeSnapshot() error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if i.staleRefCounts {
+		return ErrStaleRefCounts
+	}
+	if i.Header.IncompatibleFeatures&IncompatibleCorrupt != 0 {
+		return errors.New("the image is corrupt, it must be repaired first")
+	}
+	return nil
+}
+
+// findSnapshot returns the index of the snapshot with the id, or else
+// of the first one with the name, -1 if there is none
+func findSnapshot(snapshots []SnapshotHeader, idOrName string) int {
+	for index, s := range snapshots {
+		if s.ID == idOrName {
+			return index
+		}
+	}
+	for index, s := range snapshots {
+		if s.Name == idOrName {
+			return index
+		}
+	}
+	return -1
+}
+
+// updateL1RefCounts adds delta to the refcount of every l2 table of the
+// l1 table and of every cluster they point to, then sets the copied
+// flags from the new refcounts like qcow2_update_snapshot_refcount of
+// qemu. The l1 entries are updated in place, the caller writes them.
+func (i *Image) updateL1RefCounts(l1 []L1Entry, delta int) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	for index, l1Entry := range l1 {
+		if l1Entry.L2TableOffset == 0 {
+			continue
+		}
+		l2Refcount, err := i.getRefCount(l1Entry.L2TableOffset / clusterSize)
+		if err != nil {
+			return err
+		}
+		if delta < 0 && l2Refcount < uint64(-delta) {
+			return fmt.Errorf("refcount of l2 table at %d drops below zero", l1Entry.L2TableOffset)
+		}
+		// a freed table is not worth updating
+		keep := int64(l2Refcount)+int64(delta) > 0
+
+		table, err := i.ExtractL2Table(l1Entry.L2TableOffset)
+		if err != nil {
+			return err
+		}
+		for l2Index, entry := range table {
+			if entry.Compressed != nil {
+				if delta != 0 {
+					offset, length := i.compressedRange(entry.Compressed)
+					if err := i.updateRefCount(offset, length, delta); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if entry.Standard.DataOffset == 0 {
+				continue
+			}
+			if delta != 0 {
+				if err := i.updateRefCount(entry.Standard.DataOffset, clusterSize, delta); err != nil {
+					return err
+				}
+			}
+			if !keep {
+				continue
+			}
+			refcount, err := i.getRefCount(entry.Standard.DataOffset / clusterSize)
+			if err != nil {
+				return err
+			}
+			if entry.Flag != (refcount == 1) {
+				entry.Flag = refcount == 1
+				if err := i.writeL2Entry(l1Entry.L2TableOffset, uint64(l2Index), entry); err != nil {
+					return err
+				}
+			}
+		}
+
+		if delta != 0 {
+			if err := i.updateRefCount(l1Entry.L2TableOffset, clusterSize, delta); err != nil {
+				return err
+			}
+		}
+		if !keep {
+			i.l2Cache.drop(l1Entry.L2TableOffset)
+		}
+		l1[index].RefCountBit = keep && uint64(int64(l2Refcount)+int64(delta)) == 1
+	}
+	return nil
+}
+
+// readL1Table reads the l1 table of a snapshot
+func (i *Image) readL1Table(offset uint64, size uint32) ([]L1Entry, error) {
+	rawTable, err := readAt(i.Handler, int64(offset), int64(size)*8)
+	if err != nil {
+		return nil, err
+	}
+	table := make([]L1Entry, 0, size)
+	for index := range uint64(size) {
+		e := binary.BigEndian.Uint64(rawTable[index*8 : index*8+8])
+		table = append(table, L1Entry{Index: int(index), L2TableOffset: e & offsetMask, RefCountBit: e>>63 == 1})
+	}
+	return table, nil
+}
+
+// rawL1Table encodes the l1 table into its on-disk format
+func (i *Image) rawL1Table(table []L1Entry) []byte {
+	rawTable := make([]byte, len(table)*8)
+	for index, entry := range table {
+		binary.BigEndian.PutUint64(rawTable[index*8:index*8+8], entry.Raw())
+	}
+	return rawTable
+}
+
+// writeL1Table writes the whole active l1 table back into the image
+func (i *Image) writeL1Table() error {
+	// the l2 tables and refcounts go before the l1 table referencing them
+	if i.WriteBack {
+		if err := i.flushMetadata(); err != nil {
+			return err
+		}
+	}
+	_, err := i.writer().WriteAt(i.rawL1Table(i.L1Table), int64(i.Header.L1TableOffset))
+	return err
+}
+
+// writeSnapshotTable writes the snapshots into a new snapshot table,
+// switches the header to it and frees the old table of oldSize bytes
+func (i *Image) writeSnapshotTable(snapshots []SnapshotHeader, oldSize uint64) error {
+	rawTable := make([]byte, 0)
+	for _, s := range snapshots {
+		entry := make([]byte, snapshotHeaderSize+snapshotExtraSize)
+		binary.BigEndian.PutUint64(entry[0:8], s.L1TableOffset)
+		binary.BigEndian.PutUint32(entry[8:12], s.L1Size)
+		binary.BigEndian.PutUint16(entry[12:14], uint16(len(s.ID)))
+		binary.BigEndian.PutUint16(entry[14:16], uint16(len(s.Name)))
+		binary.BigEndian.PutUint32(entry[16:20], uint32(s.Date.Unix()))
+		binary.BigEndian.PutUint32(entry[20:24], uint32(s.Date.Nanosecond()))
+		binary.BigEndian.PutUint64(entry[24:32], uint64(s.VMClock))
+		binary.BigEndian.PutUint32(entry[32:36], uint32(min(s.VMStateSize, 1<<32-1)))
+		binary.BigEndian.PutUint32(entry[36:40], snapshotExtraSize)
+		binary.BigEndian.PutUint64(entry[40:48], s.VMStateSize)
+		binary.BigEndian.PutUint64(entry[48:56], s.DiskSize)
+		binary.BigEndian.PutUint64(entry[56:64], uint64(s.ICount))
+		entry = append(entry, s.ID...)
+		entry = append(entry, s.Name...)
+		// entries are aligned to 8 bytes
+		entry = append(entry, make([]byte, alignUp(uint64(len(entry)), 8)-uint64(len(entry)))...)
+		rawTable = append(rawTable, entry...)
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	tableOffset := uint64(0)
+	if len(rawTable) > 0 {
+		var err error
+		if tableOffset, err = i.allocateClusters(divRoundUp(uint64(len(rawTable)), clusterSize)); err != nil {
+			return err
+		}
+		if _, err := i.writer().WriteAt(rawTable, int64(tableOffset)); err != nil {
+			return err
+		}
+	}
+	if i.WriteBack {
+		if err := i.flushMetadata(); err != nil {
+			return err
+		}
+	}
+
+	oldOffset := i.Header.SnapshotOffset
+	i.Header.SnapshotOffset = tableOffset
+	i.Header.NumSnapshots = uint32(len(snapshots))
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+	if oldSize > 0 {
+		return i.updateRefCount(oldOffset, oldSize, -1)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checkConsistent checks the image has neither corruptions nor leaks
+func checkConsistent(t *testing.T, image *gqcow2.Image) {
+	result, err := image.Check()
+	require.NoError(t, err)
+	assert.True(t, result.Consistent(), result.Problems)
+	assert.Zero(t, result.Leaks, result.Problems)
+}
+
+func Test_Snapshots(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.qcow2")
+	image, content := createTestImage(t, path, gqcow2.CreateOptions{Size: 4 << 20},
+		[]gqcow2.Extent{{Start: 0, Length: 200000}, {Start: 3 << 20, Length: 4096}})
+
+	require.NoError(t, image.CreateSnapshot("clean"))
+	checkConsistent(t, image)
+	snapshots, err := image.LoadSnapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	assert.Equal(t, "1", snapshots[0].ID)
+	assert.Equal(t, "clean", snapshots[0].Name)
+	assert.Equal(t, uint64(4<<20), snapshots[0].DiskSize)
+
+	_, err = image.WriteAt(bytes.Repeat([]byte{0x44}, 100000), 50000)
+	require.NoError(t, err)
+	require.NoError(t, image.Resize(6<<20, gqcow2.ResizeOptions{}))
+	_, err = image.WriteAt(bytes.Repeat([]byte{0x55}, 4096), 5<<20)
+	require.NoError(t, err)
+	checkConsistent(t, image)
+
+	require.NoError(t, image.CreateSnapshot("changed"))
+	assert.Error(t, image.CreateSnapshot("changed"))
+
+	require.NoError(t, image.ApplySnapshot("clean"))
+	checkConsistent(t, image)
+	assert.Equal(t, uint64(4<<20), image.VirtualSize())
+	assert.Equal(t, content, readGuest(t, image))
+
+	// the snapshot stays usable after being applied
+	_, err = image.WriteAt(bytes.Repeat([]byte{0x66}, 10), 0)
+	require.NoError(t, err)
+	require.NoError(t, image.ApplySnapshot("1"))
+	assert.Equal(t, content, readGuest(t, image))
+
+	require.NoError(t, image.DeleteSnapshot("changed"))
+	require.NoError(t, image.DeleteSnapshot("clean"))
+	checkConsistent(t, image)
+	assert.Error(t, image.DeleteSnapshot("clean"))
+	require.NoError(t, image.Close())
+
+	reopened, err := gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	defer reopened.Close()
+	checkConsistent(t, reopened)
+	assert.Equal(t, uint32(0), reopened.Header.NumSnapshots)
+	assert.Equal(t, content, readGuest(t, reopened))
+	assert.ErrorIs(t, reopened.CreateSnapshot("read only"), gqcow2.ErrReadOnly)
+}
+
+func Test_SnapshotsOfQemu(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.qcow2")
+	content := putSnapshotImage(t, path)
+
+	image, err := gqcow2.OpenImage(path, true)
+	require.NoError(t, err)
+	defer image.Close()
+	_, err = image.WriteAt(bytes.Repeat([]byte{0x77}, 70000), 0)
+	require.NoError(t, err)
+
+	require.NoError(t, image.ApplySnapshot("first"))
+	checkConsistent(t, image)
+	assert.Equal(t, content, readGuest(t, image))
+
+	// the clusters only belong to the active l1 table again
+	require.NoError(t, image.DeleteSnapshot("first"))
+	checkConsistent(t, image)
+	for _, cluster := range []uint64{4, 5, 6} {
+		refcount, err := image.ReadRefCount(cluster * 65536)
+		require.NoError(t, err)
+		assert.Equal(t, 1, refcount, "cluster %d", cluster)
+	}
+	assert.Error(t, image.ApplySnapshot("first"))
+}
+
+func Test_ApplySnapshotBitmaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitmaps.qcow2")
+	image, _ := createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20},
+		[]gqcow2.Extent{{Start: 0, Length: 100000}})
+	require.NoError(t, image.CreateSnapshot("small"))
+	require.NoError(t, image.Resize(2<<20, gqcow2.ResizeOptions{}))
+	require.NoError(t, image.CreateSnapshot("large"))
+
+	bitmap := gqcow2.NewBitmap("nightly", 16, 2<<20)
+	bitmap.SetDirty(gqcow2.Extent{Start: 0, Length: 65536})
+	require.NoError(t, image.StoreBitmap(bitmap))
+	_, err := image.DirtyExtents("nightly")
+	require.NoError(t, err)
+
+	assert.Error(t, image.ApplySnapshot("small"))
+	_, err = image.DirtyExtents("nightly")
+	require.NoError(t, err)
+
+	// the bitmap no longer describes the guest data
+	require.NoError(t, image.ApplySnapshot("large"))
+	_, err = image.DirtyExtents("nightly")
+	assert.Error(t, err)
+	checkConsistent(t, image)
+}
+
+func Test_ApplySnapshotLazyRefCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lazy.qcow2")
+	image, content := createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20},
+		[]gqcow2.Extent{{Start: 0, Length: 100000}})
+	require.NoError(t, image.CreateSnapshot("first"))
+	lazy := true
+	require.NoError(t, image.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy}))
+	require.False(t, image.Dirty())
+
+	require.NoError(t, image.ApplySnapshot("first"))
+	assert.True(t, image.Dirty())
+	assert.Equal(t, content, readGuest(t, image))
+	require.NoError(t, image.MarkClean())
+	checkConsistent(t, image)
+}
@@ -0,0 +1,176 @@
+package gqcow2
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+type StreamOptions struct {
+	// stream down to this disk of the backing chain, it becomes the
+	// new backing file. nil streams the whole chain and drops the
+	// backing file.
+	Base BackingDisk
+
+	// the backing file name written for Base, by default the name
+	// the image above Base refers to it by
+	BaseFile   string
+	BaseFormat string
+
+	// resume an interrupted stream from this guest offset
+	Offset uint64
+
+	// limit the copy speed in bytes per second, 0 means no limit
+	Speed uint64
+
+	// done is the guest offset reached, it can be used as Offset
+	// to resume the stream later
+	Progress ProgressFunc
+}
+
+// Stream copies every cluster that is unallocated in the overlay but
+// allocated in the backing chain above Base into the overlay, like the
+// qemu block-stream job. The backing file of the overlay is then
+// changed to Base.
+//
+// Clusters already copied are skipped, so an interrupted stream can
+// simply be run again. The stream stops when ctx is done.
+func Stream(ctx context.Context, overlay *Image, opts StreamOptions) error {
+	if !overlay.RWMode {
+		return ErrReadOnly
+	}
+
+	baseFile, baseFormat := opts.BaseFile, opts.BaseFormat
+	if opts.Base != nil {
+		above := findAbove(overlay, opts.Base)
+		if above == nil {
+			return errors.New("the base is not in the backing chain of the image")
+		}
+		if baseFile == "" {
+			baseFile, baseFormat = above.BackingFile, above.BackingFormat
+		}
+	}
+
+	clusterSize := uint64(overlay.Header.ClusterSize())
+	virtualSize := overlay.Header.Size
+	buf := make([]byte, clusterSize)
+	start := time.Now()
+	copied := uint64(0)
+	for offset := opts.Offset / clusterSize * clusterSize; offset < virtualSize; offset += clusterSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		length := min(clusterSize, virtualSize-offset)
+
+		entry, err := overlay.FindL2Entry(offset)
+		if err != nil {
+			return err
+		}
+		if !isAllocated(entry) {
+			above, err := allocatedAbove(overlay.Backing, opts.Base, offset)
+			if err != nil {
+				return err
+			}
+			if above {
+				if err := overlay.readBacking(offset, buf[:length]); err != nil {
+					return err
+				}
+				switch {
+				case !isAllZero(buf[:length]):
+					_, err = overlay.WriteAt(buf[:length], int64(offset))
+					copied += length
+				case opts.Base != nil:
+					err = overlay.WriteZeroes(offset, length, true)
+				}
+				// otherwise zeros read the same once the backing file is gone
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if opts.Progress != nil {
+			opts.Progress(offset+length, virtualSize)
+		}
+		if err := throttle(ctx, start, copied, opts.Speed); err != nil {
+			return err
+		}
+	}
+
+	overlay.BackingFile, overlay.BackingFormat = baseFile, baseFormat
+	if err := overlay.WriteHeader(); err != nil {
+		return err
+	}
+
+	// the disks between the overlay and the base are no longer used,
+	// the base stays open as the new backing disk
+	dropped := overlay.Backing
+	if dropped == opts.Base {
+		return nil
+	}
+	if opts.Base != nil {
+		findAbove(overlay, opts.Base).Backing = nil
+	}
+	overlay.Backing = opts.Base
+	return closeDisk(dropped)
+}
+
+// isAllocated tells if the l2 entry decides the content itself,
+// either by data or by the zero flag
+func isAllocated(entry L2Entry) bool {
+	return entry.Allocated() || (entry.Standard != nil && entry.Standard.AllZero)
+}
+
+// findAbove returns the image of the chain whose backing disk is base
+func findAbove(image *Image, base BackingDisk) *Image {
+	for image != nil {
+		if image.Backing == base {
+			return image
+		}
+		image, _ = image.Backing.(*Image)
+	}
+	return nil
+}
+
+// allocatedAbove tells if any disk from the top down to base (excluded)
+// decides the content at offset. A raw disk decides everything, and so
+// does a disk smaller than offset, as it hides what is below with zeros.
+func allocatedAbove(top BackingDisk, base BackingDisk, offset uint64) (bool, error) {
+	for disk := top; disk != nil && disk != base; {
+		image, ok := disk.(*Image)
+		if !ok || offset >= disk.VirtualSize() {
+			return true, nil
+		}
+
+		entry, err := image.FindL2Entry(offset)
+		if err != nil {
+			return false, err
+		}
+		if isAllocated(entry) {
+			return true, nil
+		}
+		disk = image.Backing
+	}
+	return false, nil
+}
+
+// throttle sleeps until copying the bytes fits into the speed limit
+func throttle(ctx context.Context, start time.Time, copied uint64, speed uint64) error {
+	if speed == 0 {
+		return nil
+	}
+
+	wait := time.Until(start.Add(time.Duration(float64(copied) / float64(speed) * float64(time.Second))))
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
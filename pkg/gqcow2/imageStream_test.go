@@ -0,0 +1,109 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Stream(t *testing.T) {
+	// base.raw <- mid.qcow2 <- top.qcow2
+	setup := func(t *testing.T) (string, *gqcow2.Image) {
+		dir := t.TempDir()
+		base := bytes.Repeat([]byte{1}, 1<<20)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "base.raw"), base, 0o644))
+
+		mid := createOverlay(t, filepath.Join(dir, "mid.qcow2"), 1<<20, "base.raw", "raw")
+		_, err := mid.WriteAt(bytes.Repeat([]byte{2}, 200000), 300000)
+		require.NoError(t, err)
+		require.NoError(t, mid.WriteZeroes(768<<10, 64<<10, true))
+
+		top := createOverlay(t, filepath.Join(dir, "top.qcow2"), 1<<20, "mid.qcow2", "qcow2")
+		_, err = top.WriteAt(bytes.Repeat([]byte{3}, 1000), 400000)
+		require.NoError(t, err)
+		return dir, top
+	}
+
+	t.Run("Stream the intermediate image only",
+		func(t *testing.T) {
+			dir, top := setup(t)
+			want := readGuest(t, top)
+			mid := top.Backing.(*gqcow2.Image)
+
+			base := mid.Backing
+			require.NoError(t, gqcow2.Stream(context.Background(), top,
+				gqcow2.StreamOptions{Base: base}))
+			assert.Equal(t, want, readGuest(t, top))
+
+			// the intermediate image is closed, the base stays open
+			_, err := mid.Handler.(*os.File).Stat()
+			assert.ErrorIs(t, err, os.ErrClosed)
+			_, err = base.(*gqcow2.RawDisk).Handler.(*os.File).Stat()
+			assert.NoError(t, err)
+			assert.Equal(t, base, top.Backing)
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "top.qcow2"), false)
+			require.NoError(t, err)
+			assert.Equal(t, "base.raw", reopened.BackingFile)
+			assert.Equal(t, "raw", reopened.BackingFormat)
+			assert.Equal(t, want, readGuest(t, reopened))
+
+			// clusters only the raw base has are left in the base
+			entry, err := reopened.FindL2Entry(0)
+			require.NoError(t, err)
+			assert.False(t, entry.Allocated())
+			entry, err = reopened.FindL2Entry(768 << 10)
+			require.NoError(t, err)
+			assert.True(t, entry.Standard.AllZero)
+		})
+
+	t.Run("Stream the whole chain and resume after a cancel",
+		func(t *testing.T) {
+			dir, top := setup(t)
+			want := readGuest(t, top)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			resume := uint64(0)
+			err := gqcow2.Stream(ctx, top, gqcow2.StreamOptions{
+				Progress: func(done uint64, total uint64) {
+					resume = done
+					if done >= 512<<10 {
+						cancel()
+					}
+				},
+			})
+			require.ErrorIs(t, err, context.Canceled)
+			assert.Equal(t, uint64(512<<10), resume)
+			assert.Equal(t, "mid.qcow2", top.BackingFile)
+			assert.Equal(t, want, readGuest(t, top))
+
+			require.NoError(t, gqcow2.Stream(context.Background(), top,
+				gqcow2.StreamOptions{Offset: resume}))
+			assert.Nil(t, top.Backing)
+
+			reopened, err := gqcow2.OpenImage(filepath.Join(dir, "top.qcow2"), false)
+			require.NoError(t, err)
+			assert.Empty(t, reopened.BackingFile)
+			assert.Equal(t, want, readGuest(t, reopened))
+		})
+
+	t.Run("Stream is throttled",
+		func(t *testing.T) {
+			_, top := setup(t)
+			mid := top.Backing.(*gqcow2.Image)
+
+			// 3 clusters of the intermediate image at 1 MiB/s
+			start := time.Now()
+			require.NoError(t, gqcow2.Stream(context.Background(), top,
+				gqcow2.StreamOptions{Base: mid.Backing, Speed: 1 << 20}))
+			assert.GreaterOrEqual(t, time.Since(start), 180*time.Millisecond)
+		})
+}
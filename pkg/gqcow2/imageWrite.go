@@ -0,0 +1,193 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var ErrOutOfRange = errors.New("offset is beyond the end of the virtual disk")
+
+// WriteAt writes the guest data into the virtual disk, clusters that
+// are not owned by this image yet (unallocated, zero, compressed or
+// shared) are copied on write into newly allocated clusters.
+func (i *Image) WriteAt(p []byte, off int64) (int, error) {
+	if !i.RWMode {
+		return 0, ErrReadOnly
+	}
+	if off < 0 || uint64(off)+uint64(len(p)) > i.Header.Size {
+		return 0, ErrOutOfRange
+	}
+	if err := i.beforeWrite(); err != nil {
+		return 0, err
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	done := 0
+	for done < len(p) {
+		vdOffset := uint64(off) + uint64(done)
+		chunk := min(clusterSize-vdOffset%clusterSize, uint64(len(p)-done))
+
+		if err := i.writeCluster(vdOffset, p[done:done+int(chunk)]); err != nil {
+			return done, err
+		}
+		done += int(chunk)
+	}
+
+	return done, nil
+}
+
+// beforeWrite runs once before the guest data is modified
+func (i *Image) beforeWrite() error {
+	if i.LazyRefCounts() && !i.Dirty() {
+		if err := i.markDirty(); err != nil {
+			return err
+		}
+	}
+
+	// bitmaps are not maintained by the write path, clearing the
+	// autoclear bit marks them inconsistent as the spec requires
+	if i.Header.AutoclearFeatures&AutoclearBitmaps != 0 {
+		i.Header.AutoclearFeatures &^= AutoclearBitmaps
+		return i.WriteHeader()
+	}
+	return nil
+}
+
+// writeCluster writes data, which never crosses the cluster boundary, at vdOffset
+func (i *Image) writeCluster(vdOffset uint64, data []byte) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	inCluster := vdOffset % clusterSize
+
+	l2TableStart, l2Index, err := i.l2TableForWrite(vdOffset)
+	if err != nil {
+		return err
+	}
+	entry, err := i.FindL2Entry(vdOffset)
+	if err != nil {
+		return err
+	}
+
+	// the cluster is owned by this image, write in place
+	if entry.Standard != nil && entry.Flag && entry.Standard.DataOffset != 0 {
+		hostOffset := entry.Standard.DataOffset
+		if !entry.Standard.AllZero {
+			_, err := i.writer().WriteAt(data, int64(hostOffset+inCluster))
+			return err
+		}
+
+		buf := make([]byte, clusterSize)
+		copy(buf[inCluster:], data)
+		if _, err := i.writer().WriteAt(buf, int64(hostOffset)); err != nil {
+			return err
+		}
+		entry.Standard.AllZero = false
+		return i.writeL2Entry(l2TableStart, l2Index, entry)
+	}
+
+	buf := make([]byte, clusterSize)
+	if uint64(len(data)) < clusterSize {
+		clusterStart := vdOffset - inCluster
+		guestLength := min(clusterSize, i.Header.Size-clusterStart)
+		if err := i.readGuest(entry, clusterStart, buf[:guestLength]); err != nil {
+			return err
+		}
+	}
+	copy(buf[inCluster:], data)
+
+	hostOffset, err := i.allocateClusters(1)
+	if err != nil {
+		return err
+	}
+	// data goes before the metadata referencing it
+	if _, err := i.writer().WriteAt(buf, int64(hostOffset)); err != nil {
+		return err
+	}
+
+	newEntry := L2Entry{Flag: true, Standard: &StandardDescriptor{DataOffset: hostOffset}}
+	if err := i.writeL2Entry(l2TableStart, l2Index, newEntry); err != nil {
+		return err
+	}
+
+	return i.releaseL2Entry(entry)
+}
+
+// releaseL2Entry drops the reference of the entry on its host clusters
+func (i *Image) releaseL2Entry(entry L2Entry) error {
+	if entry.Compressed != nil {
+		offset, length := i.compressedRange(entry.Compressed)
+		return i.updateRefCount(offset, length, -1)
+	}
+	if entry.Standard != nil && entry.Standard.DataOffset != 0 {
+		return i.updateRefCount(entry.Standard.DataOffset, uint64(i.Header.ClusterSize()), -1)
+	}
+	return nil
+}
+
+// compressedRange returns the host byte range of the compressed cluster
+func (i *Image) compressedRange(cd *CompressedDescriptor) (uint64, uint64) {
+	sectors := uint64(cd.AdditionalSectorCount + 1)
+	return cd.DataOffset, sectors*512 - cd.DataOffset%512
+}
+
+// l2TableForWrite returns the l2 table which holds the entry of the
+// vdOffset, the table is allocated, or copied if it is shared.
+func (i *Image) l2TableForWrite(vdOffset uint64) (uint64, uint64, error) {
+	l1Index, l2Index := i.l2Position(vdOffset)
+	if l1Index >= uint64(len(i.L1Table)) {
+		return 0, 0, fmt.Errorf("l1 table is too small for offset %d", vdOffset)
+	}
+
+	l1Entry := i.L1Table[l1Index]
+	if l1Entry.L2TableOffset != 0 && l1Entry.RefCountBit {
+		return l1Entry.L2TableOffset, l2Index, nil
+	}
+
+	newOffset, err := i.allocateClusters(1)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	rawTable := make([]byte, i.Header.ClusterSize())
+	if l1Entry.L2TableOffset != 0 {
+		// the table is shared (e.g. with a snapshot), the refcounts of
+		// the clusters it points to already count every l1 table
+		// referencing them, only the old table loses a reference
+		oldTable, err := i.loadTable(i.l2Cache, l1Entry.L2TableOffset)
+		if err != nil {
+			return 0, 0, err
+		}
+		copy(rawTable, oldTable)
+
+		for index := range i.Header.L2EntryPerTable() {
+			entry := extractL2Entry(rawTable, uint64(index), i.Header.ClusterBits)
+			if entry.Standard != nil && entry.Standard.DataOffset != 0 && entry.Flag {
+				// the cluster is shared, writes must copy it
+				entry.Flag = false
+				binary.BigEndian.PutUint64(rawTable[index*8:index*8+8], entry.Raw(i.Header.ClusterBits))
+			}
+		}
+	}
+	if err := i.storeTable(i.l2Cache, newOffset, rawTable); err != nil {
+		return 0, 0, err
+	}
+	// the table and its refcounts must be on disk before the l1 entry
+	if i.WriteBack {
+		if err := i.flushMetadata(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	i.L1Table[l1Index] = L1Entry{Index: int(l1Index), L2TableOffset: newOffset, RefCountBit: true}
+	if err := i.writeL1Entry(int(l1Index)); err != nil {
+		return 0, 0, err
+	}
+
+	if l1Entry.L2TableOffset != 0 {
+		if err := i.updateRefCount(l1Entry.L2TableOffset, uint64(i.Header.ClusterSize()), -1); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return newOffset, l2Index, nil
+}
@@ -0,0 +1,112 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WriteAt(t *testing.T) {
+	dir := t.TempDir()
+	basePath := filepath.Join(dir, "base.qcow2")
+	f, err := os.Create(basePath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	base, err := gqcow2.Create(f, basePath, gqcow2.CreateOptions{Size: 1 << 20, ClusterBits: 12})
+	require.NoError(t, err)
+	content := make([]byte, 1<<20)
+	copy(content[1000:], bytes.Repeat([]byte{0x11}, 10000))
+	_, err = base.WriteAt(content[1000:11000], 1000)
+	require.NoError(t, err)
+
+	got := make([]byte, 1<<20)
+	_, err = base.ReadAt(got, 0)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+
+	t.Run("Keep the written data after reopening",
+		func(t *testing.T) {
+			reopened, err := gqcow2.OpenImage(basePath, false)
+			require.NoError(t, err)
+			got := make([]byte, 1<<20)
+			_, err = reopened.ReadAt(got, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, got)
+
+			refcount, err := reopened.ReadRefCount(reopened.Header.L1TableOffset)
+			require.NoError(t, err)
+			assert.Equal(t, 1, refcount)
+
+			// the file is opened read only
+			_, err = reopened.WriteAt([]byte{1}, 0)
+			assert.ErrorIs(t, err, gqcow2.ErrReadOnly)
+		})
+
+	t.Run("Copy the backing data around a partial write into an overlay",
+		func(t *testing.T) {
+			overlayPath := filepath.Join(dir, "overlay.qcow2")
+			of, err := os.Create(overlayPath)
+			require.NoError(t, err)
+			defer of.Close()
+			_, err = gqcow2.Create(of, overlayPath, gqcow2.CreateOptions{
+				Size: 1 << 20, ClusterBits: 12, BackingFile: "base.qcow2", BackingFormat: "qcow2",
+			})
+			require.NoError(t, err)
+
+			overlay, err := gqcow2.OpenImage(overlayPath, true)
+			require.NoError(t, err)
+			_, err = overlay.WriteAt([]byte{0x22, 0x22}, 5000)
+			require.NoError(t, err)
+
+			expected := bytes.Clone(content)
+			copy(expected[5000:], []byte{0x22, 0x22})
+			got := make([]byte, 1<<20)
+			_, err = overlay.ReadAt(got, 0)
+			require.NoError(t, err)
+			assert.Equal(t, expected, got)
+
+			// the base is left untouched
+			_, err = base.ReadAt(got, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, got)
+		})
+}
+
+func Test_WriteSnapshotImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.qcow2")
+	content := putSnapshotImage(t, path)
+	before, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	image, err := gqcow2.OpenImage(path, true)
+	require.NoError(t, err)
+	defer image.Close()
+	// the shared l2 table and the first data cluster are copied
+	_, err = image.WriteAt(bytes.Repeat([]byte{0x33}, 100), 10)
+	require.NoError(t, err)
+	copy(content[10:], bytes.Repeat([]byte{0x33}, 100))
+	assert.Equal(t, content, readGuest(t, image))
+
+	result, err := image.Check()
+	require.NoError(t, err)
+	assert.True(t, result.Consistent(), result.Problems)
+	assert.Zero(t, result.Leaks, result.Problems)
+
+	// the old l2 table only belongs to the snapshot, the untouched data
+	// cluster is still shared by both l2 tables
+	for cluster, want := range map[uint64]int{4: 1, 5: 1, 6: 2} {
+		refcount, err := image.ReadRefCount(cluster * 65536)
+		require.NoError(t, err)
+		assert.Equal(t, want, refcount, "cluster %d", cluster)
+	}
+	after, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, before[4*65536:7*65536], after[4*65536:7*65536])
+}
@@ -53,37 +53,39 @@ func (l2e L2Entry) String() string {
 	return str
 }
 
+// only the 9-55bits are meaningful for the offsets
+// inside the l1 and l2 table entries
+const offsetMask = uint64((1<<56)-1) &^ uint64(511)
+
 // LoadL1Table load the l1 table content from the Image.
 func (i *Image) LoadL1Table() error {
 	clusterSize := i.Header.ClusterSize()
 	offset := i.Header.L1TableOffset
-	totalTableSize := i.Header.L1Size * uint32(clusterSize)
-	totalEntryCount := totalTableSize / 8 // each L1 table entry is 64bit
+	totalEntryCount := i.Header.L1Size
+	totalTableSize := totalEntryCount * 8 // each L1 table entry is 64bit
 
 	tableBuf := make([]byte, totalTableSize)
 
-	rc, err := i.Handler.ReadAt(tableBuf, int64(offset))
-	if err != nil {
-		return err
-	}
-	// even its read, but corrupted, should abort
-	if rc < int(totalTableSize) {
-		return io.ErrUnexpectedEOF
+	if totalTableSize > 0 {
+		rc, err := i.Handler.ReadAt(tableBuf, int64(offset))
+		// even its read, but corrupted, should abort
+		if rc < int(totalTableSize) {
+			if err == nil {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
 	}
 
-	if i.L1Table == nil {
-		i.L1Table = make([]L1Entry, 0, totalEntryCount)
-	}
-	// only the 9-55bits are meaningful
-	l2OffsetMask := uint64((1 << 47) - 1<<9)
+	i.L1Table = make([]L1Entry, 0, totalEntryCount)
 
 	for index := range totalEntryCount {
 		// each entry takes 8 bytes
-		e := binary.BigEndian.Uint64(tableBuf[index : index+8])
+		e := binary.BigEndian.Uint64(tableBuf[index*8 : index*8+8])
 
 		newEntry := L1Entry{
 			Index:         int(index),
-			L2TableOffset: e & l2OffsetMask,
+			L2TableOffset: e & offsetMask,
 		}
 
 		if newEntry.L2TableOffset%uint64(clusterSize) != 0 {
@@ -102,13 +104,30 @@ func (i *Image) LoadL1Table() error {
 	return nil
 }
 
+// Raw encodes the entry into its on-disk format
+func (l1e L1Entry) Raw() uint64 {
+	raw := l1e.L2TableOffset & offsetMask
+	if l1e.RefCountBit {
+		raw |= 1 << 63
+	}
+	return raw
+}
+
+// writeL1Entry writes the in-memory l1 entry back into the image
+func (i *Image) writeL1Entry(index int) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, i.L1Table[index].Raw())
+	_, err := i.writer().WriteAt(buf, int64(i.Header.L1TableOffset)+int64(index)*8)
+	return err
+}
+
 func (i *Image) ExtractL2Table(offset uint64) ([]L2Entry, error) {
 	l2EntryCountPerTable := i.Header.ClusterSize() / 8
 	wholeTable := make([]L2Entry, 0, l2EntryCountPerTable)
 
 	// read the l2 table
-	rawL2Table := make([]byte, i.Header.ClusterSize())
-	if _, err := i.Handler.ReadAt(rawL2Table, int64(offset)); err != nil {
+	rawL2Table, err := i.loadTable(i.l2Cache, offset)
+	if err != nil {
 		return wholeTable, errors.Join(
 			fmt.Errorf("reading l2 entry failed, offset %d at image file", offset),
 			err)
@@ -121,20 +140,30 @@ func (i *Image) ExtractL2Table(offset uint64) ([]L2Entry, error) {
 	return wholeTable, nil
 }
 
-// FindL2Entry takes virtual disk's offset as input, and return provide the l2 table entry
-func (i *Image) FindL2Entry(vdOffset uint64) (L2Entry, error) {
+// l2Position returns the l1 index and the l2 index of the virtual disk's offset
+func (i *Image) l2Position(vdOffset uint64) (uint64, uint64) {
 	// each L2 table entry take 64bits, 8bytes
 	// and each L2 table takes 1 cluster size
-	l2EntryCountPerTable := i.Header.ClusterSize() / 8
+	l2EntryCountPerTable := uint64(i.Header.L2EntryPerTable())
 
-	l1Index := (vdOffset / uint64(i.Header.ClusterSize())) / uint64(l2EntryCountPerTable)
-	l2Index := (vdOffset / uint64(i.Header.ClusterSize())) % uint64(l2EntryCountPerTable)
+	l1Index := (vdOffset / uint64(i.Header.ClusterSize())) / l2EntryCountPerTable
+	l2Index := (vdOffset / uint64(i.Header.ClusterSize())) % l2EntryCountPerTable
+	return l1Index, l2Index
+}
 
+// FindL2Entry takes virtual disk's offset as input, and return provide the l2 table entry
+func (i *Image) FindL2Entry(vdOffset uint64) (L2Entry, error) {
+	l1Index, l2Index := i.l2Position(vdOffset)
+
+	// the l2 table is not allocated, so is the cluster
+	if l1Index >= uint64(len(i.L1Table)) || i.L1Table[l1Index].L2TableOffset == 0 {
+		return L2Entry{Standard: &StandardDescriptor{}}, nil
+	}
 	l2TableStart := i.L1Table[l1Index].L2TableOffset
 
 	// read the l2 table
-	rawL2Table := make([]byte, i.Header.ClusterSize())
-	if _, err := i.Handler.ReadAt(rawL2Table, int64(l2TableStart)); err != nil {
+	rawL2Table, err := i.loadTable(i.l2Cache, l2TableStart)
+	if err != nil {
 		return L2Entry{}, errors.Join(
 			fmt.Errorf("reading l2 entry failed, offset %d at image file", l2TableStart),
 			err)
@@ -143,6 +172,13 @@ func (i *Image) FindL2Entry(vdOffset uint64) (L2Entry, error) {
 	return extractL2Entry(rawL2Table, l2Index, i.Header.ClusterBits), nil
 }
 
+// writeL2Entry stores the entry at the index of the l2 table starts at l2TableStart
+func (i *Image) writeL2Entry(l2TableStart uint64, l2Index uint64, entry L2Entry) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, entry.Raw(i.Header.ClusterBits))
+	return i.storeTableEntry(i.l2Cache, l2TableStart, int(l2Index)*8, buf)
+}
+
 func extractL2Entry(block []byte, index uint64, cb uint32) L2Entry {
 	offset := index * 8
 
@@ -155,8 +191,7 @@ func extractL2Entry(block []byte, index uint64, cb uint32) L2Entry {
 	}
 	if descriptorType == 0 {
 		sd := &StandardDescriptor{}
-		mask := uint64((1 << 47) - 1<<9)
-		sd.DataOffset = mask & rawEntry
+		sd.DataOffset = offsetMask & rawEntry
 		sd.AllZero = rawEntry&1 == 1
 		entry.Standard = sd
 	} else {
@@ -171,3 +206,31 @@ func extractL2Entry(block []byte, index uint64, cb uint32) L2Entry {
 
 	return entry
 }
+
+// Raw encodes the entry into its on-disk format, cb is the cluster bits
+func (l2e L2Entry) Raw(cb uint32) uint64 {
+	var raw uint64
+	if l2e.Compressed != nil {
+		split := 62 - (cb - 8)
+		raw = 1 << 62
+		raw |= l2e.Compressed.DataOffset & ((1 << split) - 1)
+		raw |= uint64(l2e.Compressed.AdditionalSectorCount) << split
+		return raw
+	}
+
+	if l2e.Standard != nil {
+		raw = l2e.Standard.DataOffset & offsetMask
+		if l2e.Standard.AllZero {
+			raw |= 1
+		}
+	}
+	if l2e.Flag {
+		raw |= 1 << 63
+	}
+	return raw
+}
+
+// Allocated tells whether the entry points to host clusters
+func (l2e L2Entry) Allocated() bool {
+	return l2e.Compressed != nil || (l2e.Standard != nil && l2e.Standard.DataOffset != 0)
+}
@@ -0,0 +1,178 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var ErrStaleRefCounts = errors.New("the image is dirty, its refcounts must be rebuilt first")
+
+// LazyRefCounts tells if the image allows postponing refcount updates
+func (i *Image) LazyRefCounts() bool {
+	return i.Header.CompatibleFeatures&CompatibleLazyRefCounts != 0
+}
+
+// Dirty tells if the refcounts on disk may be inconsistent
+func (i *Image) Dirty() bool {
+	return i.Header.IncompatibleFeatures&IncompatibleDirty != 0
+}
+
+// markDirty sets the dirty bit before the first postponed refcount
+// update, from then on refcount blocks are only updated in memory.
+func (i *Image) markDirty() error {
+	i.Header.IncompatibleFeatures |= IncompatibleDirty
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+	i.refCountCache.writeBack = true
+	return nil
+}
+
+// MarkClean writes the postponed refcount updates back and clears
+// the dirty bit. An image that was dirty when it was opened gets
+// its refcounts rebuilt.
+func (i *Image) MarkClean() error {
+	if !i.Dirty() {
+		return nil
+	}
+	if i.staleRefCounts {
+		return i.RebuildRefCounts()
+	}
+
+	// the refcounts must be durable before the bit is cleared
+	if err := i.flushMetadata(); err != nil {
+		return err
+	}
+	if err := i.sync(); err != nil {
+		return err
+	}
+	i.refCountCache.writeBack = false
+
+	i.Header.IncompatibleFeatures &^= IncompatibleDirty
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+	return i.sync()
+}
+
+// RebuildRefCounts computes the refcount of every host cluster from
+// the image metadata, writes them into new refcount structures and
+// clears the dirty bit, like qemu-img check -r all.
+func (i *Image) RebuildRefCounts() error {
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+
+	counts, err := i.computeRefCounts()
+	if err != nil {
+		return err
+	}
+
+	// the header switching to the new refcounts marks the image clean as well
+	i.Header.IncompatibleFeatures &^= IncompatibleDirty
+	if err := i.rewriteRefCounts(counts, i.Header.RefCountOrder); err != nil {
+		return err
+	}
+	i.staleRefCounts = false
+	return nil
+}
+
+// computeRefCounts walks every structure referencing host clusters
+func (i *Image) computeRefCounts() ([]uint64, error) {
+	clusterSize := uint64(i.Header.ClusterSize())
+	counts := make([]uint64, 0)
+	add := func(offset uint64, length uint64) {
+		last := (offset + length - 1) / clusterSize
+		for uint64(len(counts)) <= last {
+			counts = append(counts, 0)
+		}
+		for c := offset / clusterSize; c <= last; c++ {
+			counts[c]++
+		}
+	}
+
+	add(0, clusterSize)
+	// the old refcount structures are freed by the rewrite, counting
+	// them keeps the new ones from overwriting them
+	for _, c := range i.refCountStructureClusters() {
+		add(c*clusterSize, clusterSize)
+	}
+	// every l1 table references its l2 tables and their clusters once,
+	// a table shared with a snapshot is counted by both
+	addL2Tables := func(l2TableOffsets []uint64) error {
+		for _, l2TableOffset := range l2TableOffsets {
+			if l2TableOffset == 0 {
+				continue
+			}
+			add(l2TableOffset, clusterSize)
+
+			table, err := i.ExtractL2Table(l2TableOffset)
+			if err != nil {
+				return err
+			}
+			for _, entry := range table {
+				if entry.Compressed != nil {
+					add(i.compressedRange(entry.Compressed))
+				} else if entry.Standard.DataOffset != 0 {
+					add(entry.Standard.DataOffset, clusterSize)
+				}
+			}
+		}
+		return nil
+	}
+
+	add(i.Header.L1TableOffset, max(uint64(i.Header.L1Size)*8, 1))
+	l2TableOffsets := make([]uint64, 0, len(i.L1Table))
+	for _, l1Entry := range i.L1Table {
+		l2TableOffsets = append(l2TableOffsets, l1Entry.L2TableOffset)
+	}
+	if err := addL2Tables(l2TableOffsets); err != nil {
+		return nil, err
+	}
+
+	snapshots, tableSize, err := i.loadSnapshotTable()
+	if err != nil {
+		return nil, err
+	}
+	if tableSize > 0 {
+		add(i.Header.SnapshotOffset, tableSize)
+	}
+	for _, s := range snapshots {
+		add(s.L1TableOffset, max(uint64(s.L1Size)*8, 1))
+		rawTable, err := readAt(i.Handler, int64(s.L1TableOffset), int64(s.L1Size)*8)
+		if err != nil {
+			return nil, err
+		}
+		l2TableOffsets := make([]uint64, 0, s.L1Size)
+		for index := range uint64(s.L1Size) {
+			l2TableOffsets = append(l2TableOffsets, binary.BigEndian.Uint64(rawTable[index*8:index*8+8])&offsetMask)
+		}
+		if err := addL2Tables(l2TableOffsets); err != nil {
+			return nil, err
+		}
+	}
+
+	if ext := i.Extension(ExtensionBitmaps); ext != nil {
+		add(binary.BigEndian.Uint64(ext.Data[16:24]), binary.BigEndian.Uint64(ext.Data[8:16]))
+
+		bitmaps, err := i.LoadBitmaps()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range bitmaps {
+			add(b.TableOffset, max(uint64(b.TableSize)*8, 1))
+			rawTable, err := readAt(i.Handler, int64(b.TableOffset), int64(b.TableSize)*8)
+			if err != nil {
+				return nil, err
+			}
+			for index := range uint64(b.TableSize) {
+				dataOffset := binary.BigEndian.Uint64(rawTable[index*8:index*8+8]) & offsetMask
+				if dataOffset != 0 {
+					add(dataOffset, clusterSize)
+				}
+			}
+		}
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,110 @@
+package gqcow2_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openOnDisk opens another read only view of the image file, so the
+// state on disk can be checked while the image is still in use
+func openOnDisk(t *testing.T, path string) *gqcow2.Image {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	image, err := gqcow2.NewFileImage(f, path)
+	require.NoError(t, err)
+	return image
+}
+
+func Test_LazyRefCounts(t *testing.T) {
+	setup := func(t *testing.T) (string, *gqcow2.Image, []byte) {
+		path := filepath.Join(t.TempDir(), "lazy.qcow2")
+		image, content := createTestImage(t, path,
+			gqcow2.CreateOptions{Size: 1 << 20},
+			[]gqcow2.Extent{{Start: 0, Length: 65536}})
+
+		lazy := true
+		require.NoError(t, image.Amend(gqcow2.AmendOptions{LazyRefCounts: &lazy}))
+		assert.False(t, image.Dirty())
+
+		_, err := image.WriteAt(bytes.Repeat([]byte{4}, 100000), 500000)
+		require.NoError(t, err)
+		copy(content[500000:], bytes.Repeat([]byte{4}, 100000))
+		return path, image, content
+	}
+
+	t.Run("Refcount updates are postponed until the image is marked clean",
+		func(t *testing.T) {
+			path, image, content := setup(t)
+			assert.True(t, image.Dirty())
+
+			entry, err := image.FindL2Entry(500000)
+			require.NoError(t, err)
+			refcount, err := image.ReadRefCount(entry.Standard.DataOffset)
+			require.NoError(t, err)
+			assert.Equal(t, 1, refcount)
+
+			onDisk := openOnDisk(t, path)
+			assert.True(t, onDisk.Dirty())
+			refcount, err = onDisk.ReadRefCount(entry.Standard.DataOffset)
+			require.NoError(t, err)
+			assert.Equal(t, 0, refcount)
+
+			require.NoError(t, image.MarkClean())
+			assert.False(t, image.Dirty())
+
+			onDisk = openOnDisk(t, path)
+			assert.False(t, onDisk.Dirty())
+			refcount, err = onDisk.ReadRefCount(entry.Standard.DataOffset)
+			require.NoError(t, err)
+			assert.Equal(t, 1, refcount)
+			assert.Equal(t, content, readGuest(t, onDisk))
+		})
+
+	t.Run("A dirty image gets its refcounts rebuilt when it is opened",
+		func(t *testing.T) {
+			// the image is left dirty as if the process crashed
+			path, image, content := setup(t)
+			entry, err := image.FindL2Entry(500000)
+			require.NoError(t, err)
+
+			// a read only image still reads, but refuses to allocate
+			onDisk := openOnDisk(t, path)
+			assert.Equal(t, content, readGuest(t, onDisk))
+
+			rw, err := os.OpenFile(path, os.O_RDWR, 0)
+			require.NoError(t, err)
+			defer rw.Close()
+			stale, err := gqcow2.NewFileImage(rw, path)
+			require.NoError(t, err)
+			_, err = stale.WriteAt([]byte{1}, 900000)
+			assert.ErrorIs(t, err, gqcow2.ErrStaleRefCounts)
+
+			reopened, err := gqcow2.OpenImage(path, true)
+			require.NoError(t, err)
+			assert.False(t, reopened.Dirty())
+			assert.True(t, reopened.LazyRefCounts())
+			assert.Equal(t, content, readGuest(t, reopened))
+
+			for _, offset := range []uint64{0, entry.Standard.DataOffset, reopened.Header.L1TableOffset} {
+				refcount, err := reopened.ReadRefCount(offset)
+				require.NoError(t, err)
+				assert.Equal(t, 1, refcount)
+			}
+
+			_, err = reopened.WriteAt(bytes.Repeat([]byte{6}, 1000), 900000)
+			require.NoError(t, err)
+			copy(content[900000:], bytes.Repeat([]byte{6}, 1000))
+			assert.True(t, reopened.Dirty())
+			require.NoError(t, reopened.MarkClean())
+			assert.Equal(t, content, readGuest(t, openOnDisk(t, path)))
+		})
+}
@@ -0,0 +1,144 @@
+package gqcow2
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// PreallocMode follows the preallocation option of qemu-img
+type PreallocMode string
+
+const (
+	// only the header and the tables are created
+	PreallocOff PreallocMode = "off"
+	// l2 tables and data clusters are allocated, the data clusters
+	// are flagged as zero (v3) and the image file stays sparse
+	PreallocMetadata PreallocMode = "metadata"
+	// like metadata, the data clusters are also allocated in the
+	// file system by fallocate
+	PreallocFalloc PreallocMode = "falloc"
+	// like metadata, zeros are written into the data clusters
+	PreallocFull PreallocMode = "full"
+)
+
+func ParsePreallocMode(mode string) (PreallocMode, error) {
+	switch PreallocMode(mode) {
+	case "", PreallocOff:
+		return PreallocOff, nil
+	case PreallocMetadata, PreallocFalloc, PreallocFull:
+		return PreallocMode(mode), nil
+	}
+	return PreallocOff, fmt.Errorf("invalid preallocation mode %s", mode)
+}
+
+// Preallocate allocates the l2 tables and data clusters of the virtual
+// disk range [start, end), clusters already allocated are kept.
+func (i *Image) Preallocate(start uint64, end uint64, mode PreallocMode) error {
+	if mode == "" || mode == PreallocOff || start >= end {
+		return nil
+	}
+	if !i.RWMode {
+		return ErrReadOnly
+	}
+	if i.BackingFile != "" {
+		return errors.New("backing file and preallocation cannot be used at the same time")
+	}
+	if end > i.Header.Size {
+		return ErrOutOfRange
+	}
+	if mode == PreallocFalloc && !i.FastMode {
+		return errors.New("falloc preallocation requires a file descriptor")
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	l2Coverage := clusterSize * uint64(i.Header.L2EntryPerTable())
+
+	// the image file holds stale data before its end, those
+	// clusters must read as zeros as well
+	fileEnd := uint64(0)
+	if size, err := HandlerSize(i.Handler); err == nil {
+		fileEnd = size
+	}
+	dataEnd := uint64(0)
+
+	for tableStart := start - start%l2Coverage; tableStart < end; tableStart += l2Coverage {
+		first := max(start, tableStart) / clusterSize
+		last := divRoundUp(min(end, tableStart+l2Coverage), clusterSize)
+
+		l2TableStart, _, err := i.l2TableForWrite(tableStart)
+		if err != nil {
+			return err
+		}
+		rawTable, err := i.loadTable(i.l2Cache, l2TableStart)
+		if err != nil {
+			return err
+		}
+
+		// allocate a contiguous run for the unallocated clusters
+		missing := make([]uint64, 0, last-first)
+		for clusterIndex := first; clusterIndex < last; clusterIndex++ {
+			l2Index := clusterIndex % uint64(i.Header.L2EntryPerTable())
+			if !extractL2Entry(rawTable, l2Index, i.Header.ClusterBits).Allocated() {
+				missing = append(missing, l2Index)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		dataOffset, err := i.allocateClusters(uint64(len(missing)))
+		if err != nil {
+			return err
+		}
+		dataLength := uint64(len(missing)) * clusterSize
+		dataEnd = max(dataEnd, dataOffset+dataLength)
+
+		zeroFlag := false
+		switch mode {
+		case PreallocFull:
+			if err := writeZeros(i.writer(), dataOffset, dataLength); err != nil {
+				return err
+			}
+		case PreallocFalloc:
+			if err := Fallocate(i.Handler.(FastHandler), int64(dataOffset), int64(dataLength)); err != nil {
+				return errors.Join(errors.New("fallocate failed"), err)
+			}
+			zeroFlag = true
+		case PreallocMetadata:
+			zeroFlag = true
+		}
+
+		if zeroFlag && i.Header.Version < 3 && dataOffset < fileEnd {
+			// no zero flag in v2, reused clusters are zeroed instead
+			if err := writeZeros(i.writer(), dataOffset, min(dataLength, fileEnd-dataOffset)); err != nil {
+				return err
+			}
+		}
+
+		for n, l2Index := range missing {
+			entry := L2Entry{
+				Flag: true,
+				Standard: &StandardDescriptor{
+					DataOffset: dataOffset + uint64(n)*clusterSize,
+					AllZero:    zeroFlag && i.Header.Version >= 3,
+				},
+			}
+			binary.BigEndian.PutUint64(rawTable[l2Index*8:l2Index*8+8], entry.Raw(i.Header.ClusterBits))
+		}
+		if err := i.storeTable(i.l2Cache, l2TableStart, rawTable); err != nil {
+			return err
+		}
+	}
+
+	// the sparse data clusters at the end are part of the file
+	t, ok := i.Handler.(Truncater)
+	if !ok {
+		return nil
+	}
+	size, err := HandlerSize(i.Handler)
+	if err != nil || dataEnd <= size {
+		return err
+	}
+	return t.Truncate(int64(dataEnd))
+}
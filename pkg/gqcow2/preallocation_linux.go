@@ -0,0 +1,11 @@
+package gqcow2
+
+import (
+	"syscall"
+)
+
+// Fallocate allocates the byte range of the file in the file system,
+// the file grows if the range ends beyond its size.
+func Fallocate(f FastHandler, off int64, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), 0, off, length)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package gqcow2
+
+import (
+	"errors"
+	"io"
+)
+
+// Fallocate allocates the byte range of the file in the file system,
+// the file grows if the range ends beyond its size. There is no
+// fallocate outside of linux, zeros are written into the range instead,
+// which must not hold data.
+func Fallocate(f FastHandler, off int64, length int64) error {
+	w, ok := f.(io.WriterAt)
+	if !ok {
+		return errors.New("fallocate is not supported by the handler")
+	}
+	return writeZeros(w, uint64(off), uint64(length))
+}
@@ -0,0 +1,67 @@
+package gqcow2_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Preallocation(t *testing.T) {
+	size := uint64(8 << 20)
+
+	for _, mode := range []gqcow2.PreallocMode{gqcow2.PreallocMetadata, gqcow2.PreallocFalloc, gqcow2.PreallocFull} {
+		t.Run("Create with preallocation "+string(mode),
+			func(t *testing.T) {
+				path := filepath.Join(t.TempDir(), "prealloc.qcow2")
+				f, err := os.Create(path)
+				require.NoError(t, err)
+				defer f.Close()
+
+				image, err := gqcow2.Create(f, path, gqcow2.CreateOptions{Size: size, Preallocation: mode})
+				require.NoError(t, err)
+
+				// every cluster is allocated and reads as zeros
+				for _, region := range image.Dump() {
+					assert.True(t, region.Present)
+				}
+				assert.True(t, isZero(readGuest(t, image)))
+
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				assert.GreaterOrEqual(t, info.Size(), int64(size))
+
+				// metadata leaves the data clusters sparse
+				blocks := info.Sys().(*syscall.Stat_t).Blocks * 512
+				if mode == gqcow2.PreallocMetadata {
+					assert.Less(t, blocks, int64(size))
+				} else {
+					assert.GreaterOrEqual(t, blocks, int64(size))
+				}
+			})
+	}
+
+	t.Run("Grow with preallocation",
+		func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "grow.qcow2")
+			image, content := createTestImage(t, path,
+				gqcow2.CreateOptions{Size: 1 << 20},
+				[]gqcow2.Extent{{Start: 0, Length: 1 << 19}})
+
+			require.NoError(t, image.Resize(size, gqcow2.ResizeOptions{Preallocation: gqcow2.PreallocFull}))
+
+			for _, region := range image.Dump() {
+				if region.Start >= 1<<20 {
+					assert.True(t, region.Present)
+				}
+			}
+			got := readGuest(t, image)
+			assert.Equal(t, content, got[:1<<20])
+			assert.True(t, isZero(got[1<<20:]))
+		})
+}
@@ -35,26 +35,24 @@ func (i *Image) LoadRefcountTable() error {
 
 	tableBuf := make([]byte, totalTableSize)
 	rc, err := i.Handler.ReadAt(tableBuf, int64(offset))
-	if err != nil {
-		return err
-	}
 	// even its read, but corrupted, should abort
 	if rc < int(totalTableSize) {
-		return io.ErrUnexpectedEOF
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
 	}
 
-	if i.RefCountTable == nil {
-		i.RefCountTable = make([]RefCountTableEntry, 0, totalEntryCount)
-	}
+	i.RefCountTable = make([]RefCountTableEntry, 0, totalEntryCount)
 
 	for index := range totalEntryCount {
 		// each entry takes 8 bytes
-		e := binary.BigEndian.Uint64(tableBuf[index : index+8])
+		e := binary.BigEndian.Uint64(tableBuf[index*8 : index*8+8])
 
 		newEntry := RefCountTableEntry{
 			Index: int(index),
-			// only the last 55bits are meaningful
-			RefCountBlockOffset: (e & ((1 << 55) - 1)) << 9,
+			// bits 0-8 are reserved, 9-63 is the offset
+			RefCountBlockOffset: e &^ uint64(511),
 		}
 
 		i.RefCountTable = append(i.RefCountTable, newEntry)
@@ -66,64 +64,466 @@ func (i *Image) LoadRefcountTable() error {
 
 // ReadRefCount query the image file to find out given offset's refcount
 func (i *Image) ReadRefCount(offset uint64) (int, error) {
-	refCountTableIndex := (offset / uint64(i.Header.ClusterSize()) / uint64(i.Header.RefCountBlockEntryCount()))
-	refCountBlockIndex := (offset / uint64(i.Header.ClusterSize()) % uint64(i.Header.RefCountBlockEntryCount()))
+	refcount, err := i.getRefCount(offset / uint64(i.Header.ClusterSize()))
+	return int(refcount), err
+}
 
-	blockOffset := i.RefCountTable[refCountTableIndex].RefCountBlockOffset
-	if blockOffset == 0 {
+// refCountPosition returns the refcount table index and the
+// refcount block index of the host cluster
+func (i *Image) refCountPosition(clusterIndex uint64) (uint64, uint64) {
+	entryCount := uint64(i.Header.RefCountBlockEntryCount())
+	return clusterIndex / entryCount, clusterIndex % entryCount
+}
+
+// getRefCount reads the refcount of the host cluster, clusters not
+// covered by any refcount block are free.
+func (i *Image) getRefCount(clusterIndex uint64) (uint64, error) {
+	tableIndex, blockIndex := i.refCountPosition(clusterIndex)
+	if tableIndex >= uint64(len(i.RefCountTable)) {
 		return 0, nil
 	}
 
-	// read the block
-	rawBlock := make([]byte, 0, i.Header.ClusterSize())
-	if _, err := i.Handler.ReadAt(rawBlock, int64(blockOffset)); err != nil {
-		return 0, err
+	blockOffset := i.RefCountTable[tableIndex].RefCountBlockOffset
+	if blockOffset == 0 {
+		return 0, nil
 	}
 
-	refcount, err := extractRefCount(rawBlock, refCountBlockIndex, i.Header.RefCountBit())
+	// read the block
+	rawBlock, err := i.loadTable(i.refCountCache, blockOffset)
 	if err != nil {
 		return 0, err
 	}
 
-	return refcount, nil
+	return extractRefCount(rawBlock, blockIndex, i.Header.RefCountBit())
 }
 
-func extractRefCount(block []byte, index uint64, entryBitSize int) (int, error) {
+func extractRefCount(block []byte, index uint64, entryBitSize int) (uint64, error) {
 	offset := index * uint64(entryBitSize)
 
-	// support 16 and 32 bit entry size for now
-
 	byteIndex := offset / 8
 	bitOffset := offset % 8
 
-	if bitOffset != 0 {
-		return 0, fmt.Errorf("not valid refcount bits[%d]", bitOffset)
+	switch entryBitSize {
+	case 1, 2, 4:
+		// sub-byte entries, the first entry is the least significant bits
+		return uint64(block[byteIndex]>>bitOffset) & (1<<entryBitSize - 1), nil
+	case 8:
+		return uint64(block[byteIndex]), nil
+	case 16:
+		return uint64(binary.BigEndian.Uint16(block[byteIndex : byteIndex+2])), nil
+	case 32:
+		return uint64(binary.BigEndian.Uint32(block[byteIndex : byteIndex+4])), nil
+	case 64:
+		return binary.BigEndian.Uint64(block[byteIndex : byteIndex+8]), nil
 	}
 
-	if entryBitSize == 16 {
-		return int(binary.BigEndian.Uint16(block[byteIndex : byteIndex+2])), nil
+	return 0, fmt.Errorf("not valid refcount bits[%d]", entryBitSize)
+}
+
+// putRefCount is the reverse of extractRefCount, it returns the
+// byte range of the block that has been modified
+func putRefCount(block []byte, index uint64, entryBitSize int, value uint64) (int, int, error) {
+	if entryBitSize < 64 && value >= 1<<entryBitSize {
+		return 0, 0, fmt.Errorf("refcount %d overflows refcount bits[%d]", value, entryBitSize)
 	}
 
-	if entryBitSize == 32 {
-		return int(binary.BigEndian.Uint32(block[byteIndex : byteIndex+4])), nil
+	offset := index * uint64(entryBitSize)
+	byteIndex := int(offset / 8)
+	bitOffset := offset % 8
+
+	switch entryBitSize {
+	case 1, 2, 4:
+		mask := byte(1<<entryBitSize-1) << bitOffset
+		block[byteIndex] = block[byteIndex]&^mask | byte(value)<<bitOffset
+		return byteIndex, byteIndex + 1, nil
+	case 8:
+		block[byteIndex] = byte(value)
+		return byteIndex, byteIndex + 1, nil
+	case 16:
+		binary.BigEndian.PutUint16(block[byteIndex:byteIndex+2], uint16(value))
+		return byteIndex, byteIndex + 2, nil
+	case 32:
+		binary.BigEndian.PutUint32(block[byteIndex:byteIndex+4], uint32(value))
+		return byteIndex, byteIndex + 4, nil
+	case 64:
+		binary.BigEndian.PutUint64(block[byteIndex:byteIndex+8], value)
+		return byteIndex, byteIndex + 8, nil
 	}
 
-	return 0, fmt.Errorf("not valid refcount bits[%d]", bitOffset)
+	return 0, 0, fmt.Errorf("not valid refcount bits[%d]", entryBitSize)
 }
 
-//func extraUint16(block []byte, offset int) uint16 {
-//	// big endian only for now
-//	byteIndex := offset / 8
-//	bitOffset := offset % 8
-//
-//	// uint16 will expand two bytes
-//
-//	// already aligned
-//	if bitOffset == 0 {
-//		return binary.BigEndian.Uint16(block[byteIndex : byteIndex+2])
-//	}
+// setRefCount updates the refcount of the host cluster, the refcount
+// block (and table) is allocated if the cluster is not covered yet.
+func (i *Image) setRefCount(clusterIndex uint64, value uint64) error {
+	if i.staleRefCounts {
+		return ErrStaleRefCounts
+	}
+	if err := i.ensureRefCountBlock(clusterIndex); err != nil {
+		return err
+	}
+
+	tableIndex, blockIndex := i.refCountPosition(clusterIndex)
+	blockOffset := i.RefCountTable[tableIndex].RefCountBlockOffset
+	rawBlock, err := i.loadTable(i.refCountCache, blockOffset)
+	if err != nil {
+		return err
+	}
+
+	oldValue, err := extractRefCount(rawBlock, blockIndex, i.Header.RefCountBit())
+	if err != nil {
+		return err
+	}
+	// the freed cluster may be reused right away, the references
+	// to it must be gone on disk before
+	if value == 0 && oldValue != 0 && i.WriteBack {
+		if err := i.flushMetadata(); err != nil {
+			return err
+		}
+	}
+	start, end, err := putRefCount(rawBlock, blockIndex, i.Header.RefCountBit(), value)
+	if err != nil {
+		return err
+	}
+	if err := i.storeTableEntry(i.refCountCache, blockOffset, start, rawBlock[start:end]); err != nil {
+		return err
+	}
+
+	if value == 0 && oldValue != 0 {
+		if clusterIndex < i.freeClusterIndex {
+			i.freeClusterIndex = clusterIndex
+		}
+		return i.punchHole(clusterIndex)
+	}
+
+	return nil
+}
+
+// updateRefCount adds delta to the refcount of every host cluster
+// overlaps the range [offset, offset+length)
+func (i *Image) updateRefCount(offset uint64, length uint64, delta int) error {
+	if length == 0 {
+		return nil
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	first := offset / clusterSize
+	last := (offset + length - 1) / clusterSize
+	for clusterIndex := first; clusterIndex <= last; clusterIndex++ {
+		refcount, err := i.getRefCount(clusterIndex)
+		if err != nil {
+			return err
+		}
+		if delta < 0 && refcount < uint64(-delta) {
+			return fmt.Errorf("refcount of cluster %d drops below zero", clusterIndex)
+		}
+		if err := i.setRefCount(clusterIndex, uint64(int64(refcount)+int64(delta))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ensureRefCountBlock makes sure the refcount block that covers the
+// host cluster exists.
 //
-//	// like bigEndian implementation
-//	return uint16((block[byteIndex])<<bitOffset|block[byteIndex+1]>>(8-bitOffset)) |
-//		uint16((block[byteIndex+1]<<(8-bitOffset) | block[byteIndex+2]>>byte(bitOffset)))
-//}
+// A new refcount block is always put into the first cluster of the
+// range it covers, a missing block means the whole range is free, so
+// the new block describes itself and never recurses.
+func (i *Image) ensureRefCountBlock(clusterIndex uint64) error {
+	tableIndex, _ := i.refCountPosition(clusterIndex)
+	if tableIndex >= uint64(len(i.RefCountTable)) {
+		if err := i.growRefCountTable(tableIndex + 1); err != nil {
+			return err
+		}
+	}
+	if i.RefCountTable[tableIndex].RefCountBlockOffset != 0 {
+		return nil
+	}
+
+	clusterSize := uint64(i.Header.ClusterSize())
+	blockCluster := tableIndex * uint64(i.Header.RefCountBlockEntryCount())
+	blockOffset := blockCluster * clusterSize
+
+	rawBlock := make([]byte, clusterSize)
+	if _, _, err := putRefCount(rawBlock, 0, i.Header.RefCountBit(), 1); err != nil {
+		return err
+	}
+	if err := i.storeTable(i.refCountCache, blockOffset, rawBlock); err != nil {
+		return err
+	}
+	// the block must be on disk before the refcount table points to it
+	if err := i.writeCachedTable(i.refCountCache, blockOffset); err != nil {
+		return err
+	}
+	if i.WriteBack {
+		if err := i.sync(); err != nil {
+			return err
+		}
+	}
+
+	i.RefCountTable[tableIndex].RefCountBlockOffset = blockOffset
+	return i.writeRefCountTableEntry(int(tableIndex))
+}
+
+// writeRefCountTableEntry writes the in-memory refcount table entry
+// back into the image, entries beyond the on-disk table are kept in
+// memory until the table is relocated.
+func (i *Image) writeRefCountTableEntry(index int) error {
+	capacity := int(i.Header.RefcountTableClusters) * i.Header.ClusterSize() / RefCountTableEntrySizeByte
+	if index >= capacity {
+		return nil
+	}
+
+	buf := make([]byte, RefCountTableEntrySizeByte)
+	binary.BigEndian.PutUint64(buf, i.RefCountTable[index].RefCountBlockOffset)
+	_, err := i.writer().WriteAt(buf, int64(i.Header.RefCountTableOffset)+int64(index)*RefCountTableEntrySizeByte)
+	return err
+}
+
+// growRefCountTable relocates the refcount table into a larger one
+// that has at least minEntries entries.
+func (i *Image) growRefCountTable(minEntries uint64) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	oldOffset := i.Header.RefCountTableOffset
+	oldClusters := uint64(i.Header.RefcountTableClusters)
+
+	// the table is being relocated, the new entries only live
+	// in memory until the new table is written
+	for uint64(len(i.RefCountTable)) < minEntries {
+		i.RefCountTable = append(i.RefCountTable, RefCountTableEntry{Index: len(i.RefCountTable)})
+	}
+	if i.growingRefCountTable {
+		return nil
+	}
+	i.growingRefCountTable = true
+	defer func() { i.growingRefCountTable = false }()
+
+	for {
+		// leave some room so the table doesn't grow on every allocation
+		entries := uint64(len(i.RefCountTable)) * 3 / 2
+		newClusters := divRoundUp(entries*RefCountTableEntrySizeByte, clusterSize)
+		newOffset, err := i.allocateClusters(newClusters)
+		if err != nil {
+			return err
+		}
+
+		// allocating the new table may need more entries than planned
+		if uint64(len(i.RefCountTable))*RefCountTableEntrySizeByte > newClusters*clusterSize {
+			if err := i.updateRefCount(newOffset, newClusters*clusterSize, -1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for uint64(len(i.RefCountTable)) < newClusters*clusterSize/RefCountTableEntrySizeByte {
+			i.RefCountTable = append(i.RefCountTable, RefCountTableEntry{Index: len(i.RefCountTable)})
+		}
+		rawTable := make([]byte, newClusters*clusterSize)
+		for index, entry := range i.RefCountTable {
+			binary.BigEndian.PutUint64(rawTable[index*8:index*8+8], entry.RefCountBlockOffset)
+		}
+		if _, err := i.writer().WriteAt(rawTable, int64(newOffset)); err != nil {
+			return err
+		}
+
+		i.Header.RefCountTableOffset = newOffset
+		i.Header.RefcountTableClusters = uint32(newClusters)
+		if err := i.WriteHeader(); err != nil {
+			return err
+		}
+
+		return i.updateRefCount(oldOffset, oldClusters*clusterSize, -1)
+	}
+}
+
+// isFreeRange tells whether count host clusters starting at
+// clusterIndex all have refcount 0
+func (i *Image) isFreeRange(clusterIndex uint64, count uint64) (bool, error) {
+	for c := clusterIndex; c < clusterIndex+count; c++ {
+		refcount, err := i.getRefCount(c)
+		if err != nil {
+			return false, err
+		}
+		if refcount != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// findFreeClusters returns the index of the first run of count free
+// host clusters
+func (i *Image) findFreeClusters(count uint64) (uint64, error) {
+	start := i.freeClusterIndex
+	for {
+		found := true
+		for c := start; c < start+count; c++ {
+			refcount, err := i.getRefCount(c)
+			if err != nil {
+				return 0, err
+			}
+			if refcount != 0 {
+				// every cluster before the hint is in use
+				if c == i.freeClusterIndex {
+					i.freeClusterIndex = c + 1
+				}
+				start = c + 1
+				found = false
+				break
+			}
+		}
+		if found {
+			return start, nil
+		}
+	}
+}
+
+// allocateClusters reserves count contiguous host clusters with
+// refcount 1 and returns the image offset of the first one.
+func (i *Image) allocateClusters(count uint64) (uint64, error) {
+	if i.staleRefCounts {
+		return 0, ErrStaleRefCounts
+	}
+	for {
+		start, err := i.findFreeClusters(count)
+		if err != nil {
+			return 0, err
+		}
+
+		// creating refcount blocks may take clusters inside the range
+		for c := start; c < start+count; c++ {
+			if err := i.ensureRefCountBlock(c); err != nil {
+				return 0, err
+			}
+		}
+		free, err := i.isFreeRange(start, count)
+		if err != nil {
+			return 0, err
+		}
+		if !free {
+			continue
+		}
+
+		for c := start; c < start+count; c++ {
+			if err := i.setRefCount(c, 1); err != nil {
+				return 0, err
+			}
+		}
+		if start == i.freeClusterIndex {
+			i.freeClusterIndex = start + count
+		}
+
+		return start * uint64(i.Header.ClusterSize()), nil
+	}
+}
+
+// clusterRefCounts reads the refcount of every host cluster up to the
+// last one in use
+func (i *Image) clusterRefCounts() ([]uint64, error) {
+	last, err := i.lastUsedCluster()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]uint64, last+1)
+	for clusterIndex := range counts {
+		if counts[clusterIndex], err = i.getRefCount(uint64(clusterIndex)); err != nil {
+			return nil, err
+		}
+	}
+	return counts, nil
+}
+
+// refCountStructureClusters returns the host clusters of the
+// refcount table and the refcount blocks
+func (i *Image) refCountStructureClusters() []uint64 {
+	clusterSize := uint64(i.Header.ClusterSize())
+	clusters := make([]uint64, 0, len(i.RefCountTable)+int(i.Header.RefcountTableClusters))
+	first := i.Header.RefCountTableOffset / clusterSize
+	for c := first; c < first+uint64(i.Header.RefcountTableClusters); c++ {
+		clusters = append(clusters, c)
+	}
+	for _, entry := range i.RefCountTable {
+		if entry.RefCountBlockOffset != 0 {
+			clusters = append(clusters, entry.RefCountBlockOffset/clusterSize)
+		}
+	}
+	return clusters
+}
+
+// rewriteRefCounts writes a new refcount table and new refcount blocks
+// with the given refcount order behind the clusters of counts, then
+// switches the header over to them. The current refcount structures
+// are freed by the switch.
+func (i *Image) rewriteRefCounts(counts []uint64, order uint32) error {
+	clusterSize := uint64(i.Header.ClusterSize())
+	oldClusters := i.refCountStructureClusters()
+	for _, c := range oldClusters {
+		if c < uint64(len(counts)) {
+			counts[c] = 0
+		}
+	}
+	bits := 1 << order
+	entriesPerBlock := clusterSize * 8 / uint64(bits)
+
+	// the new structures must cover themselves as well
+	start := uint64(len(counts))
+	blocks, tableClusters := uint64(0), uint64(0)
+	for {
+		total := start + tableClusters + blocks
+		needBlocks := divRoundUp(total, entriesPerBlock)
+		needTableClusters := divRoundUp(needBlocks*RefCountTableEntrySizeByte, clusterSize)
+		if needBlocks == blocks && needTableClusters == tableClusters {
+			break
+		}
+		blocks, tableClusters = needBlocks, needTableClusters
+	}
+	for c := start; c < start+tableClusters+blocks; c++ {
+		counts = append(counts, 1)
+	}
+
+	rawTable := make([]byte, tableClusters*clusterSize)
+	for blockIndex := range blocks {
+		rawBlock := make([]byte, clusterSize)
+		for entryIndex := range entriesPerBlock {
+			clusterIndex := blockIndex*entriesPerBlock + entryIndex
+			if clusterIndex >= uint64(len(counts)) {
+				break
+			}
+			if _, _, err := putRefCount(rawBlock, entryIndex, bits, counts[clusterIndex]); err != nil {
+				return err
+			}
+		}
+
+		blockOffset := (start + tableClusters + blockIndex) * clusterSize
+		if _, err := i.writer().WriteAt(rawBlock, int64(blockOffset)); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint64(rawTable[blockIndex*8:blockIndex*8+8], blockOffset)
+	}
+	if _, err := i.writer().WriteAt(rawTable, int64(start*clusterSize)); err != nil {
+		return err
+	}
+
+	i.Header.RefCountOrder = order
+	i.Header.RefCountTableOffset = start * clusterSize
+	i.Header.RefcountTableClusters = uint32(tableClusters)
+	if err := i.WriteHeader(); err != nil {
+		return err
+	}
+
+	i.refCountCache = newTableCache()
+	i.freeClusterIndex = 0
+	if err := i.LoadRefcountTable(); err != nil {
+		return err
+	}
+
+	for _, c := range oldClusters {
+		if err := i.punchHole(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
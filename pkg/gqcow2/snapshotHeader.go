@@ -1,3 +1,88 @@
 package gqcow2
 
-type SnapshotHeader struct{}
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// SnapshotHeader is an entry of the snapshot table
+type SnapshotHeader struct {
+	L1TableOffset uint64
+	L1Size        uint32
+
+	ID   string
+	Name string
+
+	// the time the snapshot was taken
+	Date time.Time
+	// the time passed in the guest when the snapshot was taken
+	VMClock time.Duration
+	// the size of the saved vm state, 0 for disk only snapshots
+	VMStateSize uint64
+	// the virtual size of the disk when the snapshot was taken,
+	// 0 if not recorded by a v2 image
+	DiskSize uint64
+	// the instruction counter of the guest, -1 if not recorded
+	ICount int64
+}
+
+// the size of the fixed part of a snapshot table entry
+const snapshotHeaderSize = 40
+
+// LoadSnapshots reads the snapshot table of the image
+func (i *Image) LoadSnapshots() ([]SnapshotHeader, error) {
+	snapshots, _, err := i.loadSnapshotTable()
+	return snapshots, err
+}
+
+// loadSnapshotTable reads the snapshot table and returns its size in bytes
+func (i *Image) loadSnapshotTable() ([]SnapshotHeader, uint64, error) {
+	snapshots := make([]SnapshotHeader, 0, i.Header.NumSnapshots)
+	offset := i.Header.SnapshotOffset
+	for range i.Header.NumSnapshots {
+		fixed, err := readAt(i.Handler, int64(offset), snapshotHeaderSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		s := SnapshotHeader{
+			L1TableOffset: binary.BigEndian.Uint64(fixed[0:8]),
+			L1Size:        binary.BigEndian.Uint32(fixed[8:12]),
+			Date: time.Unix(int64(binary.BigEndian.Uint32(fixed[16:20])),
+				int64(binary.BigEndian.Uint32(fixed[20:24]))),
+			VMClock:     time.Duration(binary.BigEndian.Uint64(fixed[24:32])),
+			VMStateSize: uint64(binary.BigEndian.Uint32(fixed[32:36])),
+			ICount:      -1,
+		}
+		idSize := uint64(binary.BigEndian.Uint16(fixed[12:14]))
+		nameSize := uint64(binary.BigEndian.Uint16(fixed[14:16]))
+		extraSize := uint64(binary.BigEndian.Uint32(fixed[36:40]))
+
+		variable, err := readAt(i.Handler, int64(offset+snapshotHeaderSize), int64(extraSize+idSize+nameSize))
+		if err != nil {
+			return nil, 0, err
+		}
+		extra := variable[:extraSize]
+		if len(extra) >= 8 {
+			s.VMStateSize = binary.BigEndian.Uint64(extra[0:8])
+		}
+		if len(extra) >= 16 {
+			s.DiskSize = binary.BigEndian.Uint64(extra[8:16])
+		}
+		if len(extra) >= 24 {
+			s.ICount = int64(binary.BigEndian.Uint64(extra[16:24]))
+		}
+		s.ID = string(variable[extraSize : extraSize+idSize])
+		s.Name = string(variable[extraSize+idSize:])
+
+		if s.L1TableOffset%uint64(i.Header.ClusterSize()) != 0 {
+			return nil, 0, fmt.Errorf("snapshot %s has an unaligned l1 table", s.ID)
+		}
+		snapshots = append(snapshots, s)
+
+		// entries are aligned to 8 bytes
+		offset = alignUp(offset+snapshotHeaderSize+extraSize+idSize+nameSize, 8)
+	}
+	return snapshots, offset - i.Header.SnapshotOffset, nil
+}
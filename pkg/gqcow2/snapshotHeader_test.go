@@ -0,0 +1,79 @@
+package gqcow2_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotEntry encodes a snapshot table entry with the extra data of v3
+func snapshotEntry(l1Offset uint64, l1Size uint32, id string, name string, date time.Time, diskSize uint64) []byte {
+	entry := make([]byte, 40+24)
+	binary.BigEndian.PutUint64(entry[0:8], l1Offset)
+	binary.BigEndian.PutUint32(entry[8:12], l1Size)
+	binary.BigEndian.PutUint16(entry[12:14], uint16(len(id)))
+	binary.BigEndian.PutUint16(entry[14:16], uint16(len(name)))
+	binary.BigEndian.PutUint32(entry[16:20], uint32(date.Unix()))
+	binary.BigEndian.PutUint32(entry[20:24], uint32(date.Nanosecond()))
+	binary.BigEndian.PutUint64(entry[24:32], uint64(90*time.Second))
+	binary.BigEndian.PutUint32(entry[36:40], 24)
+	binary.BigEndian.PutUint64(entry[48:56], diskSize)
+	binary.BigEndian.PutUint64(entry[56:64], 12345)
+	entry = append(entry, id...)
+	entry = append(entry, name...)
+	for len(entry)%8 != 0 {
+		entry = append(entry, 0)
+	}
+	return entry
+}
+
+func Test_LoadSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.qcow2")
+	image, _ := createTestImage(t, path, gqcow2.CreateOptions{Size: 1 << 20}, nil)
+	snapshots, err := image.LoadSnapshots()
+	require.NoError(t, err)
+	assert.Empty(t, snapshots)
+
+	date := time.Unix(1700000000, 5000)
+	table := snapshotEntry(image.Header.L1TableOffset, image.Header.L1Size, "1", "first", date, 1<<20)
+	table = append(table, snapshotEntry(image.Header.L1TableOffset, image.Header.L1Size, "2", "second snapshot", date, 1<<20)...)
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer f.Close()
+	info, err := f.Stat()
+	require.NoError(t, err)
+	tableOffset := uint64(info.Size()+65535) / 65536 * 65536
+	_, err = f.WriteAt(table, int64(tableOffset))
+	require.NoError(t, err)
+	header := make([]byte, 12)
+	binary.BigEndian.PutUint32(header[0:4], 2)
+	binary.BigEndian.PutUint64(header[4:12], tableOffset)
+	_, err = f.WriteAt(header, 60)
+	require.NoError(t, err)
+
+	reopened, err := gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	defer reopened.Close()
+	snapshots, err = reopened.LoadSnapshots()
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, gqcow2.SnapshotHeader{
+		L1TableOffset: image.Header.L1TableOffset,
+		L1Size:        image.Header.L1Size,
+		ID:            "1",
+		Name:          "first",
+		Date:          date,
+		VMClock:       90 * time.Second,
+		DiskSize:      1 << 20,
+		ICount:        12345,
+	}, snapshots[0])
+	assert.Equal(t, "second snapshot", snapshots[1].Name)
+}
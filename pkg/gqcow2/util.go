@@ -21,3 +21,45 @@ func readAt(r FileHandler, offset int64, length int64) ([]byte, error) {
 
 	return result, nil
 }
+
+// ReadFull reads len(p) bytes at offset, a short read is an
+// io.ErrUnexpectedEOF even at the end of the file
+func ReadFull(f FileHandler, p []byte, offset uint64) (int, error) {
+	n, err := f.ReadAt(p, int64(offset))
+	if n == len(p) {
+		return n, nil
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// alignUp rounds v up to the next multiple of align
+func alignUp(v uint64, align uint64) uint64 {
+	return (v + align - 1) / align * align
+}
+
+// divRoundUp is the ceiling of a / b
+func divRoundUp(a uint64, b uint64) uint64 {
+	return (a + b - 1) / b
+}
+
+// Extent is a byte range of the virtual disk
+type Extent struct {
+	Start  uint64 `json:"start"`
+	Length uint64 `json:"length"`
+}
+
+func (e Extent) End() uint64 {
+	return e.Start + e.Length
+}
+
+func isAllZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,725 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// DefaultPort is the port of nbd:// urls without one
+const DefaultPort = "10809"
+
+// block status is asked for at most this much at once
+const maxStatusLength = 1 << 30
+
+// option replies, error messages and block status descriptors are read
+// into memory up to this length, the server is not trusted with more
+const maxPayloadLength = 64 << 10
+
+// Client is a connection to an export of an NBD server, like qemu-nbd
+// or nbdkit. It is a gqcow2.FileHandler and a gqcow2.DiskHandler, so an
+// image stored on the export can be opened by gqcow2.NewFileImage, and
+// a guest exported as raw is a gqcow2.BackingDisk whose holes are found
+// by block status. Requests are sent one at a time.
+type Client struct {
+	Export string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+
+	size       uint64
+	flags      uint16
+	structured bool
+	// the id of base:allocation, 0 if the server doesn't support it
+	metaContext uint32
+	handle      uint64
+}
+
+// Dial connects to the export over tcp or a unix socket
+func Dial(network string, address string, export string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// DialURL connects to an export named by an url like qemu does,
+// nbd://host[:port]/export or nbd+unix:///export?socket=path
+func DialURL(rawURL string) (*Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	export := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "nbd", "nbd+tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("nbd url %s has no host", rawURL)
+		}
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), DefaultPort)
+		}
+		return Dial("tcp", address, export)
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return nil, fmt.Errorf("nbd url %s has no socket", rawURL)
+		}
+		return Dial("unix", socket, export)
+	}
+	return nil, fmt.Errorf("unsupported nbd url %s", rawURL)
+}
+
+// IsURL tells if the path is an url of an export
+func IsURL(path string) bool {
+	return strings.HasPrefix(path, "nbd://") || strings.HasPrefix(path, "nbd+tcp://") ||
+		strings.HasPrefix(path, "nbd+unix://")
+}
+
+// NewClient runs the handshake on the connection and selects the
+// export, structured replies and base:allocation are used if the
+// server supports them
+func NewClient(conn net.Conn, export string) (*Client, error) {
+	c := &Client{
+		Export: export,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+	}
+	if err := c.handshake(); err != nil {
+		return nil, errors.Join(fmt.Errorf("nbd handshake for export %q failed", export), err)
+	}
+	return c, nil
+}
+
+func (c *Client) write(v ...any) error {
+	for _, value := range v {
+		if err := binary.Write(c.w, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) read(v ...any) error {
+	for _, value := range v {
+		if err := binary.Read(c.r, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) handshake() error {
+	var magic, option uint64
+	var serverFlags uint16
+	if err := c.read(&magic, &option, &serverFlags); err != nil {
+		return err
+	}
+	if magic != nbdMagic || option != optionMagic {
+		return errors.New("the server does not speak the newstyle handshake")
+	}
+	if serverFlags&flagFixedNewstyle == 0 {
+		return errors.New("the server does not support the fixed newstyle handshake")
+	}
+	noZeroes := serverFlags&flagNoZeroes != 0
+	clientFlags := uint32(flagFixedNewstyle)
+	if noZeroes {
+		clientFlags |= flagNoZeroes
+	}
+	if err := c.write(clientFlags); err != nil {
+		return err
+	}
+
+	replies, err := c.option(optStructuredReply, nil)
+	if err != nil {
+		return err
+	}
+	c.structured = replies[len(replies)-1].Type == repAck
+
+	name := binary.BigEndian.AppendUint32(nil, uint32(len(c.Export)))
+	name = append(name, c.Export...)
+	if c.structured {
+		query := binary.BigEndian.AppendUint32(name, 1)
+		query = binary.BigEndian.AppendUint32(query, uint32(len(BaseAllocation)))
+		query = append(query, BaseAllocation...)
+		if replies, err = c.option(optSetMetaContext, query); err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Type == repMetaContext && len(reply.Data) >= 4 && string(reply.Data[4:]) == BaseAllocation {
+				c.metaContext = binary.BigEndian.Uint32(reply.Data)
+			}
+		}
+	}
+
+	// no information requests, the export information is always sent
+	if replies, err = c.option(optGo, binary.BigEndian.AppendUint16(name, 0)); err != nil {
+		return err
+	}
+	last := replies[len(replies)-1]
+	if last.Type == repErrUnsup {
+		return c.exportName(noZeroes)
+	}
+	if last.Type != repAck {
+		return fmt.Errorf("the server refused the export: %s", optionError(last))
+	}
+	for _, reply := range replies {
+		if reply.Type == repInfo && len(reply.Data) >= 12 && binary.BigEndian.Uint16(reply.Data) == infoExport {
+			c.size = binary.BigEndian.Uint64(reply.Data[2:])
+			c.flags = binary.BigEndian.Uint16(reply.Data[10:])
+		}
+	}
+	if c.flags&FlagHasFlags == 0 {
+		return errors.New("the server sent no export information")
+	}
+	return nil
+}
+
+// exportName selects the export by the oldest option, for servers
+// which don't know NBD_OPT_GO
+func (c *Client) exportName(noZeroes bool) error {
+	if err := c.write(optionHeader{Magic: optionMagic, Option: optExportName, Length: uint32(len(c.Export))}); err != nil {
+		return err
+	}
+	if _, err := c.w.WriteString(c.Export); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	if err := c.read(&c.size, &c.flags); err != nil {
+		return err
+	}
+	if !noZeroes {
+		if _, err := c.r.Discard(124); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type optionReply struct {
+	Type uint32
+	Data []byte
+}
+
+// option sends the option and reads the replies up to the ack or
+// the error, which is the last one
+func (c *Client) option(option uint32, data []byte) ([]optionReply, error) {
+	if err := c.write(optionHeader{Magic: optionMagic, Option: option, Length: uint32(len(data))}); err != nil {
+		return nil, err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var replies []optionReply
+	for {
+		var hdr optionReplyHeader
+		if err := c.read(&hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Magic != optionReplyMagic || hdr.Option != option {
+			return nil, fmt.Errorf("invalid reply to option %d", option)
+		}
+		if hdr.Length > maxPayloadLength {
+			return nil, fmt.Errorf("reply to option %d is too long", option)
+		}
+		reply := optionReply{Type: hdr.Type, Data: make([]byte, hdr.Length)}
+		if _, err := io.ReadFull(c.r, reply.Data); err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+		if hdr.Type == repAck || hdr.Type&(1<<31) != 0 {
+			return replies, nil
+		}
+	}
+}
+
+func optionError(reply optionReply) string {
+	if len(reply.Data) != 0 {
+		return string(reply.Data)
+	}
+	return fmt.Sprintf("error %#x", reply.Type)
+}
+
+// Size is the size of the export, like the size of a file
+func (c *Client) Size() int64 {
+	return int64(c.size)
+}
+
+// VirtualSize is the size of the export as a guest disk
+func (c *Client) VirtualSize() uint64 {
+	return c.size
+}
+
+// Flags are the transmission flags of the export
+func (c *Client) Flags() uint16 {
+	return c.flags
+}
+
+// ReadOnly tells if the server refuses writes to the export
+func (c *Client) ReadOnly() bool {
+	return c.flags&FlagReadOnly != 0
+}
+
+// Close disconnects from the server
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.send(request{Type: cmdDisc}, nil)
+	err = errors.Join(err, c.conn.Close())
+	c.conn = nil
+	return err
+}
+
+// send sends the request with a new handle, the lock must be held
+func (c *Client) send(req request, data []byte) error {
+	if c.conn == nil {
+		return net.ErrClosed
+	}
+	c.handle++
+	req.Magic, req.Handle = requestMagic, c.handle
+	if err := c.write(req); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// reply is the header of a simple reply or of a chunk
+type reply struct {
+	simple bool
+	errno  uint32
+	flags  uint16
+	chunk  uint16
+	length uint32
+}
+
+func (r reply) done() bool {
+	return r.simple || r.flags&replyFlagDone != 0
+}
+
+// readReply reads the header of the next reply to the last request
+func (c *Client) readReply() (reply, error) {
+	var magic uint32
+	if err := c.read(&magic); err != nil {
+		return reply{}, err
+	}
+
+	var r reply
+	var handle uint64
+	switch magic {
+	case simpleReplyMagic:
+		r.simple = true
+		if err := c.read(&r.errno, &handle); err != nil {
+			return reply{}, err
+		}
+	case structuredReplyMagic:
+		if err := c.read(&r.flags, &r.chunk, &handle, &r.length); err != nil {
+			return reply{}, err
+		}
+	default:
+		return reply{}, fmt.Errorf("invalid reply magic %#x", magic)
+	}
+	if handle != c.handle {
+		return reply{}, fmt.Errorf("reply to the unknown handle %d", handle)
+	}
+	return r, nil
+}
+
+// readError reads the payload of an error chunk
+func (c *Client) readError(r reply) (uint32, string, error) {
+	if r.length > maxPayloadLength {
+		return 0, "", errors.New("error chunk is too long")
+	}
+	payload := make([]byte, r.length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, "", err
+	}
+	if len(payload) < 6 {
+		return 0, "", errors.New("invalid error chunk")
+	}
+	length := min(int(binary.BigEndian.Uint16(payload[4:])), len(payload)-6)
+	return binary.BigEndian.Uint32(payload), string(payload[6 : 6+length]), nil
+}
+
+// commandError is the error the server replied to the request, it
+// wraps the errno so errors.Is tells e.g. syscall.EPERM
+func commandError(req request, errno uint32, message string) error {
+	if message == "" {
+		message = "no message"
+	}
+	return errors.Join(fmt.Errorf("nbd command %d at %d failed: %s", req.Type, req.Offset, message), systemErrno(errno))
+}
+
+// systemErrno translates the error of a reply, which has the value of
+// linux, to the errno of this system. Unknown errors are EINVAL, like
+// qemu does.
+func systemErrno(errno uint32) syscall.Errno {
+	switch errno {
+	case errPerm:
+		return syscall.EPERM
+	case errIO:
+		return syscall.EIO
+	case errNoMem:
+		return syscall.ENOMEM
+	case errNoSpc:
+		return syscall.ENOSPC
+	case errOverflow:
+		return syscall.EOVERFLOW
+	case errNotSup:
+		return syscall.ENOTSUP
+	case errShutdown:
+		return syscall.ESHUTDOWN
+	}
+	return syscall.EINVAL
+}
+
+// command sends a request without data in the reply and waits for it
+func (c *Client) command(req request, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.send(req, data); err != nil {
+		return err
+	}
+
+	var replyErr error
+	for {
+		r, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		if r.simple {
+			if r.errno != 0 {
+				return commandError(req, r.errno, "")
+			}
+			return nil
+		}
+
+		if r.chunk&(1<<15) != 0 {
+			errno, message, err := c.readError(r)
+			if err != nil {
+				return err
+			}
+			replyErr = errors.Join(replyErr, commandError(req, errno, message))
+		} else if _, err := c.r.Discard(int(r.length)); err != nil {
+			return err
+		}
+		if r.done() {
+			return replyErr
+		}
+	}
+}
+
+// ReadAt reads the export, the holes sent by the server are not
+// transferred
+func (c *Client) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if uint64(off) >= c.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if uint64(off)+uint64(len(p)) > c.size {
+		p = p[:c.size-uint64(off)]
+		eof = io.EOF
+	}
+
+	for done := 0; done < len(p); {
+		n := min(len(p)-done, maxRequestSize)
+		if err := c.read1(p[done:done+n], uint64(off)+uint64(done)); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return len(p), eof
+}
+
+// read1 reads p by a single request
+func (c *Client) read1(p []byte, off uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := request{Type: cmdRead, Offset: off, Length: uint32(len(p))}
+	if err := c.send(req, nil); err != nil {
+		return err
+	}
+
+	var replyErr error
+	for {
+		r, err := c.readReply()
+		if err != nil {
+			return err
+		}
+		if r.simple {
+			if r.errno != 0 {
+				return commandError(req, r.errno, "")
+			}
+			_, err := io.ReadFull(c.r, p)
+			return err
+		}
+
+		switch {
+		case r.chunk == replyTypeOffsetData:
+			var offset uint64
+			if err := c.read(&offset); err != nil {
+				return err
+			}
+			length := uint64(r.length) - 8
+			if r.length < 8 || offset < off || offset-off+length > uint64(len(p)) {
+				return errors.New("data chunk beyond the request")
+			}
+			if _, err := io.ReadFull(c.r, p[offset-off:offset-off+length]); err != nil {
+				return err
+			}
+		case r.chunk == replyTypeOffsetHole:
+			var offset uint64
+			var length uint32
+			if r.length != 12 {
+				return errors.New("invalid hole chunk")
+			}
+			if err := c.read(&offset, &length); err != nil {
+				return err
+			}
+			if offset < off || offset-off+uint64(length) > uint64(len(p)) {
+				return errors.New("hole chunk beyond the request")
+			}
+			clear(p[offset-off : offset-off+uint64(length)])
+		case r.chunk&(1<<15) != 0:
+			errno, message, err := c.readError(r)
+			if err != nil {
+				return err
+			}
+			replyErr = errors.Join(replyErr, commandError(req, errno, message))
+		default:
+			if _, err := c.r.Discard(int(r.length)); err != nil {
+				return err
+			}
+		}
+		if r.done() {
+			return replyErr
+		}
+	}
+}
+
+// WriteAt writes the export, the writes beyond the end fail
+func (c *Client) WriteAt(p []byte, off int64) (int, error) {
+	if c.ReadOnly() {
+		return 0, gqcow2.ErrReadOnly
+	}
+	if off < 0 || uint64(off)+uint64(len(p)) > c.size {
+		return 0, gqcow2.ErrOutOfRange
+	}
+
+	for done := 0; done < len(p); {
+		n := min(len(p)-done, maxRequestSize)
+		req := request{Type: cmdWrite, Offset: uint64(off) + uint64(done), Length: uint32(n)}
+		if err := c.command(req, p[done:done+n]); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	return len(p), nil
+}
+
+// ranges sends the command for the range in requests of at most
+// maxStatusLength bytes
+func (c *Client) ranges(cmd uint16, flags uint16, off uint64, length uint64) error {
+	if c.ReadOnly() {
+		return gqcow2.ErrReadOnly
+	}
+	if off+length > c.size {
+		return gqcow2.ErrOutOfRange
+	}
+	for length > 0 {
+		n := min(length, maxStatusLength)
+		if err := c.command(request{Type: cmd, Flags: flags, Offset: off, Length: uint32(n)}, nil); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
+
+// WriteZeroes zeroes the range without sending the zeros, the server
+// may punch a hole if mayUnmap is set. Zeros are written if the server
+// doesn't support NBD_CMD_WRITE_ZEROES.
+func (c *Client) WriteZeroes(off uint64, length uint64, mayUnmap bool) error {
+	if c.flags&FlagSendWriteZeroes == 0 {
+		if c.ReadOnly() {
+			return gqcow2.ErrReadOnly
+		}
+		return writeZeroes(c, off, length)
+	}
+	flags := uint16(0)
+	if !mayUnmap {
+		flags = cmdFlagNoHole
+	}
+	return c.ranges(cmdWriteZeroes, flags, off, length)
+}
+
+// Discard trims the range, it is a no-op if the server doesn't support it
+func (c *Client) Discard(off uint64, length uint64) error {
+	if c.flags&FlagSendTrim == 0 {
+		return nil
+	}
+	return c.ranges(cmdTrim, 0, off, length)
+}
+
+// Flush makes the written data durable on the server
+func (c *Client) Flush() error {
+	if c.flags&FlagSendFlush == 0 {
+		return nil
+	}
+	return c.command(request{Type: cmdFlush}, nil)
+}
+
+// Sync is Flush, the images on the export sync their handler with it
+func (c *Client) Sync() error {
+	return c.Flush()
+}
+
+// MapRegions returns the allocation of the export by the block status
+// of base:allocation, the whole export is data if the server has no
+// block status. Holes are unallocated zeros.
+func (c *Client) MapRegions() ([]gqcow2.VirtualDiskRegion, error) {
+	var regions []gqcow2.VirtualDiskRegion
+	if c.metaContext == 0 {
+		if c.size != 0 {
+			regions = append(regions, gqcow2.VirtualDiskRegion{Length: c.size, Present: true, Data: true})
+		}
+		return regions, nil
+	}
+
+	for off := uint64(0); off < c.size; {
+		extents, err := c.blockStatus(off, min(c.size-off, maxStatusLength))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range extents {
+			length := min(uint64(e[0]), c.size-off)
+			if length == 0 {
+				continue
+			}
+			region := regionOf(e[1])
+			region.Start, region.Length = off, length
+			if region.Data {
+				region.Offset = off
+			}
+			if n := len(regions); n > 0 && region.SameAs(regions[n-1]) {
+				regions[n-1].Length += length
+			} else {
+				regions = append(regions, region)
+			}
+			off += length
+			if off == c.size {
+				break
+			}
+		}
+	}
+	return regions, nil
+}
+
+// regionOf is the region of the base:allocation state
+func regionOf(state uint32) gqcow2.VirtualDiskRegion {
+	switch state & (StateHole | StateZero) {
+	case StateHole | StateZero:
+		return gqcow2.VirtualDiskRegion{Zero: true}
+	case StateZero:
+		return gqcow2.VirtualDiskRegion{Present: true, Zero: true}
+	case StateHole:
+		return gqcow2.VirtualDiskRegion{Data: true}
+	}
+	return gqcow2.VirtualDiskRegion{Present: true, Data: true}
+}
+
+// blockStatus returns the lengths and the states of base:allocation
+// from off, they cover at least a part of the range
+func (c *Client) blockStatus(off uint64, length uint64) ([][2]uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := request{Type: cmdBlockStatus, Offset: off, Length: uint32(length)}
+	if err := c.send(req, nil); err != nil {
+		return nil, err
+	}
+
+	var extents [][2]uint32
+	var replyErr error
+	for {
+		r, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		if r.simple {
+			if r.errno != 0 {
+				return nil, commandError(req, r.errno, "")
+			}
+			return nil, errors.New("simple reply to block status")
+		}
+
+		if r.chunk&(1<<15) != 0 {
+			errno, message, err := c.readError(r)
+			if err != nil {
+				return nil, err
+			}
+			replyErr = errors.Join(replyErr, commandError(req, errno, message))
+		} else {
+			// the descriptors beyond the limit are dropped, they are
+			// asked for again from the end of the ones kept
+			payload := make([]byte, min(r.length, maxPayloadLength))
+			if _, err := io.ReadFull(c.r, payload); err != nil {
+				return nil, err
+			}
+			if _, err := c.r.Discard(int(r.length) - len(payload)); err != nil {
+				return nil, err
+			}
+			if r.chunk == replyTypeBlockStatus && len(payload) >= 4 && binary.BigEndian.Uint32(payload) == c.metaContext {
+				for data := payload[4:]; len(data) >= 8; data = data[8:] {
+					extents = append(extents, [2]uint32{binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])})
+				}
+			}
+		}
+		if r.done() {
+			break
+		}
+	}
+
+	if replyErr != nil {
+		return nil, replyErr
+	}
+	if len(extents) == 0 || extents[0][0] == 0 {
+		return nil, errors.New("empty block status")
+	}
+	return extents, nil
+}
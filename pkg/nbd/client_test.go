@@ -0,0 +1,247 @@
+package nbd
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serve serves the exports on a unix socket until the end of the test,
+// it returns the url of the first export
+func serve(t *testing.T, exports ...*Export) string {
+	socket := filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := NewServer(exports...)
+	go server.Serve(l)
+	t.Cleanup(func() { server.Close() })
+	return "nbd+unix:///" + exports[0].Name + "?socket=" + socket
+}
+
+// failingDisk fails the reads after the first MiB
+type failingDisk struct {
+	gqcow2.BackingDisk
+}
+
+func (d failingDisk) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > 1<<20 {
+		return 0, errors.New("bad sector")
+	}
+	return d.BackingDisk.ReadAt(p, off)
+}
+
+// stripedDisk alternates 4KiB of data and 4KiB of zeros, its block
+// status has more descriptors than the client keeps of a reply
+type stripedDisk struct {
+	size uint64
+}
+
+func (d stripedDisk) ReadAt(p []byte, off int64) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func (d stripedDisk) VirtualSize() uint64 {
+	return d.size
+}
+
+func (d stripedDisk) MapRegions() ([]gqcow2.VirtualDiskRegion, error) {
+	var regions []gqcow2.VirtualDiskRegion
+	for off := uint64(0); off < d.size; off += 4096 {
+		region := gqcow2.VirtualDiskRegion{Start: off, Length: 4096, Zero: true}
+		if off/4096%2 == 0 {
+			region = gqcow2.VirtualDiskRegion{Start: off, Length: 4096, Offset: off, Present: true, Data: true}
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+func Test_Client(t *testing.T) {
+	t.Run("Read an image and map its holes",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			c, err := DialURL(serve(t, &Export{Name: "disk", Disk: image}))
+			require.NoError(t, err)
+			defer c.Close()
+
+			assert.Equal(t, uint64(4<<20), c.VirtualSize())
+			assert.False(t, c.ReadOnly())
+			guest := make([]byte, 5<<20)
+			n, err := c.ReadAt(guest, 0)
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, 4<<20, n)
+			assert.Equal(t, content, guest[:n])
+
+			regions, err := gqcow2.Map(c)
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 1 << 20, Present: true, Data: true},
+				{Start: 1 << 20, Length: 3 << 20, Zero: true},
+			}, regions)
+
+			// a raw disk over the client is mapped the same
+			regions, err = gqcow2.Map(gqcow2.NewRawDisk(c, 2<<20))
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 1 << 20, Present: true, Data: true},
+				{Start: 1 << 20, Length: 1 << 20, Zero: true},
+			}, regions)
+		})
+
+	t.Run("Write, zero, trim and flush",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			c, err := DialURL(serve(t, &Export{Name: "disk", Disk: image}))
+			require.NoError(t, err)
+			defer c.Close()
+
+			data := bytes.Repeat([]byte{0x5a}, 100000)
+			_, err = c.WriteAt(data, 3<<20)
+			require.NoError(t, err)
+			copy(content[3<<20:], data)
+			require.NoError(t, c.WriteZeroes(0, 128<<10, false))
+			clear(content[:128<<10])
+			require.NoError(t, c.Discard(512<<10, 512<<10))
+			clear(content[512<<10 : 1<<20])
+			require.NoError(t, c.Flush())
+
+			_, err = c.WriteAt(data, 4<<20-1000)
+			assert.ErrorIs(t, err, gqcow2.ErrOutOfRange)
+
+			guest := make([]byte, 4<<20)
+			_, err = image.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+
+			regions, err := c.MapRegions()
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 128 << 10, Present: true, Zero: true},
+				{Start: 128 << 10, Length: 384 << 10, Present: true, Data: true, Offset: 128 << 10},
+				{Start: 512 << 10, Length: 2560 << 10, Zero: true},
+				{Start: 3 << 20, Length: 128 << 10, Present: true, Data: true, Offset: 3 << 20},
+				{Start: 3<<20 + 128<<10, Length: 896 << 10, Zero: true},
+			}, regions)
+		})
+
+	t.Run("Convert an image stored on the export",
+		func(t *testing.T) {
+			dir := t.TempDir()
+			image, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			require.NoError(t, image.Flush())
+			file, err := os.ReadFile(image.Name)
+			require.NoError(t, err)
+
+			// the export is the qcow2 file, not the guest
+			stored := gqcow2.NewRawDisk(bytes.NewReader(file), uint64(len(file)))
+			c, err := DialURL(serve(t, &Export{Name: "file", Disk: stored, ReadOnly: true}))
+			require.NoError(t, err)
+			defer c.Close()
+
+			remote, err := gqcow2.NewFileImage(c, "nbd")
+			require.NoError(t, err)
+			f, err := os.Create(filepath.Join(dir, "disk.raw"))
+			require.NoError(t, err)
+			defer f.Close()
+			require.NoError(t, f.Truncate(int64(len(content))))
+			vd, err := gqcow2.NewVirtualDisk(f)
+			require.NoError(t, err)
+			require.NoError(t, gqcow2.Convert(remote, vd))
+
+			converted, err := os.ReadFile(f.Name())
+			require.NoError(t, err)
+			assert.Equal(t, content, converted)
+
+			_, err = c.WriteAt([]byte{1}, 0)
+			assert.ErrorIs(t, err, gqcow2.ErrReadOnly)
+		})
+
+	t.Run("Convert an image into the export",
+		func(t *testing.T) {
+			source, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			image, _ := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			// the target has stale data everywhere
+			stale := bytes.Repeat([]byte{0xff}, 4<<20)
+			_, err := image.WriteAt(stale, 0)
+			require.NoError(t, err)
+
+			c, err := DialURL(serve(t, &Export{Name: "target", Disk: image}))
+			require.NoError(t, err)
+			defer c.Close()
+			vd, err := gqcow2.NewVirtualDisk(c)
+			require.NoError(t, err)
+			require.NoError(t, gqcow2.Convert(source, vd))
+			require.NoError(t, c.Flush())
+
+			guest := make([]byte, 4<<20)
+			_, err = image.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+		})
+
+	t.Run("Map more extents than a block status reply holds",
+		func(t *testing.T) {
+			disk := stripedDisk{size: 20000 * 4096}
+			c, err := DialURL(serve(t, &Export{Name: "disk", Disk: disk, ReadOnly: true}))
+			require.NoError(t, err)
+			defer c.Close()
+
+			want, err := disk.MapRegions()
+			require.NoError(t, err)
+			regions, err := c.MapRegions()
+			require.NoError(t, err)
+			assert.Equal(t, want, regions)
+		})
+
+	t.Run("Errors of the server",
+		func(t *testing.T) {
+			image, _ := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+			url := serve(t, &Export{Name: "disk", Disk: failingDisk{image}, ReadOnly: true})
+			c, err := DialURL(url)
+			require.NoError(t, err)
+			defer c.Close()
+
+			_, err = c.ReadAt(make([]byte, 4096), 1<<20)
+			assert.ErrorIs(t, err, syscall.EIO)
+			// the connection is still usable
+			_, err = c.ReadAt(make([]byte, 4096), 0)
+			assert.NoError(t, err)
+
+			_, err = DialURL(url[:len("nbd+unix:///")] + "missing" + url[len("nbd+unix:///disk"):])
+			assert.Error(t, err)
+			_, err = DialURL("nbd:///disk")
+			assert.Error(t, err)
+		})
+}
+
+func Test_SystemErrno(t *testing.T) {
+	t.Run("Translate the errors of linux to the errno of this system",
+		func(t *testing.T) {
+			for errno, want := range map[uint32]syscall.Errno{
+				1:   syscall.EPERM,
+				5:   syscall.EIO,
+				12:  syscall.ENOMEM,
+				22:  syscall.EINVAL,
+				28:  syscall.ENOSPC,
+				75:  syscall.EOVERFLOW,
+				95:  syscall.ENOTSUP,
+				108: syscall.ESHUTDOWN,
+				// EAGAIN is not an error of the protocol
+				11: syscall.EINVAL,
+			} {
+				assert.Equal(t, want, systemErrno(errno), "errno %d", errno)
+			}
+		})
+}
@@ -0,0 +1,154 @@
+// Package nbd serves disks over the network block device protocol,
+// following https://github.com/NetworkBlockDevice/nbd/blob/master/doc/proto.md
+// Only the fixed newstyle handshake is supported.
+package nbd
+
+const (
+	nbdMagic             = 0x4e42444d41474943 // NBDMAGIC
+	optionMagic          = 0x49484156454f5054 // IHAVEOPT
+	optionReplyMagic     = 0x3e889045565a9
+	requestMagic         = 0x25609513
+	simpleReplyMagic     = 0x67446698
+	structuredReplyMagic = 0x668e33ef
+)
+
+// handshake flags of the server and the client
+const (
+	flagFixedNewstyle = 1 << 0
+	flagNoZeroes      = 1 << 1
+)
+
+// options of the handshake
+const (
+	optExportName      = 1
+	optAbort           = 2
+	optList            = 3
+	optInfo            = 6
+	optGo              = 7
+	optStructuredReply = 8
+	optListMetaContext = 9
+	optSetMetaContext  = 10
+)
+
+// replies to the options
+const (
+	repAck         = 1
+	repServer      = 2
+	repInfo        = 3
+	repMetaContext = 4
+
+	repErrUnsup   = 1<<31 + 1
+	repErrInvalid = 1<<31 + 3
+	repErrUnknown = 1<<31 + 6
+)
+
+// information of NBD_REP_INFO
+const (
+	infoExport    = 0
+	infoName      = 1
+	infoBlockSize = 3
+)
+
+// transmission flags of an export
+const (
+	FlagHasFlags        = 1 << 0
+	FlagReadOnly        = 1 << 1
+	FlagSendFlush       = 1 << 2
+	FlagSendFUA         = 1 << 3
+	FlagSendTrim        = 1 << 5
+	FlagSendWriteZeroes = 1 << 6
+	FlagSendDF          = 1 << 7
+)
+
+// commands of the transmission phase
+const (
+	cmdRead        = 0
+	cmdWrite       = 1
+	cmdDisc        = 2
+	cmdFlush       = 3
+	cmdTrim        = 4
+	cmdWriteZeroes = 6
+	cmdBlockStatus = 7
+)
+
+// flags of the commands
+const (
+	cmdFlagFUA    = 1 << 0
+	cmdFlagNoHole = 1 << 1
+	cmdFlagDF     = 1 << 2
+	cmdFlagReqOne = 1 << 3
+)
+
+// chunks of the structured replies
+const (
+	replyFlagDone = 1 << 0
+
+	replyTypeNone        = 0
+	replyTypeOffsetData  = 1
+	replyTypeOffsetHole  = 2
+	replyTypeBlockStatus = 5
+	replyTypeError       = 1<<15 + 1
+)
+
+// the base:allocation meta context
+const (
+	BaseAllocation = "base:allocation"
+	// the only context, so it has a fixed id
+	baseAllocationID = 1
+
+	StateHole = 1 << 0
+	StateZero = 1 << 1
+)
+
+// errors of the replies, the values of linux
+const (
+	errPerm     = 1
+	errIO       = 5
+	errNoMem    = 12
+	errInval    = 22
+	errNoSpc    = 28
+	errOverflow = 75
+	errNotSup   = 95
+	errShutdown = 108
+)
+
+// requests larger than this are refused
+const maxRequestSize = 32 << 20
+
+// header of the options of the client
+type optionHeader struct {
+	Magic  uint64
+	Option uint32
+	Length uint32
+}
+
+// header of the replies to the options
+type optionReplyHeader struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+type request struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+type structuredReplyHeader struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Length uint32
+}
@@ -0,0 +1,730 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// Flusher is implemented by disks which buffer writes, like Image
+type Flusher interface {
+	Flush() error
+}
+
+// Discarder is implemented by disks which can drop a range, like Image
+type Discarder interface {
+	Discard(off uint64, length uint64) error
+}
+
+// Export is a disk served by its name. The disk is writable if it
+// implements io.WriterAt, FLUSH, TRIM and WRITE_ZEROES use Flusher,
+// Discarder and gqcow2.ZeroWriter if the disk implements them.
+type Export struct {
+	Name        string
+	Description string
+	Disk        gqcow2.BackingDisk
+	ReadOnly    bool
+
+	// serializes the access of all connections to the disk
+	mu sync.Mutex
+	// the region map of the disk, dropped by every write
+	regions []gqcow2.VirtualDiskRegion
+}
+
+// flags are the transmission flags of the export
+func (e *Export) flags() uint16 {
+	flags := uint16(FlagHasFlags | FlagSendDF | FlagSendTrim)
+	if _, ok := e.Disk.(io.WriterAt); !ok || e.ReadOnly {
+		flags |= FlagReadOnly
+	} else {
+		flags |= FlagSendWriteZeroes
+	}
+	if _, ok := e.Disk.(Flusher); ok {
+		flags |= FlagSendFlush | FlagSendFUA
+	}
+	return flags
+}
+
+// status returns the regions of the disk overlapping [off, off+length)
+func (e *Export) status(off uint64, length uint64) ([]gqcow2.VirtualDiskRegion, error) {
+	if e.regions == nil {
+		regions, err := gqcow2.Map(e.Disk)
+		if err != nil {
+			return nil, err
+		}
+		e.regions = regions
+	}
+
+	var clipped []gqcow2.VirtualDiskRegion
+	for _, r := range e.regions {
+		start, end := max(r.Start, off), min(r.Start+r.Length, off+length)
+		if start >= end {
+			continue
+		}
+		if r.Data && !r.Compressed {
+			r.Offset += start - r.Start
+		}
+		r.Start, r.Length = start, end-start
+		clipped = append(clipped, r)
+	}
+	return clipped, nil
+}
+
+// stateOf is the base:allocation state of the region, allocated
+// zero clusters are zeros but no holes
+func stateOf(r gqcow2.VirtualDiskRegion) uint32 {
+	if !r.Data && r.Present {
+		return StateZero
+	}
+	if !r.Data {
+		return StateHole | StateZero
+	}
+	if r.Zero {
+		return StateZero
+	}
+	return 0
+}
+
+// Server serves the exports to every connection
+type Server struct {
+	exports []*Export
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func NewServer(exports ...*Export) *Server {
+	return &Server{
+		exports:   exports,
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// ErrServerClosed is returned by Serve after Close
+var ErrServerClosed = errors.New("nbd server closed")
+
+// Serve accepts connections on the tcp or unix socket listener until
+// the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = true
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = true
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			s.ServeConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listeners, closes the connections and waits until
+// they are done. The exported disks are not closed.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		err = errors.Join(err, l.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// serverConn is the state of one client connection
+type serverConn struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+
+	noZeroes       bool
+	structured     bool
+	baseAllocation bool
+}
+
+// ServeConn runs the handshake and the transmission on the connection
+// until the client disconnects, the connection is closed.
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	c := &serverConn{
+		server: s,
+		conn:   conn,
+		r:      bufio.NewReader(conn),
+		w:      bufio.NewWriter(conn),
+	}
+
+	export, err := c.handshake()
+	if err != nil || export == nil {
+		return err
+	}
+	return c.transmission(export)
+}
+
+func (c *serverConn) write(v ...any) error {
+	for _, value := range v {
+		if err := binary.Write(c.w, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *serverConn) export(name string) *Export {
+	for _, e := range c.server.exports {
+		if e.Name == name {
+			return e
+		}
+	}
+	// the empty name is the default export
+	if name == "" && len(c.server.exports) == 1 {
+		return c.server.exports[0]
+	}
+	return nil
+}
+
+// handshake negotiates the options, it returns the export chosen or
+// nil if the client aborted
+func (c *serverConn) handshake() (*Export, error) {
+	if err := c.write(uint64(nbdMagic), uint64(optionMagic), uint16(flagFixedNewstyle|flagNoZeroes)); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	var clientFlags uint32
+	if err := binary.Read(c.r, binary.BigEndian, &clientFlags); err != nil {
+		return nil, err
+	}
+	if clientFlags&flagFixedNewstyle == 0 {
+		return nil, errors.New("the client does not support the fixed newstyle handshake")
+	}
+	c.noZeroes = clientFlags&flagNoZeroes != 0
+
+	for {
+		var hdr optionHeader
+		if err := binary.Read(c.r, binary.BigEndian, &hdr); err != nil {
+			return nil, err
+		}
+		if hdr.Magic != optionMagic {
+			return nil, errors.New("invalid option magic")
+		}
+		if hdr.Length > 64<<10 {
+			return nil, fmt.Errorf("option %d is too long", hdr.Option)
+		}
+		data := make([]byte, hdr.Length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+
+		export, done, err := c.option(hdr.Option, data)
+		if err != nil {
+			return nil, err
+		}
+		if err := c.w.Flush(); err != nil {
+			return nil, err
+		}
+		if done {
+			return export, nil
+		}
+	}
+}
+
+func (c *serverConn) reply(option uint32, replyType uint32, data ...[]byte) error {
+	length := 0
+	for _, d := range data {
+		length += len(d)
+	}
+	if err := c.write(optionReplyHeader{Magic: optionReplyMagic, Option: option, Type: replyType, Length: uint32(length)}); err != nil {
+		return err
+	}
+	for _, d := range data {
+		if _, err := c.w.Write(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// option answers one option, done tells the transmission starts
+// with the export, or the client aborted if the export is nil
+func (c *serverConn) option(option uint32, data []byte) (*Export, bool, error) {
+	switch option {
+	case optExportName:
+		export := c.export(string(data))
+		if export == nil {
+			// there is no way to tell the client
+			return nil, false, fmt.Errorf("unknown export %q", data)
+		}
+		if err := c.write(export.Disk.VirtualSize(), export.flags()); err != nil {
+			return nil, false, err
+		}
+		if !c.noZeroes {
+			if _, err := c.w.Write(make([]byte, 124)); err != nil {
+				return nil, false, err
+			}
+		}
+		return export, true, nil
+
+	case optAbort:
+		return nil, true, c.reply(option, repAck)
+
+	case optList:
+		if len(data) != 0 {
+			return nil, false, c.reply(option, repErrInvalid)
+		}
+		for _, e := range c.server.exports {
+			// the name and the description
+			name := binary.BigEndian.AppendUint32(nil, uint32(len(e.Name)))
+			name = append(name, e.Name...)
+			if err := c.reply(option, repServer, name, []byte(e.Description)); err != nil {
+				return nil, false, err
+			}
+		}
+		return nil, false, c.reply(option, repAck)
+
+	case optStructuredReply:
+		if len(data) != 0 {
+			return nil, false, c.reply(option, repErrInvalid)
+		}
+		c.structured = true
+		return nil, false, c.reply(option, repAck)
+
+	case optInfo, optGo:
+		name, infos, ok := parseInfoRequest(data)
+		if !ok {
+			return nil, false, c.reply(option, repErrInvalid)
+		}
+		export := c.export(name)
+		if export == nil {
+			return nil, false, c.reply(option, repErrUnknown, []byte("unknown export"))
+		}
+		if err := c.sendInfo(option, export, infos); err != nil {
+			return nil, false, err
+		}
+		if err := c.reply(option, repAck); err != nil {
+			return nil, false, err
+		}
+		return export, option == optGo, nil
+
+	case optListMetaContext, optSetMetaContext:
+		if !c.structured {
+			return nil, false, c.reply(option, repErrInvalid, []byte("structured replies are not negotiated"))
+		}
+		name, queries, ok := parseMetaContextRequest(data)
+		if !ok {
+			return nil, false, c.reply(option, repErrInvalid)
+		}
+		if c.export(name) == nil {
+			return nil, false, c.reply(option, repErrUnknown, []byte("unknown export"))
+		}
+
+		selected := false
+		for _, query := range queries {
+			selected = selected || query == BaseAllocation || (option == optListMetaContext && query == "base:")
+		}
+		if option == optListMetaContext && len(queries) == 0 {
+			selected = true
+		}
+		if option == optSetMetaContext {
+			c.baseAllocation = selected
+		}
+		if selected {
+			id := binary.BigEndian.AppendUint32(nil, baseAllocationID)
+			if err := c.reply(option, repMetaContext, id, []byte(BaseAllocation)); err != nil {
+				return nil, false, err
+			}
+		}
+		return nil, false, c.reply(option, repAck)
+	}
+
+	return nil, false, c.reply(option, repErrUnsup)
+}
+
+// sendInfo sends the size and flags of the export, and the
+// block sizes and the name if asked
+func (c *serverConn) sendInfo(option uint32, export *Export, infos []uint16) error {
+	info := binary.BigEndian.AppendUint16(nil, infoExport)
+	info = binary.BigEndian.AppendUint64(info, export.Disk.VirtualSize())
+	info = binary.BigEndian.AppendUint16(info, export.flags())
+	if err := c.reply(option, repInfo, info); err != nil {
+		return err
+	}
+
+	for _, infoType := range infos {
+		switch infoType {
+		case infoName:
+			info := binary.BigEndian.AppendUint16(nil, infoName)
+			if err := c.reply(option, repInfo, info, []byte(export.Name)); err != nil {
+				return err
+			}
+		case infoBlockSize:
+			info := binary.BigEndian.AppendUint16(nil, infoBlockSize)
+			info = binary.BigEndian.AppendUint32(info, 1)
+			info = binary.BigEndian.AppendUint32(info, 4096)
+			info = binary.BigEndian.AppendUint32(info, maxRequestSize)
+			if err := c.reply(option, repInfo, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// parseInfoRequest parses the export name and the information
+// requests of NBD_OPT_INFO and NBD_OPT_GO
+func parseInfoRequest(data []byte) (string, []uint16, bool) {
+	if len(data) < 4 {
+		return "", nil, false
+	}
+	nameLength := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 4+uint64(nameLength)+2 {
+		return "", nil, false
+	}
+	name := string(data[4 : 4+nameLength])
+	data = data[4+nameLength:]
+	count := int(binary.BigEndian.Uint16(data))
+	data = data[2:]
+	if len(data) != count*2 {
+		return "", nil, false
+	}
+	infos := make([]uint16, count)
+	for index := range infos {
+		infos[index] = binary.BigEndian.Uint16(data[index*2:])
+	}
+	return name, infos, true
+}
+
+// parseMetaContextRequest parses the export name and the queries of
+// NBD_OPT_LIST_META_CONTEXT and NBD_OPT_SET_META_CONTEXT
+func parseMetaContextRequest(data []byte) (string, []string, bool) {
+	next := func() (string, bool) {
+		if len(data) < 4 {
+			return "", false
+		}
+		length := binary.BigEndian.Uint32(data)
+		if uint64(len(data)) < 4+uint64(length) {
+			return "", false
+		}
+		s := string(data[4 : 4+length])
+		data = data[4+length:]
+		return s, true
+	}
+
+	name, ok := next()
+	if !ok || len(data) < 4 {
+		return "", nil, false
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	var queries []string
+	for range count {
+		query, ok := next()
+		if !ok {
+			return "", nil, false
+		}
+		queries = append(queries, query)
+	}
+	return name, queries, len(data) == 0
+}
+
+// transmission serves the requests until the client disconnects
+func (c *serverConn) transmission(export *Export) error {
+	for {
+		var req request
+		if err := binary.Read(c.r, binary.BigEndian, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != requestMagic {
+			return errors.New("invalid request magic")
+		}
+		if req.Type == cmdDisc {
+			return nil
+		}
+
+		var data []byte
+		if req.Type == cmdWrite {
+			if req.Length > maxRequestSize {
+				return fmt.Errorf("write of %d bytes is too large", req.Length)
+			}
+			data = make([]byte, req.Length)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				return err
+			}
+		}
+
+		if err := c.handle(export, req, data); err != nil {
+			return err
+		}
+		if err := c.w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// handle serves the request and sends the reply, only failures
+// of the connection are returned
+func (c *serverConn) handle(export *Export, req request, data []byte) error {
+	export.mu.Lock()
+	defer export.mu.Unlock()
+
+	size := export.Disk.VirtualSize()
+	if req.Offset > size || uint64(req.Length) > size-req.Offset {
+		if req.Type == cmdWrite || req.Type == cmdWriteZeroes {
+			return c.replyError(req, errNoSpc, "beyond the end of the export")
+		}
+		return c.replyError(req, errInval, "beyond the end of the export")
+	}
+
+	readOnly := export.flags()&FlagReadOnly != 0
+	switch req.Type {
+	case cmdRead:
+		if req.Length > maxRequestSize {
+			return c.replyError(req, errOverflow, "read is too large")
+		}
+		return c.read(export, req)
+
+	case cmdWrite:
+		if readOnly {
+			return c.replyError(req, errPerm, "the export is read only")
+		}
+		export.regions = nil
+		if _, err := export.Disk.(io.WriterAt).WriteAt(data, int64(req.Offset)); err != nil {
+			return c.replyError(req, errIO, err.Error())
+		}
+		return c.afterWrite(export, req)
+
+	case cmdWriteZeroes:
+		if readOnly {
+			return c.replyError(req, errPerm, "the export is read only")
+		}
+		export.regions = nil
+		var err error
+		if zw, ok := export.Disk.(gqcow2.ZeroWriter); ok {
+			err = zw.WriteZeroes(req.Offset, uint64(req.Length), req.Flags&cmdFlagNoHole == 0)
+		} else {
+			err = writeZeroes(export.Disk.(io.WriterAt), req.Offset, uint64(req.Length))
+		}
+		if err != nil {
+			return c.replyError(req, errIO, err.Error())
+		}
+		return c.afterWrite(export, req)
+
+	case cmdTrim:
+		if readOnly {
+			return c.replyError(req, errPerm, "the export is read only")
+		}
+		// trimming is advisory, disks which cannot drop ranges ignore it
+		if d, ok := export.Disk.(Discarder); ok {
+			export.regions = nil
+			if err := d.Discard(req.Offset, uint64(req.Length)); err != nil {
+				return c.replyError(req, errIO, err.Error())
+			}
+		}
+		return c.afterWrite(export, req)
+
+	case cmdFlush:
+		if f, ok := export.Disk.(Flusher); ok {
+			if err := f.Flush(); err != nil {
+				return c.replyError(req, errIO, err.Error())
+			}
+		}
+		return c.write(simpleReply{Magic: simpleReplyMagic, Handle: req.Handle})
+
+	case cmdBlockStatus:
+		if !c.baseAllocation {
+			return c.replyError(req, errInval, "no meta context is negotiated")
+		}
+		return c.blockStatus(export, req)
+	}
+
+	return c.replyError(req, errInval, fmt.Sprintf("unknown command %d", req.Type))
+}
+
+// afterWrite flushes a write with the FUA flag and replies
+func (c *serverConn) afterWrite(export *Export, req request) error {
+	if f, ok := export.Disk.(Flusher); ok && req.Flags&cmdFlagFUA != 0 {
+		if err := f.Flush(); err != nil {
+			return c.replyError(req, errIO, err.Error())
+		}
+	}
+	return c.write(simpleReply{Magic: simpleReplyMagic, Handle: req.Handle})
+}
+
+// replyError sends the error as a chunk to the commands which get
+// structured replies, or as a simple reply
+func (c *serverConn) replyError(req request, errno uint32, message string) error {
+	if !c.structured || (req.Type != cmdRead && req.Type != cmdBlockStatus) {
+		return c.write(simpleReply{Magic: simpleReplyMagic, Error: errno, Handle: req.Handle})
+	}
+
+	payload := binary.BigEndian.AppendUint32(nil, errno)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(message)))
+	payload = append(payload, message...)
+	return c.chunk(req, replyFlagDone, replyTypeError, payload)
+}
+
+func (c *serverConn) chunk(req request, flags uint16, chunkType uint16, payload ...[]byte) error {
+	length := 0
+	for _, p := range payload {
+		length += len(p)
+	}
+	hdr := structuredReplyHeader{
+		Magic:  structuredReplyMagic,
+		Flags:  flags,
+		Type:   chunkType,
+		Handle: req.Handle,
+		Length: uint32(length),
+	}
+	if err := c.write(hdr); err != nil {
+		return err
+	}
+	for _, p := range payload {
+		if _, err := c.w.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read replies the data, by structured replies the holes and zero
+// regions are sent as holes unless the client asked not to fragment
+func (c *serverConn) read(export *Export, req request) error {
+	if c.structured && req.Length == 0 {
+		return c.chunk(req, replyFlagDone, replyTypeNone)
+	}
+
+	buf := make([]byte, req.Length)
+	if !c.structured || req.Flags&cmdFlagDF != 0 {
+		if _, err := export.Disk.ReadAt(buf, int64(req.Offset)); err != nil && err != io.EOF {
+			return c.replyError(req, errIO, err.Error())
+		}
+		if !c.structured {
+			if err := c.write(simpleReply{Magic: simpleReplyMagic, Handle: req.Handle}); err != nil {
+				return err
+			}
+			_, err := c.w.Write(buf)
+			return err
+		}
+		offset := binary.BigEndian.AppendUint64(nil, req.Offset)
+		return c.chunk(req, replyFlagDone, replyTypeOffsetData, offset, buf)
+	}
+
+	regions, err := export.status(req.Offset, uint64(req.Length))
+	if err != nil {
+		return c.replyError(req, errIO, err.Error())
+	}
+	for index, r := range regions {
+		flags := uint16(0)
+		if index == len(regions)-1 {
+			flags = replyFlagDone
+		}
+		offset := binary.BigEndian.AppendUint64(nil, r.Start)
+		if stateOf(r)&StateZero != 0 {
+			hole := binary.BigEndian.AppendUint32(offset, uint32(r.Length))
+			if err := c.chunk(req, flags, replyTypeOffsetHole, hole); err != nil {
+				return err
+			}
+			continue
+		}
+
+		data := buf[r.Start-req.Offset : r.Start-req.Offset+r.Length]
+		if _, err := export.Disk.ReadAt(data, int64(r.Start)); err != nil && err != io.EOF {
+			return c.replyError(req, errIO, err.Error())
+		}
+		if err := c.chunk(req, flags, replyTypeOffsetData, offset, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blockStatus replies the base:allocation state of the range
+func (c *serverConn) blockStatus(export *Export, req request) error {
+	regions, err := export.status(req.Offset, uint64(req.Length))
+	if err != nil {
+		return c.replyError(req, errIO, err.Error())
+	}
+
+	var lengths, states []uint32
+	for _, r := range regions {
+		state := stateOf(r)
+		if n := len(states); n > 0 && states[n-1] == state {
+			lengths[n-1] += uint32(r.Length)
+			continue
+		}
+		lengths = append(lengths, uint32(r.Length))
+		states = append(states, state)
+	}
+	if req.Flags&cmdFlagReqOne != 0 && len(states) > 1 {
+		lengths, states = lengths[:1], states[:1]
+	}
+
+	payload := binary.BigEndian.AppendUint32(nil, baseAllocationID)
+	for index := range states {
+		payload = binary.BigEndian.AppendUint32(payload, lengths[index])
+		payload = binary.BigEndian.AppendUint32(payload, states[index])
+	}
+	return c.chunk(req, replyFlagDone, replyTypeBlockStatus, payload)
+}
+
+// writeZeroes zeroes the range of a disk by writing zeros
+func writeZeroes(w io.WriterAt, off uint64, length uint64) error {
+	zeros := make([]byte, min(length, 1<<20))
+	for length > 0 {
+		n := min(length, uint64(len(zeros)))
+		if _, err := w.WriteAt(zeros[:n], int64(off)); err != nil {
+			return err
+		}
+		off += n
+		length -= n
+	}
+	return nil
+}
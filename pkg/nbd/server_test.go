@@ -0,0 +1,302 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/gqcow2"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// wire speaks the protocol from the client side of a connection
+type wire struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+type chunk struct {
+	Flags uint16
+	Type  uint16
+	Data  []byte
+}
+
+func (w *wire) send(v ...any) {
+	var buf bytes.Buffer
+	for _, value := range v {
+		require.NoError(w.t, binary.Write(&buf, binary.BigEndian, value))
+	}
+	_, err := w.conn.Write(buf.Bytes())
+	require.NoError(w.t, err)
+}
+
+func (w *wire) recv(v ...any) {
+	for _, value := range v {
+		require.NoError(w.t, binary.Read(w.r, binary.BigEndian, value))
+	}
+}
+
+func (w *wire) bytes(n uint32) []byte {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(w.r, buf)
+	require.NoError(w.t, err)
+	return buf
+}
+
+// dial connects to a new connection of the server and reads its greeting
+func dial(t *testing.T, server *Server, clientFlags uint32) *wire {
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	t.Cleanup(func() { client.Close() })
+
+	w := &wire{t: t, conn: client, r: bufio.NewReader(client)}
+	var magic, option uint64
+	var flags uint16
+	w.recv(&magic, &option, &flags)
+	require.Equal(t, uint64(nbdMagic), magic)
+	require.Equal(t, uint64(optionMagic), option)
+	require.Equal(t, uint16(flagFixedNewstyle|flagNoZeroes), flags)
+	w.send(clientFlags)
+	return w
+}
+
+// option sends the option and reads the replies up to the final one
+func (w *wire) option(option uint32, data []byte) []optionReply {
+	w.send(optionHeader{Magic: optionMagic, Option: option, Length: uint32(len(data))}, data)
+	var replies []optionReply
+	for {
+		var hdr optionReplyHeader
+		w.recv(&hdr)
+		require.Equal(w.t, uint64(optionReplyMagic), hdr.Magic)
+		require.Equal(w.t, option, hdr.Option)
+		replies = append(replies, optionReply{Type: hdr.Type, Data: w.bytes(hdr.Length)})
+		if hdr.Type == repAck || hdr.Type&(1<<31) != 0 {
+			return replies
+		}
+	}
+}
+
+// request sends a request and reads its simple reply
+func (w *wire) request(req request, data []byte) uint32 {
+	req.Magic = requestMagic
+	w.send(req, data)
+	var reply simpleReply
+	w.recv(&reply)
+	require.Equal(w.t, uint32(simpleReplyMagic), reply.Magic)
+	require.Equal(w.t, req.Handle, reply.Handle)
+	return reply.Error
+}
+
+// structured sends a request and reads its chunks up to the last one
+func (w *wire) structured(req request) []chunk {
+	req.Magic = requestMagic
+	w.send(req)
+	var chunks []chunk
+	for {
+		var hdr structuredReplyHeader
+		w.recv(&hdr)
+		require.Equal(w.t, uint32(structuredReplyMagic), hdr.Magic)
+		require.Equal(w.t, req.Handle, hdr.Handle)
+		chunks = append(chunks, chunk{Flags: hdr.Flags, Type: hdr.Type, Data: w.bytes(hdr.Length)})
+		if hdr.Flags&replyFlagDone != 0 {
+			return chunks
+		}
+	}
+}
+
+func nameData(name string, rest ...any) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(name)))
+	buf = append(buf, name...)
+	var b bytes.Buffer
+	b.Write(buf)
+	for _, value := range rest {
+		binary.Write(&b, binary.BigEndian, value)
+	}
+	return b.Bytes()
+}
+
+func metaContextData(name string, queries ...string) []byte {
+	buf := nameData(name, uint32(len(queries)))
+	for _, query := range queries {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(query)))
+		buf = append(buf, query...)
+	}
+	return buf
+}
+
+// blockStatus decodes the descriptors of a block status chunk
+func blockStatus(t *testing.T, c chunk) [][2]uint32 {
+	require.Equal(t, uint16(replyTypeBlockStatus), c.Type)
+	require.Equal(t, uint32(baseAllocationID), binary.BigEndian.Uint32(c.Data))
+	var descriptors [][2]uint32
+	for data := c.Data[4:]; len(data) > 0; data = data[8:] {
+		descriptors = append(descriptors, [2]uint32{binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])})
+	}
+	return descriptors
+}
+
+func Test_ServerHandshake(t *testing.T) {
+	image, _ := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+	server := NewServer(&Export{Name: "disk", Description: "the test disk", Disk: image})
+	w := dial(t, server, flagFixedNewstyle|flagNoZeroes)
+
+	replies := w.option(optList, nil)
+	require.Len(t, replies, 2)
+	assert.Equal(t, uint32(repServer), replies[0].Type)
+	assert.Equal(t, nameData("disk"), replies[0].Data[:8])
+	assert.Equal(t, "the test disk", string(replies[0].Data[8:]))
+
+	replies = w.option(optInfo, nameData("missing", uint16(0)))
+	assert.Equal(t, uint32(repErrUnknown), replies[0].Type)
+	replies = w.option(optSetMetaContext, metaContextData("disk", BaseAllocation))
+	assert.Equal(t, uint32(repErrInvalid), replies[0].Type)
+	replies = w.option(99, nil)
+	assert.Equal(t, uint32(repErrUnsup), replies[0].Type)
+
+	replies = w.option(optStructuredReply, nil)
+	assert.Equal(t, []optionReply{{Type: repAck, Data: []byte{}}}, replies)
+
+	replies = w.option(optListMetaContext, metaContextData("disk"))
+	require.Len(t, replies, 2)
+	assert.Equal(t, uint32(repMetaContext), replies[0].Type)
+	assert.Equal(t, BaseAllocation, string(replies[0].Data[4:]))
+	replies = w.option(optSetMetaContext, metaContextData("disk", "qemu:dirty-bitmap:b0"))
+	assert.Len(t, replies, 1)
+	replies = w.option(optSetMetaContext, metaContextData("disk", BaseAllocation))
+	require.Len(t, replies, 2)
+	assert.Equal(t, uint32(baseAllocationID), binary.BigEndian.Uint32(replies[0].Data))
+
+	replies = w.option(optGo, nameData("disk", uint16(1), uint16(infoBlockSize)))
+	require.Len(t, replies, 3)
+	info := replies[0].Data
+	assert.Equal(t, uint16(infoExport), binary.BigEndian.Uint16(info))
+	assert.Equal(t, uint64(4<<20), binary.BigEndian.Uint64(info[2:]))
+	flags := binary.BigEndian.Uint16(info[10:])
+	assert.Zero(t, flags&FlagReadOnly)
+	assert.Equal(t, uint16(FlagSendFlush|FlagSendTrim|FlagSendWriteZeroes|FlagSendFUA),
+		flags&(FlagSendFlush|FlagSendTrim|FlagSendWriteZeroes|FlagSendFUA))
+	assert.Equal(t, uint16(infoBlockSize), binary.BigEndian.Uint16(replies[1].Data))
+
+	w.send(request{Magic: requestMagic, Type: cmdDisc})
+}
+
+func Test_ServerTransmission(t *testing.T) {
+	image, content := testimage.Create(t, 4<<20, gqcow2.Extent{Length: 1 << 20})
+	server := NewServer(&Export{Name: "disk", Disk: image})
+	w := dial(t, server, flagFixedNewstyle|flagNoZeroes)
+	w.option(optStructuredReply, nil)
+	w.option(optSetMetaContext, metaContextData("disk", BaseAllocation))
+	w.option(optGo, nameData("disk", uint16(0)))
+
+	t.Run("Block status follows the region map",
+		func(t *testing.T) {
+			chunks := w.structured(request{Type: cmdBlockStatus, Handle: 1, Length: 4 << 20})
+			require.Len(t, chunks, 1)
+			assert.Equal(t, [][2]uint32{{1 << 20, 0}, {3 << 20, StateHole | StateZero}}, blockStatus(t, chunks[0]))
+
+			chunks = w.structured(request{Type: cmdBlockStatus, Flags: cmdFlagReqOne, Handle: 2, Offset: 4096, Length: 2 << 20})
+			assert.Equal(t, [][2]uint32{{1<<20 - 4096, 0}}, blockStatus(t, chunks[0]))
+		})
+
+	t.Run("Reads send the holes as holes",
+		func(t *testing.T) {
+			chunks := w.structured(request{Type: cmdRead, Handle: 3, Offset: 1<<20 - 4096, Length: 8192})
+			require.Len(t, chunks, 2)
+			assert.Equal(t, uint16(replyTypeOffsetData), chunks[0].Type)
+			assert.Equal(t, uint64(1<<20-4096), binary.BigEndian.Uint64(chunks[0].Data))
+			assert.Equal(t, content[1<<20-4096:1<<20], chunks[0].Data[8:])
+			assert.Equal(t, uint16(replyTypeOffsetHole), chunks[1].Type)
+			assert.Equal(t, uint16(replyFlagDone), chunks[1].Flags)
+			assert.Equal(t, uint32(4096), binary.BigEndian.Uint32(chunks[1].Data[8:]))
+
+			chunks = w.structured(request{Type: cmdRead, Flags: cmdFlagDF, Handle: 4, Offset: 1<<20 - 4096, Length: 8192})
+			require.Len(t, chunks, 1)
+			assert.Equal(t, content[1<<20-4096:1<<20+4096], chunks[0].Data[8:])
+
+			chunks = w.structured(request{Type: cmdRead, Handle: 5, Offset: 4 << 20, Length: 1})
+			require.Len(t, chunks, 1)
+			assert.Equal(t, uint16(replyTypeError), chunks[0].Type)
+			assert.Equal(t, uint32(errInval), binary.BigEndian.Uint32(chunks[0].Data))
+		})
+
+	t.Run("Writes, zeroes and trims go to the image",
+		func(t *testing.T) {
+			data := bytes.Repeat([]byte{0xab}, 70000)
+			assert.Zero(t, w.request(request{Type: cmdWrite, Flags: cmdFlagFUA, Handle: 6, Offset: 2 << 20, Length: uint32(len(data))}, data))
+			copy(content[2<<20:], data)
+			assert.Zero(t, w.request(request{Type: cmdWriteZeroes, Handle: 7, Offset: 100000, Length: 300000}, nil))
+			clear(content[100000:400000])
+			assert.Zero(t, w.request(request{Type: cmdTrim, Handle: 8, Offset: 512 << 10, Length: 512 << 10}, nil))
+			clear(content[512<<10 : 1<<20])
+			assert.Zero(t, w.request(request{Type: cmdFlush, Handle: 9}, nil))
+			assert.Equal(t, uint32(errNoSpc), w.request(request{Type: cmdWrite, Handle: 10, Offset: 4<<20 - 1, Length: 2}, []byte{1, 2}))
+
+			guest := make([]byte, len(content))
+			_, err := image.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+
+			chunks := w.structured(request{Type: cmdBlockStatus, Handle: 11, Length: 4 << 20})
+			assert.Equal(t, [][2]uint32{
+				// whole clusters of 64KiB
+				{131072, 0},
+				{262144, StateZero},
+				{131072, 0},
+				{3 << 19, StateZero | StateHole},
+				{131072, 0},
+				{2<<20 - 131072, StateZero | StateHole},
+			}, blockStatus(t, chunks[0]))
+
+			result, err := image.Check()
+			require.NoError(t, err)
+			assert.True(t, result.Consistent(), result.Problems)
+		})
+}
+
+func Test_ServerReadOnly(t *testing.T) {
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(content)
+	raw := gqcow2.NewRawDisk(bytes.NewReader(content), uint64(len(content)))
+	server := NewServer(&Export{Name: "raw", Disk: raw, ReadOnly: true})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- server.Serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	w := &wire{t: t, conn: conn, r: bufio.NewReader(conn)}
+	w.bytes(18)
+	// the old export name option and simple replies, with the zeros
+	w.send(uint32(flagFixedNewstyle), optionHeader{Magic: optionMagic, Option: optExportName, Length: 3}, []byte("raw"))
+	var size uint64
+	var flags uint16
+	w.recv(&size, &flags)
+	assert.Equal(t, uint64(1<<20), size)
+	assert.NotZero(t, flags&FlagReadOnly)
+	assert.Equal(t, make([]byte, 124), w.bytes(124))
+
+	w.send(request{Magic: requestMagic, Type: cmdRead, Handle: 1, Offset: 1000, Length: 5000})
+	var reply simpleReply
+	w.recv(&reply)
+	assert.Zero(t, reply.Error)
+	assert.Equal(t, content[1000:6000], w.bytes(5000))
+
+	assert.Equal(t, uint32(errPerm), w.request(request{Type: cmdWrite, Handle: 2, Length: 1}, []byte{1}))
+	assert.Equal(t, uint32(errInval), w.request(request{Type: cmdBlockStatus, Handle: 3, Length: 1}, nil))
+
+	require.NoError(t, server.Close())
+	assert.ErrorIs(t, <-done, ErrServerClosed)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
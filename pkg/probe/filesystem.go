@@ -0,0 +1,299 @@
+package probe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// the superblocks looked for are all in the first 64KiB, the
+// largest is the signature of swap with 64KiB pages
+const headSize = 64 << 10
+
+// features of ext3, the others make an ext4
+const (
+	extCompatHasJournal    = 0x4
+	extIncompatFiletype    = 0x2
+	extIncompatRecover     = 0x4
+	extIncompatMetaBG      = 0x10
+	extIncompat64Bit       = 0x80
+	extROCompatSparseSuper = 0x1
+	extROCompatLargeFile   = 0x2
+	extROCompatBtreeDir    = 0x4
+
+	ext3Incompat = extIncompatFiletype | extIncompatRecover | extIncompatMetaBG
+	ext3ROCompat = extROCompatSparseSuper | extROCompatLargeFile | extROCompatBtreeDir
+)
+
+// the MFT record and the attribute holding the label of ntfs
+const (
+	ntfsVolumeRecord        = 3
+	ntfsAttributeVolumeName = 0x60
+	ntfsAttributeEnd        = 0xffffffff
+)
+
+// probeFilesystem identifies the superblock at the start of the section,
+// it returns nil if none is known
+func probeFilesystem(s section) (*Filesystem, error) {
+	head, err := s.read(0, headSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, probe := range []func([]byte) *Filesystem{probeLVM, probeXFS, probeExt, probeFAT, probeSwap} {
+		if fs := probe(head); fs != nil {
+			return fs, nil
+		}
+	}
+	return probeNTFS(s, head)
+}
+
+// uuid formats the 16 bytes of a big endian uuid
+func uuid(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// cString returns the string up to the first NUL without trailing spaces
+func cString(b []byte) string {
+	if index := bytes.IndexByte(b, 0); index >= 0 {
+		b = b[:index]
+	}
+	return strings.TrimRight(string(b), " ")
+}
+
+func isPowerOf2(v uint64) bool {
+	return v != 0 && v&(v-1) == 0
+}
+
+// probeExt reads the superblock of ext2, ext3 and ext4 at 1KiB, the
+// type is told by the features like blkid does
+func probeExt(head []byte) *Filesystem {
+	sb := head[1024:2048]
+	if binary.LittleEndian.Uint16(sb[56:]) != 0xef53 {
+		return nil
+	}
+	logBlockSize := binary.LittleEndian.Uint32(sb[24:])
+	if logBlockSize > 6 {
+		return nil
+	}
+	blockSize := uint32(1024) << logBlockSize
+
+	compat := binary.LittleEndian.Uint32(sb[92:])
+	incompat := binary.LittleEndian.Uint32(sb[96:])
+	roCompat := binary.LittleEndian.Uint32(sb[100:])
+	blocks := uint64(binary.LittleEndian.Uint32(sb[4:]))
+	if incompat&extIncompat64Bit != 0 {
+		blocks |= uint64(binary.LittleEndian.Uint32(sb[0x150:])) << 32
+	}
+
+	fsType := "ext2"
+	if incompat&^ext3Incompat != 0 || roCompat&^ext3ROCompat != 0 {
+		fsType = "ext4"
+	} else if compat&extCompatHasJournal != 0 {
+		fsType = "ext3"
+	}
+	return &Filesystem{
+		Type:      fsType,
+		Label:     cString(sb[120:136]),
+		UUID:      uuid(sb[104:120]),
+		Size:      blocks * uint64(blockSize),
+		BlockSize: blockSize,
+	}
+}
+
+// probeXFS reads the big endian superblock of xfs at 0
+func probeXFS(head []byte) *Filesystem {
+	if string(head[:4]) != "XFSB" {
+		return nil
+	}
+	blockSize := binary.BigEndian.Uint32(head[4:])
+	if blockSize < 512 || !isPowerOf2(uint64(blockSize)) {
+		return nil
+	}
+	return &Filesystem{
+		Type:      "xfs",
+		Label:     cString(head[108:120]),
+		UUID:      uuid(head[32:48]),
+		Size:      binary.BigEndian.Uint64(head[8:]) * uint64(blockSize),
+		BlockSize: blockSize,
+	}
+}
+
+// probeFAT reads the boot sector of FAT12, FAT16 and FAT32, the label
+// is the one of the boot sector
+func probeFAT(head []byte) *Filesystem {
+	if head[0] != 0xeb && head[0] != 0xe9 {
+		return nil
+	}
+	bytesPerSector := uint64(binary.LittleEndian.Uint16(head[11:]))
+	sectorsPerCluster := uint64(head[13])
+	if bytesPerSector < 512 || bytesPerSector > 4096 || !isPowerOf2(bytesPerSector) ||
+		!isPowerOf2(sectorsPerCluster) || binary.LittleEndian.Uint16(head[14:]) == 0 ||
+		head[16] == 0 || head[16] > 2 {
+		return nil
+	}
+
+	// the extended boot record follows the FAT32 fields
+	var ebr []byte
+	switch {
+	case string(head[82:87]) == "FAT32" && binary.LittleEndian.Uint16(head[22:]) == 0:
+		ebr = head[64:90]
+	case string(head[54:57]) == "FAT":
+		ebr = head[36:62]
+	default:
+		return nil
+	}
+
+	sectors := uint64(binary.LittleEndian.Uint16(head[19:]))
+	if sectors == 0 {
+		sectors = uint64(binary.LittleEndian.Uint32(head[32:]))
+	}
+	fs := &Filesystem{
+		Type:      "vfat",
+		Size:      sectors * bytesPerSector,
+		BlockSize: uint32(bytesPerSector * sectorsPerCluster),
+	}
+	if ebr[2] == 0x28 || ebr[2] == 0x29 {
+		id := binary.LittleEndian.Uint32(ebr[3:])
+		fs.UUID = fmt.Sprintf("%04X-%04X", id>>16, id&0xffff)
+	}
+	if ebr[2] == 0x29 {
+		if label := cString(ebr[7:18]); label != "NO NAME" {
+			fs.Label = label
+		}
+	}
+	return fs
+}
+
+// probeSwap looks for the signature of linux swap at the end of the
+// first page, for the page sizes in use
+func probeSwap(head []byte) *Filesystem {
+	for _, pageSize := range []int{4096, 8192, 16384, 65536} {
+		signature := string(head[pageSize-10 : pageSize])
+		if signature != "SWAPSPACE2" && signature != "SWAP-SPACE" {
+			continue
+		}
+
+		fs := &Filesystem{Type: "swap", BlockSize: uint32(pageSize)}
+		// the old format has no header
+		if signature == "SWAPSPACE2" {
+			lastPage := uint64(binary.LittleEndian.Uint32(head[1028:]))
+			fs.Size = (lastPage + 1) * uint64(pageSize)
+			fs.UUID = uuid(head[1036:1052])
+			fs.Label = cString(head[1052:1068])
+		}
+		return fs
+	}
+	return nil
+}
+
+// probeLVM looks for the label of a physical volume of LVM2 in
+// the first four sectors
+func probeLVM(head []byte) *Filesystem {
+	for sector := range 4 {
+		label := head[sector*sectorSize : (sector+1)*sectorSize]
+		if string(label[:8]) != "LABELONE" || string(label[24:32]) != "LVM2 001" {
+			continue
+		}
+		offset := int(binary.LittleEndian.Uint32(label[20:]))
+		if offset < 32 || offset+40 > sectorSize {
+			return nil
+		}
+
+		// the uuid is shown in groups of 6-4-4-4-4-4-6 characters
+		id := string(label[offset : offset+32])
+		var groups []string
+		for _, n := range []int{6, 4, 4, 4, 4, 4, 6} {
+			groups = append(groups, id[:n])
+			id = id[n:]
+		}
+		return &Filesystem{
+			Type: "LVM2_member",
+			UUID: strings.Join(groups, "-"),
+			Size: binary.LittleEndian.Uint64(label[offset+32:]),
+		}
+	}
+	return nil
+}
+
+// probeNTFS reads the boot sector of ntfs, the label is the volume
+// name attribute of the $Volume record of the MFT
+func probeNTFS(s section, head []byte) (*Filesystem, error) {
+	if string(head[3:11]) != "NTFS    " {
+		return nil, nil
+	}
+	bytesPerSector := uint64(binary.LittleEndian.Uint16(head[11:]))
+	sectorsPerCluster := uint64(head[13])
+	// large clusters are a negative power of 2
+	if sectorsPerCluster > 0x80 {
+		sectorsPerCluster = 1 << (256 - sectorsPerCluster)
+	}
+	if bytesPerSector < 256 || bytesPerSector > 4096 || !isPowerOf2(bytesPerSector) || !isPowerOf2(sectorsPerCluster) {
+		return nil, nil
+	}
+	clusterSize := bytesPerSector * sectorsPerCluster
+
+	fs := &Filesystem{
+		Type:      "ntfs",
+		UUID:      fmt.Sprintf("%016X", binary.LittleEndian.Uint64(head[72:])),
+		Size:      binary.LittleEndian.Uint64(head[40:]) * bytesPerSector,
+		BlockSize: uint32(clusterSize),
+	}
+
+	recordSize := uint64(0)
+	if clustersPerRecord := int8(head[64]); clustersPerRecord > 0 {
+		recordSize = uint64(clustersPerRecord) * clusterSize
+	} else if clustersPerRecord > -31 {
+		recordSize = 1 << -clustersPerRecord
+	}
+	if recordSize < 256 || recordSize > 64<<10 {
+		return fs, nil
+	}
+	mft := binary.LittleEndian.Uint64(head[48:]) * clusterSize
+	record, err := s.read(mft+ntfsVolumeRecord*recordSize, int(recordSize))
+	if err != nil {
+		return nil, err
+	}
+	fs.Label = ntfsVolumeName(record, int(bytesPerSector))
+	return fs, nil
+}
+
+// ntfsVolumeName applies the fixups of the MFT record and returns
+// the content of its resident volume name attribute
+func ntfsVolumeName(record []byte, bytesPerSector int) string {
+	if string(record[:4]) != "FILE" {
+		return ""
+	}
+	// the last two bytes of every sector are saved in the update
+	// sequence array, its first entry is the check value
+	usaOffset := int(binary.LittleEndian.Uint16(record[4:]))
+	usaCount := int(binary.LittleEndian.Uint16(record[6:]))
+	for index := 1; index < usaCount; index++ {
+		pos := index*bytesPerSector - 2
+		if usaOffset+2*index+2 > len(record) || pos+2 > len(record) {
+			return ""
+		}
+		copy(record[pos:pos+2], record[usaOffset+2*index:])
+	}
+
+	offset := int(binary.LittleEndian.Uint16(record[20:]))
+	for offset+24 <= len(record) {
+		attributeType := binary.LittleEndian.Uint32(record[offset:])
+		length := int(binary.LittleEndian.Uint32(record[offset+4:]))
+		if attributeType == ntfsAttributeEnd || length < 24 || offset+length > len(record) {
+			return ""
+		}
+		// the attribute is resident
+		if attributeType == ntfsAttributeVolumeName && record[offset+8] == 0 {
+			contentLength := int(binary.LittleEndian.Uint32(record[offset+16:]))
+			contentOffset := int(binary.LittleEndian.Uint16(record[offset+20:]))
+			if contentOffset+contentLength > length {
+				return ""
+			}
+			return utf16String(record[offset+contentOffset : offset+contentOffset+contentLength])
+		}
+		offset += length
+	}
+	return ""
+}
@@ -0,0 +1,252 @@
+package probe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"unicode/utf16"
+)
+
+// the sector size of a mbr, a gpt is looked for with 4096 as well
+const sectorSize = 512
+
+// bounds the chain of extended boot records, which may loop
+const maxLogicalPartitions = 128
+
+// bounds the entries of a gpt, 128 are usual
+const maxGPTEntries = 4096
+
+var mbrTypes = map[byte]string{
+	0x01: "FAT12",
+	0x04: "FAT16 <32M",
+	0x05: "Extended",
+	0x06: "FAT16",
+	0x07: "HPFS/NTFS/exFAT",
+	0x0b: "W95 FAT32",
+	0x0c: "W95 FAT32 (LBA)",
+	0x0e: "W95 FAT16 (LBA)",
+	0x0f: "W95 Ext'd (LBA)",
+	0x82: "Linux swap / Solaris",
+	0x83: "Linux",
+	0x85: "Linux extended",
+	0x8e: "Linux LVM",
+	0xee: "GPT",
+	0xef: "EFI (FAT-12/16/32)",
+	0xfd: "Linux raid autodetect",
+}
+
+var gptTypes = map[string]string{
+	"c12a7328-f81f-11d2-ba4b-00a0c93ec93b": "EFI System",
+	"21686148-6449-6e6f-744e-656564454649": "BIOS boot",
+	"e3c9e316-0b5c-4db8-817d-f92df00215ae": "Microsoft reserved",
+	"ebd0a0a2-b9e5-4433-87c0-68b6b72699c7": "Microsoft basic data",
+	"de94bba4-06d1-4d40-a16a-bfd50179d6ac": "Windows recovery environment",
+	"0fc63daf-8483-4772-8e79-3d69d8477de4": "Linux filesystem",
+	"0657fd6d-a4ab-43c4-84e5-0933c84b4f4f": "Linux swap",
+	"e6d6d379-f507-44c2-a23c-238f2a3df928": "Linux LVM",
+	"a19d880f-05fc-4d3b-a006-743f0f84911e": "Linux RAID",
+	"4f68bce3-e8cd-4db1-96e7-fbcaf984b709": "Linux root (x86-64)",
+	"bc13c2ff-59e6-4262-a352-b275fd6f7172": "Linux extended boot",
+	"933ac7e1-2eb4-4f13-b844-0e14e2aef915": "Linux home",
+}
+
+func isExtendedType(t byte) bool {
+	return t == 0x05 || t == 0x0f || t == 0x85
+}
+
+// mbrEntry is a partition entry of a mbr or an extended boot record
+type mbrEntry struct {
+	status byte
+	typ    byte
+	lba    uint64
+	count  uint64
+}
+
+func parseMBREntry(sector []byte, index int) mbrEntry {
+	e := sector[446+index*16:]
+	return mbrEntry{
+		status: e[0],
+		typ:    e[4],
+		lba:    uint64(binary.LittleEndian.Uint32(e[8:])),
+		count:  uint64(binary.LittleEndian.Uint32(e[12:])),
+	}
+}
+
+func hasBootSignature(sector []byte) bool {
+	return sector[510] == 0x55 && sector[511] == 0xaa
+}
+
+// readMBR returns the partitions of the mbr and the disk signature, or
+// no partitions if the disk has no mbr
+func readMBR(disk section) ([]*Partition, string, error) {
+	mbr, err := disk.read(0, sectorSize)
+	if err != nil || !hasBootSignature(mbr) {
+		return nil, "", err
+	}
+
+	partitions := []*Partition{}
+	for index := range 4 {
+		e := parseMBREntry(mbr, index)
+		// a boot sector of something else
+		if e.status != 0 && e.status != 0x80 {
+			return nil, "", nil
+		}
+		if e.typ == 0 || e.count == 0 {
+			continue
+		}
+
+		p := &Partition{
+			Number:   index + 1,
+			Start:    e.lba * sectorSize,
+			Size:     e.count * sectorSize,
+			Type:     fmt.Sprintf("0x%02x", e.typ),
+			TypeName: mbrTypes[e.typ],
+			Bootable: e.status == 0x80,
+			extended: isExtendedType(e.typ),
+		}
+		partitions = append(partitions, p)
+	}
+
+	for _, p := range partitions {
+		if p.extended {
+			logical, err := readLogicalPartitions(disk, p)
+			if err != nil {
+				return nil, "", err
+			}
+			partitions = append(partitions, logical...)
+			break
+		}
+	}
+	return partitions, fmt.Sprintf("0x%08x", binary.LittleEndian.Uint32(mbr[440:])), nil
+}
+
+// readLogicalPartitions follows the chain of extended boot records, the
+// first entry of each is a logical partition relative to the record and
+// the second links the next record relative to the extended partition
+func readLogicalPartitions(disk section, extended *Partition) ([]*Partition, error) {
+	var partitions []*Partition
+	ebr := extended.Start
+	for number := 5; number < 5+maxLogicalPartitions; number++ {
+		sector, err := disk.read(ebr, sectorSize)
+		if err != nil {
+			return nil, err
+		}
+		if !hasBootSignature(sector) {
+			break
+		}
+
+		e := parseMBREntry(sector, 0)
+		if e.typ != 0 && e.count != 0 {
+			partitions = append(partitions, &Partition{
+				Number:   number,
+				Start:    ebr + e.lba*sectorSize,
+				Size:     e.count * sectorSize,
+				Type:     fmt.Sprintf("0x%02x", e.typ),
+				TypeName: mbrTypes[e.typ],
+				Bootable: e.status == 0x80,
+			})
+		}
+
+		next := parseMBREntry(sector, 1)
+		if next.typ == 0 || next.lba == 0 {
+			break
+		}
+		ebr = extended.Start + next.lba*sectorSize
+		if ebr >= extended.Start+extended.Size {
+			break
+		}
+	}
+	return partitions, nil
+}
+
+// readGPT returns the partitions of the gpt and the disk guid, the
+// backup header is used if the primary one is damaged
+func readGPT(disk section) ([]*Partition, string, error) {
+	for _, sectorSize := range []uint64{512, 4096} {
+		if disk.size < 3*sectorSize {
+			break
+		}
+		for _, lba := range []uint64{1, disk.size/sectorSize - 1} {
+			partitions, id, err := readGPTHeader(disk, sectorSize, lba)
+			if err != nil || partitions != nil {
+				return partitions, id, err
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// readGPTHeader reads the gpt of the header at the lba, it returns
+// no partitions if the header or the entries are invalid
+func readGPTHeader(disk section, sectorSize uint64, lba uint64) ([]*Partition, string, error) {
+	hdr, err := disk.read(lba*sectorSize, int(sectorSize))
+	if err != nil || string(hdr[:8]) != "EFI PART" {
+		return nil, "", err
+	}
+	headerSize := binary.LittleEndian.Uint32(hdr[12:])
+	if headerSize < 92 || uint64(headerSize) > sectorSize {
+		return nil, "", nil
+	}
+	checksum := binary.LittleEndian.Uint32(hdr[16:])
+	binary.LittleEndian.PutUint32(hdr[16:], 0)
+	if crc32.ChecksumIEEE(hdr[:headerSize]) != checksum || binary.LittleEndian.Uint64(hdr[24:]) != lba {
+		return nil, "", nil
+	}
+
+	entriesLBA := binary.LittleEndian.Uint64(hdr[72:])
+	count := binary.LittleEndian.Uint32(hdr[80:])
+	entrySize := binary.LittleEndian.Uint32(hdr[84:])
+	if entrySize < 128 || entrySize > 4096 || entrySize%8 != 0 || count > maxGPTEntries {
+		return nil, "", nil
+	}
+	entries, err := disk.read(entriesLBA*sectorSize, int(count*entrySize))
+	if err != nil || crc32.ChecksumIEEE(entries) != binary.LittleEndian.Uint32(hdr[88:]) {
+		return nil, "", err
+	}
+
+	partitions := []*Partition{}
+	for index := range int(count) {
+		e := entries[index*int(entrySize):]
+		typeGUID := guid(e[:16])
+		if typeGUID == "00000000-0000-0000-0000-000000000000" {
+			continue
+		}
+		first, last := binary.LittleEndian.Uint64(e[32:]), binary.LittleEndian.Uint64(e[40:])
+		if last < first {
+			continue
+		}
+		partitions = append(partitions, &Partition{
+			Number:   index + 1,
+			Start:    first * sectorSize,
+			Size:     (last - first + 1) * sectorSize,
+			Type:     typeGUID,
+			TypeName: gptTypes[typeGUID],
+			Name:     utf16String(e[56:128]),
+			UUID:     guid(e[16:32]),
+			// the legacy bios bootable attribute
+			Bootable: binary.LittleEndian.Uint64(e[48:])&(1<<2) != 0,
+		})
+	}
+	return partitions, guid(hdr[56:72]), nil
+}
+
+// guid formats a mixed endian guid of gpt
+func guid(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16])
+}
+
+// utf16String decodes a little endian utf-16 string ended by a NUL
+func utf16String(b []byte) string {
+	units := make([]uint16, 0, len(b)/2)
+	for index := 0; index+1 < len(b); index += 2 {
+		unit := binary.LittleEndian.Uint16(b[index:])
+		if unit == 0 {
+			break
+		}
+		units = append(units, unit)
+	}
+	return strings.TrimSpace(string(utf16.Decode(units)))
+}
@@ -0,0 +1,126 @@
+// Package probe tells what is inside a guest disk without booting it.
+// It parses the MBR or GPT partition table and identifies the
+// filesystem superblocks of every partition, like blkid does.
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// Disk is the content of a guest disk
+type Disk struct {
+	Size uint64 `json:"size"`
+	// Table is "gpt", "mbr" or empty if the disk isn't partitioned
+	Table string `json:"table,omitempty"`
+	// ID is the disk guid of a gpt or the disk signature of a mbr
+	ID         string       `json:"id,omitempty"`
+	Partitions []*Partition `json:"partitions,omitempty"`
+	// Filesystem is found on a disk which isn't partitioned
+	Filesystem *Filesystem `json:"filesystem,omitempty"`
+}
+
+// Partition is an entry of the partition table
+type Partition struct {
+	// Number is the index of the entry from 1, the logical
+	// partitions of a mbr are numbered from 5 like linux does
+	Number int    `json:"number"`
+	Start  uint64 `json:"start"`
+	Size   uint64 `json:"size"`
+	// Type is the partition type guid of a gpt, or the type byte
+	// of a mbr like 0x83
+	Type     string `json:"type"`
+	TypeName string `json:"type-name,omitempty"`
+	// Name and UUID are only known for a gpt
+	Name       string      `json:"name,omitempty"`
+	UUID       string      `json:"uuid,omitempty"`
+	Bootable   bool        `json:"bootable,omitempty"`
+	Filesystem *Filesystem `json:"filesystem,omitempty"`
+
+	// the container of the logical partitions of a mbr
+	extended bool
+}
+
+// Filesystem is a superblock found at the start of a disk or partition
+type Filesystem struct {
+	// Type is named like blkid: ext2, ext3, ext4, xfs, vfat, ntfs,
+	// swap or LVM2_member
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"`
+	UUID  string `json:"uuid,omitempty"`
+	// Size is the size of the filesystem, it can be smaller than
+	// the partition
+	Size      uint64 `json:"size"`
+	BlockSize uint32 `json:"block-size,omitempty"`
+}
+
+// ErrTooSmall is returned for disks without room for a partition table
+var ErrTooSmall = errors.New("the disk is too small to be probed")
+
+// Probe reads the partition table and the filesystems of the guest disk,
+// a qcow2 image is read through its backing chain
+func Probe(disk gqcow2.BackingDisk) (*Disk, error) {
+	size := disk.VirtualSize()
+	if size < sectorSize {
+		return nil, ErrTooSmall
+	}
+	d := &Disk{Size: size}
+	whole := section{disk: disk, size: size}
+
+	var err error
+	if d.Partitions, d.ID, err = readGPT(whole); err != nil {
+		return nil, err
+	}
+	if d.Partitions != nil {
+		d.Table = "gpt"
+	} else {
+		// a filesystem on the whole disk has the boot signature of a mbr
+		if d.Filesystem, err = probeFilesystem(whole); err != nil {
+			return nil, err
+		}
+		if d.Filesystem != nil {
+			return d, nil
+		}
+		if d.Partitions, d.ID, err = readMBR(whole); err != nil {
+			return nil, err
+		}
+		if d.Partitions != nil {
+			d.Table = "mbr"
+		}
+	}
+
+	for _, p := range d.Partitions {
+		if p.extended || p.Start >= size {
+			continue
+		}
+		part := section{disk: disk, start: p.Start, size: min(p.Size, size-p.Start)}
+		if p.Filesystem, err = probeFilesystem(part); err != nil {
+			return nil, errors.Join(fmt.Errorf("probe partition %d failed", p.Number), err)
+		}
+	}
+	return d, nil
+}
+
+// section reads the disk in [start, start+size)
+type section struct {
+	disk  gqcow2.BackingDisk
+	start uint64
+	size  uint64
+}
+
+// read reads length bytes at off of the section, the part beyond
+// the end of the section is returned as zeros
+func (s section) read(off uint64, length int) ([]byte, error) {
+	buf := make([]byte, length)
+	if off >= s.size {
+		return buf, nil
+	}
+	end := min(uint64(length), s.size-off)
+	if _, err := s.disk.ReadAt(buf[:end], int64(s.start+off)); err != nil && err != io.EOF {
+		return nil, errors.Join(fmt.Errorf("read disk at %d failed", s.start+off), err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,359 @@
+package probe_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+	"unicode/utf16"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/probe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	testUUID = []byte{0x12, 0x34, 0x56, 0x78, 0x9a, 0xbc, 0xde, 0xf0, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	le       = binary.LittleEndian
+)
+
+func putExt(disk []byte, off int, label string, incompat uint32) {
+	sb := disk[off+1024:]
+	le.PutUint32(sb[4:], 1024)
+	le.PutUint32(sb[24:], 2) // 4KiB blocks
+	le.PutUint16(sb[56:], 0xef53)
+	le.PutUint32(sb[92:], 0x4)
+	le.PutUint32(sb[96:], incompat)
+	copy(sb[104:], testUUID)
+	copy(sb[120:], label)
+}
+
+func putXFS(disk []byte, off int, label string) {
+	copy(disk[off:], "XFSB")
+	binary.BigEndian.PutUint32(disk[off+4:], 4096)
+	binary.BigEndian.PutUint64(disk[off+8:], 512)
+	copy(disk[off+32:], testUUID)
+	copy(disk[off+108:], label)
+}
+
+func putFAT(disk []byte, off int, label string, fat32 bool) {
+	b := disk[off:]
+	b[0] = 0xeb
+	le.PutUint16(b[11:], 512)
+	b[13] = 4
+	le.PutUint16(b[14:], 32)
+	b[16] = 2
+	le.PutUint32(b[32:], 4096)
+	ebr := b[36:]
+	if fat32 {
+		ebr = b[64:]
+		copy(b[82:], "FAT32   ")
+	} else {
+		le.PutUint16(b[22:], 16)
+		copy(b[54:], "FAT16   ")
+	}
+	ebr[2] = 0x29
+	le.PutUint32(ebr[3:], 0xabcd1234)
+	copy(ebr[7:18], label+"           ")
+	b[510], b[511] = 0x55, 0xaa
+}
+
+func putSwap(disk []byte, off int, label string) {
+	le.PutUint32(disk[off+1024:], 1)
+	le.PutUint32(disk[off+1028:], 255)
+	copy(disk[off+1036:], testUUID)
+	copy(disk[off+1052:], label)
+	copy(disk[off+4096-10:], "SWAPSPACE2")
+}
+
+func putLVM(disk []byte, off int) {
+	label := disk[off+512:]
+	copy(label, "LABELONE")
+	le.PutUint64(label[8:], 1)
+	le.PutUint32(label[20:], 32)
+	copy(label[24:], "LVM2 001")
+	copy(label[32:], "abcdefghijklmnopqrstuvwxyz012345")
+	le.PutUint64(label[64:], 2<<20)
+}
+
+// putNTFS writes a boot sector and the $Volume record with the label,
+// the update sequence hides the end of the first sector of the record
+func putNTFS(disk []byte, off int, label string) {
+	b := disk[off:]
+	b[0] = 0xeb
+	copy(b[3:], "NTFS    ")
+	le.PutUint16(b[11:], 512)
+	b[13] = 8
+	le.PutUint64(b[40:], 4095)
+	le.PutUint64(b[48:], 4) // the MFT at 16KiB
+	b[64] = 0xf6            // 1KiB records
+	le.PutUint64(b[72:], 0x1122334455667788)
+
+	record := b[16<<10+3*1024:]
+	copy(record, "FILE")
+	le.PutUint16(record[4:], 48)
+	le.PutUint16(record[6:], 3)
+	le.PutUint16(record[20:], 56)
+	attribute := record[56:]
+	name := utf16.Encode([]rune(label))
+	le.PutUint32(attribute, 0x60)
+	le.PutUint32(attribute[4:], uint32(24+len(name)*2+7)&^7)
+	le.PutUint32(attribute[16:], uint32(len(name)*2))
+	le.PutUint16(attribute[20:], 24)
+	for index, unit := range name {
+		le.PutUint16(attribute[24+index*2:], unit)
+	}
+	le.PutUint32(attribute[le.Uint32(attribute[4:]):], 0xffffffff)
+	// the fixups, the check value is 0x0001
+	le.PutUint16(record[48:], 1)
+	copy(record[50:], record[510:512])
+	copy(record[52:], record[1022:1024])
+	le.PutUint16(record[510:], 1)
+	le.PutUint16(record[1022:], 1)
+}
+
+type gptEntry struct {
+	typeGUID    string
+	name        string
+	first, last uint64
+}
+
+// guidBytes encodes the mixed endian guid
+func guidBytes(s string) []byte {
+	var b []byte
+	var hex []byte
+	for _, c := range []byte(s) {
+		if c != '-' {
+			hex = append(hex, c)
+		}
+	}
+	for index := 0; index < len(hex); index += 2 {
+		var v byte
+		for _, c := range hex[index : index+2] {
+			v <<= 4
+			if c >= 'a' {
+				v |= c - 'a' + 10
+			} else {
+				v |= c - '0'
+			}
+		}
+		b = append(b, v)
+	}
+	b[0], b[1], b[2], b[3] = b[3], b[2], b[1], b[0]
+	b[4], b[5] = b[5], b[4]
+	b[6], b[7] = b[7], b[6]
+	return b
+}
+
+// putGPT writes the protective mbr and both gpt headers
+func putGPT(disk []byte, entries []gptEntry) {
+	mbr := disk[446:]
+	mbr[4] = 0xee
+	le.PutUint32(mbr[8:], 1)
+	le.PutUint32(mbr[12:], uint32(len(disk)/512-1))
+	disk[510], disk[511] = 0x55, 0xaa
+
+	table := make([]byte, 128*128)
+	for index, e := range entries {
+		entry := table[index*128:]
+		copy(entry, guidBytes(e.typeGUID))
+		copy(entry[16:], testUUID)
+		entry[16] = byte(index)
+		le.PutUint64(entry[32:], e.first)
+		le.PutUint64(entry[40:], e.last)
+		for i, unit := range utf16.Encode([]rune(e.name)) {
+			le.PutUint16(entry[56+i*2:], unit)
+		}
+	}
+
+	lastLBA := uint64(len(disk)/512 - 1)
+	for _, lba := range []uint64{1, lastLBA} {
+		entriesLBA := uint64(2)
+		backup := lastLBA
+		if lba != 1 {
+			entriesLBA, backup = lastLBA-32, 1
+		}
+		copy(disk[entriesLBA*512:], table)
+
+		hdr := disk[lba*512 : lba*512+512]
+		copy(hdr, "EFI PART")
+		le.PutUint32(hdr[8:], 0x10000)
+		le.PutUint32(hdr[12:], 92)
+		le.PutUint64(hdr[24:], lba)
+		le.PutUint64(hdr[32:], backup)
+		le.PutUint64(hdr[40:], 34)
+		le.PutUint64(hdr[48:], lastLBA-33)
+		copy(hdr[56:], guidBytes("0a0b0c0d-0e0f-1011-1213-141516171819"))
+		le.PutUint64(hdr[72:], entriesLBA)
+		le.PutUint32(hdr[80:], 128)
+		le.PutUint32(hdr[84:], 128)
+		le.PutUint32(hdr[88:], crc32.ChecksumIEEE(table))
+		le.PutUint32(hdr[16:], crc32.ChecksumIEEE(hdr[:92]))
+	}
+}
+
+func putMBREntry(sector []byte, index int, status byte, typ byte, lba uint32, count uint32) {
+	e := sector[446+index*16:]
+	e[0], e[4] = status, typ
+	le.PutUint32(e[8:], lba)
+	le.PutUint32(e[12:], count)
+	sector[510], sector[511] = 0x55, 0xaa
+}
+
+// qcow2Disk writes the disk into a new image and opens it again
+func qcow2Disk(t *testing.T, disk []byte) *gqcow2.Image {
+	path := filepath.Join(t.TempDir(), "disk.qcow2")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	image, err := gqcow2.Create(f, path, gqcow2.CreateOptions{Size: uint64(len(disk))})
+	require.NoError(t, err)
+	_, err = image.WriteAt(disk, 0)
+	require.NoError(t, err)
+	require.NoError(t, image.Close())
+
+	image, err = gqcow2.OpenImage(path, false)
+	require.NoError(t, err)
+	t.Cleanup(func() { image.Close() })
+	return image
+}
+
+func rawDisk(disk []byte) *gqcow2.RawDisk {
+	return gqcow2.NewRawDisk(bytes.NewReader(disk), uint64(len(disk)))
+}
+
+func Test_ProbeGPT(t *testing.T) {
+	disk := make([]byte, 16<<20)
+	putGPT(disk, []gptEntry{
+		{"c12a7328-f81f-11d2-ba4b-00a0c93ec93b", "EFI", 2048, 4095},
+		{"0fc63daf-8483-4772-8e79-3d69d8477de4", "root", 4096, 8191},
+		{"0657fd6d-a4ab-43c4-84e5-0933c84b4f4f", "swap", 8192, 10239},
+		{"e6d6d379-f507-44c2-a23c-238f2a3df928", "lvm", 10240, 14335},
+		{"ebd0a0a2-b9e5-4433-87c0-68b6b72699c7", "windows", 14336, 22527},
+		{"0fc63daf-8483-4772-8e79-3d69d8477de4", "data", 22528, 30719},
+	})
+	putFAT(disk, 2048*512, "EFI", true)
+	putExt(disk, 4096*512, "cloudimg-rootfs", 0x2c2)
+	putSwap(disk, 8192*512, "swap0")
+	putLVM(disk, 10240*512)
+	putNTFS(disk, 14336*512, "Windows")
+	putXFS(disk, 22528*512, "data")
+
+	t.Run("Probe the partitions of a qcow2 image",
+		func(t *testing.T) {
+			d, err := probe.Probe(qcow2Disk(t, disk))
+			require.NoError(t, err)
+			assert.Equal(t, "gpt", d.Table)
+			assert.Equal(t, "0a0b0c0d-0e0f-1011-1213-141516171819", d.ID)
+			require.Len(t, d.Partitions, 6)
+
+			efi := d.Partitions[0]
+			assert.Equal(t, 1, efi.Number)
+			assert.Equal(t, uint64(1<<20), efi.Start)
+			assert.Equal(t, uint64(1<<20), efi.Size)
+			assert.Equal(t, "EFI System", efi.TypeName)
+			assert.Equal(t, "EFI", efi.Name)
+			// the first byte of the unique guid is the index of the entry
+			assert.Equal(t, "78563400-bc9a-f0de-0123-456789abcdef", efi.UUID)
+			assert.Equal(t, &probe.Filesystem{Type: "vfat", Label: "EFI", UUID: "ABCD-1234", Size: 2 << 20, BlockSize: 2048}, efi.Filesystem)
+
+			assert.Equal(t, &probe.Filesystem{
+				Type: "ext4", Label: "cloudimg-rootfs", UUID: "12345678-9abc-def0-0123-456789abcdef",
+				Size: 4 << 20, BlockSize: 4096,
+			}, d.Partitions[1].Filesystem)
+			assert.Equal(t, &probe.Filesystem{
+				Type: "swap", Label: "swap0", UUID: "12345678-9abc-def0-0123-456789abcdef",
+				Size: 1 << 20, BlockSize: 4096,
+			}, d.Partitions[2].Filesystem)
+			assert.Equal(t, &probe.Filesystem{
+				Type: "LVM2_member", UUID: "abcdef-ghij-klmn-opqr-stuv-wxyz-012345", Size: 2 << 20,
+			}, d.Partitions[3].Filesystem)
+			assert.Equal(t, &probe.Filesystem{
+				Type: "ntfs", Label: "Windows", UUID: "1122334455667788", Size: 4095 * 512, BlockSize: 4096,
+			}, d.Partitions[4].Filesystem)
+			assert.Equal(t, "Linux filesystem", d.Partitions[5].TypeName)
+			assert.Equal(t, &probe.Filesystem{
+				Type: "xfs", Label: "data", UUID: "12345678-9abc-def0-0123-456789abcdef", Size: 2 << 20, BlockSize: 4096,
+			}, d.Partitions[5].Filesystem)
+		})
+
+	t.Run("The backup header replaces a damaged primary one",
+		func(t *testing.T) {
+			damaged := bytes.Clone(disk)
+			damaged[512+100]++
+			damaged[512+24]++
+			d, err := probe.Probe(rawDisk(damaged))
+			require.NoError(t, err)
+			assert.Equal(t, "gpt", d.Table)
+			assert.Len(t, d.Partitions, 6)
+
+			clear(damaged[len(damaged)-512:])
+			d, err = probe.Probe(rawDisk(damaged))
+			require.NoError(t, err)
+			// only the protective mbr is left
+			assert.Equal(t, "mbr", d.Table)
+			require.Len(t, d.Partitions, 1)
+			assert.Equal(t, "0xee", d.Partitions[0].Type)
+		})
+}
+
+func Test_ProbeMBR(t *testing.T) {
+	disk := make([]byte, 8<<20)
+	le.PutUint32(disk[440:], 0xdeadbeef)
+	putMBREntry(disk, 0, 0x80, 0x83, 2048, 4096)
+	putMBREntry(disk, 1, 0, 0x05, 6144, 8192)
+	// the logical partitions, each after its extended boot record
+	putMBREntry(disk[6144*512:], 0, 0, 0x83, 2048, 2048)
+	putMBREntry(disk[6144*512:], 1, 0, 0x05, 4096, 4096)
+	putMBREntry(disk[(6144+4096)*512:], 0, 0, 0x06, 2048, 2048)
+	putExt(disk, 2048*512, "boot", 0)
+	putExt(disk, (6144+2048)*512, "", 0)
+	disk[(6144+2048)*512+1024+92] = 0 // no journal
+	putFAT(disk, (6144+4096+2048)*512, "NO NAME", false)
+
+	d, err := probe.Probe(qcow2Disk(t, disk))
+	require.NoError(t, err)
+	assert.Equal(t, "mbr", d.Table)
+	assert.Equal(t, "0xdeadbeef", d.ID)
+	require.Len(t, d.Partitions, 4)
+
+	assert.Equal(t, &probe.Partition{
+		Number: 1, Start: 1 << 20, Size: 2 << 20, Type: "0x83", TypeName: "Linux", Bootable: true,
+		Filesystem: &probe.Filesystem{Type: "ext3", Label: "boot", UUID: "12345678-9abc-def0-0123-456789abcdef", Size: 4 << 20, BlockSize: 4096},
+	}, d.Partitions[0])
+	assert.Equal(t, "Extended", d.Partitions[1].TypeName)
+	assert.Nil(t, d.Partitions[1].Filesystem)
+
+	assert.Equal(t, 5, d.Partitions[2].Number)
+	assert.Equal(t, uint64(8192*512), d.Partitions[2].Start)
+	assert.Equal(t, "ext2", d.Partitions[2].Filesystem.Type)
+	assert.Equal(t, 6, d.Partitions[3].Number)
+	assert.Equal(t, uint64((6144+4096+2048)*512), d.Partitions[3].Start)
+	assert.Equal(t, &probe.Filesystem{Type: "vfat", UUID: "ABCD-1234", Size: 2 << 20, BlockSize: 2048}, d.Partitions[3].Filesystem)
+}
+
+func Test_ProbeWholeDisk(t *testing.T) {
+	t.Run("A filesystem without partition table",
+		func(t *testing.T) {
+			disk := make([]byte, 2<<20)
+			putFAT(disk, 0, "FLOPPY", false)
+			d, err := probe.Probe(rawDisk(disk))
+			require.NoError(t, err)
+			assert.Empty(t, d.Table)
+			assert.Nil(t, d.Partitions)
+			assert.Equal(t, "FLOPPY", d.Filesystem.Label)
+		})
+
+	t.Run("An empty disk",
+		func(t *testing.T) {
+			d, err := probe.Probe(rawDisk(make([]byte, 1<<20)))
+			require.NoError(t, err)
+			assert.Equal(t, &probe.Disk{Size: 1 << 20}, d)
+
+			_, err = probe.Probe(rawDisk(make([]byte, 100)))
+			assert.ErrorIs(t, err, probe.ErrTooSmall)
+		})
+}
@@ -0,0 +1,387 @@
+// Package remote reads images served over http or stored in an s3
+// compatible object storage by range requests, and uploads converted
+// images into a bucket. It keeps the network out of gqcow2.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// ErrHTTPFileChanged is returned when the file on the server is
+// replaced while it is read, its ETag no longer matches.
+var ErrHTTPFileChanged = errors.New("http file changed on the server")
+
+// errEmptyFile is the answer to the range of an empty file, which
+// cannot be satisfied
+var errEmptyFile = errors.New("the http file is empty")
+
+const (
+	// reads up to a block are rounded to whole blocks and cached, these
+	// are the header, the l1 and l2 tables and the refcount blocks
+	DefaultHTTPBlockSize = 64 * 1024
+	// with 64KiB blocks this is 16MiB
+	DefaultHTTPCacheBlocks = 256
+	DefaultHTTPRetries     = 3
+	DefaultHTTPRetryDelay  = 100 * time.Millisecond
+)
+
+// HTTPFile is a read only gqcow2.FileHandler of a file served over http,
+// every read is a range request.
+type HTTPFile struct {
+	URL    string
+	Client *http.Client
+
+	// failed requests are retried, the delay doubles after every try
+	Retries    int
+	RetryDelay time.Duration
+
+	// BlockSize is the unit of the cache, larger reads go to
+	// the server directly and are not cached
+	BlockSize   int64
+	CacheBlocks int
+	// ReadAhead bytes are fetched into the cache on a miss, so the
+	// tables following each other are read by one request
+	ReadAhead int64
+	// large reads are split into up to Parallel range requests
+	Parallel int
+
+	size int64
+	// the validator of the content, empty if the server sends none
+	etag string
+	// sign adds the authorization to a request, if needed
+	sign func(req *http.Request) error
+
+	mu    sync.Mutex
+	cache map[int64][]byte
+}
+
+// OpenHTTPFile finds out the size and the ETag of the file,
+// the server has to support range requests.
+func OpenHTTPFile(url string) (*HTTPFile, error) {
+	return openHTTPFile(url, http.DefaultClient, nil)
+}
+
+func openHTTPFile(url string, client *http.Client, sign func(req *http.Request) error) (*HTTPFile, error) {
+	f := &HTTPFile{
+		URL:         url,
+		Client:      client,
+		Retries:     DefaultHTTPRetries,
+		RetryDelay:  DefaultHTTPRetryDelay,
+		BlockSize:   DefaultHTTPBlockSize,
+		CacheBlocks: DefaultHTTPCacheBlocks,
+		Parallel:    1,
+		sign:        sign,
+		cache:       make(map[int64][]byte),
+	}
+
+	// the first byte tells the size by the content range, an empty
+	// file has no first byte and its range is not satisfiable
+	err := retry(f.Retries, f.RetryDelay, func() error {
+		resp, err := f.get(0, 1)
+		if errors.Is(err, errEmptyFile) {
+			f.size = 0
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if _, _, f.size, err = parseContentRange(resp.Header.Get("Content-Range")); err != nil {
+			return err
+		}
+		f.etag = resp.Header.Get("ETag")
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("opening %s failed", url), err)
+	}
+	return f, nil
+}
+
+func (f *HTTPFile) Name() string {
+	return f.URL
+}
+
+func (f *HTTPFile) Size() int64 {
+	return f.size
+}
+
+// Close drops the cached blocks
+func (f *HTTPFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	clear(f.cache)
+	return nil
+}
+
+func (f *HTTPFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if off+int64(len(p)) > f.size {
+		p = p[:f.size-off]
+		eof = io.EOF
+	}
+
+	if int64(len(p)) > f.BlockSize {
+		if err := f.fetchParallel(p, off); err != nil {
+			return 0, err
+		}
+		return len(p), eof
+	}
+
+	first := off / f.BlockSize
+	last := (off + int64(len(p)) - 1) / f.BlockSize
+	blocks, err := f.blocks(first, last)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, blocks[off-first*f.BlockSize:])
+	return n, eof
+}
+
+// blocks returns the blocks first to last, the missing ones
+// are fetched together with the read ahead by one request
+func (f *HTTPFile) blocks(first int64, last int64) ([]byte, error) {
+	start := first * f.BlockSize
+	end := min((last+1)*f.BlockSize, f.size)
+	buf := make([]byte, end-start)
+
+	missing := int64(-1)
+	f.mu.Lock()
+	for index := first; index <= last; index++ {
+		cached, ok := f.cache[index]
+		if !ok {
+			missing = index
+			break
+		}
+		copy(buf[(index-first)*f.BlockSize:], cached)
+	}
+	f.mu.Unlock()
+	if missing < 0 {
+		return buf, nil
+	}
+
+	fetchStart := missing * f.BlockSize
+	fetched := make([]byte, min(max(end, fetchStart+f.ReadAhead), f.size)-fetchStart)
+	if err := f.fetch(fetched, fetchStart); err != nil {
+		return nil, err
+	}
+	copy(buf[fetchStart-start:], fetched)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for offset := int64(0); offset < int64(len(fetched)); offset += f.BlockSize {
+		block := fetched[offset:min(offset+f.BlockSize, int64(len(fetched)))]
+		f.cachePut((fetchStart+offset)/f.BlockSize, block)
+	}
+	return buf, nil
+}
+
+// cachePut keeps a copy of the block, an arbitrary block
+// is evicted when the cache is full
+func (f *HTTPFile) cachePut(index int64, block []byte) {
+	if _, ok := f.cache[index]; !ok && len(f.cache) >= f.CacheBlocks {
+		for victim := range f.cache {
+			delete(f.cache, victim)
+			break
+		}
+	}
+	f.cache[index] = append([]byte(nil), block...)
+}
+
+// fetch fills p with the file content at off
+func (f *HTTPFile) fetch(p []byte, off int64) error {
+	return retry(f.Retries, f.RetryDelay, func() error {
+		resp, err := f.get(off, int64(len(p)))
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		if etag := resp.Header.Get("ETag"); f.etag != "" && etag != "" && etag != f.etag {
+			return permanent(ErrHTTPFileChanged)
+		}
+		start, _, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != off || size != f.size {
+			return permanent(fmt.Errorf("unexpected content range %s", resp.Header.Get("Content-Range")))
+		}
+		if _, err := io.ReadFull(resp.Body, p); err != nil {
+			return errors.Join(errors.New("reading the response body failed"), err)
+		}
+		return nil
+	})
+}
+
+// fetchParallel fills p by up to Parallel range requests at once
+func (f *HTTPFile) fetchParallel(p []byte, off int64) error {
+	pieceSize := (int64(len(p)/max(f.Parallel, 1)) + f.BlockSize - 1) / f.BlockSize * f.BlockSize
+	if pieceSize >= int64(len(p)) {
+		return f.fetch(p, off)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, (int64(len(p))+pieceSize-1)/pieceSize)
+	for index := range errs {
+		piece := p[int64(index)*pieceSize : min(int64(index+1)*pieceSize, int64(len(p)))]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[index] = f.fetch(piece, off+int64(index)*pieceSize)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// get requests length bytes at off, only a partial content
+// response is returned
+func (f *HTTPFile) get(off int64, length int64) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, f.URL, nil)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	// weak validators never match an If-Match
+	if f.etag != "" && !strings.HasPrefix(f.etag, "W/") {
+		req.Header.Set("If-Match", f.etag)
+	}
+	if f.sign != nil {
+		if err := f.sign(req); err != nil {
+			return nil, permanent(err)
+		}
+	}
+
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	err = fmt.Errorf("unexpected http status %s", resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return nil, permanent(ErrHTTPFileChanged)
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && resp.Header.Get("Content-Range") == "bytes */0":
+		return nil, permanent(errEmptyFile)
+	case resp.StatusCode == http.StatusOK:
+		return nil, permanent(errors.Join(errors.New("the server does not support range requests"), err))
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return nil, err
+	}
+	return nil, permanent(err)
+}
+
+// permanentError is not worth retrying
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return permanentError{err: err}
+}
+
+// retry calls do until it succeeds, fails permanently or
+// runs out of retries
+func retry(retries int, delay time.Duration, do func() error) error {
+	for try := 0; ; try++ {
+		err := do()
+		if err == nil {
+			return nil
+		}
+		var p permanentError
+		if errors.As(err, &p) {
+			return p.err
+		}
+		if try >= retries {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// parseContentRange parses "bytes start-end/size"
+func parseContentRange(s string) (int64, int64, int64, error) {
+	invalid := permanent(fmt.Errorf("invalid content range %q", s))
+	rest, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	rng, total, ok := strings.Cut(rest, "/")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+
+	var values [3]int64
+	for index, v := range []string{first, last, total} {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, 0, invalid
+		}
+		values[index] = n
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// OpenHTTPBacking opens the backing file from the same server as the
+// overlay, relative names are resolved against the url of the overlay.
+func OpenHTTPBacking(from *gqcow2.Image, name string) (gqcow2.FileHandler, error) {
+	base, err := url.Parse(from.Name)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(name)
+	if err != nil {
+		return nil, err
+	}
+	return OpenHTTPFile(base.ResolveReference(ref).String())
+}
+
+// OpenHTTPImage opens a qcow2 image served over http together with its
+// backing chain, the image is read only.
+func OpenHTTPImage(url string) (*gqcow2.Image, error) {
+	f, err := OpenHTTPFile(url)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := gqcow2.NewFileImage(f, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := image.OpenBacking(OpenHTTPBacking); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
@@ -0,0 +1,162 @@
+package remote_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/remote"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileServer serves the files of dir with an ETag, failures
+// requests fail with 503 before the server answers
+type fileServer struct {
+	dir      string
+	etag     string
+	failures atomic.Int32
+	requests atomic.Int32
+}
+
+func (s *fileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests.Add(1)
+	if s.failures.Add(-1) >= 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.dir, r.URL.Path))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("ETag", s.etag)
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
+
+func newFileServer(t *testing.T, dir string) (*fileServer, *httptest.Server) {
+	fs := &fileServer{dir: dir, etag: `"v1"`}
+	server := httptest.NewServer(fs)
+	t.Cleanup(server.Close)
+	return fs, server
+}
+
+func Test_HTTPFile(t *testing.T) {
+	dir := t.TempDir()
+	_, base := testimage.CreateFile(t, filepath.Join(dir, "base.qcow2"), 4<<20,
+		gqcow2.Extent{Start: 0, Length: 1 << 20}, gqcow2.Extent{Start: 3 << 20, Length: 100000})
+	overlay := testimage.Overlay(t, filepath.Join(dir, "overlay.qcow2"), 4<<20, "base.qcow2")
+	content := bytes.Clone(base)
+	changed := bytes.Repeat([]byte{0xcd}, 70000)
+	_, err := overlay.WriteAt(changed, 500000)
+	require.NoError(t, err)
+	copy(content[500000:], changed)
+	require.NoError(t, overlay.Close())
+
+	fs, server := newFileServer(t, dir)
+
+	t.Run("Read the guest content of a chain over http",
+		func(t *testing.T) {
+			image, err := remote.OpenHTTPImage(server.URL + "/overlay.qcow2")
+			require.NoError(t, err)
+			defer image.Close()
+			assert.False(t, image.RWMode)
+			assert.Equal(t, server.URL+"/base.qcow2", image.Backing.(*gqcow2.Image).Name)
+
+			assert.Equal(t, content, testimage.Read(t, image))
+
+			// both images fit into the cache, reading again is free
+			fs.requests.Store(0)
+			assert.Equal(t, content, testimage.Read(t, image))
+			assert.Zero(t, fs.requests.Load())
+		})
+
+	t.Run("Convert over http",
+		func(t *testing.T) {
+			image, err := remote.OpenHTTPImage(server.URL + "/base.qcow2")
+			require.NoError(t, err)
+			defer image.Close()
+
+			out, err := os.Create(filepath.Join(t.TempDir(), "base.raw"))
+			require.NoError(t, err)
+			defer out.Close()
+			vd, err := gqcow2.NewVirtualDisk(out)
+			require.NoError(t, err)
+			require.NoError(t, gqcow2.Convert(image, vd))
+
+			raw, err := os.ReadFile(out.Name())
+			require.NoError(t, err)
+			assert.Equal(t, base, raw[:len(base)])
+		})
+
+	t.Run("Reads are cached and coalesced",
+		func(t *testing.T) {
+			f, err := remote.OpenHTTPFile(server.URL + "/base.qcow2")
+			require.NoError(t, err)
+			f.BlockSize = 4096
+			local, err := os.ReadFile(filepath.Join(dir, "base.qcow2"))
+			require.NoError(t, err)
+			assert.Equal(t, int64(len(local)), f.Size())
+
+			fs.requests.Store(0)
+			buf := make([]byte, 100)
+			// spans two blocks, fetched by one request
+			_, err = f.ReadAt(buf, 4050)
+			require.NoError(t, err)
+			assert.Equal(t, local[4050:4150], buf)
+			_, err = f.ReadAt(buf, 8000)
+			require.NoError(t, err)
+			assert.Equal(t, local[8000:8100], buf)
+			assert.Equal(t, int32(1), fs.requests.Load())
+
+			// large reads bypass the cache
+			large := make([]byte, 10000)
+			_, err = f.ReadAt(large, 0)
+			require.NoError(t, err)
+			assert.Equal(t, local[:10000], large)
+			assert.Equal(t, int32(2), fs.requests.Load())
+		})
+
+	t.Run("Failed requests are retried",
+		func(t *testing.T) {
+			fs.failures.Store(2)
+			f, err := remote.OpenHTTPFile(server.URL + "/base.qcow2")
+			require.NoError(t, err)
+			f.RetryDelay = time.Millisecond
+
+			fs.failures.Store(3)
+			buf := make([]byte, 4)
+			_, err = f.ReadAt(buf, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []byte(gqcow2.QCOW2MagicNumber), buf)
+
+			f.Retries = 1
+			fs.failures.Store(2)
+			_, err = f.ReadAt(buf, 1<<20)
+			assert.Error(t, err)
+			fs.failures.Store(0)
+
+			_, err = remote.OpenHTTPFile(server.URL + "/missing.qcow2")
+			assert.Error(t, err)
+		})
+
+	t.Run("A replaced file is detected by its ETag",
+		func(t *testing.T) {
+			f, err := remote.OpenHTTPFile(server.URL + "/base.qcow2")
+			require.NoError(t, err)
+
+			fs.etag = `"v2"`
+			defer func() { fs.etag = `"v1"` }()
+			_, err = f.ReadAt(make([]byte, 512), 1<<20)
+			assert.ErrorIs(t, err, remote.ErrHTTPFileChanged)
+		})
+}
@@ -0,0 +1,406 @@
+package remote
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+const (
+	// a miss reads the following tables as well
+	DefaultS3ReadAhead = 1 << 20
+	DefaultS3Parallel  = 8
+	// every part but the last has to be at least 5MiB
+	MinS3PartSize     = 5 << 20
+	DefaultS3PartSize = 16 << 20
+
+	s3TimeFormat       = "20060102T150405Z"
+	s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// S3Config addresses an s3 compatible object storage, buckets are
+// addressed by path, e.g. https://s3.eu-west-1.amazonaws.com/bucket/key
+type S3Config struct {
+	Endpoint     string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// http.DefaultClient if nil
+	Client *http.Client
+}
+
+func (c *S3Config) client() *http.Client {
+	if c.Client == nil {
+		return http.DefaultClient
+	}
+	return c.Client
+}
+
+// ObjectURL is the url of the object key in the bucket
+func (c *S3Config) ObjectURL(bucket string, key string) string {
+	return strings.TrimRight(c.Endpoint, "/") + "/" + s3Escape(bucket, false) + "/" + s3Escape(key, true)
+}
+
+// Sign adds the AWS signature version 4 authorization to the request.
+// The host and every header already set on the request are signed.
+func (c *S3Config) Sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "authorization" || name == "user-agent" {
+			continue
+		}
+		headers[name] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	date := now.Format("20060102")
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := []byte("AWS4" + c.SecretKey)
+	for _, part := range []string{date, c.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		c.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3Escape percent encodes everything but the unreserved characters,
+// and the slashes of a path
+func s3Escape(s string, isPath bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && isPath:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Error is the error document of a failed request
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3 error %s: %s", e.Code, e.Message)
+}
+
+// do sends a signed request and returns the body of a successful response,
+// server errors are retried
+func (c *S3Config) do(method string, url string, body []byte) ([]byte, http.Header, error) {
+	var respBody []byte
+	var header http.Header
+	err := retry(DefaultHTTPRetries, DefaultHTTPRetryDelay, func() error {
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return permanent(err)
+		}
+		c.Sign(req, sha256Hex(body), time.Now())
+
+		resp, err := c.client().Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if respBody, err = io.ReadAll(resp.Body); err != nil {
+			return err
+		}
+		header = resp.Header
+
+		// a completed multipart upload may still fail with status 200
+		var s3Err s3Error
+		if resp.StatusCode/100 == 2 && !bytes.Contains(respBody, []byte("<Error>")) {
+			return nil
+		}
+		err = fmt.Errorf("unexpected http status %s", resp.Status)
+		if xml.Unmarshal(respBody, &s3Err) == nil && s3Err.Code != "" {
+			err = &s3Err
+		}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 ||
+			s3Err.Code == "InternalError" || s3Err.Code == "SlowDown" {
+			return err
+		}
+		return permanent(err)
+	})
+	if err != nil {
+		return nil, nil, errors.Join(fmt.Errorf("s3 %s %s failed", method, url), err)
+	}
+	return respBody, header, nil
+}
+
+// OpenS3File opens the object as a read only gqcow2.FileHandler, reads are
+// ranged GetObject requests. Misses of small reads read ahead, large
+// reads are split into parallel range requests.
+func OpenS3File(config S3Config, bucket string, key string) (*HTTPFile, error) {
+	f, err := openHTTPFile(config.ObjectURL(bucket, key), config.client(), func(req *http.Request) error {
+		config.Sign(req, s3EmptyPayloadHash, time.Now())
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.ReadAhead = DefaultS3ReadAhead
+	f.Parallel = DefaultS3Parallel
+	return f, nil
+}
+
+// OpenS3Image opens a qcow2 object together with its backing chain,
+// the backing files are objects of the same bucket.
+func OpenS3Image(config S3Config, bucket string, key string) (*gqcow2.Image, error) {
+	f, err := OpenS3File(config, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := gqcow2.NewFileImage(f, f.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := image.OpenBacking(OpenS3Backing(config, bucket)); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// OpenS3Backing opens the backing files as objects of the bucket, relative
+// names are resolved against the key of the overlay.
+func OpenS3Backing(config S3Config, bucket string) gqcow2.BackingOpener {
+	// the images are named by their url, which ends with the escaped key
+	prefix := config.ObjectURL(bucket, "")
+	return func(from *gqcow2.Image, name string) (gqcow2.FileHandler, error) {
+		if !path.IsAbs(name) {
+			fromKey, err := url.PathUnescape(strings.TrimPrefix(from.Name, prefix))
+			if err != nil {
+				return nil, err
+			}
+			name = path.Join(path.Dir(fromKey), name)
+		}
+		return OpenS3File(config, bucket, strings.TrimPrefix(name, "/"))
+	}
+}
+
+// S3Writer uploads everything written to it as one object by a
+// multipart upload, the parts are uploaded in parallel while writing.
+// The object only appears by a successful Close.
+type S3Writer struct {
+	// PartSize and Parallel may be changed before the first Write
+	PartSize int64
+	Parallel int
+
+	config   S3Config
+	url      string
+	uploadID string
+
+	buf   []byte
+	etags []string
+	sem   chan struct{}
+	wg    sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+// NewS3Writer starts the multipart upload of the object
+func NewS3Writer(config S3Config, bucket string, key string) (*S3Writer, error) {
+	w := &S3Writer{
+		PartSize: DefaultS3PartSize,
+		Parallel: DefaultS3Parallel,
+		config:   config,
+		url:      config.ObjectURL(bucket, key),
+	}
+
+	body, _, err := config.do(http.MethodPost, w.url+"?uploads", nil)
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+		return nil, errors.Join(errors.New("invalid response to create the multipart upload"), err)
+	}
+	w.uploadID = result.UploadID
+	return w, nil
+}
+
+func (w *S3Writer) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *S3Writer) Write(p []byte) (int, error) {
+	if err := w.failed(); err != nil {
+		return 0, err
+	}
+	if w.PartSize < MinS3PartSize {
+		return 0, fmt.Errorf("part size %d is below the minimum of %d", w.PartSize, MinS3PartSize)
+	}
+
+	written := len(p)
+	for len(p) > 0 {
+		n := min(int64(len(p)), w.PartSize-int64(len(w.buf)))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		if int64(len(w.buf)) == w.PartSize {
+			w.uploadPart()
+		}
+	}
+	return written, nil
+}
+
+// uploadPart uploads the buffer as the next part in the background
+func (w *S3Writer) uploadPart() {
+	if w.sem == nil {
+		w.sem = make(chan struct{}, max(w.Parallel, 1))
+	}
+	part, number := w.buf, len(w.etags)+1
+	w.buf = nil
+	w.etags = append(w.etags, "")
+
+	w.sem <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() {
+			<-w.sem
+			w.wg.Done()
+		}()
+
+		partURL := fmt.Sprintf("%s?partNumber=%d&uploadId=%s", w.url, number, url.QueryEscape(w.uploadID))
+		_, header, err := w.config.do(http.MethodPut, partURL, part)
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if err != nil {
+			w.err = errors.Join(w.err, err)
+			return
+		}
+		w.etags[number-1] = header.Get("ETag")
+	}()
+}
+
+// Close uploads the last part and completes the upload, the upload
+// is aborted if any part failed
+func (w *S3Writer) Close() error {
+	if len(w.buf) > 0 || len(w.etags) == 0 {
+		w.uploadPart()
+	}
+	w.wg.Wait()
+	if err := w.failed(); err != nil {
+		return errors.Join(err, w.Abort())
+	}
+
+	type completedPart struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{}
+	for index, etag := range w.etags {
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: index + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	if _, _, err := w.config.do(http.MethodPost, w.url+"?uploadId="+url.QueryEscape(w.uploadID), body); err != nil {
+		return errors.Join(err, w.Abort())
+	}
+	return nil
+}
+
+// Abort drops the uploaded parts, the object is not created
+func (w *S3Writer) Abort() error {
+	w.wg.Wait()
+	_, _, err := w.config.do(http.MethodDelete, w.url+"?uploadId="+url.QueryEscape(w.uploadID), nil)
+	return err
+}
@@ -0,0 +1,327 @@
+// Package vhd reads and writes the fixed and dynamic VHD disks of
+// Virtual PC, Hyper-V and Azure. A fixed disk is the raw guest content
+// followed by a footer, a dynamic disk allocates the guest in blocks.
+package vhd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// Cookie starts the footer, which is at the end of every disk and
+// copied at the start of a dynamic one
+const Cookie = "conectix"
+
+const (
+	sectorSize   = 512
+	dynamicMagic = "cxsparse"
+
+	// the disk types of the footer
+	TypeFixed        = 2
+	TypeDynamic      = 3
+	TypeDifferencing = 4
+
+	// the data offset of the footer of a fixed disk
+	noDataOffset = 0xffffffffffffffff
+	// a block table entry of a block which isn't allocated
+	unusedBlock = 0xffffffff
+
+	// the largest disk of Hyper-V and Azure
+	MaxSize = 2040 << 30
+)
+
+// the bounds of a dynamic header
+const (
+	maxBlockSize    = 256 << 20
+	maxTableEntries = 1 << 24
+)
+
+// the timestamps count seconds from this date
+var epoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Footer is the big endian footer of a disk
+type Footer struct {
+	Cookie             [8]byte
+	Features           uint32
+	FormatVersion      uint32
+	DataOffset         uint64
+	TimeStamp          uint32
+	CreatorApplication [4]byte
+	CreatorVersion     uint32
+	CreatorHostOS      [4]byte
+	OriginalSize       uint64
+	CurrentSize        uint64
+	Cylinders          uint16
+	Heads              uint8
+	SectorsPerTrack    uint8
+	DiskType           uint32
+	Checksum           uint32
+	UniqueID           [16]byte
+	SavedState         uint8
+	Reserved           [427]byte
+}
+
+// DynamicHeader is the big endian header of a dynamic disk, it locates
+// the block allocation table
+type DynamicHeader struct {
+	Cookie               [8]byte
+	DataOffset           uint64
+	TableOffset          uint64
+	HeaderVersion        uint32
+	MaxTableEntries      uint32
+	BlockSize            uint32
+	Checksum             uint32
+	ParentUniqueID       [16]byte
+	ParentTimeStamp      uint32
+	Reserved1            uint32
+	ParentUnicodeName    [512]byte
+	ParentLocatorEntries [8][24]byte
+	Reserved2            [256]byte
+}
+
+// Disk is the guest disk of a fixed or dynamic vhd, it is read only
+type Disk struct {
+	Handler gqcow2.FileHandler
+	Footer  Footer
+	// Header is nil for a fixed disk
+	Header *DynamicHeader
+
+	bat []uint32
+}
+
+// Open opens the disk from its footer at the end of the file, or from
+// the copy at the start of a dynamic disk if the footer is damaged
+func Open(f gqcow2.FileHandler) (*Disk, error) {
+	size, err := gqcow2.HandlerSize(f)
+	if err != nil {
+		return nil, err
+	}
+	if size < sectorSize {
+		return nil, errors.New("the vhd is too small for a footer")
+	}
+
+	d := &Disk{Handler: f}
+	footerErr := readStruct(f, size-sectorSize, &d.Footer)
+	if footerErr == nil {
+		footerErr = d.Footer.check()
+	}
+	if footerErr != nil {
+		if err := readStruct(f, 0, &d.Footer); err != nil || d.Footer.check() != nil ||
+			d.Footer.DiskType == TypeFixed {
+			return nil, footerErr
+		}
+	}
+
+	switch d.Footer.DiskType {
+	case TypeFixed:
+		if d.Footer.CurrentSize > size-sectorSize {
+			return nil, fmt.Errorf("the fixed vhd of %d bytes is smaller than its size %d", size, d.Footer.CurrentSize)
+		}
+		return d, nil
+	case TypeDynamic:
+	case TypeDifferencing:
+		return nil, errors.New("differencing vhd disks are not supported")
+	default:
+		return nil, fmt.Errorf("unsupported vhd disk type %d", d.Footer.DiskType)
+	}
+
+	d.Header = &DynamicHeader{}
+	if err := readStruct(f, d.Footer.DataOffset, d.Header); err != nil {
+		return nil, errors.Join(errors.New("read the vhd dynamic header failed"), err)
+	}
+	if err := d.Header.check(d.Footer.CurrentSize); err != nil {
+		return nil, err
+	}
+
+	bat := make([]byte, d.Header.MaxTableEntries*4)
+	if _, err := gqcow2.ReadFull(f, bat, d.Header.TableOffset); err != nil {
+		return nil, errors.Join(errors.New("read the vhd block allocation table failed"), err)
+	}
+	d.bat = make([]uint32, d.Header.MaxTableEntries)
+	for index := range d.bat {
+		d.bat[index] = binary.BigEndian.Uint32(bat[index*4:])
+	}
+	return d, nil
+}
+
+// OpenFile opens the vhd at path
+func OpenFile(path string) (*Disk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := Open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (footer *Footer) check() error {
+	if string(footer.Cookie[:]) != Cookie {
+		return errors.New("not a vhd footer")
+	}
+	sum := footer.Checksum
+	footer.Checksum = 0
+	defer func() { footer.Checksum = sum }()
+	if checksum(footer) != sum {
+		return errors.New("invalid vhd footer checksum")
+	}
+	return nil
+}
+
+func (h *DynamicHeader) check(size uint64) error {
+	if string(h.Cookie[:]) != dynamicMagic {
+		return errors.New("invalid vhd dynamic header")
+	}
+	sum := h.Checksum
+	h.Checksum = 0
+	defer func() { h.Checksum = sum }()
+	if checksum(h) != sum {
+		return errors.New("invalid vhd dynamic header checksum")
+	}
+	if h.BlockSize < sectorSize || h.BlockSize > maxBlockSize || h.BlockSize&(h.BlockSize-1) != 0 {
+		return fmt.Errorf("invalid vhd block size %d", h.BlockSize)
+	}
+	if h.MaxTableEntries > maxTableEntries || uint64(h.MaxTableEntries)*uint64(h.BlockSize) < size {
+		return fmt.Errorf("invalid vhd block allocation table of %d entries", h.MaxTableEntries)
+	}
+	return nil
+}
+
+// checksum is the one's complement of the sum of the bytes of the big
+// endian struct, whose checksum field is 0
+func checksum(v any) uint32 {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, v)
+	sum := uint32(0)
+	for _, b := range buf.Bytes() {
+		sum += uint32(b)
+	}
+	return ^sum
+}
+
+// VirtualSize is the current size of the footer
+func (d *Disk) VirtualSize() uint64 {
+	return d.Footer.CurrentSize
+}
+
+// Fixed tells if the disk is a fixed one
+func (d *Disk) Fixed() bool {
+	return d.Header == nil
+}
+
+// bitmapSize is the size of the sector bitmap before the data of a block,
+// one bit per sector rounded up to whole sectors
+func bitmapSize(blockSize uint32) uint64 {
+	bitmap := (uint64(blockSize)/sectorSize + 7) / 8
+	return (bitmap + sectorSize - 1) / sectorSize * sectorSize
+}
+
+// Close closes the vhd file
+func (d *Disk) Close() error {
+	return gqcow2.CloseHandler(d.Handler)
+}
+
+// Info reports the vhd like qemu-img info, which names the format vpc
+func (d *Disk) Info(name string) *gqcow2.ImageInfo {
+	size, _ := gqcow2.HandlerSize(d.Handler)
+	info := &gqcow2.ImageInfo{
+		VirtualSize: d.VirtualSize(),
+		Filename:    name,
+		Format:      "vpc",
+		ActualSize:  size,
+	}
+	if d.Header != nil {
+		info.ClusterSize = int(d.Header.BlockSize)
+	}
+	return info
+}
+
+// ReadAt reads the guest content, the blocks which aren't allocated
+// read as zeros
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	size := d.VirtualSize()
+	if off < 0 {
+		return 0, gqcow2.ErrOutOfRange
+	}
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if uint64(off)+uint64(len(p)) > size {
+		p = p[:size-uint64(off)]
+		eof = io.EOF
+	}
+
+	if d.Fixed() {
+		if _, err := gqcow2.ReadFull(d.Handler, p, uint64(off)); err != nil {
+			return 0, errors.Join(fmt.Errorf("read the vhd at %d failed", off), err)
+		}
+		return len(p), eof
+	}
+
+	blockSize := uint64(d.Header.BlockSize)
+	for done := 0; done < len(p); {
+		pos := uint64(off) + uint64(done)
+		index, inBlock := pos/blockSize, pos%blockSize
+		chunk := p[done : done+int(min(blockSize-inBlock, uint64(len(p)-done)))]
+		if entry := d.bat[index]; entry == unusedBlock {
+			clear(chunk)
+		} else {
+			offset := uint64(entry)*sectorSize + bitmapSize(d.Header.BlockSize) + inBlock
+			if _, err := gqcow2.ReadFull(d.Handler, chunk, offset); err != nil {
+				return done, errors.Join(fmt.Errorf("read the vhd block at %d failed", offset), err)
+			}
+		}
+		done += len(chunk)
+	}
+	return len(p), eof
+}
+
+// MapRegions returns the allocated blocks, a fixed disk is a single data
+// region. The offset of a data region is its guest offset.
+func (d *Disk) MapRegions() ([]gqcow2.VirtualDiskRegion, error) {
+	size := d.VirtualSize()
+	if d.Fixed() {
+		if size == 0 {
+			return nil, nil
+		}
+		return []gqcow2.VirtualDiskRegion{{Length: size, Present: true, Data: true}}, nil
+	}
+
+	var regions []gqcow2.VirtualDiskRegion
+	blockSize := uint64(d.Header.BlockSize)
+	for start := uint64(0); start < size; start += blockSize {
+		region := gqcow2.VirtualDiskRegion{Start: start, Length: min(blockSize, size-start)}
+		if d.bat[start/blockSize] == unusedBlock {
+			region.Zero = true
+		} else {
+			region.Present, region.Data, region.Offset = true, true, start
+		}
+
+		if last := len(regions) - 1; last >= 0 && region.SameAs(regions[last]) {
+			regions[last].Length += region.Length
+			continue
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
+
+// readStruct reads the big endian struct at offset
+func readStruct(f gqcow2.FileHandler, offset uint64, v any) error {
+	buf := make([]byte, binary.Size(v))
+	if _, err := gqcow2.ReadFull(f, buf, offset); err != nil {
+		return err
+	}
+	return binary.Read(bytes.NewReader(buf), binary.BigEndian, v)
+}
@@ -0,0 +1,149 @@
+package vhd_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/vhd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// checksum is the one's complement of the byte sum without the checksum
+func checksum(footer []byte) uint32 {
+	sum := uint32(0)
+	for index, b := range footer {
+		if index < 64 || index >= 68 {
+			sum += uint32(b)
+		}
+	}
+	return ^sum
+}
+
+func Test_Write(t *testing.T) {
+	t.Run("Write a fixed disk for Azure",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 4<<20+1000, testimage.Sparse...)
+			var out bytes.Buffer
+			n, err := vhd.Write(image, &out, vhd.Options{Azure: true})
+			require.NoError(t, err)
+			assert.Equal(t, uint64(out.Len()), n)
+			// the size is rounded up to a MiB
+			assert.Equal(t, 5<<20+512, out.Len())
+
+			file := out.Bytes()
+			footer := file[5<<20:]
+			assert.Equal(t, vhd.Cookie, string(footer[:8]))
+			assert.Equal(t, checksum(footer), binary.BigEndian.Uint32(footer[64:]))
+			assert.Equal(t, uint64(5<<20), binary.BigEndian.Uint64(footer[48:]))
+			assert.Equal(t, uint32(vhd.TypeFixed), binary.BigEndian.Uint32(footer[60:]))
+			assert.Equal(t, content, file[:len(content)])
+			assert.Equal(t, make([]byte, 5<<20-len(content)), file[len(content):5<<20])
+
+			d, err := vhd.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			assert.True(t, d.Fixed())
+			assert.Equal(t, uint64(5<<20), d.VirtualSize())
+			// the geometry of the specification
+			assert.Equal(t, uint16(150), d.Footer.Cylinders)
+			assert.Equal(t, uint8(4), d.Footer.Heads)
+			assert.Equal(t, uint8(17), d.Footer.SectorsPerTrack)
+
+			// the damaged footer of a fixed disk has no copy
+			file[5<<20+100] ^= 1
+			_, err = vhd.Open(bytes.NewReader(file))
+			assert.ErrorContains(t, err, "checksum")
+		})
+
+	t.Run("Write a fixed disk into a file, seeking over the holes",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 8<<20, testimage.Sparse...)
+			f, err := os.Create(filepath.Join(t.TempDir(), "disk.vhd"))
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = vhd.Write(image, f, vhd.Options{})
+			require.NoError(t, err)
+
+			d, err := vhd.OpenFile(f.Name())
+			require.NoError(t, err)
+			defer d.Close()
+			guest := make([]byte, 8<<20)
+			_, err = d.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+		})
+
+	t.Run("Write a dynamic disk and read it back",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 8<<20, testimage.Sparse...)
+			var out bytes.Buffer
+			_, err := vhd.Write(image, &out, vhd.Options{Dynamic: true})
+			require.NoError(t, err)
+
+			// the footer, its copy, the header, the table and 2 blocks
+			file := out.Bytes()
+			assert.Equal(t, 512+1024+512+2*(512+2<<20)+512, len(file))
+			assert.Equal(t, file[:512], file[len(file)-512:])
+			assert.Equal(t, "cxsparse", string(file[512:520]))
+
+			d, err := vhd.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			assert.False(t, d.Fixed())
+			guest := make([]byte, 9<<20)
+			n, err := d.ReadAt(guest, 0)
+			assert.Equal(t, io.EOF, err)
+			assert.Equal(t, content, guest[:n])
+
+			regions, err := gqcow2.Map(d)
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 4 << 20, Present: true, Data: true},
+				{Start: 4 << 20, Length: 4 << 20, Zero: true},
+			}, regions)
+
+			// the copy at the start is used if the footer is damaged
+			file[len(file)-100] ^= 1
+			d, err = vhd.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			_, err = d.ReadAt(guest[:n], 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest[:n])
+		})
+
+	t.Run("Write a dynamic disk with blocks smaller than a bitmap sector",
+		func(t *testing.T) {
+			content := make([]byte, 8192)
+			rand.Read(content)
+			var out bytes.Buffer
+			_, err := vhd.Write(gqcow2.NewRawDisk(bytes.NewReader(content), 8192), &out, vhd.Options{Dynamic: true, BlockSize: 1024})
+			require.NoError(t, err)
+
+			// a block still has a whole sector of bitmap before its data
+			file := out.Bytes()
+			assert.Equal(t, 512+1024+512+8*(512+1024)+512, len(file))
+			first := int(binary.BigEndian.Uint32(file[1536:])) * 512
+			assert.Equal(t, byte(0xff), file[first])
+			assert.Equal(t, content[:1024], file[first+512:first+1536])
+
+			d, err := vhd.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			guest := make([]byte, 8192)
+			_, err = d.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+		})
+
+	t.Run("Refuse a disk larger than the vhd limit",
+		func(t *testing.T) {
+			_, err := vhd.Write(gqcow2.NewRawDisk(bytes.NewReader(nil), 3<<40), io.Discard, vhd.Options{})
+			assert.Error(t, err)
+		})
+}
@@ -0,0 +1,282 @@
+package vhd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+const (
+	// the block size of Hyper-V and qemu
+	DefaultBlockSize = 2 << 20
+	// Azure takes fixed disks whose size is a whole number of MiB
+	azureAlignment = 1 << 20
+
+	formatVersion  = 0x00010000
+	headerVersion  = 0x00010000
+	featureDefault = 0x2
+	dynamicOffset  = sectorSize
+	tableOffset    = dynamicOffset + 1024
+)
+
+// the largest geometry, larger disks are described by their size only
+const maxGeometrySectors = 65535 * 16 * 255
+
+// Options describe the written disk
+type Options struct {
+	// Dynamic writes a dynamic disk which only allocates the blocks
+	// holding data in the source, instead of a fixed disk
+	Dynamic bool
+
+	// BlockSize of a dynamic disk, DefaultBlockSize if 0
+	BlockSize uint32
+
+	// Azure rounds the size up to a whole MiB as Azure requires, the
+	// disk must be fixed to be uploaded
+	Azure bool
+}
+
+// Write writes the guest content of source as a vhd into w in a single
+// forward pass, w needs no seeking, e.g. a page blob upload. The size is
+// the one of the source rounded up to a sector, or to a MiB for Azure.
+//
+// A fixed disk is the guest content followed by the footer, the regions
+// of the source which read as zeros are skipped by seeking if w is a
+// file. A dynamic disk has a copy of the footer, its dynamic header and
+// the block allocation table computed from the region map of the source,
+// then the allocated blocks in guest order and the footer. It returns the
+// number of bytes written.
+func Write(source gqcow2.BackingDisk, w io.Writer, opts Options) (uint64, error) {
+	alignment := uint64(sectorSize)
+	if opts.Azure {
+		alignment = azureAlignment
+	}
+	size := (source.VirtualSize() + alignment - 1) / alignment * alignment
+	if size > MaxSize {
+		return 0, fmt.Errorf("the vhd size %d is larger than %d", size, uint64(MaxSize))
+	}
+	if opts.BlockSize == 0 {
+		opts.BlockSize = DefaultBlockSize
+	}
+	if opts.BlockSize < sectorSize || opts.BlockSize > maxBlockSize || opts.BlockSize&(opts.BlockSize-1) != 0 {
+		return 0, fmt.Errorf("invalid vhd block size %d", opts.BlockSize)
+	}
+
+	regions, err := gqcow2.Map(source)
+	if err != nil {
+		return 0, err
+	}
+
+	footer := newFooter(size, opts.Dynamic)
+	cw := &countingWriter{w: w}
+	if opts.Dynamic {
+		err = writeDynamic(cw, source, regions, &footer, opts.BlockSize)
+	} else {
+		err = writeFixed(cw, source, regions, size)
+	}
+	if err != nil {
+		return cw.n, err
+	}
+	if err := binary.Write(cw, binary.BigEndian, &footer); err != nil {
+		return cw.n, err
+	}
+	return cw.n, nil
+}
+
+// newFooter describes a new disk with its checksum
+func newFooter(size uint64, dynamic bool) Footer {
+	footer := Footer{
+		Features:       featureDefault,
+		FormatVersion:  formatVersion,
+		DataOffset:     noDataOffset,
+		TimeStamp:      uint32(time.Since(epoch) / time.Second),
+		CreatorVersion: formatVersion,
+		OriginalSize:   size,
+		CurrentSize:    size,
+		DiskType:       TypeFixed,
+	}
+	copy(footer.Cookie[:], Cookie)
+	copy(footer.CreatorApplication[:], "gqc2")
+	copy(footer.CreatorHostOS[:], "Wi2k")
+	footer.Cylinders, footer.Heads, footer.SectorsPerTrack = geometry(size)
+	rand.Read(footer.UniqueID[:])
+	if dynamic {
+		footer.DataOffset = dynamicOffset
+		footer.DiskType = TypeDynamic
+	}
+	footer.Checksum = checksum(&footer)
+	return footer
+}
+
+// geometry computes the CHS of the size like the appendix of the vhd
+// specification, which Hyper-V and Azure check
+func geometry(size uint64) (uint16, uint8, uint8) {
+	totalSectors := min(size/sectorSize, maxGeometrySectors)
+
+	var sectorsPerTrack, heads, cylinderTimesHeads uint64
+	if totalSectors >= 65535*16*63 {
+		sectorsPerTrack, heads = 255, 16
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+	} else {
+		sectorsPerTrack = 17
+		cylinderTimesHeads = totalSectors / sectorsPerTrack
+		heads = max((cylinderTimesHeads+1023)/1024, 4)
+		if cylinderTimesHeads >= heads*1024 || heads > 16 {
+			sectorsPerTrack, heads = 31, 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+		if cylinderTimesHeads >= heads*1024 {
+			sectorsPerTrack, heads = 63, 16
+			cylinderTimesHeads = totalSectors / sectorsPerTrack
+		}
+	}
+	return uint16(cylinderTimesHeads / heads), uint8(heads), uint8(sectorsPerTrack)
+}
+
+// writeFixed writes the guest content as the size bytes before the footer
+func writeFixed(cw *countingWriter, source gqcow2.BackingDisk, regions []gqcow2.VirtualDiskRegion, size uint64) error {
+	buf := make([]byte, copyChunkSize)
+	for _, r := range regions {
+		if !r.Data {
+			if err := cw.skip(r.Length); err != nil {
+				return err
+			}
+			continue
+		}
+		for offset := r.Start; offset < r.Start+r.Length; {
+			chunk := buf[:min(r.Start+r.Length-offset, uint64(len(buf)))]
+			if _, err := source.ReadAt(chunk, int64(offset)); err != nil && err != io.EOF {
+				return err
+			}
+			if _, err := cw.Write(chunk); err != nil {
+				return err
+			}
+			offset += uint64(len(chunk))
+		}
+	}
+	// the size is rounded up with zeros
+	return cw.skip(size - cw.n)
+}
+
+// writeDynamic writes the footer copy, the dynamic header, the block
+// allocation table and the blocks holding data
+func writeDynamic(cw *countingWriter, source gqcow2.BackingDisk, regions []gqcow2.VirtualDiskRegion,
+	footer *Footer, blockSize uint32) error {
+	size := footer.CurrentSize
+	entries := (size + uint64(blockSize) - 1) / uint64(blockSize)
+	bitmapLength := bitmapSize(blockSize)
+	tableSize := (entries*4 + sectorSize - 1) / sectorSize * sectorSize
+
+	var blocks []uint64
+	for _, r := range regions {
+		if !r.Data {
+			continue
+		}
+		first := r.Start / uint64(blockSize)
+		if n := len(blocks); n > 0 && blocks[n-1] >= first {
+			first = blocks[n-1] + 1
+		}
+		for index := first; index < (r.Start+r.Length+uint64(blockSize)-1)/uint64(blockSize); index++ {
+			blocks = append(blocks, index)
+		}
+	}
+
+	h := DynamicHeader{
+		DataOffset:      noDataOffset,
+		TableOffset:     tableOffset,
+		HeaderVersion:   headerVersion,
+		MaxTableEntries: uint32(entries),
+		BlockSize:       blockSize,
+	}
+	copy(h.Cookie[:], dynamicMagic)
+	h.Checksum = checksum(&h)
+
+	bat := make([]byte, tableSize)
+	for index := range entries {
+		binary.BigEndian.PutUint32(bat[index*4:], unusedBlock)
+	}
+	offset := uint64(tableOffset) + tableSize
+	for _, index := range blocks {
+		binary.BigEndian.PutUint32(bat[index*4:], uint32(offset/sectorSize))
+		offset += bitmapLength + uint64(blockSize)
+	}
+
+	if err := binary.Write(cw, binary.BigEndian, footer); err != nil {
+		return err
+	}
+	if err := binary.Write(cw, binary.BigEndian, &h); err != nil {
+		return err
+	}
+	if _, err := cw.Write(bat); err != nil {
+		return err
+	}
+
+	// every sector of a block is marked as written
+	bitmap := bytes.Repeat([]byte{0xff}, int(bitmapLength))
+	block := make([]byte, blockSize)
+	for _, index := range blocks {
+		start := index * uint64(blockSize)
+		clear(block)
+		if _, err := source.ReadAt(block[:min(uint64(blockSize), source.VirtualSize()-start)], int64(start)); err != nil && err != io.EOF {
+			return err
+		}
+		if _, err := cw.Write(bitmap); err != nil {
+			return err
+		}
+		if _, err := cw.Write(block); err != nil {
+			return err
+		}
+	}
+	if offset != cw.n {
+		return errors.New("the vhd blocks don't match the block allocation table")
+	}
+	return nil
+}
+
+// the chunks of the guest content copied into a fixed disk
+const copyChunkSize = 4 << 20
+
+// countingWriter counts the bytes written through it, the holes of a
+// fixed disk are skipped by seeking if the writer can
+type countingWriter struct {
+	w     io.Writer
+	n     uint64
+	zeros []byte
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// skip writes length zeros, a file is extended by the footer
+func (c *countingWriter) skip(length uint64) error {
+	if length == 0 {
+		return nil
+	}
+	if s, ok := c.w.(io.Seeker); ok {
+		// a pipe can't seek
+		if _, err := s.Seek(int64(length), io.SeekCurrent); err == nil {
+			c.n += length
+			return nil
+		}
+	}
+	if c.zeros == nil {
+		c.zeros = make([]byte, copyChunkSize)
+	}
+	for length > 0 {
+		n, err := c.Write(c.zeros[:min(length, uint64(len(c.zeros)))])
+		if err != nil {
+			return err
+		}
+		length -= uint64(n)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+// Package vhdx reads the VHDX disks of Hyper-V. The file starts with two
+// headers and two region tables locating the block allocation table and
+// the metadata, the guest is allocated in blocks of at least 1MiB.
+package vhdx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// Signature starts the file type identifier at the start of the file
+const Signature = "vhdxfile"
+
+const (
+	headerSignature   = "head"
+	regionSignature   = "regi"
+	metadataSignature = "metadata"
+
+	header1Offset = 64 << 10
+	header2Offset = 128 << 10
+	headerSize    = 4 << 10
+	region1Offset = 192 << 10
+	region2Offset = 256 << 10
+	regionSize    = 64 << 10
+	metadataSize  = 64 << 10
+
+	maxTableEntries = 2047
+	headerVersion   = 1
+	mib             = 1 << 20
+
+	// the flags of the entries
+	regionRequired   = 1 << 0
+	metadataRequired = 1 << 2
+	hasParent        = 1 << 1
+)
+
+// the states of a payload block in the block allocation table
+const (
+	blockNotPresent       = 0
+	blockUndefined        = 1
+	blockZero             = 2
+	blockUnmapped         = 3
+	blockFullyPresent     = 6
+	blockPartiallyPresent = 7
+)
+
+// the bounds of the metadata
+const (
+	minBlockSize = 1 << 20
+	maxBlockSize = 256 << 20
+	maxSize      = 64 << 40
+)
+
+var (
+	batRegion      = guid("2DC27766-F623-4200-9D64-115E9BFD4A08")
+	metadataRegion = guid("8B7CA206-4790-4B9A-B8FE-575F050F886E")
+
+	fileParameters     = guid("CAA16737-FA36-4D43-B3B6-33F0AA44E76B")
+	virtualDiskSize    = guid("2FA54224-CD1B-4876-B211-5DBED83BF4B8")
+	virtualDiskID      = guid("BECA12AB-B2E6-4523-93EF-C309E000C746")
+	logicalSectorSize  = guid("8141BF1D-A96F-4709-BA47-F233A8FAAB5F")
+	physicalSectorSize = guid("CDA348C7-445D-4471-9CC9-E9885251C556")
+	parentLocator      = guid("A8D35F2D-B30B-454D-ABF7-D3D84834AB0C")
+
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// guid returns the mixed endian bytes of the guid as stored in the file
+func guid(s string) [16]byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid guid " + s)
+	}
+	var g [16]byte
+	binary.LittleEndian.PutUint32(g[0:], binary.BigEndian.Uint32(b[0:]))
+	binary.LittleEndian.PutUint16(g[4:], binary.BigEndian.Uint16(b[4:]))
+	binary.LittleEndian.PutUint16(g[6:], binary.BigEndian.Uint16(b[6:]))
+	copy(g[8:], b[8:])
+	return g
+}
+
+// Header is one of the two headers, the current one has the largest
+// sequence number
+type Header struct {
+	Signature      [4]byte
+	Checksum       uint32
+	SequenceNumber uint64
+	FileWriteGUID  [16]byte
+	DataWriteGUID  [16]byte
+	LogGUID        [16]byte
+	LogVersion     uint16
+	Version        uint16
+	LogLength      uint32
+	LogOffset      uint64
+}
+
+type regionEntry struct {
+	GUID       [16]byte
+	FileOffset uint64
+	Length     uint32
+	Required   uint32
+}
+
+type metadataEntry struct {
+	ItemID   [16]byte
+	Offset   uint32
+	Length   uint32
+	Flags    uint32
+	Reserved uint32
+}
+
+// Disk is the guest disk of a vhdx, it is read only
+type Disk struct {
+	Handler gqcow2.FileHandler
+	Header  Header
+
+	BlockSize         uint32
+	LogicalSectorSize uint32
+	Size              uint64
+
+	chunkRatio uint64
+	bat        []uint64
+}
+
+// Open opens the vhdx by its current header, a disk whose log must be
+// replayed or which has a parent is refused
+func Open(f gqcow2.FileHandler) (*Disk, error) {
+	signature := make([]byte, 8)
+	if _, err := gqcow2.ReadFull(f, signature, 0); err != nil || string(signature) != Signature {
+		return nil, errors.New("not a vhdx file")
+	}
+
+	d := &Disk{Handler: f}
+	if err := d.readHeader(); err != nil {
+		return nil, err
+	}
+	if d.Header.LogGUID != [16]byte{} {
+		return nil, errors.New("the vhdx has a log to replay, it was not closed cleanly")
+	}
+
+	regions, err := readRegions(f)
+	if err != nil {
+		return nil, err
+	}
+	bat, ok := regions[batRegion]
+	if !ok {
+		return nil, errors.New("the vhdx has no block allocation table")
+	}
+	metadata, ok := regions[metadataRegion]
+	if !ok {
+		return nil, errors.New("the vhdx has no metadata")
+	}
+	if err := d.readMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if err := d.readBAT(bat); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// OpenFile opens the vhdx at path
+func OpenFile(path string) (*Disk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := Open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// validChecksum checks the crc32c of the structure, its checksum is at 4
+func validChecksum(buf []byte) bool {
+	checksum := binary.LittleEndian.Uint32(buf[4:])
+	binary.LittleEndian.PutUint32(buf[4:], 0)
+	defer binary.LittleEndian.PutUint32(buf[4:], checksum)
+	return crc32.Checksum(buf, castagnoli) == checksum
+}
+
+// readHeader reads the valid header with the largest sequence number
+func (d *Disk) readHeader() error {
+	found := false
+	for _, offset := range []uint64{header1Offset, header2Offset} {
+		buf := make([]byte, headerSize)
+		if _, err := gqcow2.ReadFull(d.Handler, buf, offset); err != nil {
+			return errors.Join(errors.New("read the vhdx header failed"), err)
+		}
+		if string(buf[:4]) != headerSignature || !validChecksum(buf) {
+			continue
+		}
+		var h Header
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+			return err
+		}
+		if h.Version != headerVersion {
+			continue
+		}
+		if !found || h.SequenceNumber > d.Header.SequenceNumber {
+			d.Header, found = h, true
+		}
+	}
+	if !found {
+		return errors.New("the vhdx has no valid header")
+	}
+	return nil
+}
+
+// readRegions returns the regions of the first valid region table
+func readRegions(f gqcow2.FileHandler) (map[[16]byte]regionEntry, error) {
+	for _, offset := range []uint64{region1Offset, region2Offset} {
+		buf := make([]byte, regionSize)
+		if _, err := gqcow2.ReadFull(f, buf, offset); err != nil {
+			return nil, errors.Join(errors.New("read the vhdx region table failed"), err)
+		}
+		count := binary.LittleEndian.Uint32(buf[8:])
+		if string(buf[:4]) != regionSignature || !validChecksum(buf) || count > maxTableEntries {
+			continue
+		}
+
+		regions := map[[16]byte]regionEntry{}
+		for index := range int(count) {
+			var e regionEntry
+			if err := binary.Read(bytes.NewReader(buf[16+index*32:]), binary.LittleEndian, &e); err != nil {
+				return nil, err
+			}
+			if e.GUID != batRegion && e.GUID != metadataRegion && e.Required&regionRequired != 0 {
+				return nil, fmt.Errorf("unsupported required vhdx region %x", e.GUID)
+			}
+			if e.FileOffset%mib != 0 || e.FileOffset < mib || e.Length == 0 || e.Length%mib != 0 {
+				return nil, fmt.Errorf("invalid vhdx region at %d", e.FileOffset)
+			}
+			regions[e.GUID] = e
+		}
+		return regions, nil
+	}
+	return nil, errors.New("the vhdx has no valid region table")
+}
+
+// readMetadata reads the block size, the sector size and the size of
+// the disk
+func (d *Disk) readMetadata(region regionEntry) error {
+	buf := make([]byte, min(uint64(region.Length), metadataSize))
+	if _, err := gqcow2.ReadFull(d.Handler, buf, region.FileOffset); err != nil {
+		return errors.Join(errors.New("read the vhdx metadata failed"), err)
+	}
+	count := int(binary.LittleEndian.Uint16(buf[10:]))
+	if string(buf[:8]) != metadataSignature || count > maxTableEntries {
+		return errors.New("invalid vhdx metadata table")
+	}
+
+	items := map[[16]byte][]byte{}
+	for index := range count {
+		var e metadataEntry
+		if err := binary.Read(bytes.NewReader(buf[32+index*32:]), binary.LittleEndian, &e); err != nil {
+			return err
+		}
+		switch e.ItemID {
+		case fileParameters, virtualDiskSize, virtualDiskID, logicalSectorSize, physicalSectorSize:
+		case parentLocator:
+			return errors.New("differencing vhdx disks are not supported")
+		default:
+			if e.Flags&metadataRequired != 0 {
+				return fmt.Errorf("unsupported required vhdx metadata %x", e.ItemID)
+			}
+			continue
+		}
+		if uint64(e.Offset)+uint64(e.Length) > uint64(region.Length) {
+			return fmt.Errorf("invalid vhdx metadata item %x", e.ItemID)
+		}
+		item := make([]byte, e.Length)
+		if _, err := gqcow2.ReadFull(d.Handler, item, region.FileOffset+uint64(e.Offset)); err != nil {
+			return errors.Join(errors.New("read the vhdx metadata failed"), err)
+		}
+		items[e.ItemID] = item
+	}
+
+	parameters, size, sectorSize := items[fileParameters], items[virtualDiskSize], items[logicalSectorSize]
+	if len(parameters) < 8 || len(size) < 8 || len(sectorSize) < 4 {
+		return errors.New("the vhdx metadata is incomplete")
+	}
+	if binary.LittleEndian.Uint32(parameters[4:])&hasParent != 0 {
+		return errors.New("differencing vhdx disks are not supported")
+	}
+	d.BlockSize = binary.LittleEndian.Uint32(parameters)
+	d.LogicalSectorSize = binary.LittleEndian.Uint32(sectorSize)
+	d.Size = binary.LittleEndian.Uint64(size)
+
+	if d.BlockSize < minBlockSize || d.BlockSize > maxBlockSize || d.BlockSize&(d.BlockSize-1) != 0 {
+		return fmt.Errorf("invalid vhdx block size %d", d.BlockSize)
+	}
+	if d.LogicalSectorSize != 512 && d.LogicalSectorSize != 4096 {
+		return fmt.Errorf("invalid vhdx logical sector size %d", d.LogicalSectorSize)
+	}
+	if d.Size > maxSize || d.Size%uint64(d.LogicalSectorSize) != 0 {
+		return fmt.Errorf("invalid vhdx size %d", d.Size)
+	}
+	// a sector bitmap block covers this many payload blocks
+	d.chunkRatio = (1 << 23) * uint64(d.LogicalSectorSize) / uint64(d.BlockSize)
+	return nil
+}
+
+// readBAT reads the entries of the payload blocks, a sector bitmap
+// entry follows every chunk of payload entries
+func (d *Disk) readBAT(region regionEntry) error {
+	blocks := (d.Size + uint64(d.BlockSize) - 1) / uint64(d.BlockSize)
+	if blocks == 0 {
+		return nil
+	}
+	entries := blocks + (blocks-1)/d.chunkRatio
+	if entries*8 > uint64(region.Length) {
+		return errors.New("the vhdx block allocation table is too small")
+	}
+
+	buf := make([]byte, entries*8)
+	if _, err := gqcow2.ReadFull(d.Handler, buf, region.FileOffset); err != nil {
+		return errors.Join(errors.New("read the vhdx block allocation table failed"), err)
+	}
+	d.bat = make([]uint64, blocks)
+	for index := range d.bat {
+		d.bat[index] = binary.LittleEndian.Uint64(buf[(uint64(index)+uint64(index)/d.chunkRatio)*8:])
+	}
+	return nil
+}
+
+// VirtualSize is the size of the disk
+func (d *Disk) VirtualSize() uint64 {
+	return d.Size
+}
+
+// Close closes the vhdx file
+func (d *Disk) Close() error {
+	return gqcow2.CloseHandler(d.Handler)
+}
+
+// Info reports the vhdx like qemu-img info, the cluster size is a block
+func (d *Disk) Info(name string) *gqcow2.ImageInfo {
+	size, _ := gqcow2.HandlerSize(d.Handler)
+	return &gqcow2.ImageInfo{
+		VirtualSize: d.Size,
+		Filename:    name,
+		ClusterSize: int(d.BlockSize),
+		Format:      "vhdx",
+		ActualSize:  size,
+	}
+}
+
+// ReadAt reads the guest content, the blocks which aren't fully
+// present read as zeros
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, gqcow2.ErrOutOfRange
+	}
+	if uint64(off) >= d.Size {
+		return 0, io.EOF
+	}
+	var eof error
+	if uint64(off)+uint64(len(p)) > d.Size {
+		p = p[:d.Size-uint64(off)]
+		eof = io.EOF
+	}
+
+	blockSize := uint64(d.BlockSize)
+	for done := 0; done < len(p); {
+		pos := uint64(off) + uint64(done)
+		index, inBlock := pos/blockSize, pos%blockSize
+		chunk := p[done : done+int(min(blockSize-inBlock, uint64(len(p)-done)))]
+
+		entry := d.bat[index]
+		switch entry & 0x7 {
+		case blockFullyPresent:
+			offset := (entry>>20)*mib + inBlock
+			if _, err := gqcow2.ReadFull(d.Handler, chunk, offset); err != nil {
+				return done, errors.Join(fmt.Errorf("read the vhdx block at %d failed", offset), err)
+			}
+		case blockNotPresent, blockUndefined, blockZero, blockUnmapped:
+			clear(chunk)
+		default:
+			return done, fmt.Errorf("invalid vhdx block state %d", entry&0x7)
+		}
+		done += len(chunk)
+	}
+	return len(p), eof
+}
+
+// MapRegions returns the allocation of the blocks, the offset of a data
+// region is its guest offset
+func (d *Disk) MapRegions() ([]gqcow2.VirtualDiskRegion, error) {
+	var regions []gqcow2.VirtualDiskRegion
+	blockSize := uint64(d.BlockSize)
+	for start := uint64(0); start < d.Size; start += blockSize {
+		region := gqcow2.VirtualDiskRegion{Start: start, Length: min(blockSize, d.Size-start)}
+		switch state := d.bat[start/blockSize] & 0x7; state {
+		case blockFullyPresent:
+			region.Present, region.Data, region.Offset = true, true, start
+		case blockZero:
+			region.Present, region.Zero = true, true
+		case blockNotPresent, blockUndefined, blockUnmapped:
+			region.Zero = true
+		default:
+			return nil, fmt.Errorf("invalid vhdx block state %d", state)
+		}
+
+		if last := len(regions) - 1; last >= 0 && region.SameAs(regions[last]) {
+			regions[last].Length += region.Length
+			continue
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
@@ -0,0 +1,149 @@
+package vhdx_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"testing"
+
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/vhdx"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var le = binary.LittleEndian
+
+// the guids as stored in the file
+var (
+	batRegion      = []byte{0x66, 0x77, 0xc2, 0x2d, 0x23, 0xf6, 0x00, 0x42, 0x9d, 0x64, 0x11, 0x5e, 0x9b, 0xfd, 0x4a, 0x08}
+	metadataRegion = []byte{0x06, 0xa2, 0x7c, 0x8b, 0x90, 0x47, 0x9a, 0x4b, 0xb8, 0xfe, 0x57, 0x5f, 0x05, 0x0f, 0x88, 0x6e}
+	fileParameters = []byte{0x37, 0x67, 0xa1, 0xca, 0x36, 0xfa, 0x43, 0x4d, 0xb3, 0xb6, 0x33, 0xf0, 0xaa, 0x44, 0xe7, 0x6b}
+	diskSize       = []byte{0x24, 0x42, 0xa5, 0x2f, 0x1b, 0xcd, 0x76, 0x48, 0xb2, 0x11, 0x5d, 0xbe, 0xd8, 0x3b, 0xf4, 0xb8}
+	sectorSize     = []byte{0x1d, 0xbf, 0x41, 0x81, 0x6f, 0xa9, 0x09, 0x47, 0xba, 0x47, 0xf2, 0x33, 0xa8, 0xfa, 0xab, 0x5f}
+)
+
+func putChecksum(buf []byte) {
+	le.PutUint32(buf[4:], 0)
+	le.PutUint32(buf[4:], crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli)))
+}
+
+// putVHDX builds a vhdx of the content with 1MiB blocks, the BAT is at
+// 1MiB, the metadata at 2MiB and the blocks from 3MiB. The states are
+// the ones of the blocks, fully present blocks hold their content.
+func putVHDX(content []byte, states []uint64) []byte {
+	file := make([]byte, 3<<20)
+	copy(file, "vhdxfile")
+
+	// the second header is the current one
+	for index, sequence := range []uint64{1, 2} {
+		h := file[(64<<10)*(index+1):]
+		copy(h, "head")
+		le.PutUint64(h[8:], sequence)
+		le.PutUint16(h[66:], 1)
+		putChecksum(h[:4096])
+	}
+
+	for _, offset := range []int{192 << 10, 256 << 10} {
+		r := file[offset:]
+		copy(r, "regi")
+		le.PutUint32(r[8:], 2)
+		copy(r[16:], batRegion)
+		le.PutUint64(r[32:], 1<<20)
+		le.PutUint32(r[40:], 1<<20)
+		le.PutUint32(r[44:], 1)
+		copy(r[48:], metadataRegion)
+		le.PutUint64(r[64:], 2<<20)
+		le.PutUint32(r[72:], 1<<20)
+		le.PutUint32(r[76:], 1)
+		putChecksum(r[:64<<10])
+	}
+
+	m := file[2<<20:]
+	copy(m, "metadata")
+	le.PutUint16(m[10:], 3)
+	for index, item := range [][]byte{fileParameters, diskSize, sectorSize} {
+		e := m[32+index*32:]
+		copy(e, item)
+		le.PutUint32(e[16:], uint32(64<<10+index*8))
+		le.PutUint32(e[20:], 8)
+		le.PutUint32(e[24:], 1<<2)
+	}
+	le.PutUint32(m[64<<10:], 1<<20)
+	le.PutUint64(m[64<<10+8:], uint64(len(content)))
+	le.PutUint32(m[64<<10+16:], 512)
+
+	for index, state := range states {
+		entry := state
+		if state == 6 {
+			entry |= uint64(len(file)>>20) << 20
+			block := make([]byte, 1<<20)
+			copy(block, content[index<<20:])
+			file = append(file, block...)
+		}
+		le.PutUint64(file[1<<20+index*8:], entry)
+	}
+	return file
+}
+
+func Test_Open(t *testing.T) {
+	content := make([]byte, 4<<20-4096)
+	rand.Read(content[:1<<20])
+	rand.Read(content[3<<20:])
+	states := []uint64{6, 0, 2, 6}
+
+	d, err := vhdx.Open(bytes.NewReader(putVHDX(content, states)))
+	require.NoError(t, err)
+	defer d.Close()
+
+	assert.Equal(t, uint64(2), d.Header.SequenceNumber)
+	assert.Equal(t, uint32(1<<20), d.BlockSize)
+	assert.Equal(t, uint64(len(content)), d.VirtualSize())
+	guest := make([]byte, 5<<20)
+	n, err := d.ReadAt(guest, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, len(content), n)
+	assert.Equal(t, content, guest[:n])
+
+	regions, err := gqcow2.Map(d)
+	require.NoError(t, err)
+	assert.Equal(t, []gqcow2.VirtualDiskRegion{
+		{Start: 0, Length: 1 << 20, Present: true, Data: true},
+		{Start: 1 << 20, Length: 1 << 20, Zero: true},
+		{Start: 2 << 20, Length: 1 << 20, Present: true, Zero: true},
+		{Start: 3 << 20, Length: 1<<20 - 4096, Present: true, Data: true, Offset: 3 << 20},
+	}, regions)
+
+	t.Run("Use the other header and region table if one is damaged",
+		func(t *testing.T) {
+			file := putVHDX(content, states)
+			file[128<<10+100] ^= 1
+			file[192<<10+100] ^= 1
+			d, err := vhdx.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			assert.Equal(t, uint64(1), d.Header.SequenceNumber)
+			_, err = d.ReadAt(guest[:len(content)], 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest[:len(content)])
+		})
+
+	t.Run("Refuse a disk with a log to replay",
+		func(t *testing.T) {
+			file := putVHDX(content, states)
+			for _, offset := range []int{64 << 10, 128 << 10} {
+				file[offset+48] = 1
+				putChecksum(file[offset : offset+4096])
+			}
+			_, err := vhdx.Open(bytes.NewReader(file))
+			assert.ErrorContains(t, err, "log")
+		})
+
+	t.Run("Refuse a vhd",
+		func(t *testing.T) {
+			_, err := vhdx.Open(bytes.NewReader(make([]byte, 1<<20)))
+			assert.Error(t, err)
+		})
+}
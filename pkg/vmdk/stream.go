@@ -0,0 +1,263 @@
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// the layout of the written disks, like the ones of VMware
+const (
+	streamGrainSize    = 128
+	streamGTEsPerGT    = 512
+	streamVersion      = 3
+	descriptorSectors  = 20
+	gtSectors          = streamGTEsPerGT * 4 / sectorSize
+	streamMarkerHeader = 12
+)
+
+// a marker of metadata takes a whole sector
+type metadataMarker struct {
+	NumSectors uint64
+	Size       uint32
+	Type       uint32
+}
+
+// streamWriter writes the sectors of a streamOptimized disk in order
+type streamWriter struct {
+	w   io.Writer
+	n   uint64
+	pad []byte
+
+	gd      []uint32
+	gt      []uint32
+	gtIndex int64
+}
+
+// WriteStreamOptimized writes the guest content of source as a
+// streamOptimized vmdk into w in a single forward pass, w needs no
+// seeking, e.g. an OVA being written or an upload. The grains are found
+// from the region map of the source, so the unallocated regions of an
+// image are skipped, the grains which read as zeros are left out and the
+// others are compressed. Every grain table follows its grains and the
+// grain directory is found by the footer. name is the extent file name
+// of the descriptor, the size is rounded up to sectors. It returns the
+// number of bytes written.
+func WriteStreamOptimized(source gqcow2.BackingDisk, w io.Writer, name string) (uint64, error) {
+	size := source.VirtualSize()
+	grainBytes := uint64(streamGrainSize * sectorSize)
+	capacity := (size + sectorSize - 1) / sectorSize
+	grains := (capacity + streamGrainSize - 1) / streamGrainSize
+
+	h := Header{
+		Magic:              magic,
+		Version:            streamVersion,
+		Flags:              flagNewlineTest | flagCompressed | flagMarkers,
+		Capacity:           capacity,
+		GrainSize:          streamGrainSize,
+		DescriptorOffset:   1,
+		DescriptorSize:     descriptorSectors,
+		NumGTEsPerGT:       streamGTEsPerGT,
+		GDOffset:           gdAtEnd,
+		OverHead:           streamGrainSize,
+		SingleEndLineChar:  '\n',
+		NonEndLineChar:     ' ',
+		DoubleEndLineChar1: '\r',
+		DoubleEndLineChar2: '\n',
+		CompressAlgorithm:  compressionDeflate,
+	}
+	descriptor := streamDescriptor(capacity, name)
+	if len(descriptor) > descriptorSectors*sectorSize {
+		return 0, fmt.Errorf("the extent name %s is too long", name)
+	}
+
+	sw := &streamWriter{
+		w:       w,
+		pad:     make([]byte, sectorSize),
+		gd:      make([]uint32, (grains+streamGTEsPerGT-1)/streamGTEsPerGT),
+		gt:      make([]uint32, streamGTEsPerGT),
+		gtIndex: -1,
+	}
+	if err := sw.writeStruct(&h); err != nil {
+		return sw.n, err
+	}
+	// the grains start after the overhead
+	head := make([]byte, (h.OverHead-1)*sectorSize)
+	copy(head, descriptor)
+	if err := sw.writeSectors(head); err != nil {
+		return sw.n, err
+	}
+
+	regions, err := gqcow2.Map(source)
+	if err != nil {
+		return sw.n, err
+	}
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	buf := make([]byte, grainBytes)
+	next := uint64(0)
+	for _, r := range regions {
+		if !r.Data {
+			continue
+		}
+		first := max(r.Start/grainBytes, next)
+		next = max(next, (r.Start+r.Length+grainBytes-1)/grainBytes)
+		for index := first; index < next; index++ {
+			start := index * grainBytes
+			clear(buf)
+			if _, err := source.ReadAt(buf[:min(grainBytes, size-start)], int64(start)); err != nil && err != io.EOF {
+				return sw.n, err
+			}
+			if isZero(buf) {
+				continue
+			}
+
+			compressed.Reset()
+			zw.Reset(&compressed)
+			if _, err := zw.Write(buf); err != nil {
+				return sw.n, err
+			}
+			if err := zw.Close(); err != nil {
+				return sw.n, err
+			}
+			if err := sw.writeGrain(index, compressed.Bytes()); err != nil {
+				return sw.n, err
+			}
+		}
+	}
+	if err := sw.flushTable(); err != nil {
+		return sw.n, err
+	}
+
+	h.GDOffset = sw.n/sectorSize + 1
+	gd := make([]byte, len(sw.gd)*4)
+	for index, sector := range sw.gd {
+		binary.LittleEndian.PutUint32(gd[index*4:], sector)
+	}
+	gdSectors := (uint64(len(gd)) + sectorSize - 1) / sectorSize
+	if err := sw.writeMarker(metadataMarker{NumSectors: gdSectors, Type: markerGD}); err != nil {
+		return sw.n, err
+	}
+	if err := sw.writeSectors(gd); err != nil {
+		return sw.n, err
+	}
+	if err := sw.writeMarker(metadataMarker{NumSectors: 1, Type: markerFooter}); err != nil {
+		return sw.n, err
+	}
+	if err := sw.writeStruct(&h); err != nil {
+		return sw.n, err
+	}
+	if err := sw.writeMarker(metadataMarker{Type: markerEOS}); err != nil {
+		return sw.n, err
+	}
+	return sw.n, nil
+}
+
+// streamDescriptor is the embedded descriptor of a single extent, the
+// geometry is the one VMware gives to large disks
+func streamDescriptor(capacity uint64, name string) string {
+	if name == "" {
+		name = "disk.vmdk"
+	}
+	cylinders := min(capacity/(255*63), 65535)
+	return fmt.Sprintf(`# Disk DescriptorFile
+version=1
+CID=%08x
+parentCID=ffffffff
+createType="streamOptimized"
+
+# Extent description
+RW %d SPARSE "%s"
+
+# The Disk Data Base
+#DDB
+
+ddb.adapterType = "lsilogic"
+ddb.geometry.cylinders = "%d"
+ddb.geometry.heads = "255"
+ddb.geometry.sectors = "63"
+ddb.virtualHWVersion = "4"
+`, rand.Uint32(), capacity, name, cylinders)
+}
+
+// writeGrain writes the compressed grain with its lba and size, the
+// grain table of the previous grains is written first if it's done
+func (sw *streamWriter) writeGrain(index uint64, data []byte) error {
+	if gtIndex := int64(index / streamGTEsPerGT); gtIndex != sw.gtIndex {
+		if err := sw.flushTable(); err != nil {
+			return err
+		}
+		sw.gtIndex = gtIndex
+	}
+	if sw.n/sectorSize > math.MaxUint32 {
+		return errors.New("the vmdk is too large for its grain tables")
+	}
+	sw.gt[index%streamGTEsPerGT] = uint32(sw.n / sectorSize)
+
+	grain := make([]byte, streamMarkerHeader+len(data))
+	binary.LittleEndian.PutUint64(grain, index*streamGrainSize)
+	binary.LittleEndian.PutUint32(grain[8:], uint32(len(data)))
+	copy(grain[streamMarkerHeader:], data)
+	return sw.writeSectors(grain)
+}
+
+// flushTable writes the current grain table with its marker
+func (sw *streamWriter) flushTable() error {
+	if sw.gtIndex < 0 {
+		return nil
+	}
+	if err := sw.writeMarker(metadataMarker{NumSectors: gtSectors, Type: markerGT}); err != nil {
+		return err
+	}
+	sw.gd[sw.gtIndex] = uint32(sw.n / sectorSize)
+	gt := make([]byte, streamGTEsPerGT*4)
+	for index, sector := range sw.gt {
+		binary.LittleEndian.PutUint32(gt[index*4:], sector)
+	}
+	clear(sw.gt)
+	sw.gtIndex = -1
+	return sw.writeSectors(gt)
+}
+
+func (sw *streamWriter) writeMarker(m metadataMarker) error {
+	return sw.writeStruct(&m)
+}
+
+// writeStruct writes the little endian struct padded to a sector
+func (sw *streamWriter) writeStruct(v any) error {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.LittleEndian, v); err != nil {
+		return err
+	}
+	return sw.writeSectors(buf.Bytes())
+}
+
+// writeSectors writes p padded with zeros to a whole sector
+func (sw *streamWriter) writeSectors(p []byte) error {
+	n, err := sw.w.Write(p)
+	sw.n += uint64(n)
+	if err != nil {
+		return err
+	}
+	if tail := sw.n % sectorSize; tail != 0 {
+		n, err = sw.w.Write(sw.pad[:sectorSize-tail])
+		sw.n += uint64(n)
+	}
+	return err
+}
+
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
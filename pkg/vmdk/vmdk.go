@@ -0,0 +1,422 @@
+// Package vmdk reads the sparse extents of VMware disks, the
+// monolithicSparse and streamOptimized ones which hold the whole disk in a
+// single file, and writes streamOptimized disks as found in OVA appliances.
+package vmdk
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go-qcow2/pkg/gqcow2"
+)
+
+// MagicNumber starts the header of a sparse extent
+const MagicNumber = "KDMV"
+
+const (
+	magic      = 0x564d444b
+	sectorSize = 512
+
+	// the grain directory of a streamOptimized disk is found by the
+	// footer at the end of the file
+	gdAtEnd = 0xffffffffffffffff
+
+	flagNewlineTest = 1 << 0
+	flagZeroedGTE   = 1 << 2
+	flagCompressed  = 1 << 16
+	flagMarkers     = 1 << 17
+
+	compressionDeflate = 1
+
+	// a grain table entry of a grain which reads as zeros, with
+	// flagZeroedGTE
+	zeroedGTE = 1
+
+	markerEOS    = 0
+	markerGT     = 1
+	markerGD     = 2
+	markerFooter = 3
+)
+
+// the bounds of the header fields, the usual grain is 64KiB and the
+// usual grain table has 512 entries
+const (
+	maxGrainSize  = 1 << 16
+	maxGTEsPerGT  = 1 << 16
+	maxGDEntries  = 1 << 24
+	maxDescriptor = 1 << 20
+)
+
+// Header is the header of a sparse extent, the fields count sectors
+type Header struct {
+	Magic              uint32
+	Version            uint32
+	Flags              uint32
+	Capacity           uint64
+	GrainSize          uint64
+	DescriptorOffset   uint64
+	DescriptorSize     uint64
+	NumGTEsPerGT       uint32
+	RGDOffset          uint64
+	GDOffset           uint64
+	OverHead           uint64
+	UncleanShutdown    uint8
+	SingleEndLineChar  uint8
+	NonEndLineChar     uint8
+	DoubleEndLineChar1 uint8
+	DoubleEndLineChar2 uint8
+	CompressAlgorithm  uint16
+	Pad                [433]uint8
+}
+
+// Disk is the guest disk of a monolithicSparse or streamOptimized vmdk,
+// it is read only
+type Disk struct {
+	Handler gqcow2.FileHandler
+	Header  Header
+	// CreateType is the type of the embedded descriptor, it is empty
+	// for an extent without descriptor
+	CreateType string
+
+	gd []uint32
+	// the grain tables read so far by their index in the directory
+	tables map[uint64][]uint32
+	// the last compressed grain read
+	grain      []byte
+	grainIndex uint64
+	grainValid bool
+}
+
+// Open opens the sparse extent, the footer of a streamOptimized disk
+// overrides its header
+func Open(f gqcow2.FileHandler) (*Disk, error) {
+	h, err := readHeader(f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if h.GDOffset == gdAtEnd {
+		size, err := gqcow2.HandlerSize(f)
+		if err != nil {
+			return nil, err
+		}
+		// the footer is followed by the end of stream marker
+		if size < 4*sectorSize {
+			return nil, errors.New("the vmdk is too small for a footer")
+		}
+		if h, err = readHeader(f, size-2*sectorSize); err != nil {
+			return nil, errors.Join(errors.New("read the vmdk footer failed"), err)
+		}
+		if h.GDOffset == gdAtEnd {
+			return nil, errors.New("the vmdk footer has no grain directory")
+		}
+	}
+	if err := h.validate(); err != nil {
+		return nil, err
+	}
+
+	d := &Disk{Handler: f, Header: *h, tables: map[uint64][]uint32{}}
+	if h.DescriptorSize != 0 {
+		descriptor := make([]byte, h.DescriptorSize*sectorSize)
+		if _, err := gqcow2.ReadFull(f, descriptor, h.DescriptorOffset*sectorSize); err != nil {
+			return nil, errors.Join(errors.New("read the vmdk descriptor failed"), err)
+		}
+		if d.CreateType, err = checkDescriptor(descriptor); err != nil {
+			return nil, err
+		}
+	}
+
+	gd := make([]byte, d.gdEntries()*4)
+	if _, err := gqcow2.ReadFull(f, gd, h.GDOffset*sectorSize); err != nil {
+		return nil, errors.Join(errors.New("read the vmdk grain directory failed"), err)
+	}
+	d.gd = make([]uint32, d.gdEntries())
+	for index := range d.gd {
+		d.gd[index] = binary.LittleEndian.Uint32(gd[index*4:])
+	}
+	return d, nil
+}
+
+// OpenFile opens the vmdk at path
+func OpenFile(path string) (*Disk, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	d, err := Open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+func readHeader(f gqcow2.FileHandler, offset uint64) (*Header, error) {
+	buf := make([]byte, sectorSize)
+	if _, err := gqcow2.ReadFull(f, buf, offset); err != nil {
+		return nil, err
+	}
+	h := &Header{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	if h.Magic != magic {
+		return nil, errors.New("not a vmdk sparse extent")
+	}
+	return h, nil
+}
+
+func (h *Header) validate() error {
+	if h.Version == 0 || h.Version > 3 {
+		return fmt.Errorf("unsupported vmdk version %d", h.Version)
+	}
+	if h.GrainSize == 0 || h.GrainSize > maxGrainSize || h.GrainSize&(h.GrainSize-1) != 0 {
+		return fmt.Errorf("invalid vmdk grain size %d", h.GrainSize)
+	}
+	if h.NumGTEsPerGT == 0 || h.NumGTEsPerGT > maxGTEsPerGT {
+		return fmt.Errorf("invalid vmdk grain table size %d", h.NumGTEsPerGT)
+	}
+	if h.Capacity/h.GrainSize/uint64(h.NumGTEsPerGT) >= maxGDEntries {
+		return fmt.Errorf("the vmdk capacity of %d sectors is too large", h.Capacity)
+	}
+	if h.Flags&flagCompressed != 0 && h.CompressAlgorithm != compressionDeflate {
+		return fmt.Errorf("unsupported vmdk compression %d", h.CompressAlgorithm)
+	}
+	if h.DescriptorSize*sectorSize > maxDescriptor {
+		return fmt.Errorf("the vmdk descriptor of %d sectors is too large", h.DescriptorSize)
+	}
+	return nil
+}
+
+// checkDescriptor returns the create type of the embedded descriptor,
+// disks with a parent are refused
+func checkDescriptor(descriptor []byte) (string, error) {
+	if index := bytes.IndexByte(descriptor, 0); index >= 0 {
+		descriptor = descriptor[:index]
+	}
+	fields := map[string]string{}
+	for _, line := range strings.Split(string(descriptor), "\n") {
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"`)
+	}
+
+	if parent, ok := fields["parentCID"]; ok && parent != "ffffffff" {
+		return "", errors.New("vmdk disks with a parent are not supported")
+	}
+	createType := fields["createType"]
+	switch createType {
+	case "monolithicSparse", "streamOptimized":
+		return createType, nil
+	}
+	return "", fmt.Errorf("unsupported vmdk create type %s", createType)
+}
+
+// VirtualSize is the capacity of the disk
+func (d *Disk) VirtualSize() uint64 {
+	return d.Header.Capacity * sectorSize
+}
+
+// GrainBytes is the size of a grain in bytes
+func (d *Disk) GrainBytes() uint64 {
+	return d.Header.GrainSize * sectorSize
+}
+
+func (d *Disk) gdEntries() uint64 {
+	covered := d.Header.GrainSize * uint64(d.Header.NumGTEsPerGT)
+	return (d.Header.Capacity + covered - 1) / covered
+}
+
+func (d *Disk) compressed() bool {
+	return d.Header.Flags&flagCompressed != 0
+}
+
+// Close closes the file of the extent
+func (d *Disk) Close() error {
+	return gqcow2.CloseHandler(d.Handler)
+}
+
+// Info reports the vmdk like qemu-img info, the cluster size is a grain
+func (d *Disk) Info(name string) *gqcow2.ImageInfo {
+	size, _ := gqcow2.HandlerSize(d.Handler)
+	return &gqcow2.ImageInfo{
+		VirtualSize: d.VirtualSize(),
+		Filename:    name,
+		ClusterSize: int(d.GrainBytes()),
+		Format:      "vmdk",
+		ActualSize:  size,
+	}
+}
+
+// grainEntry returns the grain table entry of the grain, the sector of
+// its data or 0 if the grain is unallocated
+func (d *Disk) grainEntry(index uint64) (uint64, error) {
+	gtIndex := index / uint64(d.Header.NumGTEsPerGT)
+	if gtIndex >= uint64(len(d.gd)) || d.gd[gtIndex] == 0 {
+		return 0, nil
+	}
+
+	table, ok := d.tables[gtIndex]
+	if !ok {
+		buf := make([]byte, d.Header.NumGTEsPerGT*4)
+		offset := uint64(d.gd[gtIndex]) * sectorSize
+		if _, err := gqcow2.ReadFull(d.Handler, buf, offset); err != nil {
+			return 0, errors.Join(fmt.Errorf("read the vmdk grain table at %d failed", offset), err)
+		}
+		table = make([]uint32, d.Header.NumGTEsPerGT)
+		for index := range table {
+			table[index] = binary.LittleEndian.Uint32(buf[index*4:])
+		}
+		d.tables[gtIndex] = table
+	}
+	return uint64(table[index%uint64(d.Header.NumGTEsPerGT)]), nil
+}
+
+// zeroed tells if the grain table entry is a grain which reads as zeros
+func (d *Disk) zeroed(entry uint64) bool {
+	return entry == 0 || (entry == zeroedGTE && d.Header.Flags&flagZeroedGTE != 0)
+}
+
+// ReadAt reads the guest content, unallocated grains read as zeros
+func (d *Disk) ReadAt(p []byte, off int64) (int, error) {
+	size := d.VirtualSize()
+	if off < 0 {
+		return 0, gqcow2.ErrOutOfRange
+	}
+	if uint64(off) >= size {
+		return 0, io.EOF
+	}
+	var eof error
+	if uint64(off)+uint64(len(p)) > size {
+		p = p[:size-uint64(off)]
+		eof = io.EOF
+	}
+
+	grainBytes := d.GrainBytes()
+	for done := 0; done < len(p); {
+		pos := uint64(off) + uint64(done)
+		index, inGrain := pos/grainBytes, pos%grainBytes
+		chunk := p[done : done+int(min(grainBytes-inGrain, uint64(len(p)-done)))]
+		if err := d.readGrain(index, inGrain, chunk); err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+	return len(p), eof
+}
+
+// readGrain reads the part of the grain at inGrain into p
+func (d *Disk) readGrain(index uint64, inGrain uint64, p []byte) error {
+	entry, err := d.grainEntry(index)
+	if err != nil {
+		return err
+	}
+	if d.zeroed(entry) {
+		clear(p)
+		return nil
+	}
+	if d.compressed() {
+		grain, err := d.decompress(index, entry)
+		if err != nil {
+			return err
+		}
+		copy(p, grain[inGrain:])
+		return nil
+	}
+
+	offset := entry*sectorSize + inGrain
+	rc, err := d.Handler.ReadAt(p, int64(offset))
+	if err != nil && err != io.EOF {
+		return errors.Join(fmt.Errorf("read the vmdk grain at %d failed", offset), err)
+	}
+	// the last grain may end before the end of the file
+	clear(p[rc:])
+	return nil
+}
+
+// decompress returns the content of the compressed grain at the sector,
+// it starts with the lba of the grain and the size of the deflate stream
+func (d *Disk) decompress(index uint64, sector uint64) ([]byte, error) {
+	if d.grainValid && d.grainIndex == index {
+		return d.grain, nil
+	}
+	d.grainValid = false
+
+	grainBytes := d.GrainBytes()
+	offset := sector * sectorSize
+	marker := make([]byte, 12)
+	if _, err := gqcow2.ReadFull(d.Handler, marker, offset); err != nil {
+		return nil, errors.Join(fmt.Errorf("read the vmdk grain at %d failed", offset), err)
+	}
+	lba, size := binary.LittleEndian.Uint64(marker), binary.LittleEndian.Uint32(marker[8:])
+	if lba != index*d.Header.GrainSize {
+		return nil, fmt.Errorf("the vmdk grain at %d is for sector %d, not %d", offset, lba, index*d.Header.GrainSize)
+	}
+	// deflate never grows the grain that much
+	if uint64(size) > 2*grainBytes {
+		return nil, fmt.Errorf("the vmdk grain at %d has an invalid size %d", offset, size)
+	}
+
+	compressed := make([]byte, size)
+	if _, err := gqcow2.ReadFull(d.Handler, compressed, offset+12); err != nil {
+		return nil, errors.Join(fmt.Errorf("read the vmdk grain at %d failed", offset), err)
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("decompress the vmdk grain at %d failed", offset), err)
+	}
+	defer zr.Close()
+
+	if d.grain == nil {
+		d.grain = make([]byte, grainBytes)
+	}
+	// the last grain of the disk may be shorter
+	n, err := io.ReadFull(zr, d.grain)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, errors.Join(fmt.Errorf("decompress the vmdk grain at %d failed", offset), err)
+	}
+	clear(d.grain[n:])
+	d.grainIndex, d.grainValid = index, true
+	return d.grain, nil
+}
+
+// MapRegions returns the allocation of the grains, the offset of an
+// uncompressed data region is its guest offset
+func (d *Disk) MapRegions() ([]gqcow2.VirtualDiskRegion, error) {
+	var regions []gqcow2.VirtualDiskRegion
+	size, grainBytes := d.VirtualSize(), d.GrainBytes()
+	for start := uint64(0); start < size; start += grainBytes {
+		entry, err := d.grainEntry(start / grainBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		region := gqcow2.VirtualDiskRegion{Start: start, Length: min(grainBytes, size-start)}
+		switch {
+		case entry == 0:
+			region.Zero = true
+		case d.zeroed(entry):
+			region.Present, region.Zero = true, true
+		default:
+			region.Present, region.Data = true, true
+			region.Compressed = d.compressed()
+			if !region.Compressed {
+				region.Offset = start
+			}
+		}
+
+		if last := len(regions) - 1; last >= 0 && region.SameAs(regions[last]) {
+			regions[last].Length += region.Length
+			continue
+		}
+		regions = append(regions, region)
+	}
+	return regions, nil
+}
@@ -0,0 +1,213 @@
+package vmdk_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"go-qcow2/internal/testimage"
+	"go-qcow2/pkg/gqcow2"
+	"go-qcow2/pkg/vmdk"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var le = binary.LittleEndian
+
+// putSparse builds a monolithicSparse disk of 2MiB with 4KiB grains and
+// grain tables of 128 entries, only the first table is allocated
+func putSparse(t *testing.T, content []byte) []byte {
+	const (
+		grainSize = 8
+		gtEntries = 128
+		gdSector  = 21
+		gtSector  = 22
+		data      = 30
+	)
+	file := make([]byte, data*512)
+	h := vmdk.Header{
+		Magic:            0x564d444b,
+		Version:          1,
+		Flags:            1 | 1<<2,
+		Capacity:         uint64(len(content)) / 512,
+		GrainSize:        grainSize,
+		DescriptorOffset: 1,
+		DescriptorSize:   20,
+		NumGTEsPerGT:     gtEntries,
+		GDOffset:         gdSector,
+		OverHead:         data,
+	}
+	var hdr bytes.Buffer
+	require.NoError(t, binary.Write(&hdr, le, &h))
+	copy(file, hdr.Bytes())
+	copy(file[512:], "# Disk DescriptorFile\nversion=1\nCID=12345678\nparentCID=ffffffff\n"+
+		"createType=\"monolithicSparse\"\n\nRW 4096 SPARSE \"test.vmdk\"\n")
+
+	le.PutUint32(file[gdSector*512:], gtSector)
+	gt := gtSector * 512
+	next := uint32(data)
+	for index := range gtEntries {
+		grain := content[index*4096 : (index+1)*4096]
+		switch {
+		case bytes.Equal(grain, make([]byte, 4096)):
+			// a zeroed grain only every other time
+			if index%2 == 0 {
+				le.PutUint32(file[gt+index*4:], 1)
+			}
+		default:
+			le.PutUint32(file[gt+index*4:], next)
+			file = append(file, grain...)
+			next += grainSize
+		}
+	}
+	return file
+}
+
+func Test_ReadMonolithicSparse(t *testing.T) {
+	content := make([]byte, 2<<20)
+	rand.Read(content[:64<<10])
+	rand.Read(content[256<<10 : 260<<10])
+
+	file := putSparse(t, content)
+	d, err := vmdk.Open(bytes.NewReader(file))
+	require.NoError(t, err)
+	defer d.Close()
+
+	assert.Equal(t, "monolithicSparse", d.CreateType)
+	assert.Equal(t, uint64(2<<20), d.VirtualSize())
+	guest := make([]byte, 3<<20)
+	n, err := d.ReadAt(guest, 0)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2<<20, n)
+	assert.Equal(t, content, guest[:n])
+
+	// reads across grains
+	part := make([]byte, 10000)
+	_, err = d.ReadAt(part, 60000)
+	require.NoError(t, err)
+	assert.Equal(t, content[60000:70000], part)
+
+	regions, err := d.MapRegions()
+	require.NoError(t, err)
+	assert.Equal(t, []gqcow2.VirtualDiskRegion{
+		{Start: 0, Length: 64 << 10, Present: true, Data: true},
+		{Start: 64 << 10, Length: 4 << 10, Present: true, Zero: true},
+		{Start: 68 << 10, Length: 4 << 10, Zero: true},
+		{Start: 72 << 10, Length: 4 << 10, Present: true, Zero: true},
+		{Start: 76 << 10, Length: 4 << 10, Zero: true},
+	}, regions[:5])
+	assert.Contains(t, regions, gqcow2.VirtualDiskRegion{
+		Start: 256 << 10, Length: 4 << 10, Present: true, Data: true, Offset: 256 << 10,
+	})
+	// the last grain of the first table is unallocated like the next tables
+	assert.Equal(t, gqcow2.VirtualDiskRegion{Start: 508 << 10, Length: 1540 << 10, Zero: true}, regions[len(regions)-1])
+
+	t.Run("Refuse a disk with a parent",
+		func(t *testing.T) {
+			file := bytes.Replace(putSparse(t, content), []byte("parentCID=ffffffff"), []byte("parentCID=12345678"), 1)
+			_, err := vmdk.Open(bytes.NewReader(file))
+			assert.ErrorContains(t, err, "parent")
+		})
+
+	t.Run("Refuse a qcow2 image",
+		func(t *testing.T) {
+			image, _ := testimage.Create(t, 4<<20, testimage.Sparse...)
+			_, err := vmdk.Open(image.Handler)
+			assert.Error(t, err)
+		})
+}
+
+func Test_StreamOptimized(t *testing.T) {
+	t.Run("Write an image and read it back",
+		func(t *testing.T) {
+			image, content := testimage.Create(t, 4<<20, testimage.Sparse...)
+			var out bytes.Buffer
+			n, err := vmdk.WriteStreamOptimized(image, &out, "disk.vmdk")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(out.Len()), n)
+			assert.Equal(t, 0, out.Len()%512)
+			// the random data doesn't compress
+			assert.Less(t, out.Len(), 1<<20+64<<10+128<<10)
+			assert.Equal(t, vmdk.MagicNumber, out.String()[:4])
+
+			d, err := vmdk.Open(bytes.NewReader(out.Bytes()))
+			require.NoError(t, err)
+			assert.Equal(t, "streamOptimized", d.CreateType)
+			assert.Equal(t, uint64(4<<20), d.VirtualSize())
+			guest := make([]byte, 4<<20)
+			_, err = d.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+
+			regions, err := gqcow2.Map(d)
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 1 << 20, Present: true, Data: true, Compressed: true},
+				{Start: 1 << 20, Length: 2 << 20, Zero: true},
+				{Start: 3 << 20, Length: 64 << 10, Present: true, Data: true, Compressed: true},
+				{Start: 3<<20 + 64<<10, Length: 960 << 10, Zero: true},
+			}, regions)
+
+			// converted back into qcow2
+			var converted bytes.Buffer
+			_, err = gqcow2.ConvertStream(d, &converted, gqcow2.CreateOptions{})
+			require.NoError(t, err)
+			back, err := gqcow2.NewFileImage(bytes.NewReader(converted.Bytes()), "back.qcow2")
+			require.NoError(t, err)
+			_, err = back.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+		})
+
+	t.Run("Zero grains and the last partial grain are handled",
+		func(t *testing.T) {
+			// a raw disk is a single data region
+			content := make([]byte, 300<<10+512)
+			rand.Read(content[200<<10:])
+			var out bytes.Buffer
+			_, err := vmdk.WriteStreamOptimized(gqcow2.NewRawDisk(bytes.NewReader(content), uint64(len(content))), &out, "")
+			require.NoError(t, err)
+
+			d, err := vmdk.Open(bytes.NewReader(out.Bytes()))
+			require.NoError(t, err)
+			regions, err := d.MapRegions()
+			require.NoError(t, err)
+			assert.Equal(t, []gqcow2.VirtualDiskRegion{
+				{Start: 0, Length: 192 << 10, Zero: true},
+				{Start: 192 << 10, Length: 108<<10 + 512, Present: true, Data: true, Compressed: true},
+			}, regions)
+
+			guest := make([]byte, len(content))
+			_, err = d.ReadAt(guest, 0)
+			require.NoError(t, err)
+			assert.Equal(t, content, guest)
+		})
+
+	t.Run("Refuse a grain for another lba",
+		func(t *testing.T) {
+			image, _ := testimage.Create(t, 4<<20, testimage.Sparse...)
+			var out bytes.Buffer
+			_, err := vmdk.WriteStreamOptimized(image, &out, "disk.vmdk")
+			require.NoError(t, err)
+
+			// the first grain follows the overhead of 128 sectors
+			file := out.Bytes()
+			grain := file[128*512:]
+			le.PutUint64(grain, 8)
+			d, err := vmdk.Open(bytes.NewReader(file))
+			require.NoError(t, err)
+			_, err = d.ReadAt(make([]byte, 512), 0)
+			assert.ErrorContains(t, err, "not 0")
+
+			// the data is a zlib stream
+			le.PutUint64(grain, 0)
+			zr, err := zlib.NewReader(bytes.NewReader(grain[12 : 12+le.Uint32(grain[8:])]))
+			require.NoError(t, err)
+			_, err = io.Copy(io.Discard, zr)
+			assert.NoError(t, err)
+		})
+}